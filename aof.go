@@ -1,9 +1,12 @@
 package memcached
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/facebookgo/stackerr"
@@ -20,7 +23,13 @@ import (
 // is command SnapshotCommand by first byte.
 const SnapshotCommand = "\x00 LOG FILE STARTS WITH GOB ENCODED CACHE SNAPSHOT \x00" + Separator
 
+// CompressedSnapshotCommand is same as SnapshotCommand, but snapshot after it is gzip compressed.
+const CompressedSnapshotCommand = "\x00 LOG FILE STARTS WITH GZIP COMPRESSED GOB ENCODED CACHE SNAPSHOT \x00" + Separator
+
 func newLoggingCacheViewFabric(l log.Logger, p *recycle.Pool, conf Config) (f *logginCacheViewFabric, err error) {
+	if conf.BackgroundReplay {
+		return newBackgroundReplayFabric(l, p, conf)
+	}
 	c, err := readAOF(p, l, conf)
 	if err != nil {
 		if cerr, ok := err.(*CorruptedError); ok {
@@ -33,7 +42,7 @@ func newLoggingCacheViewFabric(l log.Logger, p *recycle.Pool, conf Config) (f *l
 	}
 
 	rotator := aof.RotatorFunc(func(_ aof.ROFile, w io.Writer) error {
-		return writeCacheSnapshot(c, w)
+		return writeCacheSnapshot(c, w, conf.CompressSnapshot)
 	})
 	var AOF *aof.AOF
 	AOF, err = aof.Open(l, rotator, conf.AOF)
@@ -44,17 +53,27 @@ func newLoggingCacheViewFabric(l log.Logger, p *recycle.Pool, conf Config) (f *l
 	return
 }
 
-func writeCacheSnapshot(c *cache.LockingLRU, w io.Writer) error {
-	_, err := io.WriteString(w, SnapshotCommand)
+func writeCacheSnapshot(c *cache.LockingLRU, w io.Writer, compress bool) error {
+	command := SnapshotCommand
+	if compress {
+		command = CompressedSnapshotCommand
+	}
+	_, err := io.WriteString(w, command)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 	c.RLock()
 	s := c.Snapshot()
 	c.RUnlock()
-	_, err = s.WriteTo(w)
-	return err
-
+	if !compress {
+		return s.Persist(&cache.GobPersister{W: w})
+	}
+	gz := gzip.NewWriter(w)
+	err = s.Persist(&cache.GobPersister{W: gz})
+	if err != nil {
+		return err
+	}
+	return stackerr.Wrap(gz.Close())
 }
 
 // ReadAOF try to make cache from AOF.
@@ -78,7 +97,17 @@ func readAOF(p *recycle.Pool, l log.Logger, conf Config) (c *cache.LockingLRU, e
 	l.Info("AOF is founded.")
 	defer f.Close()
 	cr := newCountingReader(f, p)
-	c, err = readSnapshotIfAny(cr.reader, l, conf.Cache)
+	err = readAOFHeader(cr)
+	if err != nil {
+		return
+	}
+	c, err = readSnapshotIfAny(cr, l, conf.Cache)
+	if util.Unwrap(err) == io.EOF {
+		l.Info("AOF is empty.")
+		err = nil
+		c = cache.NewLockingLRU(l, conf.Cache)
+		return
+	}
 	if cache.IsCacheOverflow(err) {
 		l.Warn("Cache overwlow err:", util.Unwrap(err))
 		err = nil
@@ -87,7 +116,7 @@ func readAOF(p *recycle.Pool, l log.Logger, conf Config) (c *cache.LockingLRU, e
 		return
 	}
 	var lastValidPos int64
-	lastValidPos, err = readCommandLog(cr, c)
+	lastValidPos, err = readCommandLog(l, cr, c, conf.maxKeysPerGet())
 	if err != nil {
 		l.Debug("AOF is corrupted.")
 		if !conf.FixCorruptedAOF {
@@ -105,6 +134,370 @@ func readAOF(p *recycle.Pool, l log.Logger, conf Config) (c *cache.LockingLRU, e
 	return
 }
 
+// newBackgroundReplayFabric reads AOF snapshot, and returns fabric of views of cache,
+// which command log is replayed into in background.
+func newBackgroundReplayFabric(l log.Logger, p *recycle.Pool, conf Config) (f *logginCacheViewFabric, err error) {
+	var c *replayingCache
+	var replayed chan struct{}
+	c, replayed, err = startBackgroundReplay(p, l, conf)
+	if err != nil {
+		err = stackerr.Newf("AOF can't be read: %v", err)
+		return
+	}
+	rotator := aof.RotatorFunc(func(_ aof.ROFile, w io.Writer) error {
+		// Snapshot of partially replayed cache loses not replayed items.
+		// Writes are buffered by AOF meanwhile.
+		<-replayed
+		return writeCacheSnapshot(c.LockingLRU, w, conf.CompressSnapshot)
+	})
+	var AOF *aof.AOF
+	AOF, err = aof.Open(l, rotator, conf.AOF)
+	if err != nil {
+		return
+	}
+	f = &logginCacheViewFabric{c, AOF}
+	return
+}
+
+// startBackgroundReplay reads AOF snapshot, and starts replay of command log into returned cache.
+// Cache can be used at once, and commands not replayed yet are just misses.
+// Only AOF part written before call is replayed, so commands appended later are not replayed twice.
+// AOF corruption found in replay is fatal, because AOF can't be truncated after new commands were appended.
+// replayed is closed, when replay is finished.
+func startBackgroundReplay(p *recycle.Pool, l log.Logger, conf Config) (c *replayingCache, replayed chan struct{}, err error) {
+	replayed = make(chan struct{})
+	var f *os.File
+	f, err = os.Open(conf.AOF.Name)
+	if os.IsNotExist(err) {
+		l.Info("AOF is not exists. New will be created.")
+		err = nil
+		c = &replayingCache{LockingLRU: cache.NewLockingLRU(l, conf.Cache)}
+		close(replayed)
+		return
+	}
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	var stat os.FileInfo
+	stat, err = f.Stat()
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	cr := newCountingReader(io.LimitReader(f, stat.Size()), p)
+	err = readAOFHeader(cr)
+	if err != nil {
+		return
+	}
+	var lru *cache.LockingLRU
+	lru, err = readSnapshotIfAny(cr, l, conf.Cache)
+	if util.Unwrap(err) == io.EOF {
+		l.Info("AOF is empty.")
+		err = nil
+		lru = cache.NewLockingLRU(l, conf.Cache)
+	}
+	if cache.IsCacheOverflow(err) {
+		l.Warn("Cache overwlow err:", util.Unwrap(err))
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	c = &replayingCache{
+		LockingLRU: lru,
+		modified:   make(map[string]struct{}),
+	}
+	go func() {
+		defer f.Close()
+		l.Info("Background AOF replay started.")
+		_, err := readCommandLog(l, cr, replayer{c}, conf.maxKeysPerGet())
+		if err != nil {
+			l.Fatalf("Background AOF replay failed: %v. "+
+				"Restart without background replay to check AOF corruption.", err)
+		}
+		c.finishReplay()
+		l.Info("Background AOF replay finished.")
+		close(replayed)
+	}()
+	return
+}
+
+// replayingCache is cache, which command log is replayed into in background.
+// Keys modified through it are remembered until replay finish,
+// and replay of their older commands is skipped.
+type replayingCache struct {
+	*cache.LockingLRU
+	// modified is set of keys modified while replay. Nil when replay is finished.
+	// Access requires write lock be acquired.
+	modified map[string]struct{}
+}
+
+// Set requires write lock be acquired.
+func (c *replayingCache) Set(i cache.Item) {
+	if c.modified != nil {
+		c.modified[i.Key] = struct{}{}
+	}
+	c.LockingLRU.Set(i)
+}
+
+// Add requires write lock be acquired.
+func (c *replayingCache) Add(i cache.Item) (stored bool) {
+	key := i.Key
+	stored = c.LockingLRU.Add(i)
+	if stored && c.modified != nil {
+		c.modified[key] = struct{}{}
+	}
+	return
+}
+
+// Replace requires write lock be acquired.
+// Key is not in cache yet, if its set is not replayed, so replace can be not stored while replay.
+func (c *replayingCache) Replace(i cache.Item) (stored bool) {
+	key := i.Key
+	stored = c.LockingLRU.Replace(i)
+	if stored && c.modified != nil {
+		c.modified[key] = struct{}{}
+	}
+	return
+}
+
+// Cas requires write lock be acquired.
+func (c *replayingCache) Cas(i cache.Item, casID uint64) (result cache.CasResult) {
+	key := i.Key
+	result = c.LockingLRU.Cas(i, casID)
+	if result == cache.CasStored && c.modified != nil {
+		c.modified[key] = struct{}{}
+	}
+	return
+}
+
+// Incr requires write lock be acquired.
+func (c *replayingCache) Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	newVal, found, notNumeric = c.LockingLRU.Incr(key, delta)
+	c.modifiedIf(key, found && !notNumeric)
+	return
+}
+
+// Decr requires write lock be acquired.
+func (c *replayingCache) Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	newVal, found, notNumeric = c.LockingLRU.Decr(key, delta)
+	c.modifiedIf(key, found && !notNumeric)
+	return
+}
+
+func (c *replayingCache) modifiedIf(key []byte, modified bool) {
+	if modified && c.modified != nil {
+		c.modified[string(key)] = struct{}{}
+	}
+}
+
+// Delete requires write lock be acquired.
+func (c *replayingCache) Delete(key []byte) bool {
+	if c.modified != nil {
+		c.modified[string(key)] = struct{}{}
+	}
+	return c.LockingLRU.Delete(key)
+}
+
+func (c *replayingCache) finishReplay() {
+	c.Lock()
+	c.modified = nil
+	c.Unlock()
+}
+
+// replayer is cache.Cache that replays commands into replayingCache, acquiring locks per command.
+type replayer struct{ c *replayingCache }
+
+func (r replayer) Set(i cache.Item) {
+	r.c.Lock()
+	if _, ok := r.c.modified[i.Key]; ok {
+		i.Data.Recycle()
+	} else {
+		r.c.LockingLRU.Set(i)
+	}
+	r.c.Unlock()
+}
+
+func (r replayer) Add(i cache.Item) (stored bool) {
+	r.c.Lock()
+	if _, ok := r.c.modified[i.Key]; ok {
+		i.Data.Recycle()
+	} else {
+		stored = r.c.LockingLRU.Add(i)
+	}
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Replace(i cache.Item) (stored bool) {
+	r.c.Lock()
+	if _, ok := r.c.modified[i.Key]; ok {
+		i.Data.Recycle()
+	} else {
+		stored = r.c.LockingLRU.Replace(i)
+	}
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Cas(i cache.Item, casID uint64) (result cache.CasResult) {
+	r.c.Lock()
+	if _, ok := r.c.modified[i.Key]; ok {
+		i.Data.Recycle()
+		result = cache.CasExists
+	} else {
+		result = r.c.LockingLRU.Cas(i, casID)
+	}
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	r.c.Lock()
+	if _, ok := r.c.modified[string(key)]; !ok {
+		newVal, found, notNumeric = r.c.LockingLRU.Incr(key, delta)
+	}
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	r.c.Lock()
+	if _, ok := r.c.modified[string(key)]; !ok {
+		newVal, found, notNumeric = r.c.LockingLRU.Decr(key, delta)
+	}
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Delete(key []byte) (deleted bool) {
+	r.c.Lock()
+	if _, ok := r.c.modified[string(key)]; !ok {
+		deleted = r.c.LockingLRU.Delete(key)
+	}
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Get(keys ...[]byte) (views []cache.ItemView) {
+	r.c.RLock()
+	views = r.c.LockingLRU.Get(keys...)
+	r.c.RUnlock()
+	return
+}
+
+// GetAndTouch doesn't skip modified keys, because it doesn't change item value,
+// and replayingCache doesn't remember keys touched while replay.
+func (r replayer) GetAndTouch(exptime int64, keys ...[]byte) (views []cache.ItemView) {
+	r.c.Lock()
+	views = r.c.LockingLRU.GetAndTouch(exptime, keys...)
+	r.c.Unlock()
+	return
+}
+
+func (r replayer) Touch(keys ...[]byte) {
+	r.c.RLock()
+	r.c.LockingLRU.Touch(keys...)
+	r.c.RUnlock()
+}
+
+// MergeAOFs replays AOFs in order into single cache and writes its snapshot into new AOF named conf.AOF.Name.
+// Later AOFs override earlier, so key conflicts are resolved as last writer wins.
+// Merged AOF should not exist.
+func MergeAOFs(conf Config, names []string) (err error) {
+	p, err := newPool(conf)
+	if err != nil {
+		return
+	}
+	l := newLogger(conf)
+	c := cache.NewLockingLRU(l, conf.Cache)
+	defer c.Close()
+	for _, name := range names {
+		l.Infof("Merging AOF %s.", name)
+		err = mergeAOF(p, l, conf.Cache, conf.maxKeysPerGet(), name, c)
+		if err != nil {
+			return
+		}
+	}
+	var f *os.File
+	f, err = os.OpenFile(conf.AOF.Name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, aof.Perm)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer f.Close()
+	if conf.AOF.Checksummed {
+		_, err = io.WriteString(f, aof.ChecksumHeader)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	err = writeCacheSnapshot(c, f, conf.CompressSnapshot)
+	if err != nil {
+		return
+	}
+	return stackerr.Wrap(f.Sync())
+}
+
+// mergeAOF replays AOF into c. Items of AOF snapshot are set into c in LRU order.
+func mergeAOF(p *recycle.Pool, l log.Logger, conf cache.Config, maxKeysPerGet int, name string, c *cache.LockingLRU) (err error) {
+	var f *os.File
+	f, err = os.Open(name)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer f.Close()
+	cr := newCountingReader(f, p)
+	err = readAOFHeader(cr)
+	if err != nil {
+		return
+	}
+	var fileCache *cache.LockingLRU
+	fileCache, err = readSnapshotIfAny(cr, l, conf)
+	if util.Unwrap(err) == io.EOF {
+		l.Info("AOF is empty.")
+		return nil
+	}
+	if cache.IsCacheOverflow(err) {
+		l.Warn("Cache overwlow err:", util.Unwrap(err))
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	defer fileCache.Close()
+	err = fileCache.Snapshot().Persist(settingPersister{c, p})
+	if err != nil {
+		return
+	}
+	_, err = readCommandLog(l, cr, c, maxKeysPerGet)
+	return
+}
+
+// settingPersister sets written items into cache.
+type settingPersister struct {
+	cache cache.Cache
+	pool  *recycle.Pool
+}
+
+func (p settingPersister) WriteItem(meta cache.ItemMeta, r io.Reader) error {
+	data, err := p.pool.ReadData(r, meta.Bytes)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	p.cache.Set(cache.Item{ItemMeta: meta, Data: data})
+	return nil
+}
+
+func (p settingPersister) ReadAll(func(cache.ItemMeta, io.Reader) error) error {
+	panic("settingPersister is write only")
+}
+
 type CorruptedError struct {
 	Err error
 }
@@ -113,92 +506,205 @@ func (e *CorruptedError) Error() string {
 	return fmt.Sprint("AOF is corrupted: ", e.Err)
 }
 
-func readSnapshotIfAny(r reader, l log.Logger, conf cache.Config) (c *cache.LockingLRU, err error) {
+// readAOFHeader skips aof.ChecksumHeader, if AOF starts with it, and marks r checksummed.
+func readAOFHeader(r *countingReader) error {
+	b, _ := r.Peek(len(aof.ChecksumHeader))
+	if len(b) == 0 || b[0] != aof.ChecksumHeader[0] {
+		return nil
+	}
+	if string(b) != aof.ChecksumHeader {
+		return stackerr.New("Invalid checksum header.")
+	}
+	r.Discard(len(b))
+	r.checksummed = true
+	return nil
+}
+
+func readSnapshotIfAny(r *countingReader, l log.Logger, conf cache.Config) (c *cache.LockingLRU, err error) {
 	b, err := r.ReadByte()
 	r.UnreadByte()
 	if err != nil {
 		err = stackerr.Wrap(err)
 		return
 	}
-	if b == SnapshotCommand[0] {
+	isSnapshot := b == SnapshotCommand[0]
+	if isSnapshot && r.checksummed {
+		// Transaction frame starts with zero byte of length too.
+		prefix, _ := r.Peek(len(CompressedSnapshotCommand))
+		isSnapshot = bytes.HasPrefix(prefix, []byte(SnapshotCommand)) || string(prefix) == CompressedSnapshotCommand
+	}
+	if isSnapshot {
 		l.Debug("Reading snapshot.")
 		var raw []byte
 		raw, _, _, _, err = r.readCommand()
 		if err != nil {
 			return
 		}
-		if !bytes.Equal(raw, []byte(SnapshotCommand)) {
-			err = stackerr.New("Invalid snapshot command.")
-			return
+		switch string(raw) {
+		case SnapshotCommand:
+			return cache.ReadLockingLRUPersisted(&cache.GobPersister{R: r.reader}, r.pool, l, conf)
+		case CompressedSnapshotCommand:
+			l.Debug("Snapshot is compressed.")
+			return readCompressedSnapshot(r.reader, l, conf)
 		}
-		return cache.ReadLockingLRUSnapshot(r, r.pool, l, conf)
+		err = stackerr.New("Invalid snapshot command.")
+		return
 	}
 	l.Debug("No snapshot detected.")
 	c = cache.NewLockingLRU(l, conf)
 	return
 }
 
-func readCommandLog(r *countingReader, c cache.Cache) (lastValidPos int64, err error) {
-	var (
-		command   []byte
-		fields    [][]byte
-		clientErr error
-	)
+// readCompressedSnapshot reads gzip compressed snapshot. Only compressed stream is read from r,
+// so command log after snapshot can be read from r then.
+func readCompressedSnapshot(r reader, l log.Logger, conf cache.Config) (c *cache.LockingLRU, err error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	gz.Multistream(false)
+	// Buffered data is decompressed, so it is ok to read ahead.
+	br := bufio.NewReader(gz)
+	c, err = cache.ReadLockingLRUPersisted(&cache.GobPersister{R: br}, r.pool, l, conf)
+	if err != nil && !cache.IsCacheOverflow(err) {
+		return
+	}
+	// Read stream end, to verify its checksum and make r point after it.
+	_, discardErr := io.Copy(ioutil.Discard, br)
+	if discardErr != nil {
+		c.Close()
+		c, err = nil, stackerr.Wrap(discardErr)
+	}
+	return
+}
 
-	for ; ; lastValidPos = r.pos() {
-		_, command, fields, clientErr, err = r.readCommand()
-		if err != nil {
+// readCommandLog replays logged commands into c. Transactions of checksummed AOF are verified before replay.
+// Returned lastValidPos is position after last command or transaction replayed before error.
+// Gets with more than maxKeysPerGet keys are skipped, as conn rejects them.
+func readCommandLog(l log.Logger, r *countingReader, c cache.Cache, maxKeysPerGet int) (lastValidPos int64, err error) {
+	if !r.checksummed {
+		for ; ; lastValidPos = r.pos() {
+			err = replayCommand(l, r.reader, c, maxKeysPerGet)
 			if err == io.EOF {
 				err = nil
 				return
 			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	var frame []byte
+	frameReader := newReader(nil, r.pool)
+	for ; ; lastValidPos = r.pos() {
+		frame, err = aof.ReadFrame(r, frame, MaxItemSize+MaxCommandSize+len(Separator))
+		if err == io.EOF {
+			err = nil
 			return
 		}
-		if clientErr != nil {
-			err = clientErr
+		if err != nil {
 			return
 		}
-
-		switch string(command) { // No allocation.
-		case GetCommand, GetsCommand:
-			var keys [][]byte
-			keys, err = parseGetFields(fields)
+		frameReader.Reset(bytes.NewReader(frame))
+		for {
+			err = replayCommand(l, frameReader, c, maxKeysPerGet)
+			if err == io.EOF {
+				break
+			}
 			if err != nil {
 				return
 			}
-			c.Touch(keys...)
+		}
+	}
+}
+
+// replayCommand reads logged command and replays it into c. io.EOF is returned, if r has no more commands.
+// Get and gat commands only touch items, so invalid or too large get or gat is skipped with warning,
+// and doesn't prevent replay of following commands.
+func replayCommand(l log.Logger, r reader, c cache.Cache, maxKeysPerGet int) (err error) {
+	_, command, fields, clientErr, err := r.readCommand()
+	if err != nil {
+		return
+	}
+	if util.Unwrap(clientErr) == ErrTooLargeCommand {
+		// Line is discarded already. Only get can be so large.
+		l.Warn("Skipping too large command.")
+		return
+	}
+	if clientErr != nil {
+		return clientErr
+	}
+
+	switch string(command) { // No allocation.
+	case GetCommand, GetsCommand, GetQuietCommand:
+		keys, parseErr := parseGetFields(fields, maxKeysPerGet)
+		if parseErr != nil {
+			l.Warnf("Skipping invalid %s: %v", command, parseErr)
+			return
+		}
+		c.Touch(keys...)
 
-		case SetCommand:
-			var meta cache.ItemMeta
+	case GatCommand, GatsCommand:
+		exptime, keys, parseErr := parseGatFields(fields, maxKeysPerGet)
+		if parseErr != nil {
+			l.Warnf("Skipping invalid %s: %v", command, parseErr)
+			return
+		}
+		for _, view := range c.GetAndTouch(exptime, keys...) {
+			view.Reader.Close()
+		}
+
+	case SetCommand, AddCommand, ReplaceCommand, CasCommand:
+		// Only stored add, replace and cas are logged, so they are replayed as set.
+		// Replaced item can be expired at replay time.
+		var meta cache.ItemMeta
+		if string(command) == CasCommand {
+			meta, _, _, err = parseCasFields(fields)
+		} else {
 			meta, _, err = parseSetFields(fields)
-			if err != nil {
-				return
-			}
-			var data *recycle.Data
-			data, clientErr, err = r.readDataBlock(meta.Bytes)
-			if err != nil {
-				return
-			}
-			if clientErr != nil {
-				err = clientErr
-				return
-			}
-			c.Set(cache.Item{meta, data})
+		}
+		if err != nil {
+			return
+		}
+		var data *recycle.Data
+		data, clientErr, err = r.readDataBlock(meta.Bytes)
+		if err != nil {
+			return
+		}
+		if clientErr != nil {
+			err = clientErr
+			return
+		}
+		c.Set(cache.Item{ItemMeta: meta, Data: data})
 
-		case DeleteCommand:
-			var key []byte
-			key, _, err = parseDeleteFields(fields)
-			if err != nil {
-				return
-			}
-			c.Delete(key)
+	case IncrCommand, DecrCommand:
+		// Changed value is logged as set now, but AOF written before can have raw incr and decr.
+		var key []byte
+		var delta uint64
+		key, delta, _, err = parseIncrFields(fields)
+		if err != nil {
+			return
+		}
+		if string(command) == IncrCommand {
+			c.Incr(key, delta)
+		} else {
+			c.Decr(key, delta)
+		}
 
-		default:
-			err = stackerr.Newf("Unexpected command: %q", command)
+	case DeleteCommand:
+		var key []byte
+		key, _, err = parseDeleteFields(fields)
+		if err != nil {
 			return
 		}
-	}
+		c.Delete(key)
 
+	default:
+		err = stackerr.Newf("Unexpected command: %q", command)
+		return
+	}
+	return
 }
 
 func newCountingReader(r io.Reader, p *recycle.Pool) *countingReader {
@@ -215,6 +721,8 @@ func newCountingReader(r io.Reader, p *recycle.Pool) *countingReader {
 type countingReader struct {
 	reader
 	readedFromUnderlying int64
+	// checksummed is set by readAOFHeader, if AOF is checksummed.
+	checksummed bool
 }
 
 func (cr *countingReader) pos() int64 {
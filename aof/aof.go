@@ -3,10 +3,14 @@ package aof
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/facebookgo/stackerr"
@@ -15,14 +19,72 @@ import (
 )
 
 const MinSyncPeriod = 100 * time.Millisecond
+
+// DefaultSyncPeriod is period of FsyncEverySec sync, if Config.Sync is less than MinSyncPeriod.
+const DefaultSyncPeriod = time.Second
 const MinRotateCompress = 0.7
 const Perm = 0664 // TODO make configurable.
 
+var (
+	ErrRotateInProcess = errors.New("AOF rotation is in process already")
+	ErrClosed          = errors.New("AOF is closed")
+	ErrInvalidFsync    = errors.New("invalid fsync policy")
+)
+
+// FsyncPolicy defines when AOF data is synced to disk, like Redis appendfsync option.
+type FsyncPolicy string
+
+const (
+	// FsyncAuto is FsyncAlways, if Config.Sync is less than MinSyncPeriod, and FsyncEverySec otherwise.
+	FsyncAuto FsyncPolicy = ""
+	// FsyncAlways syncs every transaction. Slow, but no acknowledged transaction is lost on crash.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncEverySec syncs in background every Config.Sync period, or DefaultSyncPeriod if it is
+	// less than MinSyncPeriod. Transactions written since last sync can be lost on crash.
+	FsyncEverySec FsyncPolicy = "everysec"
+	// FsyncNo flushes buffer on every transaction, but never syncs and leaves it to OS.
+	// Fast, but amount of data lost on OS crash or power loss is unbounded.
+	FsyncNo FsyncPolicy = "no"
+)
+
+func FsyncPolicyFromString(s string) (p FsyncPolicy, err error) {
+	p = FsyncPolicy(strings.ToLower(s))
+	switch p {
+	case FsyncAuto, FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		err = stackerr.Newf("%s: %s", ErrInvalidFsync, s)
+	}
+	return
+}
+
 type Config struct {
 	Name       string
 	Sync       time.Duration
-	RotateSize int64 // AOF size, after which Rotator will be called.
+	Fsync      FsyncPolicy
+	RotateSize int64 // AOF size, after which Rotator will be called. 0 if rotation by size is disabled.
 	BufSize    int   // 0 if no buffering.
+	// Checksummed makes new AOF checksummed. See ChecksumHeader for details.
+	// Existing AOF format is kept, because rotation appends transactions written in old format.
+	Checksummed bool
+}
+
+// fsync returns policy with FsyncAuto resolved.
+func (c Config) fsync() FsyncPolicy {
+	if c.Fsync != FsyncAuto {
+		return c.Fsync
+	}
+	if c.Sync < MinSyncPeriod {
+		return FsyncAlways
+	}
+	return FsyncEverySec
+}
+
+// syncPeriod returns period of FsyncEverySec background sync.
+func (c Config) syncPeriod() time.Duration {
+	if c.Sync < MinSyncPeriod {
+		return DefaultSyncPeriod
+	}
+	return c.Sync
 }
 
 // AOF represents Append Only File.
@@ -42,14 +104,23 @@ type AOF struct {
 	// Current AOF size.
 	size            int64
 	rotateInProcess bool
+	// rotations is number of finished rotations. Atomic, so it can be read without lock.
+	rotations int64
+	// checksummed is set, if current file is checksummed.
+	checksummed bool
+	// frame accumulates transaction bytes of checksummed AOF, until frame can be written.
+	frame bytes.Buffer
 }
 
 func Open(log log.Logger, r Rotator, conf Config) (aof *AOF, err error) {
 	if r == nil {
 		panic("nil rotator")
 	}
+	if _, err = FsyncPolicyFromString(string(conf.Fsync)); err != nil {
+		return
+	}
 	if conf.RotateSize == 0 {
-		panic("zero rotate size")
+		log.Info("AOF rotation by size is disabled.")
 	}
 	aof = &AOF{
 		log:     log,
@@ -60,13 +131,20 @@ func Open(log log.Logger, r Rotator, conf Config) (aof *AOF, err error) {
 	if err != nil {
 		return
 	}
-	if !aof.isSyncEveryTransaction() {
+	if aof.checksummed != conf.Checksummed {
+		log.Warnf("AOF checksummed option is %v, but existing AOF format is kept.", conf.Checksummed)
+	}
+	if conf.fsync() == FsyncEverySec {
 		aof.startSync()
 	}
 	return
 }
 
 func (f *AOF) init() (err error) {
+	f.checksummed, err = IsChecksummed(f.config.Name)
+	if err != nil {
+		return
+	}
 	var file *os.File
 	file, err = os.OpenFile(f.config.Name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, Perm|os.ModeAppend)
 	if err != nil {
@@ -78,6 +156,15 @@ func (f *AOF) init() (err error) {
 	}
 	f.size = stat.Size()
 	f.file = file
+	if f.size == 0 && f.config.Checksummed {
+		var n int
+		n, err = io.WriteString(file, ChecksumHeader)
+		f.size += int64(n)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		f.checksummed = true
+	}
 
 	if f.config.BufSize == 0 {
 		f.writer = file
@@ -92,7 +179,7 @@ func (f *AOF) init() (err error) {
 }
 
 func (f *AOF) isSyncEveryTransaction() bool {
-	return f.config.Sync < MinSyncPeriod
+	return f.config.fsync() == FsyncAlways
 }
 
 func (f *AOF) sync() (err error) {
@@ -130,99 +217,135 @@ func (f *AOF) NewTransaction() io.WriteCloser {
 	return &transaction{f}
 }
 
-// rotate start background rotation of file snapshot into new file.
+// Rotations returns number of rotations finished since AOF open.
+func (f *AOF) Rotations() int64 { return atomic.LoadInt64(&f.rotations) }
+
+// Rotate synchronously rotates AOF and returns when rotation is finished.
+// Unlike rotation started by RotateSize, it is done regardless of AOF size and rotation compression.
+// ErrRotateInProcess is returned, if rotation has been started already.
+func (f *AOF) Rotate() error {
+	f.lock.Lock()
+	if f.isClosed() {
+		f.lock.Unlock()
+		return stackerr.Wrap(ErrClosed)
+	}
+	if f.rotateInProcess {
+		f.lock.Unlock()
+		return stackerr.Wrap(ErrRotateInProcess)
+	}
+	f.rotateInProcess = true
+	f.lock.Unlock()
+	f.rotate(false)
+	return nil
+}
+
+// startRotate start background rotation.
+// rotateInProcess flag should be set before call.
+func (f *AOF) startRotate() {
+	go f.rotate(true)
+}
+
+// rotate rotates file snapshot into new file.
 // While rotation in process, all appended data is buffering in memory.
 // When rotation complete, all buffered data is appended to new file and
 // old file is atomically replace with new.
 // rotate should be called without acquired lock.
-func (f *AOF) startRotate() {
-	go func() {
-		// Prepare.
-		assertNoErr := func(err error) {
-			if err != nil {
-				f.log.Panicf("AOF roatation error: %v", err)
-			}
-		}
-		f.log.Info("AOF rotation started.")
-		// Note: No recover. Crushing program on error.
-		// So no unlocks in defer.
-		newFile, err := newRotationFile()
-		assertNoErr(err)
-
-		// Buffer for extra data appended after rotation start.
-		extra := &bytes.Buffer{}
-
-		// Take file snapshot.
-		f.lock.Lock()
-		if f.rotateInProcess == false {
-			f.log.Panic("AOF rotation in process, but flag is not set.")
+// If checkCompress is true, rotation that doesn't compress AOF enough cause panic.
+func (f *AOF) rotate(checkCompress bool) {
+	// Prepare.
+	assertNoErr := func(err error) {
+		if err != nil {
+			f.log.Panicf("AOF roatation error: %v", err)
 		}
-		// We should to flush data for reader.
-		err = f.flusher.Flush()
-		assertNoErr(err)
-		oldWriter := f.writer
-		f.writer = io.MultiWriter(oldWriter, extra)
-		size := f.size
-		f.lock.Unlock()
-
-		afterFileSnapshotTestHook()
-
-		// Rotate file snapshot.
-		f.log.Debug("AOF snapshot rotation started.")
-		err = RotateFile(f.rotator, f.config.Name, size, newFile)
-		assertNoErr(err)
-		newFileStat, err := newFile.Stat()
+	}
+	f.log.Info("AOF rotation started.")
+	// Note: No recover. Crushing program on error.
+	// So no unlocks in defer.
+	newFile, err := newRotationFile()
+	assertNoErr(err)
+	if f.checksummed {
+		// Format is kept, because extra transactions are written in it.
+		_, err = io.WriteString(newFile, ChecksumHeader)
 		assertNoErr(err)
-		if newFileStat.Size() > size*(MinRotateCompress*100)/100 {
-			f.log.Panic("rotation doesn't compress AOF enough")
-		}
-		f.log.Debug("AOF snapshot rotation finished.")
+	}
 
-		// Meanwhile extra can grow large. Writing it in background decreases lock time.
-		newExtra := &bytes.Buffer{}
+	// Buffer for extra data appended after rotation start.
+	extra := &bytes.Buffer{}
 
-		// Take extra written.
-		f.lock.Lock()
-		f.writer = io.MultiWriter(oldWriter, newExtra)
-		f.lock.Unlock()
+	// Take file snapshot.
+	f.lock.Lock()
+	if f.rotateInProcess == false {
+		f.log.Panic("AOF rotation in process, but flag is not set.")
+	}
+	// We should to flush data for reader.
+	err = f.flusher.Flush()
+	assertNoErr(err)
+	oldWriter := f.writer
+	f.writer = io.MultiWriter(oldWriter, extra)
+	size := f.size
+	f.lock.Unlock()
 
-		extraSize := extra.Len()
-		// Write extra.
-		_, err = extra.WriteTo(newFile)
-		assertNoErr(err)
-		err = newFile.Sync() // Do without lock as much work, as we can.
-		assertNoErr(err)
-		newFileName := newFile.Name()
+	afterFileSnapshotTestHook()
 
-		afterExtraWriteTestHook()
+	// Rotate file snapshot.
+	f.log.Debug("AOF snapshot rotation started.")
+	err = RotateFile(f.rotator, f.config.Name, size, newFile)
+	assertNoErr(err)
+	newFileStat, err := newFile.Stat()
+	assertNoErr(err)
+	if checkCompress && newFileStat.Size() > size*(MinRotateCompress*100)/100 {
+		f.log.Panic("rotation doesn't compress AOF enough")
+	}
+	f.log.Debug("AOF snapshot rotation finished.")
 
-		// Write newExtra, replace old with new.
-		f.lock.Lock()
-		newExtraSize := newExtra.Len()
-		_, err = newExtra.WriteTo(newFile)
-		assertNoErr(err)
+	// Meanwhile extra can grow large. Writing it in background decreases lock time.
+	newExtra := &bytes.Buffer{}
 
-		err = f.close()
-		assertNoErr(err)
-		err = newFile.Close()
-		assertNoErr(err)
+	// Take extra written.
+	f.lock.Lock()
+	f.writer = io.MultiWriter(oldWriter, newExtra)
+	f.lock.Unlock()
 
-		err = os.Rename(newFileName, f.config.Name) // Atomic. No data corruption on fail.
-		assertNoErr(err)
+	extraSize := extra.Len()
+	// Write extra.
+	_, err = extra.WriteTo(newFile)
+	assertNoErr(err)
+	err = newFile.Sync() // Do without lock as much work, as we can.
+	assertNoErr(err)
+	newFileName := newFile.Name()
 
-		sizeWas := f.size
-		err = f.init()
-		assertNoErr(err)
-		sizeIs := f.size
+	afterExtraWriteTestHook()
 
-		f.rotateInProcess = false
-		f.lock.Unlock()
+	// Write newExtra, replace old with new.
+	f.lock.Lock()
+	newExtraSize := newExtra.Len()
+	_, err = newExtra.WriteTo(newFile)
+	assertNoErr(err)
+
+	err = f.close()
+	assertNoErr(err)
+	err = newFile.Close()
+	assertNoErr(err)
+
+	err = os.Rename(newFileName, f.config.Name) // Atomic. No data corruption on fail.
+	assertNoErr(err)
+	// Rename is not durable until directory sync. Crash can revert AOF to pre-rotation file otherwise.
+	err = syncDir(filepath.Dir(f.config.Name))
+	assertNoErr(err)
+
+	sizeWas := f.size
+	err = f.init()
+	assertNoErr(err)
+	sizeIs := f.size
+
+	f.rotateInProcess = false
+	atomic.AddInt64(&f.rotations, 1)
+	f.lock.Unlock()
 
-		f.log.Infof("AOF rotation finished. Size was %v, become %v.\n"+
-			"Extra log while rotated: %v.\n"+
-			"NewExtraLog while write extra: %v", sizeWas, sizeIs, extraSize, newExtraSize)
-		afterFinishTestHook()
-	}()
+	f.log.Infof("AOF rotation finished. Size was %v, become %v.\n"+
+		"Extra log while rotated: %v.\n"+
+		"NewExtraLog while write extra: %v", sizeWas, sizeIs, extraSize, newExtraSize)
+	afterFinishTestHook()
 }
 
 var (
@@ -233,7 +356,7 @@ var (
 
 func (f *AOF) startSync() {
 	go func() {
-		ticker := time.NewTicker(f.config.Sync)
+		ticker := time.NewTicker(f.config.syncPeriod())
 		defer ticker.Stop()
 		var prevSize int64
 		for {
@@ -252,6 +375,16 @@ func (f *AOF) startSync() {
 	}()
 }
 
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	err = dir.Sync()
+	dir.Close()
+	return stackerr.Wrap(err)
+}
+
 func newRotationFile() (file *os.File, err error) {
 	file, err = ioutil.TempFile("", "rotating_aof_")
 	if err != nil {
@@ -6,10 +6,12 @@ import (
 	"io/ioutil"
 	"os"
 	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/Skipor/memcached/internal/util"
 	"github.com/Skipor/memcached/log"
 	. "github.com/Skipor/memcached/testutil"
 )
@@ -93,6 +95,43 @@ var _ = Describe("AOF write and sync", func() {
 		Consistently(onSync, 2*syncPeriod).ShouldNot(Receive())
 	})
 
+	It("fsync always", func() {
+		aof.config.Sync = time.Minute
+		aof.config.Fsync = FsyncAlways
+		Expect(aof.isSyncEveryTransaction()).To(BeTrue())
+		mfile.On("Sync").Return(nil)
+		WriteData()
+		mfile.AssertNumberOfCalls(GinkgoT(), "Sync", 1)
+	})
+
+	It("fsync no", func() {
+		aof.config.Fsync = FsyncNo
+		Expect(aof.isSyncEveryTransaction()).To(BeFalse())
+		for i := 0; i < writeNum; i++ {
+			WriteData()
+			mflusher.AssertNumberOfCalls(GinkgoT(), "Flush", i+1)
+		}
+		mfile.AssertNotCalled(GinkgoT(), "Sync")
+	})
+
+	It("fsync everysec", func() {
+		aof.config.Fsync = FsyncEverySec
+		Expect(aof.isSyncEveryTransaction()).To(BeFalse())
+		Expect(aof.config.syncPeriod()).To(Equal(DefaultSyncPeriod))
+		mflusher.ExpectedCalls = nil // Data is flushed only by background sync.
+		WriteData()
+	})
+
+})
+
+var _ = Describe("Fsync policy", func() {
+	It("parsed", func() {
+		p, err := FsyncPolicyFromString("EverySec")
+		Expect(err).To(BeNil())
+		Expect(p).To(Equal(FsyncEverySec))
+		_, err = FsyncPolicyFromString("sometimes")
+		Expect(err).NotTo(BeNil())
+	})
 })
 
 var _ = Describe("AOF init", func() {
@@ -102,7 +141,6 @@ var _ = Describe("AOF init", func() {
 		aof         *AOF
 		filename    string
 		conf        Config
-		writeNum    int
 		dataWriten  *bytes.Buffer
 		initialData *bytes.Buffer
 	)
@@ -115,7 +153,6 @@ var _ = Describe("AOF init", func() {
 			Name:       filename,
 			RotateSize: rotateSize,
 		}
-		writeNum = Rand.Intn(5)
 		conf.BufSize = Rand.Intn(oneWriteLimit * 2)
 	})
 	AfterEach(func() {
@@ -164,6 +201,54 @@ var _ = Describe("AOF init", func() {
 		WriteSomeData()
 		ExpectFileDataEqualExpected()
 	})
+
+	Context("rotation disabled", func() {
+		BeforeEach(func() { conf.RotateSize = 0 })
+		It("no rotation", func() {
+			WriteSomeData()
+			ExpectFileDataEqualExpected()
+		})
+	})
+
+	Context("checksummed", func() {
+		BeforeEach(func() { conf.Checksummed = true })
+		It("transactions framed", func() {
+			WriteSomeData()
+			aof.Close()
+			Expect(IsChecksummed(filename)).To(BeTrue())
+			data, err := ioutil.ReadFile(filename)
+			Expect(err).To(BeNil())
+			r := bytes.NewReader(data[len(ChecksumHeader):])
+			read := &bytes.Buffer{}
+			for {
+				p, err := ReadFrame(r, nil, oneWriteLimit)
+				if err == io.EOF {
+					break
+				}
+				Expect(err).To(BeNil())
+				read.Write(p)
+			}
+			ExpectBytesEqual(read.Bytes(), dataWriten.Bytes())
+
+			data[len(data)-1] ^= 1
+			r = bytes.NewReader(data[len(ChecksumHeader):])
+			for err == nil {
+				_, err = ReadFrame(r, nil, oneWriteLimit)
+			}
+			Expect(util.Unwrap(err)).To(Equal(ErrChecksumMismatch))
+		})
+		Context("existing not checksummed", func() {
+			BeforeEach(func() {
+				initialData.WriteString("set")
+				Expect(ioutil.WriteFile(filename, initialData.Bytes(), Perm)).To(Succeed())
+			})
+			It("format kept", func() {
+				WriteSomeData()
+				aof.Close()
+				ExpectFileDataEqualExpected()
+			})
+		})
+	})
 })
 
 var _ = Describe("AOF rotation", func() {
@@ -254,3 +339,47 @@ var _ = Describe("AOF rotation", func() {
 	})
 
 })
+
+var _ = Describe("AOF manual rotation", func() {
+	It("rotate", func() {
+		initial := []byte("initial data")
+		rotated := []byte("rotated data that is larger than initial")
+		rotator := RotatorFunc(func(r ROFile, w io.Writer) error {
+			fileSnapshotData, err := ioutil.ReadAll(r)
+			Expect(err).To(BeNil())
+			ExpectBytesEqual(fileSnapshotData, initial)
+			_, err = w.Write(rotated)
+			return err
+		})
+		filename := TmpFileName()
+		defer os.Remove(filename)
+		aof, err := Open(log.NewLogger(log.DebugLevel, GinkgoWriter), rotator, Config{
+			Name:       filename,
+			RotateSize: 1 << 30,
+		})
+		Expect(err).To(BeNil())
+		t := aof.NewTransaction()
+		t.Write(initial)
+		t.Close()
+
+		err = aof.Rotate()
+		Expect(err).To(BeNil())
+		Expect(aof.rotateInProcess).To(BeFalse())
+		Expect(aof.size).To(BeEquivalentTo(len(rotated)))
+		Expect(aof.Rotations()).To(BeEquivalentTo(1))
+
+		aof.rotateInProcess = true
+		err = aof.Rotate()
+		Expect(util.Unwrap(err)).To(Equal(ErrRotateInProcess))
+		aof.rotateInProcess = false
+
+		err = aof.Close()
+		Expect(err).To(BeNil())
+		actual, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil())
+		ExpectBytesEqual(actual, rotated)
+
+		err = aof.Rotate()
+		Expect(util.Unwrap(err)).To(Equal(ErrClosed))
+	})
+})
@@ -0,0 +1,95 @@
+package aof
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// ChecksumHeader starts checksummed AOF. Every transaction of checksummed AOF is framed:
+// it is prefixed with big endian uint32 length and CRC32 (IEEE) of transaction bytes.
+// First byte is invalid for any memcached command and snapshot, so AOF format can be detected by it.
+const ChecksumHeader = "\x01 CHECKSUMMED AOF \x01\r\n"
+
+const frameHeaderSize = 8
+
+var (
+	ErrChecksumMismatch = errors.New("AOF transaction checksum mismatch")
+	ErrTooLargeFrame    = errors.New("AOF transaction is too large")
+)
+
+// IsChecksummed returns true, if file named name starts with ChecksumHeader.
+// Not existing and empty files are not checksummed.
+func IsChecksummed(name string) (checksummed bool, err error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, stackerr.Wrap(err)
+	}
+	defer file.Close()
+	header := make([]byte, len(ChecksumHeader))
+	_, err = io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, stackerr.Wrap(err)
+	}
+	return string(header) == ChecksumHeader, nil
+}
+
+// writeFrame writes frame header and p into w.
+func writeFrame(w io.Writer, p []byte) (n int, err error) {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(p)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(p))
+	n, err = w.Write(header[:])
+	if err != nil {
+		return n, stackerr.Wrap(err)
+	}
+	m, err := w.Write(p)
+	return n + m, stackerr.Wrap(err)
+}
+
+// ReadFrame reads transaction frame, verifies its checksum and returns transaction bytes.
+// Returned slice reuses buf, if it is large enough.
+// io.EOF is returned only if r has no data before frame start. Frame larger than maxSize is treated as corrupted.
+func ReadFrame(r io.Reader, buf []byte, maxSize int) (p []byte, err error) {
+	var header [frameHeaderSize]byte
+	_, err = io.ReadFull(r, header[:])
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > uint32(maxSize) {
+		err = stackerr.Newf("%s: %v bytes", ErrTooLargeFrame, size)
+		return
+	}
+	p = buf
+	if cap(p) < int(size) {
+		p = make([]byte, size)
+	}
+	p = p[:size]
+	_, err = io.ReadFull(r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	if crc32.ChecksumIEEE(p) != binary.BigEndian.Uint32(header[4:]) {
+		err = stackerr.Wrap(ErrChecksumMismatch)
+	}
+	return
+}
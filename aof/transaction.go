@@ -5,6 +5,10 @@ import "github.com/facebookgo/stackerr"
 type transaction struct{ *AOF }
 
 func (t *transaction) Write(p []byte) (n int, err error) {
+	if t.checksummed {
+		// Frame is written on close, when transaction length is known.
+		return t.frame.Write(p)
+	}
 	n, err = t.writer.Write(p)
 	err = stackerr.Wrap(err)
 	t.size += int64(n)
@@ -15,10 +19,16 @@ func (t *transaction) Close() (err error) {
 	if t.AOF == nil {
 		return
 	}
-	if t.isSyncEveryTransaction() {
-		err = t.sync()
+	if t.checksummed {
+		var n int
+		n, err = writeFrame(t.writer, t.frame.Bytes())
+		t.size += int64(n)
+		t.frame.Reset()
+	}
+	if err == nil {
+		err = t.flush()
 	}
-	startRotate := t.size > t.config.RotateSize && !t.rotateInProcess
+	startRotate := t.config.RotateSize != 0 && t.size > t.config.RotateSize && !t.rotateInProcess
 	if startRotate {
 		t.rotateInProcess = true
 	}
@@ -29,3 +39,14 @@ func (t *transaction) Close() (err error) {
 	t.AOF = nil
 	return
 }
+
+// flush makes transaction data durable, as fsync policy requires.
+func (t *transaction) flush() error {
+	switch t.config.fsync() {
+	case FsyncAlways:
+		return t.sync()
+	case FsyncNo:
+		return stackerr.Wrap(t.flusher.Flush())
+	}
+	return nil
+}
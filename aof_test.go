@@ -2,14 +2,20 @@ package memcached
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"github.com/Skipor/memcached/aof"
 	"github.com/Skipor/memcached/cache"
+	"github.com/Skipor/memcached/cache/cachemocks"
+	"github.com/Skipor/memcached/internal/util"
 	"github.com/Skipor/memcached/log"
 	"github.com/Skipor/memcached/recycle"
 	. "github.com/Skipor/memcached/testutil"
@@ -43,12 +49,12 @@ var _ = Describe("cache aof", func() {
 		itYYY.Key = "yyy"
 		itYYY.Bytes = Rand.Intn(500)
 		itYYY.Data, _ = p.ReadData(Rand, itYYY.Bytes)
-		xxxMeta = cache.ItemMeta{"xxx", 100, 100, 5}
+		xxxMeta = cache.ItemMeta{Key: "xxx", Flags: 100, Exptime: 100, Bytes: 5}
 	})
 
 	It("read no snapshot", func() {
 		data.WriteString(delYYY)
-		c, err := readSnapshotIfAny(r, l, cacheConf)
+		c, err := readSnapshotIfAny(cr, l, cacheConf)
 		Expect(err).To(BeNil())
 		Expect(c).NotTo(BeNil())
 		Expect(ioutil.ReadAll(r)).To(BeEquivalentTo(delYYY))
@@ -57,10 +63,10 @@ var _ = Describe("cache aof", func() {
 	It("snapshot write and read", func() {
 		actualCache := cache.NewLockingLRU(l, cacheConf)
 		actualCache.Set(itYYY)
-		writeCacheSnapshot(actualCache, data)
+		writeCacheSnapshot(actualCache, data, false)
 		data.WriteString(delYYY)
 
-		c, err := readSnapshotIfAny(r, l, cacheConf)
+		c, err := readSnapshotIfAny(cr, l, cacheConf)
 		Expect(err).To(BeNil())
 		Expect(c).NotTo(BeNil())
 		Expect(ioutil.ReadAll(r)).To(BeEquivalentTo(delYYY))
@@ -68,11 +74,77 @@ var _ = Describe("cache aof", func() {
 		gotIts := c.Get([]byte(itYYY.Key))
 		Expect(gotIts).To(HaveLen(1))
 		gotIt := gotIts[0]
+		Expect(gotIt.CAS).To(BeEquivalentTo(1), "CAS unique assigned on set is restored")
+		gotIt.CAS = itYYY.CAS
 		Expect(gotIt.ItemMeta).To(Equal(itYYY.ItemMeta))
 		actualData, _ := ioutil.ReadAll(itYYY.Data.NewReader())
 		Expect(ioutil.ReadAll(gotIt.Reader)).To(Equal(actualData))
 	})
 
+	It("compressed snapshot write and read", func() {
+		actualCache := cache.NewLockingLRU(l, cacheConf)
+		actualCache.Set(itYYY)
+		writeCacheSnapshot(actualCache, data, true)
+		data.WriteString(delYYY)
+
+		c, err := readSnapshotIfAny(cr, l, cacheConf)
+		Expect(err).To(BeNil())
+		Expect(ioutil.ReadAll(r)).To(BeEquivalentTo(delYYY))
+		gotIts := c.Get([]byte(itYYY.Key))
+		Expect(gotIts).To(HaveLen(1))
+		actualData, _ := ioutil.ReadAll(itYYY.Data.NewReader())
+		Expect(ioutil.ReadAll(gotIts[0].Reader)).To(Equal(actualData))
+	})
+
+	It("empty value snapshot and command log", func() {
+		empty := cache.Item{ItemMeta: cache.ItemMeta{Key: "empty"}}
+		empty.Data, _ = p.ReadData(Rand, 0)
+		actualCache := cache.NewLockingLRU(l, cacheConf)
+		actualCache.Set(empty)
+		writeCacheSnapshot(actualCache, data, false)
+		data.WriteString("set xxx 0 0 0" + Separator + Separator)
+
+		c, err := readSnapshotIfAny(cr, l, cacheConf)
+		Expect(err).To(BeNil())
+		_, err = readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		for _, key := range []string{empty.Key, xxxMeta.Key} {
+			views := c.Get([]byte(key))
+			Expect(views).To(HaveLen(1))
+			Expect(views[0].Bytes).To(BeZero())
+			Expect(ioutil.ReadAll(views[0].Reader)).To(BeEmpty())
+			views[0].Reader.Close()
+		}
+	})
+
+	It("binary values snapshot and command log", func() {
+		values := []string{"\r\n", "\x00", "END\r\n", "a\r\nset xxx 0 0 1\r\nb\r\n"}
+		snapshotCache := cache.NewLockingLRU(l, cacheConf)
+		for i, v := range values {
+			it := cache.Item{ItemMeta: cache.ItemMeta{Key: fmt.Sprint("snapshot_", i), Bytes: len(v)}}
+			it.Data, _ = p.ReadData(strings.NewReader(v), len(v))
+			snapshotCache.Set(it)
+		}
+		writeCacheSnapshot(snapshotCache, data, false)
+		for i, v := range values {
+			fmt.Fprintf(data, "set log_%v 0 0 %v"+Separator+"%s"+Separator, i, len(v), v)
+		}
+
+		c, err := readSnapshotIfAny(cr, l, cacheConf)
+		Expect(err).To(BeNil())
+		_, err = readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		Expect(c.Get([]byte(xxxMeta.Key))).To(BeEmpty())
+		for i, v := range values {
+			for _, prefix := range []string{"snapshot_", "log_"} {
+				views := c.Get([]byte(fmt.Sprint(prefix, i)))
+				Expect(views).To(HaveLen(1))
+				Expect(ioutil.ReadAll(views[0].Reader)).To(BeEquivalentTo(v))
+				views[0].Reader.Close()
+			}
+		}
+	})
+
 	It("read correct command log", func() {
 		c := cache.NewLockingLRU(l, cacheConf)
 		c.Set(itYYY)
@@ -80,7 +152,7 @@ var _ = Describe("cache aof", func() {
 		data.WriteString(getXXX)
 		data.WriteString(setXXX)
 		dataLen := data.Len()
-		lastValidPos, err := readCommandLog(cr, c)
+		lastValidPos, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
 		Expect(err).To(BeNil())
 		Expect(lastValidPos).To(BeEquivalentTo(dataLen))
 
@@ -89,10 +161,131 @@ var _ = Describe("cache aof", func() {
 		Expect(xxxIts).To(HaveLen(1))
 		gotIt := xxxIts[0]
 		gotIt.Exptime = xxxMeta.Exptime // Exptime will be different.
+		gotIt.CAS = xxxMeta.CAS         // CAS unique is assigned by cache.
 		Expect(gotIt.ItemMeta).To(Equal(xxxMeta))
 		Expect(ioutil.ReadAll(gotIt.Reader)).To(BeEquivalentTo(xxxData))
 	})
 
+	It("logged replace replayed as set", func() {
+		// Replaced item can be expired at replay time, but logged replace was stored.
+		c := cache.NewLockingLRU(l, cacheConf)
+		data.WriteString(ReplaceCommand + strings.TrimPrefix(setXXX, SetCommand))
+		_, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		xxxIts := c.Get([]byte(xxxMeta.Key))
+		Expect(xxxIts).To(HaveLen(1))
+		Expect(ioutil.ReadAll(xxxIts[0].Reader)).To(BeEquivalentTo(xxxData))
+	})
+
+	It("logged add replayed as set", func() {
+		// Added key can be set at replay time, because it was expired, when add was logged.
+		c := cache.NewLockingLRU(l, cacheConf)
+		c.Set(itYYY)
+		data.WriteString(AddCommand + " yyy" + strings.TrimPrefix(setXXX, SetCommand+" xxx"))
+		_, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		yyyIts := c.Get([]byte(itYYY.Key))
+		Expect(yyyIts).To(HaveLen(1))
+		Expect(ioutil.ReadAll(yyyIts[0].Reader)).To(BeEquivalentTo(xxxData))
+	})
+
+	It("logged cas replayed as set", func() {
+		c := cache.NewLockingLRU(l, cacheConf)
+		data.WriteString(CasCommand + " xxx 100 100 5 42" + Separator + xxxData + Separator)
+		_, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		xxxIts := c.Get([]byte(xxxMeta.Key))
+		Expect(xxxIts).To(HaveLen(1))
+		Expect(ioutil.ReadAll(xxxIts[0].Reader)).To(BeEquivalentTo(xxxData))
+	})
+
+	It("incr and decr replayed", func() {
+		c := cache.NewLockingLRU(l, cacheConf)
+		data.WriteString("set counter 0 0 2" + Separator + "10" + Separator)
+		data.WriteString(IncrCommand + " counter 5" + Separator)
+		data.WriteString(DecrCommand + " counter 3 noreply" + Separator)
+		_, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		views := c.Get([]byte("counter"))
+		Expect(views).To(HaveLen(1))
+		Expect(ioutil.ReadAll(views[0].Reader)).To(BeEquivalentTo("12"))
+	})
+
+	It("logged incr of item expired at replay doesn't make CAS uniques repeat", func() {
+		filename := TmpFileName()
+		defer os.Remove(filename)
+		AOF, err := aof.Open(nil, aof.RotatorFunc(nil), aof.Config{Name: filename, RotateSize: 1 << 20})
+		Expect(err).To(BeNil())
+		c := cache.NewLockingLRU(l, cacheConf)
+		v := newLoggingCacheView(c, AOF)
+		exptime := cache.NowUnix() + 1
+		setRaw := fmt.Sprintf("set counter 0 %v 2%s", exptime, Separator)
+		counter, _ := p.ReadData(strings.NewReader("10"), 2)
+		v.NewSetter([]byte(setRaw)).Set(cache.Item{
+			ItemMeta: cache.ItemMeta{Key: "counter", Exptime: exptime, Bytes: 2},
+			Data:     counter,
+		})
+		newVal, found, _ := v.NewIncrementer([]byte("incr counter 5"+Separator)).Incr([]byte("counter"), 5)
+		Expect(found).To(BeTrue())
+		Expect(newVal).To(BeEquivalentTo(15))
+		views := c.Get([]byte("counter"))
+		Expect(views).To(HaveLen(1))
+		lastCAS := views[0].CAS
+		views[0].Reader.Close()
+		Expect(AOF.Close()).To(BeNil())
+		Eventually(cache.NowUnix, 3*time.Second, 100*time.Millisecond).Should(BeNumerically(">", exptime))
+
+		logged, err := ioutil.ReadFile(filename)
+		Expect(err).To(BeNil())
+		data.Write(logged)
+		replayed := cache.NewLockingLRU(l, cacheConf)
+		_, err = readCommandLog(l, cr, replayed, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		Expect(replayed.Get([]byte("counter"))).To(BeEmpty())
+		replayed.Set(itYYY)
+		views = replayed.Get([]byte(itYYY.Key))
+		Expect(views).To(HaveLen(1))
+		Expect(views[0].CAS).To(BeNumerically(">", lastCAS))
+		views[0].Reader.Close()
+	})
+
+	It("gat replayed", func() {
+		c := cache.NewLockingLRU(l, cacheConf)
+		exptime := cache.NowUnix() + 2*MaxRelativeExptime
+		data.WriteString(setXXX)
+		data.WriteString(fmt.Sprintf("%s %v %s%s", GatCommand, exptime, xxxMeta.Key, Separator))
+		data.WriteString(GatsCommand + " 0" + Separator)
+		_, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		views := c.Get([]byte(xxxMeta.Key))
+		Expect(views).To(HaveLen(1))
+		Expect(views[0].Exptime).To(Equal(exptime))
+		views[0].Reader.Close()
+	})
+
+	It("get with too many keys skipped", func() {
+		c := &cachemocks.Cache{}
+		data.WriteString(GetCommand + " xxx yyy zzz" + Separator)
+		data.WriteString(GetCommand + " xxx yyy" + Separator)
+		c.On("Touch", [][]byte{[]byte("xxx"), []byte("yyy")}).Once()
+		_, err := readCommandLog(l, cr, c, 2)
+		Expect(err).To(BeNil())
+		c.AssertExpectations(GinkgoT())
+	})
+
+	It("invalid gets skipped", func() {
+		c := cache.NewLockingLRU(l, cacheConf)
+		data.WriteString(GetCommand + Separator)
+		data.WriteString(GetCommand + " " + strings.Repeat("k", MaxKeySize+1) + Separator)
+		data.WriteString(GetCommand + strings.Repeat(" key", MaxCommandSize) + Separator)
+		data.WriteString(setXXX)
+		dataLen := data.Len()
+		lastValidPos, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
+		Expect(err).To(BeNil())
+		Expect(lastValidPos).To(BeEquivalentTo(dataLen))
+		Expect(c.Get([]byte(xxxMeta.Key))).To(HaveLen(1))
+	})
+
 	It("read incorrect command log", func() {
 		c := cache.NewLockingLRU(l, cacheConf)
 		c.Set(itYYY)
@@ -101,7 +294,7 @@ var _ = Describe("cache aof", func() {
 		expectedLastValidPos := data.Len()
 		data.WriteString(setXXX[:len(setXXX)-3])
 
-		lastValidPos, err := readCommandLog(cr, c)
+		lastValidPos, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
 		Expect(err).NotTo(BeNil())
 		Expect(lastValidPos).To(BeEquivalentTo(expectedLastValidPos))
 
@@ -117,7 +310,7 @@ var _ = Describe("cache aof", func() {
 		expectedLastValidPos := data.Len()
 		data.WriteString(setXXX[:len(setXXX)-3])
 
-		lastValidPos, err := readCommandLog(cr, c)
+		lastValidPos, err := readCommandLog(l, cr, c, DefaultMaxKeysPerGet)
 		Expect(err).NotTo(BeNil())
 		Expect(lastValidPos).To(BeEquivalentTo(expectedLastValidPos))
 
@@ -129,7 +322,6 @@ var _ = Describe("cache aof", func() {
 		var (
 			filename      string
 			err           error
-			c             *cache.LockingLRU
 			memcachedConf Config
 		)
 		BeforeEach(func() {
@@ -147,7 +339,7 @@ var _ = Describe("cache aof", func() {
 		})
 		AfterEach(func() { os.Remove(filename) })
 		DoReadAOF := func() {
-			c, err = readAOF(p, l, memcachedConf)
+			_, err = readAOF(p, l, memcachedConf)
 			if err != nil {
 				Byf("%v", err)
 			}
@@ -161,7 +353,7 @@ var _ = Describe("cache aof", func() {
 			BeforeEach(func() {
 				actualCache := cache.NewLockingLRU(l, cacheConf)
 				actualCache.Set(itYYY)
-				writeCacheSnapshot(actualCache, data)
+				writeCacheSnapshot(actualCache, data, false)
 				data.WriteString(delYYY)
 				data.WriteString(getXXX)
 				expectedTruncated = append([]byte(nil), data.Bytes()...)
@@ -182,6 +374,199 @@ var _ = Describe("cache aof", func() {
 				Expect(ioutil.ReadFile(filename)).To(Equal(expectedTruncated))
 			})
 		})
+		Context("checksummed", func() {
+			var validSize int64
+			BeforeEach(func() {
+				memcachedConf.AOF.Checksummed = true
+				memcachedConf.AOF.RotateSize = 0
+				f, err := aof.Open(l, aof.RotatorFunc(nil), memcachedConf.AOF)
+				Expect(err).To(BeNil())
+				for _, command := range []string{setXXX, delYYY, getXXX} {
+					t := f.NewTransaction()
+					io.WriteString(t, command)
+					Expect(t.Close()).To(Succeed())
+				}
+				Expect(f.Close()).To(Succeed())
+				stat, err := os.Stat(filename)
+				Expect(err).To(BeNil())
+				validSize = stat.Size()
+			})
+			It("read", func() {
+				c, err := readAOF(p, l, memcachedConf)
+				Expect(err).To(BeNil())
+				Expect(c.Get([]byte(xxxMeta.Key))).To(HaveLen(1))
+			})
+			Context("value corrupted", func() {
+				BeforeEach(func() {
+					f, err := aof.Open(l, aof.RotatorFunc(nil), memcachedConf.AOF)
+					Expect(err).To(BeNil())
+					t := f.NewTransaction()
+					io.WriteString(t, strings.Replace(setXXX, "xxx", "zzz", 1))
+					Expect(t.Close()).To(Succeed())
+					Expect(f.Close()).To(Succeed())
+					data, err := ioutil.ReadFile(filename)
+					Expect(err).To(BeNil())
+					data[len(data)-len(xxxData)] ^= 1 // Parseable, but corrupted value.
+					Expect(ioutil.WriteFile(filename, data, 0600)).To(Succeed())
+				})
+				It("no fix corruption", func() {
+					DoReadAOF()
+					Expect(err).To(BeAssignableToTypeOf(&CorruptedError{}))
+					Expect(util.Unwrap(err.(*CorruptedError).Err)).To(Equal(aof.ErrChecksumMismatch))
+				})
+				It("fix corruption", func() {
+					memcachedConf.FixCorruptedAOF = true
+					DoReadAOF()
+					Expect(err).To(BeNil())
+					stat, err := os.Stat(filename)
+					Expect(err).To(BeNil())
+					Expect(stat.Size()).To(Equal(validSize))
+				})
+			})
+		})
+	})
+
+	Context("rotate command", func() {
+		const rotateSize = 1 << 14
+		var (
+			filename string
+			f        *logginCacheViewFabric
+		)
+		BeforeEach(func() {
+			filename = TmpFileName()
+			// Same item set many times. Only one should remain after rotation.
+			err := ioutil.WriteFile(filename, []byte(strings.Repeat(setXXX, 500)), 0600)
+			Expect(err).To(BeNil())
+			f, err = newLoggingCacheViewFabric(l, p, Config{
+				Cache: cacheConf,
+				AOF: aof.Config{
+					Name:       filename,
+					RotateSize: rotateSize,
+				},
+			})
+			Expect(err).To(BeNil())
+		})
+		AfterEach(func() {
+			f.aof.Close()
+			os.Remove(filename)
+		})
+		FileSize := func() int64 {
+			stat, err := os.Stat(filename)
+			Expect(err).To(BeNil())
+			return stat.Size()
+		}
+
+		It("file shrank", func() {
+			sizeBefore := FileSize()
+			Expect(sizeBefore).To(BeNumerically(">", len(setXXX)*100))
+			err := f.New().(aofRotatorView).RotateAOF()
+			Expect(err).To(BeNil())
+			Expect(FileSize()).To(BeNumerically("<", sizeBefore))
+			Expect(FileSize()).To(BeNumerically("<", rotateSize))
+			Expect(f.aof.Rotations()).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("background replay", func() {
+		var (
+			filename string
+			conf     Config
+		)
+		BeforeEach(func() {
+			filename = TmpFileName()
+			conf = Config{Cache: cacheConf}
+			conf.AOF.Name = filename
+		})
+		AfterEach(func() { os.Remove(filename) })
+
+		It("snapshot read and command log replayed", func() {
+			snapshotCache := cache.NewLockingLRU(l, cacheConf)
+			snapshotCache.Set(itYYY)
+			writeCacheSnapshot(snapshotCache, data, false)
+			data.WriteString(setXXX)
+			Expect(ioutil.WriteFile(filename, data.Bytes(), 0600)).To(Succeed())
+
+			c, replayed, err := startBackgroundReplay(p, l, conf)
+			Expect(err).To(BeNil())
+			Eventually(replayed).Should(BeClosed())
+			for _, key := range []string{itYYY.Key, xxxMeta.Key} {
+				views := c.Get([]byte(key))
+				Expect(views).To(HaveLen(1), key)
+				views[0].Reader.Close()
+			}
+		})
+
+		It("no aof file", func() {
+			c, replayed, err := startBackgroundReplay(p, l, conf)
+			Expect(err).To(BeNil())
+			Expect(c).NotTo(BeNil())
+			Expect(replayed).To(BeClosed())
+		})
+
+		It("replay doesn't override keys modified while replay", func() {
+			c := &replayingCache{
+				LockingLRU: cache.NewLockingLRU(l, cacheConf),
+				modified:   make(map[string]struct{}),
+			}
+			c.Lock()
+			c.Set(itYYY)
+			c.Delete([]byte(xxxMeta.Key))
+			c.Unlock()
+
+			data.WriteString(delYYY)
+			data.WriteString(setXXX)
+			_, err := readCommandLog(l, cr, replayer{c}, DefaultMaxKeysPerGet)
+			Expect(err).To(BeNil())
+			c.finishReplay()
+
+			Expect(c.Get([]byte(xxxMeta.Key))).To(BeEmpty())
+			views := c.Get([]byte(itYYY.Key))
+			Expect(views).To(HaveLen(1))
+			views[0].Reader.Close()
+		})
+	})
+
+	Context("merge", func() {
+		var names []string
+		var merged string
+		BeforeEach(func() {
+			merged = TmpFileName()
+			names = []string{TmpFileName(), TmpFileName()}
+
+			// First AOF with snapshot.
+			snapshotCache := cache.NewLockingLRU(l, cacheConf)
+			snapshotCache.Set(itYYY)
+			writeCacheSnapshot(snapshotCache, data, false)
+			data.WriteString(setXXX)
+			Expect(ioutil.WriteFile(names[0], data.Bytes(), 0600)).To(Succeed())
+			// Second overrides xxx and deletes yyy.
+			Expect(ioutil.WriteFile(names[1], []byte(delYYY+"set xxx 1 0 3"+Separator+"abc"+Separator), 0600)).To(Succeed())
+		})
+		AfterEach(func() {
+			for _, name := range append(names, merged) {
+				os.Remove(name)
+			}
+		})
+		It("last writer wins", func() {
+			conf := Config{LogDestination: GinkgoWriter, LogLevel: log.DebugLevel, Cache: cacheConf}
+			conf.AOF.Name = merged
+			err := MergeAOFs(conf, names)
+			Expect(err).To(BeNil())
+
+			c, err := readAOF(p, l, conf)
+			Expect(err).To(BeNil())
+			Expect(c.Get([]byte(itYYY.Key))).To(BeEmpty())
+			xxxIts := c.Get([]byte(xxxMeta.Key))
+			Expect(xxxIts).To(HaveLen(1))
+			Expect(xxxIts[0].Flags).To(BeEquivalentTo(1))
+			Expect(ioutil.ReadAll(xxxIts[0].Reader)).To(BeEquivalentTo("abc"))
+		})
+		It("merged AOF is not overwritten", func() {
+			Expect(ioutil.WriteFile(merged, nil, 0600)).To(Succeed())
+			conf := Config{LogDestination: GinkgoWriter, Cache: cacheConf}
+			conf.AOF.Name = merged
+			Expect(MergeAOFs(conf, names)).NotTo(Succeed())
+		})
 	})
 
 })
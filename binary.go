@@ -0,0 +1,411 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/facebookgo/stackerr"
+
+	"github.com/Skipor/memcached/cache"
+	"github.com/Skipor/memcached/internal/util"
+	"github.com/Skipor/memcached/recycle"
+)
+
+// Binary protocol is chosen by client, if first byte it sends is binaryRequestMagic.
+// Only key value commands are supported. Commands are passed to cache view as equivalent
+// text commands, so they are logged in AOF as such.
+const (
+	binaryRequestMagic  = 0x80
+	binaryResponseMagic = 0x81
+	binaryHeaderSize    = 24
+	// binaryStoreExtrasLen is length of storage request extras: flags and exptime.
+	binaryStoreExtrasLen = 8
+	// binaryGetExtrasLen is length of get response extras: flags.
+	binaryGetExtrasLen = 4
+)
+
+type binaryOpcode byte
+
+const (
+	binaryGet     binaryOpcode = 0x00
+	binarySet     binaryOpcode = 0x01
+	binaryAdd     binaryOpcode = 0x02
+	binaryReplace binaryOpcode = 0x03
+	binaryDelete  binaryOpcode = 0x04
+	binaryQuit    binaryOpcode = 0x07
+	binaryGetQ    binaryOpcode = 0x09
+	binaryNoop    binaryOpcode = 0x0a
+	binaryVersion binaryOpcode = 0x0b
+	binaryGetK    binaryOpcode = 0x0c
+	binaryGetKQ   binaryOpcode = 0x0d
+)
+
+// binaryCommands are text commands equivalent to supported binary opcodes.
+// They are used for DisabledCommands check and logging.
+var binaryCommands = map[binaryOpcode]string{
+	binaryGet:     GetCommand,
+	binaryGetQ:    GetCommand,
+	binaryGetK:    GetCommand,
+	binaryGetKQ:   GetCommand,
+	binarySet:     SetCommand,
+	binaryAdd:     AddCommand,
+	binaryReplace: ReplaceCommand,
+	binaryDelete:  DeleteCommand,
+	binaryNoop:    NoopCommand,
+	binaryVersion: VersionCommand,
+	binaryQuit:    QuitCommand,
+}
+
+type binaryStatus uint16
+
+const (
+	binaryNoError          binaryStatus = 0x00
+	binaryKeyNotFound      binaryStatus = 0x01
+	binaryKeyExists        binaryStatus = 0x02
+	binaryValueTooLarge    binaryStatus = 0x03
+	binaryInvalidArguments binaryStatus = 0x04
+	binaryNotStored        binaryStatus = 0x05
+	binaryUnknownCommand   binaryStatus = 0x81
+	binaryOutOfMemory      binaryStatus = 0x82
+	binaryNotSupported     binaryStatus = 0x83
+	binaryTemporaryFailure binaryStatus = 0x86
+)
+
+// binaryHeader is request or response header. Status is vbucket id in request, and is ignored.
+type binaryHeader struct {
+	magic     byte
+	opcode    binaryOpcode
+	keyLen    uint16
+	extrasLen uint8
+	dataType  uint8
+	status    binaryStatus
+	bodyLen   uint32
+	opaque    uint32
+	cas       uint64
+}
+
+func (h *binaryHeader) decode(b []byte) {
+	h.magic = b[0]
+	h.opcode = binaryOpcode(b[1])
+	h.keyLen = binary.BigEndian.Uint16(b[2:])
+	h.extrasLen = b[4]
+	h.dataType = b[5]
+	h.status = binaryStatus(binary.BigEndian.Uint16(b[6:]))
+	h.bodyLen = binary.BigEndian.Uint32(b[8:])
+	h.opaque = binary.BigEndian.Uint32(b[12:])
+	h.cas = binary.BigEndian.Uint64(b[16:])
+}
+
+func (h *binaryHeader) encode(b []byte) {
+	b[0] = h.magic
+	b[1] = byte(h.opcode)
+	binary.BigEndian.PutUint16(b[2:], h.keyLen)
+	b[4] = h.extrasLen
+	b[5] = h.dataType
+	binary.BigEndian.PutUint16(b[6:], uint16(h.status))
+	binary.BigEndian.PutUint32(b[8:], h.bodyLen)
+	binary.BigEndian.PutUint32(b[12:], h.opaque)
+	binary.BigEndian.PutUint64(b[16:], h.cas)
+}
+
+// valueLen returns length of body part following extras and key. It is negative for invalid header.
+func (h *binaryHeader) valueLen() int {
+	return int(h.bodyLen) - int(h.keyLen) - int(h.extrasLen)
+}
+
+// valid checks that request has extras, key and value required by opcode.
+// Unknown opcodes are valid, so unknown command status can be replied.
+func (h *binaryHeader) valid() bool {
+	if h.valueLen() < 0 || h.keyLen > MaxKeySize {
+		return false
+	}
+	switch h.opcode {
+	case binaryGet, binaryGetQ, binaryGetK, binaryGetKQ, binaryDelete:
+		return h.extrasLen == 0 && h.keyLen != 0 && h.valueLen() == 0
+	case binarySet, binaryAdd, binaryReplace:
+		return h.extrasLen == binaryStoreExtrasLen && h.keyLen != 0
+	case binaryNoop, binaryVersion, binaryQuit:
+		return h.bodyLen == 0
+	}
+	return true
+}
+
+// isBinaryClient returns true if client sent binary request magic first.
+// It blocks until first byte is received.
+func (c *conn) isBinaryClient() bool {
+	b, err := c.Peek(1)
+	return err == nil && b[0] == binaryRequestMagic
+}
+
+// binaryLoop serves binary protocol commands. Returned values are same as loop returns.
+func (c *conn) binaryLoop() (reason closeReason, err error) {
+	c.binary = true
+	for {
+		if !c.waitCommand() {
+			return closeServerStop, nil
+		}
+		var req binaryHeader
+		var extras, key []byte
+		req, extras, key, err = c.readBinaryRequest()
+		if err != nil {
+			if util.Unwrap(err) == io.EOF {
+				return closeClientEOF, nil
+			}
+			return c.closeReason(err), err
+		}
+		command, known := binaryCommands[req.opcode]
+		switch {
+		case !known:
+			c.log.Errorf("Unexpected binary opcode: %#x", req.opcode)
+			err = c.discardBinaryStatus(req, binaryUnknownCommand, "Unknown command")
+		case !req.valid():
+			err = c.discardBinaryStatus(req, binaryInvalidArguments, "Invalid arguments")
+		case c.DisabledCommands[command]:
+			c.log.Warnf("Disabled command: %s.", command)
+			err = c.discardBinaryStatus(req, binaryNotSupported, ErrCommandDisabled.Error())
+		case c.cache == nil && !c.isWarmedUp() && !availableWhileWarmingUp(command):
+			c.log.Debugf("Command %s received while warming up.", command)
+			err = c.discardBinaryStatus(req, binaryTemporaryFailure, WarmingUpMessage)
+		default:
+			if c.cache == nil && c.isWarmedUp() {
+				c.cache = c.newCacheView()
+			}
+			c.log.Debugf("Binary command: %s.", command)
+			switch req.opcode {
+			case binaryGet, binaryGetQ, binaryGetK, binaryGetKQ:
+				err = c.binaryGet(req, key)
+			case binarySet, binaryAdd, binaryReplace:
+				err = c.binaryStore(req, extras, key)
+			case binaryDelete:
+				err = c.binaryDelete(req, key)
+			case binaryNoop:
+				err = c.sendBinaryResponse(req, binaryNoError, nil)
+			case binaryVersion:
+				err = c.sendBinaryResponse(req, binaryNoError, []byte(Version))
+			case binaryQuit:
+				err = c.sendBinaryResponse(req, binaryNoError, nil)
+				if err == nil {
+					return closeClientQuit, nil
+				}
+			}
+		}
+		if cause := util.Unwrap(err); cause == io.EOF || cause == io.ErrUnexpectedEOF {
+			// Client disconnect in the middle of command. Ok.
+			return closeClientEOF, nil
+		}
+		if err != nil {
+			return c.closeReason(err), err
+		}
+	}
+}
+
+// readBinaryRequest reads request header, extras and key. Request value is left unread.
+// WARN: returned extras and key are invalidated on next call.
+func (c *conn) readBinaryRequest() (req binaryHeader, extras, key []byte, err error) {
+	var header [binaryHeaderSize]byte
+	_, err = io.ReadFull(c.reader, header[:])
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	req.decode(header[:])
+	if req.magic != binaryRequestMagic {
+		err = stackerr.Wrap(ErrInvalidMagic)
+		return
+	}
+	if req.valueLen() < 0 || req.keyLen > MaxKeySize {
+		// Invalid request. Body will be discarded.
+		return
+	}
+	size := int(req.extrasLen) + int(req.keyLen)
+	if cap(c.binaryBuf) < size {
+		c.binaryBuf = make([]byte, size)
+	}
+	c.binaryBuf = c.binaryBuf[:size]
+	_, err = io.ReadFull(c.reader, c.binaryBuf)
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	extras, key = c.binaryBuf[:req.extrasLen], c.binaryBuf[req.extrasLen:]
+	return
+}
+
+func (c *conn) binaryGet(req binaryHeader, key []byte) error {
+	quiet := req.opcode == binaryGetQ || req.opcode == binaryGetKQ
+	withKey := req.opcode == binaryGetK || req.opcode == binaryGetKQ
+	raw := c.binaryRawCommand(GetCommand, key)
+	views := c.cache.NewGetter(raw).Get(key)
+	c.Stats.countGet(1, len(views))
+	if len(views) == 0 {
+		if quiet {
+			return nil
+		}
+		return c.sendBinaryStatus(req, binaryKeyNotFound, "Not found")
+	}
+	view := views[0]
+	defer view.Reader.Close()
+	if err := view.Reader.Verify(); err != nil {
+		// Treat as cache miss. See writeValues.
+		c.log.Errorf("Value of key %s: %v. Evicting.", view.Key, err)
+		c.deleteKey(view.Key)
+		if quiet {
+			return nil
+		}
+		return c.sendBinaryStatus(req, binaryKeyNotFound, "Not found")
+	}
+	c.backlog += len(view.Key) + view.Bytes
+	if c.MaxResponseBacklog != 0 && c.backlog > c.MaxResponseBacklog {
+		c.log.Errorf("Response backlog exceeded: %v bytes of values are not flushed.", c.backlog)
+		return stackerr.Wrap(ErrBacklogExceeded)
+	}
+
+	res := newBinaryResponse(req, binaryNoError)
+	res.cas = view.CAS
+	res.extrasLen = binaryGetExtrasLen
+	if withKey {
+		res.keyLen = uint16(len(key))
+	}
+	res.bodyLen = uint32(int(res.extrasLen) + int(res.keyLen) + view.Bytes)
+	c.refreshWriteDeadline()
+	c.writeBinaryHeader(res)
+	var flags [binaryGetExtrasLen]byte
+	binary.BigEndian.PutUint32(flags[:], view.Flags)
+	c.Write(flags[:])
+	if withKey {
+		c.Write(key)
+	}
+	_, err := view.Reader.WriteTo(chunkWriter{c})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if quiet && !c.FlushPerCommand {
+		// Flushed with next response.
+		return nil
+	}
+	return c.Flush()
+}
+
+// binaryStore reads value of storage request and stores it. Set and replace with not zero CAS are
+// stored only if item CAS unique matches, same as cas command.
+func (c *conn) binaryStore(req binaryHeader, extras, key []byte) (err error) {
+	exptime := binary.BigEndian.Uint32(extras[4:])
+	meta := cache.ItemMeta{
+		Key:     string(key),
+		Flags:   binary.BigEndian.Uint32(extras),
+		Exptime: absExptime(int64(exptime)),
+		Bytes:   req.valueLen(),
+	}
+	c.log.Debugf("binary store %#v", meta)
+	if meta.Bytes > c.maxItemSize || !c.itemFits(meta) {
+		return c.discardBinaryStatus(req, binaryValueTooLarge, ErrTooLargeItem.Error())
+	}
+	if c.isReservedKey(meta.Key) {
+		return c.discardBinaryStatus(req, binaryNotStored, ErrReservedKeyPrefix.Error())
+	}
+	i := cache.Item{ItemMeta: meta}
+	i.Data, err = c.pool.ReadData(c.reader, meta.Bytes)
+	if util.Unwrap(err) == recycle.ErrOutOfMemory {
+		c.log.Error("Item data doesn't fit in memory budget.")
+		return c.discardBinaryStatus(req, binaryOutOfMemory, recycle.ErrOutOfMemory.Error())
+	}
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+
+	// Stored add, replace and cas are logged and replayed as set.
+	raw := c.binaryRawCommand(SetCommand, key, uint64(meta.Flags), uint64(exptime), uint64(meta.Bytes))
+	atomic.AddInt64(&c.Stats.CmdSet, 1)
+	status := binaryNoError
+	switch {
+	case req.opcode != binaryAdd && req.cas != 0:
+		switch c.cache.NewCaser(raw).Cas(i, req.cas) {
+		case cache.CasExists:
+			status = binaryKeyExists
+		case cache.CasNotFound:
+			status = binaryKeyNotFound
+		}
+	case req.opcode == binarySet:
+		c.cache.NewSetter(raw).Set(i)
+	case req.opcode == binaryAdd:
+		if !c.cache.NewAdder(raw).Add(i) {
+			status = binaryKeyExists
+		}
+	case req.opcode == binaryReplace:
+		if !c.cache.NewReplacer(raw).Replace(i) {
+			status = binaryKeyNotFound
+		}
+	}
+	if status != binaryNoError {
+		return c.sendBinaryStatus(req, status, "Not stored")
+	}
+	return c.sendBinaryResponse(req, status, nil)
+}
+
+func (c *conn) binaryDelete(req binaryHeader, key []byte) error {
+	raw := c.binaryRawCommand(DeleteCommand, key)
+	deleted := c.cache.NewDeleter(raw).Delete(key)
+	c.Stats.countDelete(deleted)
+	if !deleted {
+		return c.sendBinaryStatus(req, binaryKeyNotFound, "Not found")
+	}
+	return c.sendBinaryResponse(req, binaryNoError, nil)
+}
+
+// binaryRawCommand returns text command with key and numeric args, that is passed to cache view.
+// Returned slice is invalidated on next call.
+func (c *conn) binaryRawCommand(command string, key []byte, args ...uint64) []byte {
+	raw := append(append(append(c.binaryRaw[:0], command...), ' '), key...)
+	for _, arg := range args {
+		raw = strconv.AppendUint(append(raw, ' '), arg, 10)
+	}
+	c.binaryRaw = append(raw, Separator...)
+	return c.binaryRaw
+}
+
+func newBinaryResponse(req binaryHeader, status binaryStatus) binaryHeader {
+	return binaryHeader{
+		magic:  binaryResponseMagic,
+		opcode: req.opcode,
+		status: status,
+		opaque: req.opaque,
+	}
+}
+
+func (c *conn) writeBinaryHeader(h binaryHeader) {
+	var b [binaryHeaderSize]byte
+	h.encode(b[:])
+	c.Write(b[:])
+}
+
+// sendBinaryResponse sends response with value and without extras and key.
+func (c *conn) sendBinaryResponse(req binaryHeader, status binaryStatus, value []byte) error {
+	res := newBinaryResponse(req, status)
+	res.bodyLen = uint32(len(value))
+	c.refreshWriteDeadline()
+	c.writeBinaryHeader(res)
+	c.Write(value)
+	return c.Flush()
+}
+
+// sendBinaryStatus sends error status with message as value.
+func (c *conn) sendBinaryStatus(req binaryHeader, status binaryStatus, message string) error {
+	c.log.Debugf("Binary response status %#x: %s", status, message)
+	return c.sendBinaryResponse(req, status, []byte(message))
+}
+
+// discardBinaryStatus discards not read part of request body, and sends error status.
+func (c *conn) discardBinaryStatus(req binaryHeader, status binaryStatus, message string) error {
+	left := int(req.bodyLen)
+	if req.valueLen() >= 0 && req.keyLen <= MaxKeySize {
+		// Extras and key are read already.
+		left = req.valueLen()
+	}
+	_, err := c.Discard(left)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return c.sendBinaryStatus(req, status, message)
+}
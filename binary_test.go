@@ -0,0 +1,234 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Skipor/memcached/cache"
+	"github.com/Skipor/memcached/cache/cachemocks"
+	"github.com/Skipor/memcached/log"
+)
+
+type binaryResponse struct {
+	binaryHeader
+	extras, key, value []byte
+}
+
+func binaryRequest(opcode binaryOpcode, cas uint64, extras []byte, key, value string) []byte {
+	req := binaryHeader{
+		magic:     binaryRequestMagic,
+		opcode:    opcode,
+		keyLen:    uint16(len(key)),
+		extrasLen: uint8(len(extras)),
+		bodyLen:   uint32(len(extras) + len(key) + len(value)),
+		opaque:    0xdeadbeef,
+		cas:       cas,
+	}
+	b := make([]byte, binaryHeaderSize)
+	req.encode(b)
+	return append(append(append(b, extras...), key...), value...)
+}
+
+func storeExtras(flags, exptime uint32) []byte {
+	extras := make([]byte, binaryStoreExtrasLen)
+	binary.BigEndian.PutUint32(extras, flags)
+	binary.BigEndian.PutUint32(extras[4:], exptime)
+	return extras
+}
+
+var _ = Describe("Binary conn", func() {
+	var (
+		mcache        *cachemocks.Cache
+		c             *conn
+		out           *gbytes.Buffer
+		in            *io.PipeWriter
+		serveFinished chan struct{}
+	)
+	BeforeEach(func() {
+		serveFinished = make(chan struct{})
+		out = gbytes.NewBuffer()
+		mcache = &cachemocks.Cache{}
+		var connReader *io.PipeReader
+		connReader, in = io.Pipe()
+		cMeta := &ConnMeta{}
+		cMeta.init()
+		rwc := struct {
+			io.ReadCloser
+			io.Writer
+		}{connReader, out}
+		c = newConn(log.NewLogger(log.DebugLevel, GinkgoWriter), cMeta, mcache, rwc)
+		go func() {
+			defer GinkgoRecover()
+			c.serve()
+			close(serveFinished)
+		}()
+	})
+	AfterEach(func() {
+		in.Close()
+		Eventually(serveFinished).Should(BeClosed())
+		Expect(out).NotTo(gbytes.Say(`(?s).`))
+		mcache.AssertExpectations(GinkgoT())
+	})
+
+	readN := func(n int) []byte {
+		b := make([]byte, n)
+		var read int
+		Eventually(func() int {
+			m, _ := out.Read(b[read:])
+			read += m
+			return read
+		}, ReadTimeout).Should(Equal(n))
+		return b
+	}
+	ReadResponse := func() (res binaryResponse) {
+		res.decode(readN(binaryHeaderSize))
+		ExpectWithOffset(1, res.magic).To(BeEquivalentTo(binaryResponseMagic))
+		ExpectWithOffset(1, res.opaque).To(BeEquivalentTo(0xdeadbeef))
+		res.extras = readN(int(res.extrasLen))
+		res.key = readN(int(res.keyLen))
+		res.value = readN(res.valueLen())
+		return
+	}
+	Write := func(b []byte) {
+		go func() {
+			in.Write(b)
+		}()
+	}
+
+	Context("get", func() {
+		var it *cache.Item
+		BeforeEach(func() {
+			it = &cache.Item{ItemMeta: cache.ItemMeta{Key: "test_key", Flags: 7, Bytes: 1, CAS: 42}}
+			it.Data, _ = c.Pool.ReadData(strings.NewReader("x"), it.Bytes)
+		})
+		AfterEach(func() { it.Data.Recycle() })
+		It("found", func() {
+			mcache.On("Get", [][]byte{[]byte("test_key")}).Return([]cache.ItemView{it.NewView()})
+			Write(binaryRequest(binaryGetK, 0, nil, "test_key", ""))
+			res := ReadResponse()
+			Expect(res.opcode).To(Equal(binaryGetK))
+			Expect(res.status).To(Equal(binaryNoError))
+			Expect(res.cas).To(BeEquivalentTo(42))
+			Expect(binary.BigEndian.Uint32(res.extras)).To(BeEquivalentTo(7))
+			Expect(res.key).To(BeEquivalentTo("test_key"))
+			Expect(res.value).To(BeEquivalentTo("x"))
+		})
+		It("not found", func() {
+			mcache.On("Get", mock.Anything).Return(nil)
+			Write(binaryRequest(binaryGet, 0, nil, "test_key", ""))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryKeyNotFound))
+		})
+		It("quiet miss is not replied", func() {
+			mcache.On("Get", mock.Anything).Return(nil)
+			Write(append(binaryRequest(binaryGetQ, 0, nil, "test_key", ""),
+				binaryRequest(binaryNoop, 0, nil, "", "")...))
+			res := ReadResponse()
+			Expect(res.opcode).To(Equal(binaryNoop))
+		})
+		It("without key is invalid", func() {
+			Write(binaryRequest(binaryGet, 0, nil, "", ""))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryInvalidArguments))
+		})
+	})
+
+	Context("store", func() {
+		ExpectItem := func(i cache.Item) {
+			Expect(i.Key).To(Equal("test_key"))
+			Expect(i.Flags).To(BeEquivalentTo(7))
+			Expect(ReadAll(&i)).To(BeEquivalentTo("xxx"))
+		}
+		It("set", func() {
+			mcache.On("Set", mock.Anything).Run(func(args mock.Arguments) {
+				ExpectItem(args.Get(0).(cache.Item))
+			})
+			Write(binaryRequest(binarySet, 0, storeExtras(7, 0), "test_key", "xxx"))
+			res := ReadResponse()
+			Expect(res.opcode).To(Equal(binarySet))
+			Expect(res.status).To(Equal(binaryNoError))
+		})
+		It("set with cas", func() {
+			mcache.On("Cas", mock.Anything, uint64(42)).Return(func(i cache.Item, _ uint64) cache.CasResult {
+				ExpectItem(i)
+				return cache.CasExists
+			})
+			Write(binaryRequest(binarySet, 42, storeExtras(7, 0), "test_key", "xxx"))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryKeyExists))
+		})
+		It("add not stored", func() {
+			mcache.On("Add", mock.Anything).Return(func(i cache.Item) bool {
+				ExpectItem(i)
+				return false
+			})
+			Write(binaryRequest(binaryAdd, 0, storeExtras(7, 0), "test_key", "xxx"))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryKeyExists))
+		})
+		It("replace", func() {
+			mcache.On("Replace", mock.Anything).Return(func(i cache.Item) bool {
+				ExpectItem(i)
+				return true
+			})
+			Write(binaryRequest(binaryReplace, 0, storeExtras(7, 0), "test_key", "xxx"))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryNoError))
+		})
+		It("too large value discarded", func() {
+			Write(append(binaryRequest(binarySet, 0, storeExtras(7, 0), "test_key", strings.Repeat("x", c.maxItemSize+1)),
+				binaryRequest(binaryNoop, 0, nil, "", "")...))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryValueTooLarge))
+			res = ReadResponse()
+			Expect(res.opcode).To(Equal(binaryNoop))
+		})
+	})
+
+	Context("delete", func() {
+		It("deleted", func() {
+			mcache.On("Delete", []byte("test_key")).Return(true)
+			Write(binaryRequest(binaryDelete, 0, nil, "test_key", ""))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryNoError))
+		})
+		It("not found", func() {
+			mcache.On("Delete", []byte("test_key")).Return(false)
+			Write(binaryRequest(binaryDelete, 0, nil, "test_key", ""))
+			res := ReadResponse()
+			Expect(res.status).To(Equal(binaryKeyNotFound))
+		})
+	})
+
+	It("version", func() {
+		Write(binaryRequest(binaryVersion, 0, nil, "", ""))
+		res := ReadResponse()
+		Expect(res.value).To(BeEquivalentTo(Version))
+	})
+
+	It("version not preceded by banner", func() {
+		c.Banner = "test banner"
+		Write(binaryRequest(binaryVersion, 0, nil, "", ""))
+		res := ReadResponse()
+		Expect(res.value).To(BeEquivalentTo(Version))
+	})
+
+	It("unknown command", func() {
+		Write(binaryRequest(0x30, 0, []byte{1, 2}, "key", "value"))
+		res := ReadResponse()
+		Expect(res.status).To(Equal(binaryUnknownCommand))
+	})
+
+	It("quit", func() {
+		Write(binaryRequest(binaryQuit, 0, nil, "", ""))
+		res := ReadResponse()
+		Expect(res.status).To(Equal(binaryNoError))
+		Eventually(serveFinished).Should(BeClosed())
+	})
+})
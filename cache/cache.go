@@ -1,7 +1,13 @@
 package cache
 
 import (
+	"errors"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stackerr"
 
 	"github.com/Skipor/memcached/log"
 	"github.com/Skipor/memcached/recycle"
@@ -10,40 +16,181 @@ import (
 // Handler implementation must not retain key slices.
 type Cache interface {
 	Set(i Item)
+	// Add sets item only if key is not in cache, and returns true in such case.
+	// Not stored item data is recycled.
+	Add(i Item) (stored bool)
+	// Replace sets item only if key is in cache, and returns true in such case.
+	// Not stored item data is recycled.
+	Replace(i Item) (stored bool)
+	// Cas sets item only if key is in cache, and its CAS unique is casID.
+	// Not stored item data is recycled.
+	Cas(i Item, casID uint64) CasResult
+	// Incr adds delta to item value, that should be decimal uint64. Value wraps around on overflow.
+	// Found is false, if there is no such key. NotNumeric is true, if value is not decimal uint64.
+	Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool)
+	// Decr is same as Incr, but subtracts delta. Value is clamped at zero.
+	Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool)
 	Delete(key []byte) (deleted bool)
 	// Get returns ItemReaders for keys that was found in cache.
 	// views can be nil, if no key was found.
 	Get(key ...[]byte) (views []ItemView)
+	// GetAndTouch is Get, that sets exptime of found items.
+	GetAndTouch(exptime int64, key ...[]byte) (views []ItemView)
 	Touch(key ...[]byte)
 }
 
+// CasResult is result of Cache.Cas.
+type CasResult int
+
+const (
+	CasStored CasResult = iota
+	// CasExists means that item was modified since CAS unique was got.
+	CasExists
+	CasNotFound
+)
+
+// StoreFrom reads meta.Bytes of item data from r into Data from p, and sets item into c.
+// On read error nothing is set, and no data leaks.
+func StoreFrom(c Cache, p *recycle.Pool, meta ItemMeta, r io.Reader) error {
+	data, err := p.ReadData(r, meta.Bytes)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	c.Set(Item{ItemMeta: meta, Data: data})
+	return nil
+}
+
 type Config struct {
 	Size int64
+	// ExpiredSweep is max number of items scanned for expired on overflow, before live items eviction.
+	// 0 disables sweep.
+	ExpiredSweep int
+	// PromoteAfterHits is number of hits after which item becomes active.
+	// Hits are counted until item reaches queue bottom. 0 is same as 1.
+	PromoteAfterHits int
+	// LockWaitBuckets are sorted upper bounds in microseconds of write lock wait time histogram.
+	// Nil disables wait time measurement, that has overhead.
+	LockWaitBuckets []int64
+	// SnapshotParallelism is number of goroutines encoding snapshot in parallel.
+	// 0 or 1 means sequential encoding into single stream.
+	// Segmented snapshot is decoded by same number of goroutines on read.
+	SnapshotParallelism int
+	// CrawlPeriod is period of Crawler walks, that remove expired items in background. 0 disables crawler.
+	CrawlPeriod time.Duration
+	// CrawlBatchSize is max number of items scanned by Crawler under single write lock acquire.
+	// DefaultCrawlBatchSize is used, if it is 0.
+	CrawlBatchSize int
+	// AsyncEviction makes set return without eviction, that is done by background goroutine then.
+	// Cache and hot queue can exceed their limits until eviction, but if they exceed them more than
+	// MaxAsyncOverflow, eviction is done synchronously. Synchronous eviction is default.
+	AsyncEviction bool
+	// MaxAsyncOverflow is hard limit overflow in bytes. Size / DefaultAsyncOverflowDivisor is used, if it is 0.
+	MaxAsyncOverflow int64
+	// HotCap and WarmCap are parts of Size, that HOT and WARM queues are limited by.
+	// Each should be in (0, 1], and their sum should be not greater than 1. DefaultCap is used, if 0.
+	// Larger HOT benefits workloads with mostly read hot set.
+	HotCap  float64
+	WarmCap float64
+	// OnEvict is called with key and data size of every evicted item. Expired items are not reported.
+	// It is called after write lock release, so it can use cache, but for LockingLRU it is called
+	// by Unlock call. Callback calls are not synchronized. Nil if not needed.
+	OnEvict func(key string, bytes int)
+	// Metrics is notified about gets, sets, evictions and expirations. Nil if not needed.
+	Metrics Metrics
+}
+
+var ErrInvalidCaps = errors.New("hot and warm caps should be in (0, 1], and their sum should not be greater than 1")
+
+// caps returns HotCap and WarmCap with defaults applied.
+func (conf Config) caps() (hot, warm float64) {
+	hot, warm = conf.HotCap, conf.WarmCap
+	if hot == 0 {
+		hot = DefaultCap
+	}
+	if warm == 0 {
+		warm = DefaultCap
+	}
+	return
 }
 
+// CheckCaps returns ErrInvalidCaps, if HotCap or WarmCap are invalid.
+func (conf Config) CheckCaps() error {
+	hot, warm := conf.caps()
+	if hot <= 0 || hot > 1 || warm <= 0 || warm > 1 || hot+warm > 1 {
+		return stackerr.Wrap(ErrInvalidCaps)
+	}
+	return nil
+}
+
+// DefaultAsyncOverflowDivisor is divisor of cache size, that gives default Config.MaxAsyncOverflow.
+const DefaultAsyncOverflowDivisor = 16
+
 func NewLRU(l log.Logger, conf Config) *LRU {
-	return &LRU{*newLRU(l, conf)}
+	return &LRU{newLRU(l, conf)}
 }
 
 func NewLockingLRU(l log.Logger, conf Config) *LockingLRU {
-	return &LockingLRU{*newLRU(l, conf)}
+	return &LockingLRU{newLRU(l, conf)}
 }
 
 // LRU is Cache with auto locking on Cache operations.
-type LRU struct{ lru }
+type LRU struct{ *lru }
 
 var _ Cache = (*LRU)(nil)
 
 func (c *LRU) Set(i Item) {
-	c.lock.Lock()
+	c.writeLock()
 	c.set(i)
-	c.lock.Unlock()
+	c.unlock()
+}
+
+func (c *LRU) Add(i Item) (stored bool) {
+	c.writeLock()
+	stored = c.add(i)
+	c.unlock()
+	return
+}
+
+func (c *LRU) Replace(i Item) (stored bool) {
+	c.writeLock()
+	stored = c.replace(i)
+	c.unlock()
+	return
+}
+
+func (c *LRU) Cas(i Item, casID uint64) (result CasResult) {
+	c.writeLock()
+	result = c.casSet(i, casID)
+	c.unlock()
+	return
+}
+
+func (c *LRU) Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	c.writeLock()
+	newVal, found, notNumeric = c.incr(key, delta, false)
+	c.unlock()
+	return
+}
+
+func (c *LRU) Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	c.writeLock()
+	newVal, found, notNumeric = c.incr(key, delta, true)
+	c.unlock()
+	return
 }
 
+// Delete checks key presence under read lock first, so deletes of missing keys
+// don't contend with gets. Presence is rechecked under write lock.
 func (c *LRU) Delete(key []byte) (deleted bool) {
-	c.lock.Lock()
+	c.lock.RLock()
+	_, ok := c.table[string(key)] // No allocation.
+	c.lock.RUnlock()
+	if !ok {
+		return false
+	}
+	c.writeLock()
 	deleted = c.delete(key)
-	c.lock.Unlock()
+	c.unlock()
 	return
 }
 
@@ -54,42 +201,275 @@ func (c *LRU) Get(keys ...[]byte) (views []ItemView) {
 	return
 }
 
+// GetOne is Get of single key, that avoids slice allocations.
+func (c *LRU) GetOne(key []byte) (view ItemView, found bool) {
+	c.lock.RLock()
+	view, found = c.getOne(key, NowUnix())
+	c.lock.RUnlock()
+	return
+}
+
+// GetAndTouch modifies items, so it takes write lock.
+func (c *LRU) GetAndTouch(exptime int64, keys ...[]byte) (views []ItemView) {
+	c.writeLock()
+	views = c.getAndTouch(exptime, keys...)
+	c.unlock()
+	return
+}
+
 func (c *LRU) Touch(keys ...[]byte) {
 	c.lock.RLock()
 	c.touch(keys...)
 	c.lock.RUnlock()
 }
 
+// TTLHistogram returns live items number bucketed by remaining TTL. See lru.ttlHistogram for details.
+func (c *LRU) TTLHistogram(buckets []int64) (hist []int) {
+	c.lock.RLock()
+	hist = c.ttlHistogram(buckets)
+	c.lock.RUnlock()
+	return
+}
+
+// LockWaitHistogram returns number of write lock acquisitions bucketed by wait time.
+// See lru.writeLock for details.
+func (c *LRU) LockWaitHistogram() (hist []int) {
+	c.lock.RLock()
+	hist = c.lockWaitHistogram()
+	c.lock.RUnlock()
+	return
+}
+
+// TailAge returns age in seconds of oldest item in every queue. See lru.tailAge for details.
+func (c *LRU) TailAge() (hot, warm, cold int64) {
+	c.lock.RLock()
+	hot, warm, cold = c.tailAge()
+	c.lock.RUnlock()
+	return
+}
+
+// QueueStats returns stats of cold, warm and hot queues. See lru.queueStats for details.
+func (c *LRU) QueueStats() (stats []QueueStats) {
+	c.lock.RLock()
+	stats = c.queueStats()
+	c.lock.RUnlock()
+	return
+}
+
+// ReclaimedByOverwrite returns total size of items, deleted because of overwrite.
+func (c *LRU) ReclaimedByOverwrite() (size int64) {
+	c.lock.RLock()
+	size = c.reclaimedByOverwrite
+	c.lock.RUnlock()
+	return
+}
+
+// Unfetched returns numbers of items expired and evicted without being got since set.
+func (c *LRU) Unfetched() (expired, evicted int64) {
+	c.lock.RLock()
+	expired, evicted = c.expiredUnfetched, c.evictedUnfetched
+	c.lock.RUnlock()
+	return
+}
+
+// Usage returns number of items in cache and their total size. See lru.usage for details.
+func (c *LRU) Usage() (items int, size int64) {
+	c.lock.RLock()
+	items, size = c.usage()
+	c.lock.RUnlock()
+	return
+}
+
+// Len returns number of items in cache, expired included.
+func (c *LRU) Len() (n int) {
+	c.lock.RLock()
+	n = c.itemsNum()
+	c.lock.RUnlock()
+	return
+}
+
+// Size returns total size of items in cache, expired included.
+func (c *LRU) Size() (size int64) {
+	c.lock.RLock()
+	size = c.size()
+	c.lock.RUnlock()
+	return
+}
+
+// Free returns size left before cache overflow. Negative, if cache is overflowed and items are not evicted yet.
+func (c *LRU) Free() (free int64) {
+	c.lock.RLock()
+	free = c.free()
+	c.lock.RUnlock()
+	return
+}
+
+// Close stops background crawler and evictor, if they are enabled.
+func (c *LRU) Close() { c.close() }
+
+// Evictions returns number of items evicted since cache creation.
+func (c *LRU) Evictions() int64 { return atomic.LoadInt64(&c.evictions) }
+
+// Keys returns up to limit keys of live items in unspecified order. All keys are returned, if limit <= 0.
+func (c *LRU) Keys(limit int) (keys [][]byte) {
+	c.lock.RLock()
+	keys = c.keys(limit)
+	c.lock.RUnlock()
+	return
+}
+
+// QueueItems returns metas of up to limit live items of queue, from queue head. See Queues for queue index.
+// All queue items are returned, if limit <= 0.
+func (c *LRU) QueueItems(queue, limit int) (metas []ItemMeta) {
+	c.lock.RLock()
+	metas = c.queueItems(queue, limit)
+	c.lock.RUnlock()
+	return
+}
+
+// ColdestKeys returns keys of up to n items, that would be evicted first.
+func (c *LRU) ColdestKeys(n int) (keys []string) {
+	c.lock.RLock()
+	keys = c.coldestKeys(n)
+	c.lock.RUnlock()
+	return
+}
+
+// Sizer is cache, that can report its usage.
+type Sizer interface {
+	Len() int
+	Size() int64
+	Free() int64
+}
+
+var _ Sizer = (*LRU)(nil)
+var _ Sizer = (*LockingLRU)(nil)
+
 type RWCache interface {
 	Cache
 	sync.Locker
 	RLock()
 	RUnlock()
+	// ColdestKeys requires read lock be acquired.
+	ColdestKeys(n int) (keys []string)
+	// Keys requires read lock be acquired.
+	Keys(limit int) (keys [][]byte)
+	// QueueItems requires read lock be acquired.
+	QueueItems(queue, limit int) (metas []ItemMeta)
+	// Usage requires read lock be acquired.
+	Usage() (items int, size int64)
+	// Peek returns view of live item without counting access. Requires read lock be acquired.
+	Peek(key []byte) (view ItemView, found bool)
+	// QueueStats requires read lock be acquired.
+	QueueStats() []QueueStats
+	// Evictions doesn't require lock.
+	Evictions() int64
 }
 
 // LockingLRU is cache that requires explicit lock calls.
-type LockingLRU struct{ lru }
+type LockingLRU struct{ *lru }
 
 var _ RWCache = (*LockingLRU)(nil)
 
-func (c *LockingLRU) Set(i Item)                            { c.set(i) }
-func (c *LockingLRU) Delete(key []byte) (deleted bool)      { return c.delete(key) }
+func (c *LockingLRU) Set(i Item)                         { c.set(i) }
+func (c *LockingLRU) Add(i Item) (stored bool)           { return c.add(i) }
+func (c *LockingLRU) Replace(i Item) (stored bool)       { return c.replace(i) }
+func (c *LockingLRU) Cas(i Item, casID uint64) CasResult { return c.casSet(i, casID) }
+func (c *LockingLRU) Delete(key []byte) (deleted bool)   { return c.delete(key) }
+
+func (c *LockingLRU) Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	return c.incr(key, delta, false)
+}
+
+func (c *LockingLRU) Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	return c.incr(key, delta, true)
+}
+
 func (c *LockingLRU) Get(keys ...[]byte) (views []ItemView) { return c.get(keys...) }
 func (c *LockingLRU) Touch(keys ...[]byte)                  { c.touch(keys...) }
 
-func (c *LockingLRU) Lock()    { c.lock.Lock() }
-func (c *LockingLRU) Unlock()  { c.lock.Unlock() }
+// GetOne requires read lock be acquired.
+func (c *LockingLRU) GetOne(key []byte) (ItemView, bool) { return c.getOne(key, NowUnix()) }
+
+// Peek requires read lock be acquired.
+func (c *LockingLRU) Peek(key []byte) (ItemView, bool) { return c.peek(key) }
+
+// GetAndTouch requires write lock be acquired.
+func (c *LockingLRU) GetAndTouch(exptime int64, keys ...[]byte) (views []ItemView) {
+	return c.getAndTouch(exptime, keys...)
+}
+
+func (c *LockingLRU) Lock()    { c.writeLock() }
+func (c *LockingLRU) Unlock()  { c.unlock() }
 func (c *LockingLRU) RLock()   { c.lock.RLock() }
 func (c *LockingLRU) RUnlock() { c.lock.RUnlock() }
 
 func (c *LockingLRU) Snapshot() *Snapshot { return c.snapshot() }
 
+// TTLHistogram requires read lock be acquired.
+func (c *LockingLRU) TTLHistogram(buckets []int64) []int { return c.ttlHistogram(buckets) }
+
+// LockWaitHistogram requires read lock be acquired.
+func (c *LockingLRU) LockWaitHistogram() []int { return c.lockWaitHistogram() }
+
+// TailAge requires read lock be acquired.
+func (c *LockingLRU) TailAge() (hot, warm, cold int64) { return c.tailAge() }
+
+// ReclaimedByOverwrite requires read lock be acquired.
+func (c *LockingLRU) ReclaimedByOverwrite() int64 { return c.reclaimedByOverwrite }
+
+// Unfetched requires read lock be acquired.
+func (c *LockingLRU) Unfetched() (expired, evicted int64) {
+	return c.expiredUnfetched, c.evictedUnfetched
+}
+
+// ColdestKeys requires read lock be acquired.
+func (c *LockingLRU) ColdestKeys(n int) []string { return c.coldestKeys(n) }
+
+// Keys requires read lock be acquired.
+func (c *LockingLRU) Keys(limit int) [][]byte { return c.keys(limit) }
+
+// QueueItems requires read lock be acquired.
+func (c *LockingLRU) QueueItems(queue, limit int) []ItemMeta { return c.queueItems(queue, limit) }
+
+// Usage requires read lock be acquired.
+func (c *LockingLRU) Usage() (items int, size int64) { return c.usage() }
+
+// Len requires read lock be acquired.
+func (c *LockingLRU) Len() int { return c.itemsNum() }
+
+// Size requires read lock be acquired.
+func (c *LockingLRU) Size() int64 { return c.size() }
+
+// Free requires read lock be acquired.
+func (c *LockingLRU) Free() int64 { return c.free() }
+
+// Close requires lock be not acquired, because crawler and evictor can wait for it.
+func (c *LockingLRU) Close() { c.close() }
+
+// Evictions doesn't require lock.
+func (c *LockingLRU) Evictions() int64 { return atomic.LoadInt64(&c.evictions) }
+
+// QueueStats requires read lock be acquired.
+func (c *LockingLRU) QueueStats() []QueueStats { return c.queueStats() }
+
+// ReadLockingLRUSnapshot reads snapshot written by Snapshot.WriteTo. It is ReadLockingLRUPersisted of GobPersister.
 func ReadLockingLRUSnapshot(r SnapshotReader, p *recycle.Pool, l log.Logger, conf Config) (c *LockingLRU, err error) {
+	return ReadLockingLRUPersisted(&GobPersister{R: r}, p, l, conf)
+}
+
+// ReadLockingLRUPersisted makes cache from items read from p. LRU state is restored, if p persists it.
+// On cache overflow error, cache with items that fit is returned too.
+func ReadLockingLRUPersisted(p Persister, pool *recycle.Pool, l log.Logger, conf Config) (c *LockingLRU, err error) {
 	var lru *lru
-	lru, err = readSnapshot(r, p, l, conf)
+	if sp, ok := p.(snapshotPersister); ok {
+		lru, err = sp.readSnapshot(pool, l, conf)
+	} else {
+		lru, err = readPersisted(p, pool, l, conf)
+	}
 	if err != nil && !IsCacheOverflow(err) {
 		return
 	}
-	c = &LockingLRU{*lru}
+	c = &LockingLRU{lru}
 	return
 }
@@ -23,6 +23,7 @@ func TestCache(t *testing.T) {
 func ExpectLRUsToBeEquvalent(a, b *lru) {
 	a.ExpectInvariantsOk()
 	b.ExpectInvariantsOk()
+	Expect(a.cas).To(Equal(b.cas))
 	for i, queue := range a.queues {
 		ExpectQueuesToBeEquvalent(queue, b.queues[i])
 	}
@@ -33,6 +34,7 @@ func ExpectQueuesToBeEquvalent(a, b *queue) {
 	na, nb := a.head(), b.head()
 	for ; !(a.end(na) || b.end(nb)); na, nb = na.next, nb.next {
 		Expect(na.isActive()).To(Equal(nb.isActive()))
+		Expect(na.CAS).To(Equal(nb.CAS))
 		ExpectViewOfItem(nb.NewView(), na.Item)
 	}
 	Expect(a.end(na)).To(BeTrue())
@@ -40,7 +42,7 @@ func ExpectQueuesToBeEquvalent(a, b *queue) {
 }
 
 func ExpectViewOfItem(view ItemView, it Item) {
-	ExpectWithOffset(1, view.ItemMeta).To(BeIdenticalTo(it.ItemMeta))
+	ExpectWithOffset(1, withoutCAS(view.ItemMeta)).To(BeIdenticalTo(withoutCAS(it.ItemMeta)))
 	itReader := it.NewView().Reader
 	expectedData, _ := ioutil.ReadAll(itReader)
 	actualData, _ := ioutil.ReadAll(view.Reader)
@@ -88,13 +90,22 @@ func (q *queue) nodes() (nodes []*node) {
 	return
 }
 
+// items returns queue items without CAS uniques, so they can be compared with set items.
 func (q *queue) items() (items []Item) {
 	for n := q.head(); !q.end(n); n = n.next {
-		items = append(items, n.Item)
+		it := n.Item
+		it.ItemMeta = withoutCAS(it.ItemMeta)
+		items = append(items, it)
 	}
 	return
 }
 
+// withoutCAS returns meta with zeroed CAS unique, which is assigned by cache on set.
+func withoutCAS(m ItemMeta) ItemMeta {
+	m.CAS = 0
+	return m
+}
+
 var testKey, resetTestKeys = func() (k func() string, rk func()) {
 	var i int
 	k = func() string {
@@ -119,7 +130,7 @@ func (p testPool) randSizeItem() (i Item) {
 }
 func (p testPool) sizeItem(size int) (i Item) {
 	i.Key = testKey()
-	i.Exptime = nowUnix() + 100
+	i.Exptime = NowUnix() + 100
 	i.Bytes = size
 	i.Data, _ = p.ReadData(Rand, i.Bytes)
 	return
@@ -127,7 +138,7 @@ func (p testPool) sizeItem(size int) (i Item) {
 
 func (p testPool) testItem() (i Item) {
 	i.Key = testKey()
-	i.Exptime = nowUnix() + 100
+	i.Exptime = NowUnix() + 100
 	i.Bytes = testNodeSize - int((&node{Item: i}).size())
 	i.Data, _ = p.ReadData(Rand, i.Bytes)
 	return
@@ -139,7 +150,7 @@ func (p testPool) testNode() *node {
 
 func testNode() *node {
 	n := expiredNode()
-	n.Exptime = nowUnix() + 100
+	n.Exptime = NowUnix() + 100
 	return n
 }
 
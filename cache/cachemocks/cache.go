@@ -41,6 +41,76 @@ func (c *Cache) Get(key ...[]byte) []cache.ItemView {
 	return r0
 }
 
+// GetAndTouch provides a mock function with given fields: exptime, key
+func (c *Cache) GetAndTouch(exptime int64, key ...[]byte) []cache.ItemView {
+	ret := c.Called(exptime, key)
+
+	var r0 []cache.ItemView
+	if rf, ok := ret.Get(0).(func(int64, ...[]byte) []cache.ItemView); ok {
+		r0 = rf(exptime, key...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]cache.ItemView)
+		}
+	}
+
+	return r0
+}
+
+// Add provides a mock function with given fields: i
+func (c *Cache) Add(i cache.Item) bool {
+	ret := c.Called(i)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(cache.Item) bool); ok {
+		r0 = rf(i)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// Replace provides a mock function with given fields: i
+func (c *Cache) Replace(i cache.Item) bool {
+	ret := c.Called(i)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(cache.Item) bool); ok {
+		r0 = rf(i)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// Cas provides a mock function with given fields: i, casID
+func (c *Cache) Cas(i cache.Item, casID uint64) cache.CasResult {
+	ret := c.Called(i, casID)
+
+	var r0 cache.CasResult
+	if rf, ok := ret.Get(0).(func(cache.Item, uint64) cache.CasResult); ok {
+		r0 = rf(i, casID)
+	} else {
+		r0 = ret.Get(0).(cache.CasResult)
+	}
+
+	return r0
+}
+
+// Incr provides a mock function with given fields: key, delta
+func (c *Cache) Incr(key []byte, delta uint64) (uint64, bool, bool) {
+	ret := c.Called(key, delta)
+	return ret.Get(0).(uint64), ret.Bool(1), ret.Bool(2)
+}
+
+// Decr provides a mock function with given fields: key, delta
+func (c *Cache) Decr(key []byte, delta uint64) (uint64, bool, bool) {
+	ret := c.Called(key, delta)
+	return ret.Get(0).(uint64), ret.Bool(1), ret.Bool(2)
+}
+
 func (c *Cache) Touch(key ...[]byte) { c.Called(key) }
 func (c *Cache) Set(i cache.Item)    { c.Called(i) }
 
@@ -49,9 +119,81 @@ func (c *Cache) Unlock()  { c.Called() }
 func (c *Cache) RLock()   { c.Called() }
 func (c *Cache) RUnlock() { c.Called() }
 
-func (c *Cache) NewGetter(rawCommand []byte) cache.Getter   { return c }
-func (c *Cache) NewSetter(rawCommand []byte) cache.Setter   { return c }
-func (c *Cache) NewDeleter(rawCommand []byte) cache.Deleter { return c }
+// ColdestKeys provides a mock function with given fields: n
+func (c *Cache) ColdestKeys(n int) []string {
+	ret := c.Called(n)
+
+	var r0 []string
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]string)
+	}
+
+	return r0
+}
+
+// Keys provides a mock function with given fields: limit
+func (c *Cache) Keys(limit int) [][]byte {
+	ret := c.Called(limit)
+
+	var r0 [][]byte
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).([][]byte)
+	}
+
+	return r0
+}
+
+// QueueItems provides a mock function with given fields: queue, limit
+func (c *Cache) QueueItems(queue, limit int) []cache.ItemMeta {
+	ret := c.Called(queue, limit)
+
+	var r0 []cache.ItemMeta
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]cache.ItemMeta)
+	}
+
+	return r0
+}
+
+// Usage provides a mock function with given fields:
+func (c *Cache) Usage() (int, int64) {
+	ret := c.Called()
+	return ret.Int(0), ret.Get(1).(int64)
+}
+
+// Peek provides a mock function with given fields: key
+func (c *Cache) Peek(key []byte) (cache.ItemView, bool) {
+	ret := c.Called(key)
+	return ret.Get(0).(cache.ItemView), ret.Bool(1)
+}
+
+// Evictions provides a mock function with given fields:
+func (c *Cache) Evictions() int64 {
+	ret := c.Called()
+	return ret.Get(0).(int64)
+}
+
+// QueueStats provides a mock function with given fields:
+func (c *Cache) QueueStats() []cache.QueueStats {
+	ret := c.Called()
+
+	var r0 []cache.QueueStats
+	if ret.Get(0) != nil {
+		r0 = ret.Get(0).([]cache.QueueStats)
+	}
+
+	return r0
+}
+
+func (c *Cache) NewGetter(rawCommand []byte) cache.Getter     { return c }
+func (c *Cache) NewSetter(rawCommand []byte) cache.Setter     { return c }
+func (c *Cache) NewAdder(rawCommand []byte) cache.Adder       { return c }
+func (c *Cache) NewReplacer(rawCommand []byte) cache.Replacer { return c }
+func (c *Cache) NewCaser(rawCommand []byte) cache.Caser       { return c }
+func (c *Cache) NewDeleter(rawCommand []byte) cache.Deleter   { return c }
+
+func (c *Cache) NewIncrementer(rawCommand []byte) cache.Incrementer     { return c }
+func (c *Cache) NewGetAndToucher(rawCommand []byte) cache.GetAndToucher { return c }
 
 var _ cache.Cache = (*Cache)(nil)
 var _ cache.View = (*Cache)(nil)
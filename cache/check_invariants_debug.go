@@ -49,6 +49,11 @@ func (c *lru) checkInvariants() {
 		}
 	}
 	ExpectWithOffset(1, items).To(Equal(len(c.table)), "too many items in table")
+	if c.evictSignal != nil {
+		// Overflow is fixed in background, until it reaches hard limit.
+		ExpectWithOffset(1, c.hardOverflow()).To(BeFalse(), "hard overflow")
+		return
+	}
 	ExpectWithOffset(1, c.totalOverflow()).To(BeFalse(), "total overflow")
 	ExpectWithOffset(1, c.hotOverflow()).To(BeFalse(), "hot overflow")
 	ExpectWithOffset(1, c.warmOverflow()).To(BeFalse(), "warm overflow")
@@ -0,0 +1,38 @@
+package cache
+
+import "time"
+
+// MaxClockSkew is system wall clock divergence from cache clock, after which warning is logged.
+const MaxClockSkew = time.Second
+
+// epoch is process start time. It has monotonic clock reading.
+var epoch = time.Now()
+
+// wallNow returns system wall clock time. Replaced in tests.
+var wallNow = time.Now
+
+// NowUnix returns current unix time that cache uses for items expiration.
+// It is computed as process start wall clock time plus monotonic time passed since start,
+// so system wall clock jumps (NTP correction, for example) can't resurrect or
+// prematurely expire items. Relative exptimes should be converted to absolute with it.
+func NowUnix() int64 {
+	return epoch.Add(time.Since(epoch)).Unix()
+}
+
+// ClockSkew returns how much system wall clock diverged from cache clock since process start.
+// Negative skew means that wall clock went backwards.
+func ClockSkew() time.Duration {
+	wallPassed := wallNow().Round(0).Sub(epoch.Round(0)) // Round(0) strips monotonic reading.
+	return wallPassed - time.Since(epoch)
+}
+
+// checkClockSkew warns when clock skew changed more than MaxClockSkew since last check.
+// Requires write lock be acquired.
+func (c *lru) checkClockSkew() {
+	skew := ClockSkew()
+	if diff := skew - c.clockSkew; diff > MaxClockSkew || diff < -MaxClockSkew {
+		c.log.Warnf("System clock skew detected: wall clock diverged from cache clock on %v. "+
+			"Cache clock is used for expiration.", skew)
+		c.clockSkew = skew
+	}
+}
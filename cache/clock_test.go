@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gbytes"
+
+	"github.com/Skipor/memcached/log"
+)
+
+var _ = Describe("Clock", func() {
+	var (
+		shift time.Duration
+		out   *Buffer
+		c     *LRU
+		p     testPool
+	)
+	BeforeEach(func() {
+		shift = 0
+		wallNow = func() time.Time { return time.Now().Add(shift) }
+		out = NewBuffer()
+		c = NewLRU(log.NewLogger(log.WarnLevel, out), Config{Size: 1 << 20})
+		p = newTestPool()
+	})
+	AfterEach(func() { wallNow = time.Now })
+
+	It("no skew", func() {
+		Expect(ClockSkew()).To(BeNumerically("~", 0, MaxClockSkew))
+		Expect(NowUnix()).To(BeNumerically("~", time.Now().Unix(), 1))
+		c.Set(p.testItem())
+		Expect(out).NotTo(Say("skew"))
+	})
+
+	It("wall clock goes backwards", func() {
+		shift = -time.Hour
+		now := NowUnix()
+		Expect(ClockSkew()).To(BeNumerically("~", shift, MaxClockSkew))
+		Expect(NowUnix()).To(BeNumerically(">=", now))
+
+		it := p.testItem()
+		c.Set(it)
+		Expect(out).To(Say("skew"))
+		views := c.Get([]byte(it.Key))
+		Expect(views).To(HaveLen(1))
+		views[0].Reader.Close()
+
+		By("skew is reported once")
+		c.Set(p.testItem())
+		Expect(out).NotTo(Say("skew"))
+	})
+})
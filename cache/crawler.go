@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCrawlBatchSize is used, if Config.CrawlBatchSize is not set.
+const DefaultCrawlBatchSize = 100
+
+// Crawler periodically walks cache queues and removes expired items.
+// Without crawler expired items are removed only on access or overflow, so
+// items, that are never accessed after expiration, consume memory until eviction.
+// Queues are walked in batches, and write lock is released between batches to limit lock hold time.
+type Crawler struct {
+	cache     *lru
+	period    time.Duration
+	batchSize int
+	stop      chan struct{}
+	done      chan struct{} // Closed when crawler goroutine is finished.
+	closeOnce sync.Once
+}
+
+func newCrawler(c *lru, period time.Duration, batchSize int) *Crawler {
+	if batchSize <= 0 {
+		batchSize = DefaultCrawlBatchSize
+	}
+	return &Crawler{
+		cache:     c,
+		period:    period,
+		batchSize: batchSize,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (cr *Crawler) run() {
+	defer close(cr.done)
+	ticker := time.NewTicker(cr.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cr.stop:
+			return
+		case <-ticker.C:
+			cr.crawl()
+		}
+	}
+}
+
+// Close stops crawler and waits until crawler goroutine is finished.
+// It should not be called with cache lock acquired.
+func (cr *Crawler) Close() {
+	cr.closeOnce.Do(func() { close(cr.stop) })
+	<-cr.done
+}
+
+// crawl walks every queue once.
+func (cr *Crawler) crawl() {
+	var expired int
+	for _, q := range cr.cache.queues {
+		var cursor *node
+		for {
+			select {
+			case <-cr.stop:
+				return
+			default:
+			}
+			var batchExpired int
+			cursor, batchExpired = cr.crawlBatch(q, cursor)
+			expired += batchExpired
+			if cursor == nil {
+				break
+			}
+		}
+	}
+	if expired > 0 {
+		cr.cache.log.Debugf("Crawler removed %v expired items.", expired)
+	}
+}
+
+// crawlBatch removes expired items among at most batchSize nodes, starting from cursor,
+// or from queue head, if cursor is nil. It returns node to continue from, or nil if queue end
+// was reached, or cursor was lost: deleted or moved to another queue, while lock was released.
+// Lost cursor finishes queue walk, because rescan from head can take unbounded time on churn.
+func (cr *Crawler) crawlBatch(q *queue, cursor *node) (next *node, expired int) {
+	c := cr.cache
+	c.writeLock()
+	defer c.lock.Unlock()
+	defer c.checkInvariants()
+	n := cursor
+	if n == nil {
+		n = q.head()
+	} else if n.owner != q || c.table[string(n.Key)] != n {
+		return
+	}
+	now := NowUnix()
+	for i := 0; i < cr.batchSize && !q.end(n); i++ {
+		following := n.next
+		if n.expired(now) {
+			n.detach()
+			c.onExpire(n)
+			expired++
+		}
+		n = following
+	}
+	if !q.end(n) {
+		next = n
+	}
+	return
+}
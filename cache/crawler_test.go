@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/Skipor/memcached/log"
+)
+
+var _ = Describe("Crawler", func() {
+	const crawlPeriod = 50 * time.Millisecond
+	var (
+		p testPool
+		c *LRU
+	)
+	BeforeEach(func() {
+		resetTestKeys()
+		p = newTestPool()
+		c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{
+			Size:           1 << 20,
+			CrawlPeriod:    crawlPeriod,
+			CrawlBatchSize: 2,
+		})
+	})
+	AfterEach(func() {
+		c.Close()
+	})
+	Items := func() int {
+		items, _ := c.Usage()
+		return items
+	}
+
+	It("expired items removed", func() {
+		live := p.testItem()
+		c.Set(live)
+		for i := 0; i < 5; i++ {
+			it := p.testItem()
+			it.Exptime = NowUnix() + 1
+			c.Set(it)
+		}
+		Expect(Items()).To(Equal(6))
+		// Exptime has second precision, so items expire in up to two seconds.
+		Eventually(Items, 2*time.Second+2*crawlPeriod, crawlPeriod/5).Should(Equal(1))
+		Expect(c.Get([]byte(live.Key))).To(HaveLen(1))
+		expired, _ := c.Unfetched()
+		Expect(expired).To(BeEquivalentTo(5))
+	})
+
+	It("lost cursor finishes queue walk", func() {
+		c.Close()
+		for i := 0; i < 3; i++ {
+			c.Set(p.testItem())
+		}
+		q := c.hot()
+		cursor, expired := c.crawler.crawlBatch(q, nil)
+		Expect(expired).To(BeZero())
+		Expect(cursor).To(Equal(q.tail()))
+		c.Delete([]byte(cursor.Key))
+		cursor, _ = c.crawler.crawlBatch(q, cursor)
+		Expect(cursor).To(BeNil())
+	})
+
+	It("close is idempotent", func() {
+		c.Close()
+		c.Close()
+	})
+})
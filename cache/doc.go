@@ -15,5 +15,8 @@
 // eviction), move to WARM. There they can stay relatively protected.
 // A secondary goal is to improve latency. The LRU locks are no longer used on
 // item reads, only during sets and deletes.
-// TODO update doc after add LRU crawler.
+//
+// Expired items are removed lazily on access, or on overflow if Config.ExpiredSweep is set.
+// Items expired and never accessed again can be reclaimed before eviction by Crawler,
+// that walks queues every Config.CrawlPeriod in background.
 package cache
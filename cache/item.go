@@ -16,6 +16,8 @@ type ItemMeta struct {
 	Flags   uint32
 	Exptime int64
 	Bytes   int
+	// CAS is unique id assigned by cache on every store. Value passed to cache is ignored.
+	CAS uint64
 }
 
 func (m ItemMeta) expired(now int64) bool {
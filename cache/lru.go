@@ -3,7 +3,10 @@ package cache
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Skipor/memcached/internal/tag"
@@ -16,17 +19,69 @@ type lru struct {
 	queues []*queue
 	limits limits
 	log    log.Logger
+	// expiredSweep is Config.ExpiredSweep.
+	expiredSweep int
+	// promoteAfterHits is Config.PromoteAfterHits, but at least 1.
+	promoteAfterHits int32
+	// snapshotParallelism is Config.SnapshotParallelism.
+	snapshotParallelism int
+	// lockWaitBuckets is Config.LockWaitBuckets.
+	lockWaitBuckets []int64
+	// lockWaitHist has len(lockWaitBuckets)+1 counters. Access requires write lock be acquired.
+	lockWaitHist []int
+	// reclaimedByOverwrite is total size of nodes deleted by overwrite.
+	reclaimedByOverwrite int64
+	// cas is last CAS unique assigned on set.
+	cas uint64
+	// expiredUnfetched and evictedUnfetched are numbers of items removed
+	// without being fetched since set. Such items are probably write-only keys.
+	expiredUnfetched int64
+	evictedUnfetched int64
+	// evictions is number of evicted items. Atomic, so it can be read without lock.
+	evictions int64
+	// clockSkew is last reported ClockSkew.
+	clockSkew time.Duration
+	// crawler removes expired items in background. Nil if crawler is disabled.
+	crawler *Crawler
+	// evictSignal wakes up evictor goroutine on overflow. Nil if eviction is synchronous.
+	evictSignal chan struct{}
+	// maxAsyncOverflow is Config.MaxAsyncOverflow or its default.
+	maxAsyncOverflow int64
+	evictorStop      chan struct{}
+	evictorDone      chan struct{} // Closed when evictor goroutine is finished.
+	closeOnce        sync.Once
+	// onEvictCallback is Config.OnEvict.
+	onEvictCallback func(key string, bytes int)
+	// evicted are items evicted under write lock, that OnEvict should be called for after unlock.
+	// Collected only if onEvictCallback is set.
+	evicted []ItemMeta
+	// metrics is Config.Metrics, or nopMetrics if it is nil.
+	metrics Metrics
 }
 
 func newLRU(l log.Logger, conf Config) *lru {
+	if err := conf.CheckCaps(); err != nil {
+		l.Panic(err)
+	}
 	c := &lru{
-		log:   l,
-		table: make(map[string]*node),
-		limits: limits{
-			total: conf.Size,
-			hot:   conf.Size * (hotCap * 100) / 100,
-			warm:  conf.Size * (warmCap * 100) / 100,
-		},
+		log:                 l,
+		table:               make(map[string]*node),
+		expiredSweep:        conf.ExpiredSweep,
+		promoteAfterHits:    1,
+		snapshotParallelism: conf.SnapshotParallelism,
+		limits:              newLimits(conf),
+		onEvictCallback:     conf.OnEvict,
+		metrics:             conf.Metrics,
+	}
+	if c.metrics == nil {
+		c.metrics = nopMetrics{}
+	}
+	if conf.LockWaitBuckets != nil {
+		c.lockWaitBuckets = conf.LockWaitBuckets
+		c.lockWaitHist = make([]int, len(conf.LockWaitBuckets)+1)
+	}
+	if conf.PromoteAfterHits > 1 {
+		c.promoteAfterHits = int32(conf.PromoteAfterHits)
 	}
 	for i := 0; i < temps; i++ {
 		queue := newQueue()
@@ -40,9 +95,41 @@ func newLRU(l log.Logger, conf Config) *lru {
 	c.hot().onInactive = moveTo(c.cold())
 	c.warm().onInactive = moveTo(c.cold())
 	c.cold().onInactive = c.onEvict
+	if conf.CrawlPeriod > 0 {
+		c.crawler = newCrawler(c, conf.CrawlPeriod, conf.CrawlBatchSize)
+		go c.crawler.run()
+	}
+	if conf.AsyncEviction {
+		c.maxAsyncOverflow = conf.MaxAsyncOverflow
+		if c.maxAsyncOverflow == 0 {
+			c.maxAsyncOverflow = conf.Size / DefaultAsyncOverflowDivisor
+		}
+		c.evictSignal = make(chan struct{}, 1)
+		c.evictorStop = make(chan struct{})
+		c.evictorDone = make(chan struct{})
+		go c.runEvictor()
+	}
 	return c
 }
 
+// close stops background goroutines.
+func (c *lru) close() {
+	if c.crawler != nil {
+		c.crawler.Close()
+	}
+	if c.evictSignal != nil {
+		c.closeOnce.Do(func() { close(c.evictorStop) })
+		<-c.evictorDone
+	}
+}
+
+// recycleItems recycles data of all items. It is used to drop partially read cache.
+func (c *lru) recycleItems() {
+	for _, n := range c.table {
+		n.Data.Recycle()
+	}
+}
+
 type temp uint8
 
 const (
@@ -52,8 +139,8 @@ const (
 
 	temps = 3
 
-	hotCap  = 0.32
-	warmCap = 0.32
+	// DefaultCap is default Config.HotCap and Config.WarmCap.
+	DefaultCap = 0.32
 )
 
 type limits struct {
@@ -62,9 +149,28 @@ type limits struct {
 	warm  int64
 }
 
+func newLimits(conf Config) limits {
+	hotCap, warmCap := conf.caps()
+	return limits{
+		total: conf.Size,
+		hot:   int64(float64(conf.Size) * hotCap),
+		warm:  int64(float64(conf.Size) * warmCap),
+	}
+}
+
+// ItemFits returns true if item can be set in cache configured by conf.
+// Item that doesn't fit is not stored on set, and old item with same key is removed.
+func ItemFits(conf Config, meta ItemMeta) bool {
+	return meta.size() <= newLimits(conf).hot
+}
+
 func (c *lru) set(i Item) {
 	defer c.checkInvariants()
-	now := nowUnix()
+	c.checkClockSkew()
+	// Assigned even for expired item, so AOF replay of same sets assigns same ids.
+	c.cas++
+	i.CAS = c.cas
+	now := NowUnix()
 	expired := i.expired(now)
 	if expired {
 		c.log.Warn("Set expired item.")
@@ -74,6 +180,7 @@ func (c *lru) set(i Item) {
 	if ok {
 		c.log.Debugf("Remove old item %s value.", i.Key)
 		wasActive = n.isActive()
+		c.reclaimedByOverwrite += n.size()
 		n.detach()
 		c.deleteDetached(n)
 	}
@@ -82,7 +189,14 @@ func (c *lru) set(i Item) {
 		i.Data.Recycle()
 		return
 	}
+	if i.size() > c.limits.hot {
+		// Server checks ItemFits before set, but AOF written with larger cache size can have such items.
+		c.log.Errorf("Skip add of too large item %s. Size %v, limit %v.", i.Key, i.size(), c.limits.hot)
+		i.Data.Recycle()
+		return
+	}
 	c.log.Debugf("Add %s.", i.Key)
+	c.metrics.Set()
 	n = newNode(i)
 	c.table[i.Key] = n
 	c.queues[hot].push(n)
@@ -90,36 +204,140 @@ func (c *lru) set(i Item) {
 		n.active = active
 	}
 
-	if n.size() > c.limits.hot {
-		c.log.Panic("Too large item. Size %v, limit %v", n.size(), c.limits.hot)
+	if c.hotOverflow() || c.totalOverflow() {
+		c.evict()
 	}
 
-	if c.hotOverflow() || c.totalOverflow() {
-		// TODO do this in background goroutine. That improves latency.
-		c.fixOverflows()
+}
+
+// add sets item only if there is no live item with same key in cache.
+// Otherwise item data is recycled.
+func (c *lru) add(i Item) (stored bool) {
+	n, ok := c.table[i.Key]
+	if ok && !n.expired(NowUnix()) {
+		c.log.Debugf("Not added %s.", i.Key)
+		i.Data.Recycle()
+		return false
 	}
+	c.set(i)
+	return true
+}
 
+// replace sets item only if live item with same key is in cache.
+// Otherwise item data is recycled.
+func (c *lru) replace(i Item) (stored bool) {
+	n, ok := c.table[i.Key]
+	if !ok || n.expired(NowUnix()) {
+		c.log.Debugf("Not replaced %s.", i.Key)
+		i.Data.Recycle()
+		return false
+	}
+	c.set(i)
+	return true
+}
+
+// casSet sets item only if live item with same key has casID CAS.
+// Otherwise item data is recycled.
+func (c *lru) casSet(i Item, casID uint64) CasResult {
+	n, ok := c.table[i.Key]
+	if !ok || n.expired(NowUnix()) {
+		c.log.Debugf("CAS of %s: not found.", i.Key)
+		i.Data.Recycle()
+		return CasNotFound
+	}
+	if n.CAS != casID {
+		c.log.Debugf("CAS of %s: exists with other CAS.", i.Key)
+		i.Data.Recycle()
+		return CasExists
+	}
+	c.set(i)
+	return CasStored
+}
+
+// incr adds delta to item value, that should be decimal uint64, or subtracts delta, if decr is true.
+// Incremented value wraps around on overflow, and decremented is clamped at zero.
+// Item with new value is set, so it gets new CAS unique.
+func (c *lru) incr(key []byte, delta uint64, decr bool) (newVal uint64, found, notNumeric bool) {
+	n, ok := c.table[string(key)] // No allocation.
+	if !ok || n.expired(NowUnix()) {
+		return
+	}
+	found = true
+	val, err := n.Data.ParseUint()
+	if err != nil {
+		notNumeric = true
+		return
+	}
+	switch {
+	case !decr:
+		newVal = val + delta
+	case delta < val:
+		newVal = val - delta
+	}
+	i := Item{ItemMeta: n.ItemMeta, Data: n.Data.NewUint(newVal)}
+	i.Bytes = len(strconv.FormatUint(newVal, 10))
+	c.set(i)
+	return
+}
+
+// peek returns view of live item, without changing its activity, fetched flag and metrics.
+func (c *lru) peek(key []byte) (view ItemView, ok bool) {
+	n, ok := c.table[string(key)] // No allocation.
+	if !ok || n.expired(NowUnix()) {
+		return ItemView{}, false
+	}
+	return n.NewView(), true
 }
 
 func (c *lru) get(keys ...[]byte) (views []ItemView) {
 	c.log.Debugf("Get %s", keysPrinter{keys})
-	now := time.Now().Unix()
+	now := NowUnix()
 	for _, key := range keys {
-		if n, ok := c.table[string(key)]; ok { // No allocation.
-			if !n.expired(now) {
-				n.setActive()
-				views = append(views, n.NewView())
-			}
+		if view, ok := c.getOne(key, now); ok {
+			views = append(views, view)
 		}
 	}
 	return
 }
 
+// getOne is get of single key, that doesn't allocate views slice. It is not logged,
+// because log call arguments are allocated even if debug level is disabled.
+func (c *lru) getOne(key []byte, now int64) (view ItemView, ok bool) {
+	n, ok := c.table[string(key)] // No allocation.
+	if !ok || n.expired(now) {
+		c.metrics.Miss()
+		return ItemView{}, false
+	}
+	c.metrics.Hit()
+	n.hit(c.promoteAfterHits)
+	n.setFetched()
+	return n.NewView(), true
+}
+
+// getAndTouch is get, that sets exptime of found items.
+func (c *lru) getAndTouch(exptime int64, keys ...[]byte) (views []ItemView) {
+	c.log.Debugf("Get and touch %s", keysPrinter{keys})
+	now := NowUnix()
+	for _, key := range keys {
+		n, ok := c.table[string(key)] // No allocation.
+		if !ok || n.expired(now) {
+			c.metrics.Miss()
+			continue
+		}
+		c.metrics.Hit()
+		n.Exptime = exptime
+		n.hit(c.promoteAfterHits)
+		n.setFetched()
+		views = append(views, n.NewView())
+	}
+	return
+}
+
 func (c *lru) touch(keys ...[]byte) {
 	c.log.Debugf("Touch %s", keysPrinter{keys})
 	for _, key := range keys {
 		if n, ok := c.table[string(key)]; ok { // No allocation.
-			n.setActive()
+			n.hit(c.promoteAfterHits)
 		}
 	}
 	return
@@ -137,9 +355,183 @@ func (c *lru) delete(key []byte) (deleted bool) {
 	return true
 }
 
+// tailAge returns seconds passed since last access of oldest items in hot, warm and cold queues.
+// Age of empty queue is 0.
+func (c *lru) tailAge() (hot, warm, cold int64) {
+	now := NowUnix()
+	age := func(q *queue) int64 {
+		if q.empty() {
+			return 0
+		}
+		return now - atomic.LoadInt64(&q.head().lastAccess)
+	}
+	return age(c.hot()), age(c.warm()), age(c.cold())
+}
+
+// QueueStats describes items of one of cache queues.
+type QueueStats struct {
+	Items int
+	Size  int64
+	// Age is seconds passed since last access of oldest item. 0 for empty queue.
+	Age int64
+}
+
+// queueStats returns stats of cold, warm and hot queues. Items are counted by queue iteration.
+func (c *lru) queueStats() []QueueStats {
+	stats := make([]QueueStats, temps)
+	for t, q := range c.queues {
+		for node := q.head(); !q.end(node); node = node.next {
+			stats[t].Items++
+		}
+		stats[t].Size = q.size
+	}
+	stats[hot].Age, stats[warm].Age, stats[cold].Age = c.tailAge()
+	return stats
+}
+
+// Queues is number of cache queues. Queue index is same as in QueueStats: 0 for cold, 1 for warm and 2 for hot.
+const Queues = temps
+
+// queueItems returns metas of up to limit live items of queue from its head, or all of them,
+// if limit <= 0. Unlike get, it doesn't change items activity.
+func (c *lru) queueItems(queue, limit int) (metas []ItemMeta) {
+	now := NowUnix()
+	q := c.queues[queue]
+	for n := q.head(); !q.end(n) && (limit <= 0 || len(metas) < limit); n = n.next {
+		if !n.expired(now) {
+			metas = append(metas, n.ItemMeta)
+		}
+	}
+	return
+}
+
+// coldestKeys returns keys of up to n items in eviction order:
+// from cold queue head to hot queue tail.
+func (c *lru) coldestKeys(n int) (keys []string) {
+	for _, q := range c.queues {
+		for node := q.head(); !q.end(node) && len(keys) < n; node = node.next {
+			keys = append(keys, node.Key)
+		}
+	}
+	return
+}
+
+// keys returns up to limit keys of live items, or all of them, if limit <= 0.
+// Keys order is unspecified. Unlike get, it doesn't change items activity.
+func (c *lru) keys(limit int) (keys [][]byte) {
+	now := NowUnix()
+	for key, n := range c.table {
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+		if !n.expired(now) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	return
+}
+
+// writeLock acquires write lock. If lock wait buckets are set, wait time is measured,
+// and counted in lock wait histogram: i-th counter is number of waits in (buckets[i-1], buckets[i]]
+// microseconds, last is number of longer waits.
+func (c *lru) writeLock() {
+	if c.lockWaitBuckets == nil {
+		c.lock.Lock()
+		return
+	}
+	start := time.Now()
+	c.lock.Lock()
+	wait := int64(time.Since(start) / time.Microsecond)
+	buckets := c.lockWaitBuckets
+	c.lockWaitHist[sort.Search(len(buckets), func(i int) bool { return wait <= buckets[i] })]++
+}
+
+// unlock releases write lock, and then calls OnEvict for items evicted under it.
+func (c *lru) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.lock.Unlock()
+	c.notifyEvicted(evicted)
+}
+
+func (c *lru) notifyEvicted(evicted []ItemMeta) {
+	for _, meta := range evicted {
+		c.onEvictCallback(meta.Key, meta.Bytes)
+	}
+}
+
+// lockWaitHistogram returns copy of lock wait histogram. Nil if wait time is not measured.
+func (c *lru) lockWaitHistogram() []int {
+	if c.lockWaitHist == nil {
+		return nil
+	}
+	return append([]int(nil), c.lockWaitHist...)
+}
+
+// ttlHistogram returns live items number bucketed by remaining TTL in seconds.
+// Buckets are cumulative, like Prometheus histogram buckets: buckets are sorted bucket upper bounds ("le"),
+// and result has len(buckets)+1 counters: i-th counter is number of items with remaining TTL not greater
+// than buckets[i], last is "+Inf" bucket, that is number of all live items, including ones without expiration.
+// It is O(n) scan, so it should not be called often.
+func (c *lru) ttlHistogram(buckets []int64) []int {
+	hist := make([]int, len(buckets)+1)
+	now := NowUnix()
+	for _, q := range c.queues {
+		for n := q.head(); !q.end(n); n = n.next {
+			if n.expired(now) {
+				continue
+			}
+			i := len(buckets)
+			if n.Exptime != 0 {
+				ttl := n.Exptime - now
+				i = sort.Search(len(buckets), func(i int) bool { return ttl <= buckets[i] })
+			}
+			hist[i]++
+		}
+	}
+	for i := 1; i < len(hist); i++ {
+		hist[i] += hist[i-1]
+	}
+	return hist
+}
+
+// evict fixes overflows synchronously, or signals evictor goroutine, if eviction is asynchronous
+// and overflow doesn't exceed hard limit.
+func (c *lru) evict() {
+	if c.evictSignal == nil || c.hardOverflow() {
+		c.fixOverflows()
+		return
+	}
+	select {
+	case c.evictSignal <- struct{}{}:
+	default:
+		// Evictor has been signalled already.
+	}
+}
+
+// runEvictor fixes overflows on evictSignal, until evictorStop is closed.
+func (c *lru) runEvictor() {
+	defer close(c.evictorDone)
+	for {
+		select {
+		case <-c.evictorStop:
+			return
+		case <-c.evictSignal:
+		}
+		c.writeLock()
+		if c.hotOverflow() || c.totalOverflow() {
+			c.fixOverflows()
+		}
+		c.unlock()
+	}
+}
+
 func (c *lru) fixOverflows() {
 	c.log.Debug("Fixing overflows")
-	now := time.Now().Unix()
+	now := NowUnix()
+	if c.expiredSweep != 0 {
+		c.sweepExpired(c.expiredSweep, now)
+	}
 	if c.hotOverflow() {
 		c.log.Debug("Hot overflow.")
 		c.hot().shrinkWhile(c.hotOverflow, now)
@@ -169,13 +561,41 @@ func (c *lru) fixOverflows() {
 	}
 }
 
+// sweepExpired removes expired items while cache is overflowed.
+// It scans at most limit items from bottom of cold, warm and hot queues.
+func (c *lru) sweepExpired(limit int, now int64) {
+	overflow := func() bool { return c.hotOverflow() || c.totalOverflow() }
+	for _, q := range c.queues {
+		for n := q.head(); !q.end(n) && limit > 0 && overflow(); limit-- {
+			next := n.next
+			if n.expired(now) {
+				n.detach()
+				c.onExpire(n)
+			}
+			n = next
+		}
+	}
+}
+
 func (c *lru) onEvict(n *node) {
 	c.log.Debugf("Item %s evicted.", n.Key)
+	atomic.AddInt64(&c.evictions, 1)
+	c.metrics.Evict()
+	if !n.isFetched() {
+		c.evictedUnfetched++
+	}
+	if c.onEvictCallback != nil {
+		c.evicted = append(c.evicted, n.ItemMeta)
+	}
 	c.deleteDetached(n)
 }
 
 func (c *lru) onExpire(n *node) {
 	c.log.Debugf("Item %s expired.", n.Key)
+	c.metrics.Expire()
+	if !n.isFetched() {
+		c.expiredUnfetched++
+	}
 	c.deleteDetached(n)
 }
 
@@ -201,10 +621,20 @@ func (c *lru) hotOverflow() bool   { return c.hot().size > c.limits.hot }
 func (c *lru) warmOverflow() bool  { return c.warm().size > c.limits.warm }
 func (c *lru) totalOverflow() bool { return c.free() < 0 }
 
+// hardOverflow returns true, if cache or hot queue exceeded limit more than maxAsyncOverflow.
+func (c *lru) hardOverflow() bool {
+	return c.hot().size > c.limits.hot+c.maxAsyncOverflow || c.free() < -c.maxAsyncOverflow
+}
+
 func (c *lru) itemsNum() int {
 	return len(c.table)
 }
 
+// usage returns number of items in cache and their total size, expired included.
+func (c *lru) usage() (items int, size int64) {
+	return c.itemsNum(), c.size()
+}
+
 func (c *lru) size() int64 {
 	var size int64
 	for i := range c.queues {
@@ -222,7 +652,3 @@ func (p keysPrinter) String() string {
 	}
 	return buf.String()
 }
-
-func nowUnix() int64 {
-	return time.Now().Unix()
-}
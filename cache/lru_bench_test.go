@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/Skipor/memcached/log"
+	"github.com/Skipor/memcached/recycle"
+)
+
+func benchLRU(b *testing.B, keysNum int) (c *LRU, p *recycle.Pool, keys [][]byte) {
+	c = NewLRU(log.NewLogger(log.ErrorLevel, ioutil.Discard), Config{Size: 1 << 30})
+	p = recycle.NewPool()
+	for i := 0; i < keysNum; i++ {
+		keys = append(keys, []byte("bench_key_"+strconv.Itoa(i)))
+	}
+	return
+}
+
+// BenchmarkLRUSet measures set of already parsed item. Key string is allocated
+// in protocol parse and shared by ItemMeta and table, so set itself allocates only node.
+func BenchmarkLRUSet(b *testing.B) {
+	const keysNum = 1 << 10
+	c, p, keys := benchLRU(b, keysNum)
+	items := make([]Item, keysNum)
+	for i := range items {
+		items[i].Key = string(keys[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := items[i%keysNum]
+		it.Data, _ = p.ReadData(nil, 0)
+		c.Set(it)
+	}
+}
+
+func BenchmarkLRUGet(b *testing.B) {
+	const keysNum = 1 << 10
+	c, p, keys := benchLRU(b, keysNum)
+	for i := range keys {
+		data, _ := p.ReadData(nil, 0)
+		c.Set(Item{ItemMeta: ItemMeta{Key: string(keys[i])}, Data: data})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		views := c.Get(keys[i%keysNum])
+		views[0].Reader.Close()
+	}
+}
+
+// BenchmarkLRUGetOne is BenchmarkLRUGet with single key get, that doesn't allocate views slice.
+func BenchmarkLRUGetOne(b *testing.B) {
+	const keysNum = 1 << 10
+	c, p, keys := benchLRU(b, keysNum)
+	for i := range keys {
+		data, _ := p.ReadData(nil, 0)
+		c.Set(Item{ItemMeta: ItemMeta{Key: string(keys[i])}, Data: data})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		view, _ := c.GetOne(keys[i%keysNum])
+		view.Reader.Close()
+	}
+}
+
+func benchLRUDeleteMiss(b *testing.B, del func(c *LRU, key []byte)) {
+	const keysNum = 1 << 10
+	c, _, keys := benchLRU(b, keysNum)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			del(c, keys[i%keysNum])
+			i++
+		}
+	})
+}
+
+// BenchmarkLRUDeleteMiss measures delete of missing keys, that takes only read lock.
+func BenchmarkLRUDeleteMiss(b *testing.B) {
+	benchLRUDeleteMiss(b, func(c *LRU, key []byte) { c.Delete(key) })
+}
+
+// BenchmarkLRUDeleteMissWriteLock measures delete of missing keys under write lock, as it was before read lock fast path.
+func BenchmarkLRUDeleteMissWriteLock(b *testing.B) {
+	benchLRUDeleteMiss(b, func(c *LRU, key []byte) {
+		c.lock.Lock()
+		c.delete(key)
+		c.lock.Unlock()
+	})
+}
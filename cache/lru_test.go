@@ -1,13 +1,19 @@
 package cache
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
 	"runtime"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/Skipor/memcached/internal/util"
 	"github.com/Skipor/memcached/log"
 	"github.com/Skipor/memcached/recycle"
+	. "github.com/Skipor/memcached/testutil"
 )
 
 func testLimits(n int64) limits {
@@ -150,6 +156,229 @@ var _ = Describe("Cache", func() {
 				Expect(c.Get(Key(0))).To(BeEmpty())
 			})
 		})
+
+		Context("add", func() {
+			BESetHotWarmLimit(1)
+			BeforeEach(CheckLeaks)
+			It("not found", func() {
+				Expect(c.Add(it[0])).To(BeTrue())
+				ExpectContainsItem(it[0])
+			})
+			It("found", func() {
+				c.Set(it[0])
+				add := it[1]
+				add.Key = it[0].Key
+				Expect(c.Add(add)).To(BeFalse())
+				Expect(c.itemsNum()).To(Equal(1))
+				ExpectContainsItem(it[0])
+			})
+			It("expired", func() {
+				c.Set(it[0])
+				Node(0).Exptime = NowUnix() - 1
+				add := it[1]
+				add.Key = it[0].Key
+				Expect(c.Add(add)).To(BeTrue())
+				ExpectContainsItem(add)
+			})
+		})
+
+		Context("replace", func() {
+			BESetHotWarmLimit(1)
+			BeforeEach(CheckLeaks)
+			It("not found", func() {
+				c.Set(it[0])
+				Expect(c.Replace(it[1])).To(BeFalse())
+				Expect(c.itemsNum()).To(Equal(1))
+				Expect(c.Get(Key(1))).To(BeEmpty())
+			})
+			It("found", func() {
+				c.Set(it[0])
+				Touch(0)
+				replace := it[1]
+				replace.Key = it[0].Key
+				Expect(c.Replace(replace)).To(BeTrue())
+				Expect(c.itemsNum()).To(Equal(1))
+				Expect(Node(0).isActive()).To(BeTrue())
+				ExpectContainsItem(replace)
+			})
+			It("expired", func() {
+				c.Set(it[0])
+				Node(0).Exptime = NowUnix() - 1
+				replace := it[1]
+				replace.Key = it[0].Key
+				Expect(c.Replace(replace)).To(BeFalse())
+				Expect(c.Get(Key(0))).To(BeEmpty())
+			})
+		})
+
+		Context("cas", func() {
+			BESetHotWarmLimit(1)
+			BeforeEach(CheckLeaks)
+			It("unique assigned on every set", func() {
+				c.Set(it[0])
+				c.Set(it[1])
+				casID := Node(0).CAS
+				Expect(Node(1).CAS).To(BeNumerically(">", casID))
+				overwrite := it[2]
+				overwrite.Key = it[0].Key
+				c.Set(overwrite)
+				Expect(Node(0).CAS).To(BeNumerically(">", Node(1).CAS))
+			})
+			It("not found", func() {
+				Expect(c.Cas(it[0], 0)).To(Equal(CasNotFound))
+				Expect(c.itemsNum()).To(BeZero())
+			})
+			It("exists", func() {
+				c.Set(it[0])
+				casID := Node(0).CAS
+				c.Set(it[1])
+				cas := it[2]
+				cas.Key = it[0].Key
+				Expect(c.Cas(cas, casID+1)).To(Equal(CasExists))
+				Expect(Node(0).CAS).To(Equal(casID))
+			})
+			It("stored", func() {
+				c.Set(it[0])
+				casID := Node(0).CAS
+				cas := it[1]
+				cas.Key = it[0].Key
+				Expect(c.Cas(cas, casID)).To(Equal(CasStored))
+				Expect(Node(0).CAS).NotTo(Equal(casID))
+				ExpectContainsItem(cas)
+			})
+		})
+
+		Context("too large item", func() {
+			BESetHotWarmLimit(1)
+			BeforeEach(CheckLeaks)
+			It("not stored, and old item removed", func() {
+				c.Set(it[0])
+				large := p.sizeItem(2 * testNodeSize)
+				large.Key = it[0].Key
+				Expect(func() { c.Set(large) }).NotTo(Panic())
+				Expect(c.Get([]byte(it[0].Key))).To(BeEmpty())
+				Expect(c.Len()).To(BeZero())
+			})
+		})
+
+		Context("usage", func() {
+			BESetHotWarmLimit(2)
+			It("items counted", func() {
+				c.Set(it[0])
+				c.Set(it[1])
+				items, size := c.Usage()
+				Expect(items).To(Equal(2))
+				Expect(size).To(Equal(Node(0).size() + Node(1).size()))
+			})
+			It("size tracks sets and deletes", func() {
+				Expect(c.Len()).To(BeZero())
+				Expect(c.Size()).To(BeZero())
+				Expect(c.Free()).To(Equal(c.limits.total))
+				c.Set(it[0])
+				c.Set(it[1])
+				Expect(c.Len()).To(Equal(2))
+				Expect(c.Size()).To(Equal(Node(0).size() + Node(1).size()))
+				Expect(c.Free()).To(Equal(c.free()))
+				Expect(c.Free()).To(Equal(c.limits.total - c.Size()))
+				c.Delete([]byte(it[0].Key))
+				Expect(c.Len()).To(Equal(1))
+				Expect(c.Size()).To(Equal(Node(1).size()))
+				Expect(c.Free()).To(Equal(c.limits.total - Node(1).size()))
+			})
+			It("queue stats", func() {
+				c.Set(it[0])
+				c.Set(it[1])
+				stats := c.QueueStats()
+				Expect(stats).To(HaveLen(temps))
+				Expect(stats[hot]).To(Equal(QueueStats{Items: 2, Size: Node(0).size() + Node(1).size()}))
+				Expect(stats[cold]).To(Equal(QueueStats{}))
+			})
+		})
+
+		Context("get and touch", func() {
+			BESetHotWarmLimit(1)
+			BeforeEach(CheckLeaks)
+			It("exptime set for found", func() {
+				c.Set(it[0])
+				exptime := NowUnix() + 100
+				views := c.GetAndTouch(exptime, Key(0), Key(1))
+				Expect(views).To(HaveLen(1))
+				views[0].Reader.Close()
+				Expect(Node(0).Exptime).To(Equal(exptime))
+				Expect(Node(0).isActive()).To(BeTrue())
+			})
+			It("expired not found", func() {
+				c.Set(it[0])
+				Node(0).Exptime = NowUnix() - 1
+				Expect(c.GetAndTouch(NowUnix()+100, Key(0))).To(BeEmpty())
+				Expect(Node(0).Exptime).To(BeNumerically("<", NowUnix()))
+			})
+			It("zero exptime makes item never expire", func() {
+				c.Set(it[0])
+				views := c.GetAndTouch(0, Key(0))
+				Expect(views).To(HaveLen(1))
+				views[0].Reader.Close()
+				Expect(Node(0).Exptime).To(BeZero())
+				view, found := c.getOne(Key(0), NowUnix()+10*365*24*60*60)
+				Expect(found).To(BeTrue())
+				view.Reader.Close()
+			})
+		})
+
+		Context("incr", func() {
+			BESetHotWarmLimit(1)
+			BeforeEach(CheckLeaks)
+			key := []byte("counter")
+			SetValue := func(v string) {
+				data, _ := p.ReadData(bytes.NewReader([]byte(v)), len(v))
+				c.Set(Item{ItemMeta: ItemMeta{Key: string(key), Flags: 7, Bytes: len(v)}, Data: data})
+			}
+			ExpectValue := func(v string) {
+				views := c.Get(key)
+				ExpectWithOffset(1, views).To(HaveLen(1))
+				ExpectWithOffset(1, views[0].Flags).To(BeEquivalentTo(7))
+				ExpectWithOffset(1, views[0].Bytes).To(Equal(len(v)))
+				data, _ := ioutil.ReadAll(views[0].Reader)
+				ExpectWithOffset(1, data).To(BeEquivalentTo(v))
+				views[0].Reader.Close()
+			}
+			It("not found", func() {
+				_, found, _ := c.Incr(key, 1)
+				Expect(found).To(BeFalse())
+			})
+			It("not numeric", func() {
+				SetValue("1x")
+				_, found, notNumeric := c.Incr(key, 1)
+				Expect(found).To(BeTrue())
+				Expect(notNumeric).To(BeTrue())
+				ExpectValue("1x")
+			})
+			It("incremented", func() {
+				SetValue("99")
+				casID := c.table[string(key)].CAS
+				newVal, found, notNumeric := c.Incr(key, 1)
+				Expect(newVal).To(BeEquivalentTo(100))
+				Expect(found).To(BeTrue())
+				Expect(notNumeric).To(BeFalse())
+				ExpectValue("100")
+				Expect(c.table[string(key)].CAS).NotTo(Equal(casID))
+			})
+			It("increment wraps around", func() {
+				SetValue("18446744073709551615")
+				newVal, _, _ := c.Incr(key, 2)
+				Expect(newVal).To(BeEquivalentTo(1))
+				ExpectValue("1")
+			})
+			It("decrement clamped at zero", func() {
+				SetValue("10")
+				newVal, _, _ := c.Decr(key, 3)
+				Expect(newVal).To(BeEquivalentTo(7))
+				ExpectValue("7")
+				newVal, _, _ = c.Decr(key, 8)
+				Expect(newVal).To(BeZero())
+				ExpectValue("0")
+			})
+		})
 	})
 
 	Context("item flow", func() {
@@ -167,11 +396,43 @@ var _ = Describe("Cache", func() {
 			c.Set(it[0])
 			Expect(Node(0).isActive()).To(BeFalse())
 		})
+		It("overwrite reclaimed size", func() {
+			c.Set(it[0])
+			c.Set(it[1])
+			Expect(c.ReclaimedByOverwrite()).To(BeZero())
+			size := Node(0).size()
+			overwrite := it[2]
+			overwrite.Key = it[0].Key
+			c.Set(overwrite)
+			Expect(c.ReclaimedByOverwrite()).To(BeEquivalentTo(size))
+		})
 		It("active after get", func() {
 			c.Set(it[0])
 			Touch(0)
 			Expect(Node(0).isActive()).To(BeTrue())
 		})
+		It("get one same as get", func() {
+			c.Set(it[0])
+			view, found := c.GetOne(Key(0))
+			Expect(found).To(BeTrue())
+			Expect(view.ItemMeta).To(Equal(Node(0).ItemMeta))
+			view.Reader.Close()
+			Expect(Node(0).isActive()).To(BeTrue())
+			Expect(Node(0).isFetched()).To(BeTrue())
+
+			_, found = c.GetOne(Key(1))
+			Expect(found).To(BeFalse())
+			Node(0).Exptime = NowUnix() - 1
+			_, found = c.GetOne(Key(0))
+			Expect(found).To(BeFalse())
+		})
+		It("item with zero exptime never expires", func() {
+			it[0].Exptime = 0
+			c.Set(it[0])
+			view, found := c.getOne(Key(0), NowUnix()+10*365*24*60*60)
+			Expect(found).To(BeTrue())
+			view.Reader.Close()
+		})
 
 		BeforeEach(CheckLeaks)
 		It("items flow", func() {
@@ -233,7 +494,7 @@ var _ = Describe("Cache", func() {
 			}
 
 			By("expired evicted by inactive")
-			Node(4).Exptime = nowUnix() - 1
+			Node(4).Exptime = NowUnix() - 1
 			// h:{it4*}, w:{it1}, c:{it2}
 			c.Set(it[5])
 			// it5 evict expired hot it4
@@ -244,6 +505,323 @@ var _ = Describe("Cache", func() {
 		})
 	})
 
+	Context("expired sweep", func() {
+		BESetHotWarmLimit(1)
+		var sweep int
+		BeforeEach(func() { sweep = 0 })
+		JustBeforeEach(func() {
+			c.expiredSweep = sweep
+			for i := 0; i < 3; i++ {
+				c.Set(it[i])
+			}
+			// h:{it2}, w:{}, c:{it0, it1}
+			it[1].Exptime = NowUnix() - 1
+			Node(1).Exptime = it[1].Exptime
+			c.Set(it[3])
+		})
+		AfterEach(func() { c.ExpectInvariantsOk() })
+
+		It("disabled, live item evicted", func() {
+			Expect(c.hot().items()).To(ConsistOf(it[3]))
+			Expect(c.cold().items()).To(Equal([]Item{it[1], it[2]}))
+		})
+		Context("enabled", func() {
+			BeforeEach(func() { sweep = 2 })
+			It("expired item reaped first", func() {
+				Expect(c.hot().items()).To(ConsistOf(it[3]))
+				Expect(c.cold().items()).To(Equal([]Item{it[0], it[2]}))
+			})
+		})
+		Context("limit is too small", func() {
+			BeforeEach(func() { sweep = 1 })
+			It("live item evicted", func() {
+				Expect(c.cold().items()).To(Equal([]Item{it[1], it[2]}))
+			})
+		})
+	})
+
+	Context("promote after hits", func() {
+		BESetHotWarmLimit(1)
+		JustBeforeEach(func() {
+			c.promoteAfterHits = 2
+			c.Set(it[0])
+		})
+		It("inactive after first hit", func() {
+			Touch(0)
+			Expect(Node(0).isActive()).To(BeFalse())
+		})
+		It("active after second hit", func() {
+			Touch(0)
+			Touch(0)
+			Expect(Node(0).isActive()).To(BeTrue())
+		})
+		It("hits reset when node reaches queue bottom", func() {
+			Touch(0)
+			c.Set(it[1])
+			// h:{it1}, w:{}, c:{it0}
+			Expect(c.cold().items()).To(ConsistOf(it[0]))
+			Touch(0)
+			Expect(Node(0).isActive()).To(BeFalse())
+		})
+	})
+
+	Context("unfetched", func() {
+		BESetHotWarmLimit(1)
+		// Evicts it0. h:{it3}, w:{}, c:{it1, it2}
+		SetItems := func(fetch func()) {
+			c.Set(it[0])
+			fetch()
+			for i := 1; i < 4; i++ {
+				c.Set(it[i])
+			}
+			Expect(c.Get(Key(0))).To(BeEmpty())
+		}
+		It("evicted counted", func() {
+			SetItems(func() {})
+			expired, evicted := c.Unfetched()
+			Expect(expired).To(BeZero())
+			Expect(evicted).To(BeEquivalentTo(1))
+		})
+		It("fetched not counted", func() {
+			// Fetch without activation, so item is evicted.
+			c.promoteAfterHits = 2
+			SetItems(func() { Touch(0) })
+			expired, evicted := c.Unfetched()
+			Expect(expired).To(BeZero())
+			Expect(evicted).To(BeZero())
+			Expect(c.Evictions()).To(BeEquivalentTo(1))
+		})
+		It("expired counted", func() {
+			c.expiredSweep = 2
+			for i := 0; i < 3; i++ {
+				c.Set(it[i])
+			}
+			// h:{it2}, w:{}, c:{it0, it1}
+			Node(1).Exptime = NowUnix() - 1
+			c.Set(it[3])
+			expired, evicted := c.Unfetched()
+			Expect(expired).To(BeEquivalentTo(1))
+			Expect(evicted).To(BeZero())
+		})
+	})
+
+	Context("lock wait histogram", func() {
+		It("nil when disabled", func() {
+			Expect(c.LockWaitHistogram()).To(BeNil())
+		})
+		It("write locks counted", func() {
+			c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{
+				Size:            1 << 20,
+				LockWaitBuckets: []int64{1000, 1000000},
+			})
+			item := p.testItem()
+			c.Set(item)
+			c.Delete([]byte("not_found")) // Read lock only.
+			c.Delete([]byte(item.Key))
+			hist := c.LockWaitHistogram()
+			Expect(hist).To(HaveLen(3))
+			Expect(hist[0] + hist[1] + hist[2]).To(Equal(2))
+		})
+	})
+
+	Context("evict callback", func() {
+		It("called after unlock for evicted items", func() {
+			const itemsNum = 10
+			evicted := map[string]int{}
+			c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{
+				Size: itemsNum * testNodeSize,
+				OnEvict: func(key string, bytes int) {
+					c.Len() // Lock is released, so cache can be used.
+					evicted[key] = bytes
+				},
+			})
+			var items []ItemMeta
+			for i := 0; i < 2*itemsNum; i++ {
+				item := p.testItem()
+				items = append(items, item.ItemMeta)
+				c.Set(item)
+			}
+			Expect(c.Len()).To(Equal(itemsNum))
+			Expect(evicted).To(HaveLen(itemsNum))
+			for _, item := range items {
+				if len(c.Get([]byte(item.Key))) == 0 {
+					Expect(evicted).To(HaveKeyWithValue(item.Key, item.Bytes))
+				}
+			}
+		})
+
+		It("not called for expired items", func() {
+			var called bool
+			c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{
+				Size:         4 * testNodeSize,
+				ExpiredSweep: 10,
+				OnEvict:      func(string, int) { called = true },
+			})
+			for i := 0; i < 4; i++ {
+				expired := p.testItem()
+				expired.Exptime = 1
+				c.Set(expired)
+			}
+			c.Set(p.testItem())
+			Expect(c.Len()).To(BeNumerically("<", 5))
+			Expect(called).To(BeFalse())
+		})
+	})
+
+	Context("metrics", func() {
+		It("notified about events", func() {
+			m := &AtomicMetrics{}
+			c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{Size: 4 * testNodeSize, Metrics: m})
+			a, b := p.testItem(), p.testItem()
+			c.Set(a)
+			c.Set(b)
+			Expect(m.Load()).To(Equal(AtomicMetrics{Sets: 2}))
+
+			views := c.Get([]byte(a.Key), []byte("not_found"))
+			views = append(views, c.GetAndTouch(0, []byte(a.Key))...)
+			for _, view := range views {
+				view.Reader.Close()
+			}
+			Expect(m.Load()).To(Equal(AtomicMetrics{Sets: 2, Hits: 2, Misses: 1}))
+
+			c.table[b.Key].Exptime = NowUnix() - 1
+			_, found := c.GetOne([]byte(b.Key))
+			Expect(found).To(BeFalse())
+			newCrawler(c.lru, time.Hour, 0).crawl()
+			Expect(m.Load()).To(Equal(AtomicMetrics{Sets: 2, Hits: 2, Misses: 2, Expirations: 1}))
+
+			const sets = 10
+			for i := 0; i < sets; i++ {
+				c.Set(p.testItem())
+			}
+			loaded := m.Load()
+			Expect(loaded.Sets).To(BeEquivalentTo(2 + sets))
+			Expect(loaded.Evictions).To(BeNumerically(">", 0))
+			Expect(loaded.Evictions).To(BeEquivalentTo(int(loaded.Sets-loaded.Expirations) - c.Len()))
+		})
+
+		It("nil is no-op", func() {
+			c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{Size: 4 * testNodeSize})
+			c.Set(p.testItem())
+			Expect(c.Get([]byte("not_found"))).To(BeEmpty())
+		})
+	})
+
+	Context("store from reader", func() {
+		BESetHotWarmLimit(k)
+		BeforeEach(CheckLeaks)
+		var data []byte
+		BeforeEach(func() {
+			data = make([]byte, it[0].Bytes)
+			Rand.Read(data)
+		})
+		It("stored", func() {
+			err := StoreFrom(c, p.Pool, it[0].ItemMeta, bytes.NewReader(data))
+			Expect(err).To(BeNil())
+			views := c.Get(Key(0))
+			Expect(views).To(HaveLen(1))
+			actual, _ := ioutil.ReadAll(views[0].Reader)
+			views[0].Reader.Close()
+			ExpectBytesEqual(actual, data)
+		})
+		It("short read", func() {
+			err := StoreFrom(c, p.Pool, it[0].ItemMeta, bytes.NewReader(data[1:]))
+			Expect(util.Unwrap(err)).To(Equal(io.ErrUnexpectedEOF))
+			Expect(c.Get(Key(0))).To(BeEmpty())
+		})
+	})
+
+	Context("tail age", func() {
+		BESetHotWarmLimit(1)
+		It("age of queue heads", func() {
+			hot, warm, cold := c.TailAge()
+			Expect([]int64{hot, warm, cold}).To(Equal([]int64{0, 0, 0}))
+			for i := 0; i < 3; i++ {
+				c.Set(it[i])
+			}
+			// h:{it2}, w:{}, c:{it0, it1}
+			Node(0).lastAccess -= 100
+			Node(1).lastAccess -= 200
+			Node(2).lastAccess -= 10
+			hot, warm, cold = c.TailAge()
+			Expect(hot).To(BeNumerically("~", 10, 1))
+			Expect(warm).To(BeZero())
+			Expect(cold).To(BeNumerically("~", 100, 1))
+
+			By("access resets age")
+			Touch(0)
+			_, _, cold = c.TailAge()
+			Expect(cold).To(BeNumerically("~", 0, 1))
+		})
+	})
+
+	Context("coldest keys", func() {
+		BESetHotWarmLimit(1)
+		It("in eviction order", func() {
+			for i := 0; i < 3; i++ {
+				c.Set(it[i])
+			}
+			// h:{it2}, w:{}, c:{it0, it1}
+			Expect(c.ColdestKeys(2)).To(Equal([]string{it[0].Key, it[1].Key}))
+			Expect(c.ColdestKeys(5)).To(Equal([]string{it[0].Key, it[1].Key, it[2].Key}))
+			Expect(c.ColdestKeys(0)).To(BeEmpty())
+		})
+	})
+
+	Context("queue items", func() {
+		BESetHotWarmLimit(1)
+		It("live items from head", func() {
+			for i := 0; i < 3; i++ {
+				c.Set(it[i])
+			}
+			// h:{it2}, w:{}, c:{it0, it1}
+			Node(0).Exptime = NowUnix() - 1
+			Keys := func(metas []ItemMeta) (keys []string) {
+				for _, m := range metas {
+					keys = append(keys, m.Key)
+				}
+				return
+			}
+			Expect(Keys(c.QueueItems(int(cold), 0))).To(Equal([]string{it[1].Key}))
+			Expect(Keys(c.QueueItems(int(cold), 1))).To(Equal([]string{it[1].Key}))
+			Expect(c.QueueItems(int(hot), 0)).To(Equal([]ItemMeta{Node(2).ItemMeta}))
+			Expect(c.QueueItems(int(warm), 0)).To(BeEmpty())
+			Expect(Node(1).isActive()).To(BeFalse())
+		})
+	})
+
+	Context("keys", func() {
+		BESetHotWarmLimit(3)
+		It("live keys returned", func() {
+			for i := 0; i < 3; i++ {
+				c.Set(it[i])
+			}
+			Node(1).Exptime = NowUnix() - 1
+			Expect(c.Keys(0)).To(ConsistOf(Key(0), Key(2)))
+			Expect(c.Keys(1)).To(HaveLen(1))
+			Expect(Node(0).isActive()).To(BeFalse())
+			Expect(Node(0).isFetched()).To(BeFalse())
+		})
+	})
+
+	Context("ttl histogram", func() {
+		BESetHotWarmLimit(k)
+		It("", func() {
+			ttls := []int64{10, 50, 100, 1000}
+			for i, ttl := range ttls {
+				it[i].Exptime = NowUnix() + ttl
+				c.Set(it[i])
+			}
+			it[4].Exptime = 0
+			c.Set(it[4])
+			c.Set(it[5])
+			Node(5).Exptime = NowUnix() - 1 // Expired.
+
+			Expect(c.TTLHistogram([]int64{20, 100})).To(Equal([]int{1, 3, 5}))
+			Expect(c.TTLHistogram(nil)).To(Equal([]int{5}))
+		})
+	})
+
 	Context("total owerflow with empty warm and active cold", func() {
 		const limit = 6
 		BeforeEach(func() {
@@ -271,4 +849,63 @@ var _ = Describe("Cache", func() {
 		})
 	})
 
+	Context("caps", func() {
+		const size = 1000000
+		NewCapsLRU := func(hotCap, warmCap float64) *LRU {
+			return NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{Size: size, HotCap: hotCap, WarmCap: warmCap})
+		}
+		It("default", func() {
+			c := NewCapsLRU(0, 0)
+			Expect(c.limits).To(Equal(limits{total: size, hot: 320000, warm: 320000}))
+		})
+		It("configured", func() {
+			c := NewCapsLRU(0.6, 0.2)
+			Expect(c.limits).To(Equal(limits{total: size, hot: 600000, warm: 200000}))
+			Expect(ItemFits(Config{Size: size, HotCap: 0.6}, ItemMeta{Bytes: 500000})).To(BeTrue())
+			Expect(ItemFits(Config{Size: size}, ItemMeta{Bytes: 500000})).To(BeFalse())
+		})
+		It("invalid", func() {
+			for _, caps := range [][2]float64{{-0.1, 0.5}, {0.5, 1.1}, {0.6, 0.6}} {
+				conf := Config{Size: size, HotCap: caps[0], WarmCap: caps[1]}
+				Expect(util.Unwrap(conf.CheckCaps())).To(Equal(ErrInvalidCaps))
+				Expect(func() { NewCapsLRU(caps[0], caps[1]) }).To(Panic())
+			}
+		})
+	})
+
+	Context("async eviction", func() {
+		BESetHotWarmLimit(1)
+		JustBeforeEach(func() {
+			c = NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{
+				AsyncEviction:    true,
+				MaxAsyncOverflow: testNodeSize,
+			})
+			c.limits = testLimits(hotWarmLimit)
+		})
+		AfterEach(func() { c.Close() })
+		HotOverflow := func() bool {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+			return c.hotOverflow()
+		}
+
+		It("overflow fixed in background", func() {
+			c.Set(it[0])
+			c.Set(it[1])
+			Eventually(HotOverflow).Should(BeFalse())
+			items, _ := c.Usage()
+			Expect(items).To(Equal(2))
+		})
+		It("hard overflow fixed synchronously", func() {
+			c.Close()
+			c.Set(it[0])
+			c.Set(it[1])
+			Expect(c.hotOverflow()).To(BeTrue())
+			c.Set(it[2])
+			Expect(c.hotOverflow()).To(BeFalse())
+			Expect(c.hot().items()).To(ConsistOf(it[2]))
+			Expect(c.cold().items()).To(ConsistOf(it[:2]))
+		})
+	})
+
 })
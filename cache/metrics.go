@@ -0,0 +1,55 @@
+package cache
+
+import "sync/atomic"
+
+// Metrics is notified about cache events. Methods are called under cache lock, and gets
+// hold only read lock, so implementation should be fast and safe for concurrent use.
+type Metrics interface {
+	// Hit is called for every got key, that was found.
+	Hit()
+	// Miss is called for every got key, that was not found or expired.
+	Miss()
+	// Set is called for every item added to cache.
+	Set()
+	// Evict is called for every evicted item.
+	Evict()
+	// Expire is called for every expired item removed from cache.
+	Expire()
+}
+
+// AtomicMetrics is Metrics, that counts events. Counters should be read atomically.
+type AtomicMetrics struct {
+	Hits        int64
+	Misses      int64
+	Sets        int64
+	Evictions   int64
+	Expirations int64
+}
+
+var _ Metrics = (*AtomicMetrics)(nil)
+
+func (m *AtomicMetrics) Hit()    { atomic.AddInt64(&m.Hits, 1) }
+func (m *AtomicMetrics) Miss()   { atomic.AddInt64(&m.Misses, 1) }
+func (m *AtomicMetrics) Set()    { atomic.AddInt64(&m.Sets, 1) }
+func (m *AtomicMetrics) Evict()  { atomic.AddInt64(&m.Evictions, 1) }
+func (m *AtomicMetrics) Expire() { atomic.AddInt64(&m.Expirations, 1) }
+
+// Load returns copy of counters read atomically.
+func (m *AtomicMetrics) Load() AtomicMetrics {
+	return AtomicMetrics{
+		Hits:        atomic.LoadInt64(&m.Hits),
+		Misses:      atomic.LoadInt64(&m.Misses),
+		Sets:        atomic.LoadInt64(&m.Sets),
+		Evictions:   atomic.LoadInt64(&m.Evictions),
+		Expirations: atomic.LoadInt64(&m.Expirations),
+	}
+}
+
+// nopMetrics is used, if Config.Metrics is nil, so nil is checked once on cache creation.
+type nopMetrics struct{}
+
+func (nopMetrics) Hit()    {}
+func (nopMetrics) Miss()   {}
+func (nopMetrics) Set()    {}
+func (nopMetrics) Evict()  {}
+func (nopMetrics) Expire() {}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"encoding/gob"
+	"io"
+
+	"github.com/facebookgo/stackerr"
+
+	"github.com/Skipor/memcached/log"
+	"github.com/Skipor/memcached/recycle"
+)
+
+// Persister serializes cache items into some store.
+// It decouples cache walk from serialization format, so embedders can
+// implement external store backends.
+type Persister interface {
+	// WriteItem writes item meta and meta.Bytes of item data read from r.
+	WriteItem(meta ItemMeta, r io.Reader) error
+	// ReadAll calls fn for every written item in order of write.
+	// Reader passed to fn returns item data, and is valid only until fn return.
+	ReadAll(fn func(meta ItemMeta, r io.Reader) error) error
+}
+
+// snapshotPersister is Persister, that persists whole LRU state: queues, items activity and
+// last assigned CAS unique. Persist and ReadLockingLRUPersisted use it instead of item by item
+// write and read, if Persister implements it.
+type snapshotPersister interface {
+	Persister
+	writeSnapshot(s *Snapshot) error
+	readSnapshot(p *recycle.Pool, l log.Logger, conf Config) (*lru, error)
+}
+
+// GobPersister is default Persister, that serializes items in cache snapshot format.
+// Snapshot persisted into it is written the same way as by Snapshot.WriteTo, so LRU state is kept.
+// Items written by WriteItem make streamed snapshot, that is read as items set in write order.
+// ReadAll reads both. W is used for write, and R for read, so only one of them can be set.
+type GobPersister struct {
+	W io.Writer
+	// R as io.ByteReader required by the same reason as in readSnapshot.
+	R SnapshotReader
+
+	encoder *gob.Encoder
+}
+
+var _ snapshotPersister = (*GobPersister)(nil)
+
+func (p *GobPersister) WriteItem(meta ItemMeta, r io.Reader) (err error) {
+	if p.encoder == nil {
+		p.encoder = gob.NewEncoder(p.W)
+		err = p.encoder.Encode(snapshotInfo{Version: snapshotVersion, Streamed: true})
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	err = p.encoder.Encode(nodeMeta{ItemMeta: meta})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	_, err = io.CopyN(p.W, r, int64(meta.Bytes))
+	return stackerr.Wrap(err)
+}
+
+func (p *GobPersister) ReadAll(fn func(meta ItemMeta, r io.Reader) error) (err error) {
+	decoder := gob.NewDecoder(p.R)
+	info, err := readSnapshotInfo(decoder)
+	if err != nil {
+		return
+	}
+	return walkSnapshotNodes(decoder, p.R, info, func(_ int, meta nodeMeta, r io.Reader) error {
+		return fn(meta.ItemMeta, r)
+	})
+}
+
+func (p *GobPersister) writeSnapshot(s *Snapshot) error {
+	_, err := s.WriteTo(p.W)
+	return err
+}
+
+func (p *GobPersister) readSnapshot(pool *recycle.Pool, l log.Logger, conf Config) (*lru, error) {
+	return readSnapshot(p.R, pool, l, conf)
+}
+
+// Persist writes snapshot items into p from cold to hot queue.
+// Items activity is persisted only by Persister, that persists whole LRU state, like GobPersister.
+func (s *Snapshot) Persist(p Persister) error {
+	if sp, ok := p.(snapshotPersister); ok {
+		return sp.writeSnapshot(s)
+	}
+	return s.walk(func(n nodeSnapshot) error {
+		return p.WriteItem(n.meta.ItemMeta, n.reader)
+	})
+}
+
+// readPersisted makes cache from items read from p.
+// Items are set in read order, so if cache size is not enough, oldest items are evicted.
+func readPersisted(p Persister, pool *recycle.Pool, l log.Logger, conf Config) (c *lru, err error) {
+	c = newLRU(l, conf)
+	now := NowUnix()
+	discard := newDiscard()
+	err = p.ReadAll(func(meta ItemMeta, r io.Reader) error {
+		if meta.expired(now) {
+			return discard(r, meta.Bytes)
+		}
+		data, err := pool.ReadData(r, meta.Bytes)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		c.setPersisted(Item{meta, data})
+		return nil
+	})
+	if err != nil {
+		c.close()
+		c.recycleItems()
+		return nil, err
+	}
+	return
+}
+
+// setPersisted sets item read from persisted store, keeping its CAS unique.
+// Item without CAS unique is set with assigned one.
+func (c *lru) setPersisted(i Item) {
+	cas := i.CAS
+	c.set(i)
+	if cas == 0 {
+		return
+	}
+	// Keep persisted CAS unique instead of assigned, and don't assign it again.
+	if n, ok := c.table[i.Key]; ok {
+		n.CAS = cas
+	}
+	if cas > c.cas {
+		c.cas = cas
+	}
+}
+
+// assignCASIfNone assigns next CAS unique to meta of item read from snapshot written before CAS support.
+func (c *lru) assignCASIfNone(meta *ItemMeta) {
+	if meta.CAS == 0 {
+		c.cas++
+		meta.CAS = c.cas
+	}
+}
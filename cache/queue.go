@@ -2,14 +2,17 @@ package cache
 
 import (
 	"fmt"
+	"math"
 	"sync/atomic"
 
 	"github.com/Skipor/memcached/internal/tag"
 )
 
 const (
-	inactive int32 = iota
-	active
+	inactive int32 = 0
+	// active is node.active value of promoted node.
+	// Values between inactive and active are number of hits before promotion.
+	active int32 = math.MaxInt32
 )
 
 // Pre and post conditions (Invariants) for pushBack and shrink methods:
@@ -106,15 +109,21 @@ func (q *queue) empty() bool { return q.size == 0 }
 
 type node struct {
 	Item
-	// active can have concurrent and atomic access with read lock acquired,
+	// active is inactive, active or hits counted before promotion.
+	// It can have concurrent and atomic access with read lock acquired,
 	// or exclusive access with write lock acquired.
 	active int32
-	owner  *queue
-	prev   *node
-	next   *node
+	// lastAccess is unix time of node creation or last activation. Access is same as active.
+	lastAccess int64
+	// fetched is 1 if item was got since set. Unlike active, it is not reset on queue bottom.
+	// Access is same as active.
+	fetched int32
+	owner   *queue
+	prev    *node
+	next    *node
 }
 
-func newNode(i Item) *node { return &node{Item: i} }
+func newNode(i Item) *node { return &node{Item: i, lastAccess: NowUnix()} }
 
 func (n *node) disown() {
 	n.owner.size -= n.size()
@@ -132,18 +141,52 @@ func (n *node) detach() {
 }
 
 // require read lock be acquired
-func (n *node) setActive() { atomic.StoreInt32(&n.active, active) }
+func (n *node) setActive() { n.hit(1) }
+
+// hit counts node access. Node becomes active on promoteAfterHits hit, and its lastAccess is updated then.
+// Active node is not written again.
+// require read lock be acquired
+func (n *node) hit(promoteAfterHits int32) {
+	for {
+		hits := atomic.LoadInt32(&n.active)
+		if hits == active {
+			return
+		}
+		next := hits + 1
+		if next >= promoteAfterHits {
+			next = active
+		}
+		if atomic.CompareAndSwapInt32(&n.active, hits, next) {
+			if next == active {
+				atomic.StoreInt64(&n.lastAccess, NowUnix())
+			}
+			return
+		}
+	}
+}
 
 // require write lock be acquired
 func (n *node) isActive() bool { return n.active == active }
 
+// require read lock be acquired
+func (n *node) setFetched() {
+	if atomic.LoadInt32(&n.fetched) == 0 {
+		atomic.StoreInt32(&n.fetched, 1)
+	}
+}
+
+// require write lock be acquired
+func (n *node) isFetched() bool { return n.fetched == 1 }
+
 // extraMemoryForItem is approximation how much memory needed to save empty item.
 // Without such compensation it is possible to blow up cache with small values.
 const extraSizePerNode = 256 // Item, recycle.Data, node, two hash table cells.
 
 // MemSize return approximation how much memory needed to save empty item.
-func (n *node) size() int64 {
-	return int64(extraSizePerNode + len(n.Key) + n.Bytes)
+func (n *node) size() int64 { return n.ItemMeta.size() }
+
+func (m ItemMeta) size() int64 {
+	return int64(extraSizePerNode + len(m.Key) + m.Bytes)
 }
 
 func (q *queue) assertNotTail(n *node) {
@@ -106,6 +106,32 @@ var _ = Describe("LRU", func() {
 var _ = Describe("Item", func() {
 	It("zero exprime no expire", func() {
 		m := ItemMeta{Exptime: 0}
-		Expect(m.expired(nowUnix())).To(BeFalse())
+		Expect(m.expired(NowUnix())).To(BeFalse())
+	})
+})
+
+var _ = Describe("Node hit", func() {
+	var n *node
+	BeforeEach(func() {
+		resetTestKeys()
+		n = testNode()
+		n.lastAccess -= 100
+	})
+	It("last access not updated before promotion", func() {
+		n.hit(2)
+		Expect(n.isActive()).To(BeFalse())
+		Expect(n.lastAccess).To(BeNumerically("<=", NowUnix()-100))
+	})
+	It("last access updated on promotion", func() {
+		n.hit(2)
+		n.hit(2)
+		Expect(n.isActive()).To(BeTrue())
+		Expect(n.lastAccess).To(BeNumerically(">=", NowUnix()-1))
+	})
+	It("last access not updated by hit of active node", func() {
+		n.setActive()
+		n.lastAccess -= 100
+		n.hit(2)
+		Expect(n.lastAccess).To(BeNumerically("<=", NowUnix()-100))
 	})
 })
@@ -0,0 +1,304 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op is cache operation recorded by Recorder.
+type Op struct {
+	Time time.Time
+	// Name is "get", "gat", "set", "add", "replace", "cas", "incr", "decr" or "delete".
+	Name string
+	Keys []string
+	// Result is number of found items for get and gat, data size for set and stored add, replace or cas,
+	// 1 if value was changed for incr and decr, and 1 if item was deleted for delete.
+	Result int
+}
+
+func (o Op) String() string {
+	return fmt.Sprintf("%s %s %s %v", o.Time.Format(time.RFC3339Nano), o.Name, strings.Join(o.Keys, ","), o.Result)
+}
+
+// Recorder keeps last operations in ring buffer for post-mortem analysis.
+// Unlike AOF it records gets too. Recorder is thread safe.
+type Recorder struct {
+	lock sync.Mutex
+	ops  []Op
+	next int
+	full bool
+}
+
+// NewRecorder returns Recorder that keeps last size operations.
+func NewRecorder(size int) *Recorder {
+	if size <= 0 {
+		panic("recorder size should be positive")
+	}
+	return &Recorder{ops: make([]Op, size)}
+}
+
+func (r *Recorder) Record(op Op) {
+	r.lock.Lock()
+	r.ops[r.next] = op
+	r.next++
+	if r.next == len(r.ops) {
+		r.next = 0
+		r.full = true
+	}
+	r.lock.Unlock()
+}
+
+// Ops returns recorded operations from oldest to newest.
+func (r *Recorder) Ops() (ops []Op) {
+	r.lock.Lock()
+	if r.full {
+		ops = append(ops, r.ops[r.next:]...)
+	}
+	ops = append(ops, r.ops[:r.next]...)
+	r.lock.Unlock()
+	return
+}
+
+// NewRecordingView returns View that records operations made through v into r.
+// Returned View is thread unsafe same as v.
+func NewRecordingView(v View, r *Recorder) *RecordingView {
+	return &RecordingView{view: v, recorder: r}
+}
+
+// RecordingView is View decorator, that records operations into Recorder.
+type RecordingView struct {
+	view     View
+	recorder *Recorder
+}
+
+var _ View = (*RecordingView)(nil)
+
+func (v *RecordingView) NewGetter(rawCommand []byte) Getter {
+	return recordingGetter{v.view.NewGetter(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewGetAndToucher(rawCommand []byte) GetAndToucher {
+	return recordingGetAndToucher{v.view.NewGetAndToucher(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewSetter(rawCommand []byte) Setter {
+	return recordingSetter{v.view.NewSetter(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewAdder(rawCommand []byte) Adder {
+	return recordingAdder{v.view.NewAdder(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewReplacer(rawCommand []byte) Replacer {
+	return recordingReplacer{v.view.NewReplacer(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewCaser(rawCommand []byte) Caser {
+	return recordingCaser{v.view.NewCaser(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewIncrementer(rawCommand []byte) Incrementer {
+	return recordingIncrementer{v.view.NewIncrementer(rawCommand), v.recorder}
+}
+
+func (v *RecordingView) NewDeleter(rawCommand []byte) Deleter {
+	return recordingDeleter{v.view.NewDeleter(rawCommand), v.recorder}
+}
+
+// ColdestKeys passes call to wrapped view, if it supports it.
+func (v *RecordingView) ColdestKeys(n int) []string {
+	if ckv, ok := v.view.(interface {
+		ColdestKeys(n int) []string
+	}); ok {
+		return ckv.ColdestKeys(n)
+	}
+	return nil
+}
+
+// Keys passes call to wrapped view, if it supports it.
+func (v *RecordingView) Keys(limit int) [][]byte {
+	if kv, ok := v.view.(interface {
+		Keys(limit int) [][]byte
+	}); ok {
+		return kv.Keys(limit)
+	}
+	return nil
+}
+
+// QueueItems passes call to wrapped view, if it supports it.
+func (v *RecordingView) QueueItems(queue, limit int) []ItemMeta {
+	if qv, ok := v.view.(interface {
+		QueueItems(queue, limit int) []ItemMeta
+	}); ok {
+		return qv.QueueItems(queue, limit)
+	}
+	return nil
+}
+
+// Usage passes call to wrapped view, if it supports it.
+func (v *RecordingView) Usage() (items int, size int64) {
+	if uv, ok := v.view.(interface {
+		Usage() (items int, size int64)
+	}); ok {
+		return uv.Usage()
+	}
+	return
+}
+
+// Evictions passes call to wrapped view, if it supports it.
+func (v *RecordingView) Evictions() int64 {
+	if ev, ok := v.view.(interface {
+		Evictions() int64
+	}); ok {
+		return ev.Evictions()
+	}
+	return 0
+}
+
+// QueueStats passes call to wrapped view, if it supports it.
+func (v *RecordingView) QueueStats() []QueueStats {
+	if qv, ok := v.view.(interface {
+		QueueStats() []QueueStats
+	}); ok {
+		return qv.QueueStats()
+	}
+	return nil
+}
+
+// RotateAOF passes call to wrapped view, if it supports it.
+func (v *RecordingView) RotateAOF() error {
+	if rv, ok := v.view.(interface {
+		RotateAOF() error
+	}); ok {
+		return rv.RotateAOF()
+	}
+	return nil
+}
+
+type recordingGetter struct {
+	Getter
+	recorder *Recorder
+}
+
+func (g recordingGetter) Get(keys ...[]byte) (views []ItemView) {
+	views = g.Getter.Get(keys...)
+	op := Op{Time: time.Now(), Name: "get", Result: len(views)}
+	for _, key := range keys {
+		op.Keys = append(op.Keys, string(key))
+	}
+	g.recorder.Record(op)
+	return
+}
+
+type recordingGetAndToucher struct {
+	GetAndToucher
+	recorder *Recorder
+}
+
+func (g recordingGetAndToucher) GetAndTouch(exptime int64, keys ...[]byte) (views []ItemView) {
+	views = g.GetAndToucher.GetAndTouch(exptime, keys...)
+	op := Op{Time: time.Now(), Name: "gat", Result: len(views)}
+	for _, key := range keys {
+		op.Keys = append(op.Keys, string(key))
+	}
+	g.recorder.Record(op)
+	return
+}
+
+type recordingSetter struct {
+	Setter
+	recorder *Recorder
+}
+
+func (s recordingSetter) Set(i Item) {
+	op := Op{Time: time.Now(), Name: "set", Keys: []string{i.Key}, Result: i.Bytes}
+	s.Setter.Set(i)
+	s.recorder.Record(op)
+}
+
+type recordingAdder struct {
+	Adder
+	recorder *Recorder
+}
+
+func (a recordingAdder) Add(i Item) (stored bool) {
+	op := Op{Time: time.Now(), Name: "add", Keys: []string{i.Key}}
+	stored = a.Adder.Add(i)
+	if stored {
+		op.Result = i.Bytes
+	}
+	a.recorder.Record(op)
+	return
+}
+
+type recordingReplacer struct {
+	Replacer
+	recorder *Recorder
+}
+
+func (r recordingReplacer) Replace(i Item) (stored bool) {
+	op := Op{Time: time.Now(), Name: "replace", Keys: []string{i.Key}}
+	stored = r.Replacer.Replace(i)
+	if stored {
+		op.Result = i.Bytes
+	}
+	r.recorder.Record(op)
+	return
+}
+
+type recordingCaser struct {
+	Caser
+	recorder *Recorder
+}
+
+func (c recordingCaser) Cas(i Item, casID uint64) (result CasResult) {
+	op := Op{Time: time.Now(), Name: "cas", Keys: []string{i.Key}}
+	result = c.Caser.Cas(i, casID)
+	if result == CasStored {
+		op.Result = i.Bytes
+	}
+	c.recorder.Record(op)
+	return
+}
+
+type recordingIncrementer struct {
+	Incrementer
+	recorder *Recorder
+}
+
+func (r recordingIncrementer) Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	newVal, found, notNumeric = r.Incrementer.Incr(key, delta)
+	r.record("incr", key, found && !notNumeric)
+	return
+}
+
+func (r recordingIncrementer) Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	newVal, found, notNumeric = r.Incrementer.Decr(key, delta)
+	r.record("decr", key, found && !notNumeric)
+	return
+}
+
+func (r recordingIncrementer) record(name string, key []byte, changed bool) {
+	op := Op{Time: time.Now(), Name: name, Keys: []string{string(key)}}
+	if changed {
+		op.Result = 1
+	}
+	r.recorder.Record(op)
+}
+
+type recordingDeleter struct {
+	Deleter
+	recorder *Recorder
+}
+
+func (d recordingDeleter) Delete(key []byte) (deleted bool) {
+	deleted = d.Deleter.Delete(key)
+	op := Op{Time: time.Now(), Name: "delete", Keys: []string{string(key)}}
+	if deleted {
+		op.Result = 1
+	}
+	d.recorder.Record(op)
+	return
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/Skipor/memcached/log"
+)
+
+var _ = Describe("Recording view", func() {
+	var (
+		p testPool
+		r *Recorder
+		v *RecordingView
+	)
+	BeforeEach(func() {
+		resetTestKeys()
+		p = newTestPool()
+		r = NewRecorder(3)
+		v = NewRecordingView(NewLRU(log.NewLogger(log.DebugLevel, GinkgoWriter), Config{Size: 1 << 20}), r)
+	})
+	OpNames := func() (names []string) {
+		for _, op := range r.Ops() {
+			names = append(names, op.Name)
+		}
+		return
+	}
+
+	It("operations recorded", func() {
+		it := p.testItem()
+		v.NewSetter(nil).Set(it)
+		views := v.NewGetter(nil).Get([]byte(it.Key), []byte("not_found"))
+		Expect(views).To(HaveLen(1))
+		views[0].Reader.Close()
+		Expect(v.NewDeleter(nil).Delete([]byte(it.Key))).To(BeTrue())
+
+		ops := r.Ops()
+		Expect(OpNames()).To(Equal([]string{"set", "get", "delete"}))
+		Expect(ops[0].Keys).To(Equal([]string{it.Key}))
+		Expect(ops[0].Result).To(Equal(it.Bytes))
+		Expect(ops[1].Keys).To(Equal([]string{it.Key, "not_found"}))
+		Expect(ops[1].Result).To(Equal(1))
+		Expect(ops[2].Result).To(Equal(1))
+	})
+
+	It("only last operations kept", func() {
+		Expect(r.Ops()).To(BeEmpty())
+		v.NewDeleter(nil).Delete([]byte("a"))
+		v.NewGetter(nil).Get([]byte("b"))
+		Expect(OpNames()).To(Equal([]string{"delete", "get"}))
+		v.NewGetter(nil).Get([]byte("c"))
+		v.NewDeleter(nil).Delete([]byte("d"))
+		ops := r.Ops()
+		Expect(OpNames()).To(Equal([]string{"get", "get", "delete"}))
+		Expect(ops[0].Keys).To(Equal([]string{"b"}))
+		Expect(ops[2].Keys).To(Equal([]string{"d"}))
+		Expect(ops[2].Result).To(BeZero())
+	})
+})
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/Skipor/memcached/log"
+	"github.com/Skipor/memcached/recycle"
+)
+
+// Scan workload: hot working set accesses interleaved with scan of keys, that are never reused.
+// Working set fits into cache, but scan between two accesses of the same hot key
+// is usually larger than cache, so plain LRU evicts hot keys, before they are reused.
+const (
+	scanCapacity   = 1000 // Cache capacity in items.
+	scanHotKeys    = 200
+	scanPerHot     = 4 // Scan keys accessed after every hot key access.
+	scanHotAccess  = 20000
+	scanRandomSeed = 42
+)
+
+type simCache interface {
+	// get returns true on hit.
+	get(key string) bool
+	set(key string)
+}
+
+// scanWorkload runs scan workload on c. Missed keys are set, as look-aside cache clients do.
+// Returns hit ratio of hot keys accesses, measured after warm up.
+func scanWorkload(c simCache) float64 {
+	r := rand.New(rand.NewSource(scanRandomSeed))
+	var scanKey, hits int
+	access := func(key string) bool {
+		if c.get(key) {
+			return true
+		}
+		c.set(key)
+		return false
+	}
+	const warmUp = scanHotAccess / 2
+	for i := 0; i < scanHotAccess; i++ {
+		if access(hotKey(r.Intn(scanHotKeys))) && i >= warmUp {
+			hits++
+		}
+		for j := 0; j < scanPerHot; j++ {
+			access(fmt.Sprintf("scan_%07d", scanKey))
+			scanKey++
+		}
+	}
+	return float64(hits) / float64(scanHotAccess-warmUp)
+}
+
+// hotKey has same length as scan key, so all items have same size.
+func hotKey(i int) string { return fmt.Sprintf("hot__%07d", i) }
+
+type lruSim struct {
+	*LRU
+	pool *recycle.Pool
+}
+
+func newLRUSim() lruSim {
+	itemSize := (&node{Item: Item{ItemMeta: ItemMeta{Key: hotKey(0)}}}).size()
+	l := log.NewLogger(log.ErrorLevel, ioutil.Discard)
+	return lruSim{NewLRU(l, Config{Size: scanCapacity * itemSize}), recycle.NewPool()}
+}
+
+func (c lruSim) get(key string) bool {
+	views := c.Get([]byte(key))
+	for _, v := range views {
+		v.Reader.Close()
+	}
+	return len(views) != 0
+}
+
+func (c lruSim) set(key string) {
+	data, _ := c.pool.ReadData(nil, 0)
+	c.Set(Item{ItemMeta: ItemMeta{Key: key}, Data: data})
+}
+
+// plainLRU is classic LRU baseline: hit moves item to head, and tail is evicted on overflow.
+type plainLRU struct {
+	capacity int
+	queue    *list.List
+	table    map[string]*list.Element
+}
+
+func newPlainLRU() *plainLRU {
+	return &plainLRU{scanCapacity, list.New(), make(map[string]*list.Element)}
+}
+
+func (c *plainLRU) get(key string) bool {
+	e, ok := c.table[key]
+	if ok {
+		c.queue.MoveToFront(e)
+	}
+	return ok
+}
+
+func (c *plainLRU) set(key string) {
+	c.table[key] = c.queue.PushFront(key)
+	if c.queue.Len() > c.capacity {
+		delete(c.table, c.queue.Remove(c.queue.Back()).(string))
+	}
+}
+
+var _ = Describe("scan resistance", func() {
+	It("hot set survives scan", func() {
+		segmented := scanWorkload(newLRUSim())
+		plain := scanWorkload(newPlainLRU())
+		fmt.Fprintf(GinkgoWriter, "Hot set hit ratio: segmented LRU %.3f, plain LRU %.3f.\n", segmented, plain)
+		Expect(segmented).To(BeNumerically(">", 0.95))
+		Expect(segmented).To(BeNumerically(">", plain+0.25))
+	})
+})
+
+// BenchmarkScanResistance reports hot set hit ratio under scan workload for segmented and plain LRU.
+func BenchmarkScanResistance(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		new  func() simCache
+	}{
+		{"segmented", func() simCache { return newLRUSim() }},
+		{"plain", func() simCache { return newPlainLRU() }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var ratio float64
+			for i := 0; i < b.N; i++ {
+				ratio = scanWorkload(bc.new())
+			}
+			b.ReportMetric(ratio, "hot-hit-ratio")
+		})
+	}
+}
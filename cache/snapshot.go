@@ -1,6 +1,9 @@
 package cache
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"io"
@@ -30,55 +33,258 @@ type SnapshotReader interface {
 // what will cause extra data read that will remain in bufio.Reader.
 func readSnapshot(r SnapshotReader, p *recycle.Pool, l log.Logger, conf Config) (c *lru, err error) {
 	decoder := gob.NewDecoder(r)
-	var info snapshotInfo
-	err = decoder.Decode(&info)
+	info, err := readSnapshotInfo(decoder)
 	if err != nil {
-		err = stackerr.Wrap(err)
 		return
 	}
 	sizes := info.Sizes
 	c = newLRU(l, conf)
+	c.cas = info.CAS
 	c.table = make(map[string]*node, sizes[hot]+sizes[warm]+sizes[cold])
-	now := nowUnix()
-	discard := newDiscard()
-	for li, queue := range c.queues {
-		for i := 0; i < sizes[li]; i++ {
-			var meta nodeMeta // Should be zeroed before every decode.
-			err = decoder.Decode(&meta)
-			if err != nil {
-				err = stackerr.Wrap(err)
-				return
-			}
+	now := NowUnix()
+	if info.Segmented && info.Version >= 2 {
+		err = c.readSegments(r, p, sizes, conf.SnapshotParallelism, now)
+	} else {
+		err = walkSnapshotNodes(decoder, r, info, func(li int, meta nodeMeta, r io.Reader) error {
 			if meta.expired(now) {
-				err = discard(r, meta.Bytes)
-				if err != nil {
-					return
-				}
-				continue
+				return nil // Data is skipped by walk.
 			}
-			var data *recycle.Data
-			data, err = p.ReadData(r, meta.Bytes)
+			data, err := p.ReadData(r, meta.Bytes)
 			if err != nil {
-				err = stackerr.Wrap(err)
-				return
+				return stackerr.Wrap(err)
 			}
-
+			if info.Streamed {
+				c.setPersisted(Item{meta.ItemMeta, data})
+				return nil
+			}
+			c.assignCASIfNone(&meta.ItemMeta)
 			n := newNode(Item{meta.ItemMeta, data})
-			queue.push(n)
+			c.queues[li].push(n)
 			if meta.Active {
 				n.active = active
 			}
 			c.table[n.Key] = n
-		}
+			return nil
+		})
+	}
+	if err != nil {
+		// Stop background work of cache, that will not be returned.
+		c.close()
+		c.recycleItems()
+		return nil, err
 	}
-	if c.hotOverflow() || c.warmOverflow() || c.totalOverflow() {
+	// Queues are limited by caps of reading process, that can differ from caps of snapshot writer,
+	// so only total overflow loses data.
+	if c.totalOverflow() {
 		err = stackerr.Wrap(errCacheOverflow)
+	}
+	if c.warmOverflow() {
+		c.warm().shrinkWhile(c.warmOverflow, now)
+	}
+	if c.hotOverflow() || c.totalOverflow() {
 		c.fixOverflows()
 	}
 	c.checkInvariants()
+	// Cache is not shared yet, so there is no lock to release before callbacks.
+	c.notifyEvicted(c.evicted)
+	c.evicted = nil
+	return
+}
+
+// readSnapshotInfo decodes snapshot header and checks its version.
+func readSnapshotInfo(decoder *gob.Decoder) (info snapshotInfo, err error) {
+	err = decoder.Decode(&info)
+	if err != nil {
+		err = stackerr.Wrap(err)
+		return
+	}
+	if info.Version == 0 {
+		// Snapshots written before versioning.
+		info.Version = 1
+	}
+	if info.Version > snapshotVersion {
+		err = stackerr.Newf("snapshot version %v is not supported: max supported version is %v", info.Version, snapshotVersion)
+	}
+	return
+}
+
+// walkSnapshotNodes decodes nodes of snapshot with info header sequentially, and calls fn with index of node queue,
+// node meta and reader of node data. Data unread by fn is skipped. Nodes of streamed snapshot have cold queue index.
+func walkSnapshotNodes(decoder *gob.Decoder, r SnapshotReader, info snapshotInfo, fn func(li int, meta nodeMeta, r io.Reader) error) (err error) {
+	sizes := info.Sizes
+	discard := newDiscard()
+	li, left := 0, sizes[0] // Queue index and number of its nodes left to read.
+	walkNode := func(decoder *gob.Decoder, r io.Reader) (err error) {
+		if !info.Streamed {
+			for ; left == 0; left = sizes[li] {
+				li++
+			}
+			left--
+		}
+		var meta nodeMeta // Should be zeroed before every decode.
+		err = decoder.Decode(&meta)
+		if err == io.EOF && info.Streamed {
+			return // Stream end. Not wrapped, so data read errors can't be taken for it.
+		}
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		lr := &io.LimitedReader{R: r, N: int64(meta.Bytes)}
+		err = fn(li, meta, lr)
+		if err != nil {
+			return
+		}
+		return discard(lr, int(lr.N))
+	}
+	total := sizes[hot] + sizes[warm] + sizes[cold]
+	switch {
+	case info.Streamed:
+		for err == nil {
+			err = walkNode(decoder, r)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	case !info.Segmented:
+		for i := 0; i < total && err == nil; i++ {
+			err = walkNode(decoder, r)
+		}
+	default:
+		for i := 0; i < total && err == nil; {
+			var header segmentHeader
+			if info.Version >= 2 {
+				err = binary.Read(r, binary.BigEndian, &header)
+			} else {
+				// Segments of old snapshots have no nodes number and can span queues.
+				err = binary.Read(r, binary.BigEndian, &header.Size)
+			}
+			if err != nil {
+				err = stackerr.Wrap(err)
+				break
+			}
+			// Segment is independent gob stream, so it can be decoded with own decoder.
+			sr := bufio.NewReader(io.LimitReader(r, int64(header.Size)))
+			sd := gob.NewDecoder(sr)
+			for ; i < total && err == nil; i++ {
+				if _, peekErr := sr.Peek(1); peekErr == io.EOF {
+					break
+				}
+				err = walkNode(sd, sr)
+			}
+		}
+	}
 	return
 }
 
+// readSegments reads segments of snapshot version 2 or later.
+// Up to parallelism segments are read into memory and decoded in parallel,
+// then decoded nodes are merged into cache in snapshot order.
+func (c *lru) readSegments(r io.Reader, p *recycle.Pool, sizes [temps]int, parallelism int, now int64) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	bufs := make([][]byte, parallelism)
+	queues := make([]int, parallelism)
+	nums := make([]int, parallelism)
+	decoded := make([][]*node, parallelism)
+	errs := make([]error, parallelism)
+	li, left := 0, sizes[0] // Queue index and number of its nodes left to read.
+	for read, total := 0, sizes[hot]+sizes[warm]+sizes[cold]; read < total; {
+		var round int
+		for ; round < parallelism && read < total; round++ {
+			var header segmentHeader
+			err := binary.Read(r, binary.BigEndian, &header)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			for ; left == 0; left = sizes[li] {
+				li++
+			}
+			if header.Nodes == 0 || header.Nodes > uint64(left) {
+				return stackerr.Newf("invalid snapshot segment: %v nodes, but %v left in queue", header.Nodes, left)
+			}
+			left -= int(header.Nodes)
+			read += int(header.Nodes)
+			queues[round] = li
+			if uint64(cap(bufs[round])) < header.Size {
+				bufs[round] = make([]byte, header.Size)
+			}
+			bufs[round] = bufs[round][:header.Size]
+			_, err = io.ReadFull(r, bufs[round])
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			nums[round] = int(header.Nodes)
+		}
+		var wg sync.WaitGroup
+		wg.Add(round)
+		for i := 0; i < round; i++ {
+			go func(i int) {
+				decoded[i], errs[i] = decodeSegment(bufs[i], nums[i], p, now)
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < round; i++ {
+			if errs[i] != nil {
+				// Nodes of this round, that are not pushed yet, are not in table.
+				for _, nodes := range decoded[i:round] {
+					for _, n := range nodes {
+						n.Data.Recycle()
+					}
+				}
+				return errs[i]
+			}
+			for _, n := range decoded[i] {
+				// Push attaches node as inactive, so activity is restored after.
+				wasActive := n.active == active
+				c.assignCASIfNone(&n.ItemMeta)
+				c.queues[queues[i]].push(n)
+				if wasActive {
+					n.active = active
+				}
+				c.table[n.Key] = n
+			}
+		}
+	}
+	return nil
+}
+
+// decodeSegment decodes num nodes from segment data. Expired nodes are skipped.
+// Active nodes are marked active, but should be marked again after push into queue.
+// On error nodes decoded before it are returned too, so their data can be recycled.
+func decodeSegment(data []byte, num int, p *recycle.Pool, now int64) (nodes []*node, err error) {
+	r := bytes.NewReader(data)
+	decoder := gob.NewDecoder(r)
+	discard := newDiscard()
+	nodes = make([]*node, 0, num)
+	for i := 0; i < num; i++ {
+		var meta nodeMeta // Should be zeroed before every decode.
+		err = decoder.Decode(&meta)
+		if err != nil {
+			return nodes, stackerr.Wrap(err)
+		}
+		if meta.expired(now) {
+			err = discard(r, meta.Bytes)
+			if err != nil {
+				return nodes, err
+			}
+			continue
+		}
+		var data *recycle.Data
+		data, err = p.ReadData(r, meta.Bytes)
+		if err != nil {
+			return nodes, stackerr.Wrap(err)
+		}
+		n := newNode(Item{meta.ItemMeta, data})
+		if meta.Active {
+			n.active = active
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
 // Snapshot returns made snapshot. Method requires read lock be acquired.
 func (c *lru) snapshot() *Snapshot {
 	queues := make([]queueSnapshot, temps)
@@ -94,7 +300,7 @@ func (c *lru) snapshot() *Snapshot {
 		}(cycleIndex)
 	}
 	wg.Wait()
-	return &Snapshot{queues}
+	return &Snapshot{queues: queues, parallelism: c.snapshotParallelism, cas: c.cas}
 }
 
 // Snapshot hold cache LRUs state for serialization.
@@ -103,14 +309,45 @@ func (c *lru) snapshot() *Snapshot {
 // what prevent data recycle. If snapshot will not be written, all data leak.
 type Snapshot struct {
 	queues []queueSnapshot
+	// parallelism is Config.SnapshotParallelism.
+	parallelism int
+	// cas is last assigned CAS unique.
+	cas uint64
+}
+
+// snapshotVersion is version of written snapshot format. Snapshots of greater versions can't be read.
+// Version 1 is format of snapshots written before versioning.
+// Since version 2 segments don't span queues, and segment header contains number of nodes in it,
+// so segments can be decoded independently.
+const snapshotVersion = 2
+
+// segmentHeader precedes every segment of segmented snapshot.
+// Size is length of segment data. Nodes is number of nodes in segment. It is written since version 2.
+type segmentHeader struct {
+	Size  uint64
+	Nodes uint64
 }
 
+// snapshotSegmentSize is approximate size of segment data, that is encoded by one goroutine.
+// Up to parallelism segments are buffered in memory at once.
+var snapshotSegmentSize = 4 << 20
+
 var _ io.WriterTo = (*Snapshot)(nil)
 
 // snapshotInfo contains information about encoded snapshot.
 // Is gob encoded, so fields should be exported.
 type snapshotInfo struct {
 	Sizes [temps]int
+	// Segmented is true, if nodes are serialized as sequence of segments, instead of single gob stream.
+	// Segment is big endian uint64 length, followed by independent gob stream of nodes.
+	Segmented bool
+	// CAS is last assigned CAS unique. Restored, so ids are not reused after recovery.
+	CAS uint64
+	// Version is snapshotVersion of writer. Snapshots written before versioning have zero version, that is read as 1.
+	Version int
+	// Streamed is true, if items were written one by one by GobPersister.WriteItem, so their number is unknown.
+	// Items are single gob stream until reader end, and are set into cache in read order.
+	Streamed bool
 }
 
 func (s *Snapshot) WriteTo(w io.Writer) (nn int64, err error) {
@@ -125,34 +362,123 @@ func (s *Snapshot) WriteTo(w io.Writer) (nn int64, err error) {
 	})
 
 	encoder := gob.NewEncoder(w)
-	err = encoder.Encode(s.info())
+	info := s.info()
+	info.Segmented = s.parallelism > 1
+	info.Version = snapshotVersion
+	err = encoder.Encode(info)
 	if err != nil {
 		err = stackerr.Wrap(err)
 		return
 	}
+	if info.Segmented {
+		err = s.writeSegments(w)
+		return
+	}
+	err = s.walk(func(n nodeSnapshot) (err error) {
+		err = encoder.Encode(n.meta)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		_, err = n.reader.WriteTo(w)
+		return stackerr.Wrap(err)
+	})
+	return
+}
+
+// writeSegments splits queue nodes into segments, which are encoded in parallel and written in order.
+// Segments don't span queues, so reader can decode them in parallel too.
+func (s *Snapshot) writeSegments(w io.Writer) error {
+	var segments [][]nodeSnapshot
 	for _, q := range s.queues {
-		for _, n := range q.nodes {
-			err = encoder.Encode(n.meta)
+		nodes := q.nodes
+		for len(nodes) > 0 {
+			var i, size int
+			for i < len(nodes) && size < snapshotSegmentSize {
+				size += nodes[i].meta.Bytes
+				i++
+			}
+			segments = append(segments, nodes[:i])
+			nodes = nodes[i:]
+		}
+	}
+	s.queues = nil
+	bufs := make([]bytes.Buffer, s.parallelism)
+	errs := make([]error, s.parallelism)
+	for len(segments) > 0 {
+		round := segments
+		if len(round) > s.parallelism {
+			round = round[:s.parallelism]
+		}
+		segments = segments[len(round):]
+		var wg sync.WaitGroup
+		wg.Add(len(round))
+		for i := range round {
+			go func(i int) {
+				bufs[i].Reset()
+				errs[i] = encodeSegment(&bufs[i], round[i])
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		for i := range round {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			header := segmentHeader{uint64(bufs[i].Len()), uint64(len(round[i]))}
+			err := binary.Write(w, binary.BigEndian, header)
 			if err != nil {
-				err = stackerr.Wrap(err)
-				return
+				return stackerr.Wrap(err)
 			}
-			_, err = n.reader.WriteTo(w)
+			_, err = bufs[i].WriteTo(w)
 			if err != nil {
-				err = stackerr.Wrap(err)
-				return
+				return stackerr.Wrap(err)
+			}
+		}
+	}
+	return nil
+}
+
+// encodeSegment encodes nodes as independent gob stream and closes node data readers.
+func encodeSegment(w io.Writer, nodes []nodeSnapshot) error {
+	encoder := gob.NewEncoder(w)
+	for _, n := range nodes {
+		err := encoder.Encode(n.meta)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		_, err = n.reader.WriteTo(w)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		n.reader.Close()
+	}
+	return nil
+}
+
+// walk calls fn for every node snapshot from cold to hot queue and closes node data reader after.
+// Snapshot can be walked only once.
+func (s *Snapshot) walk(fn func(n nodeSnapshot) error) error {
+	if s.queues == nil {
+		panic("snapshot has been writen already or isn't initialized")
+	}
+	for _, q := range s.queues {
+		for _, n := range q.nodes {
+			err := fn(n)
+			if err != nil {
+				return err
 			}
 			n.reader.Close()
 		}
 	}
 	s.queues = nil
-	return
+	return nil
 }
 
 func (s *Snapshot) info() (info snapshotInfo) {
 	for i, queue := range s.queues {
 		info.Sizes[i] = len(queue.nodes)
 	}
+	info.CAS = s.cas
 	return
 }
 
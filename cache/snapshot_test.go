@@ -1,7 +1,13 @@
 package cache
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -83,6 +89,73 @@ var _ = Describe("Snapshot", func() {
 		AssertEquvalent()
 	})
 
+	Context("with CAS unique of deleted item", func() {
+		BeforeEach(func() {
+			expected.set(p.randSizeItem())
+			it := p.randSizeItem()
+			expected.set(it)
+			expected.delete([]byte(it.Key))
+		})
+		It("CAS counter restored", func() {
+			DoRead()
+			Expect(err).To(BeNil())
+			Expect(actual.cas).To(BeEquivalentTo(2))
+			ExpectLRUsToBeEquvalent(actual, expected)
+		})
+		It("CAS uniques assigned after read are greater than restored", func() {
+			DoRead()
+			Expect(err).To(BeNil())
+			it := p.randSizeItem()
+			actual.set(it)
+			views := actual.get([]byte(it.Key))
+			Expect(views).To(HaveLen(1))
+			Expect(views[0].CAS).To(BeNumerically(">", 2))
+			views[0].Reader.Close()
+		})
+	})
+
+	Context("without CAS uniques", func() {
+		// Snapshots written before CAS support have no CAS uniques and counter.
+		BeforeEach(func() {
+			for i := 0; i < 3; i++ {
+				expected.set(p.randSizeItem())
+			}
+			for _, n := range expected.table {
+				n.CAS = 0
+			}
+			expected.cas = 0
+		})
+		AssertCASAssigned := func() {
+			It("usable CAS uniques assigned", func() {
+				DoRead()
+				Expect(err).To(BeNil())
+				Expect(actual.cas).To(BeEquivalentTo(3))
+				var keys []string
+				for key := range actual.table {
+					keys = append(keys, key)
+				}
+				assigned := map[uint64]bool{}
+				for _, key := range keys {
+					views := actual.get([]byte(key))
+					Expect(views).To(HaveLen(1))
+					cas := views[0].CAS
+					views[0].Reader.Close()
+					Expect(cas).NotTo(BeZero())
+					Expect(assigned).NotTo(HaveKey(cas))
+					assigned[cas] = true
+					it := p.randSizeItem()
+					it.Key = key
+					Expect(actual.casSet(it, cas)).To(Equal(CasStored))
+				}
+			})
+		}
+		AssertCASAssigned()
+		Context("segmented", func() {
+			BeforeEach(func() { expected.snapshotParallelism = 2 })
+			AssertCASAssigned()
+		})
+	})
+
 	Context("with one queue", func() {
 		BeforeEach(func() {
 			for i := 0; i < Rand.Intn(10)+3; i++ {
@@ -127,6 +200,50 @@ var _ = Describe("Snapshot", func() {
 		AssertEquvalent()
 	})
 
+	Context("gzip compressed", func() {
+		BeforeEach(func() {
+			for i := 0; expected.size() < expected.limits.total-testNodeSize; i++ {
+				expected.set(p.randSizeItem())
+			}
+		})
+		It("actual equalent expected", func() {
+			compressed := &bytes.Buffer{}
+			gz := gzip.NewWriter(compressed)
+			_, err = snapshot.WriteTo(gz)
+			Expect(err).To(BeNil())
+			Expect(gz.Close()).To(Succeed())
+			gr, err := gzip.NewReader(compressed)
+			Expect(err).To(BeNil())
+			actual, err = readSnapshot(bufio.NewReader(gr), p.Pool, l, actualConf)
+			Expect(err).To(BeNil())
+			ExpectLRUsToBeEquvalent(actual, expected)
+		})
+	})
+
+	Context("read with smaller caps", func() {
+		BeforeEach(func() {
+			for i := 0; expected.size() < expected.limits.total-testNodeSize; i++ {
+				expected.set(p.randSizeItem())
+			}
+			for _, n := range expected.table {
+				n.active = active
+			}
+			for i := 0; i < 5; i++ {
+				expected.set(p.randSizeItem())
+			}
+			Expect(expected.warm().size).NotTo(BeZero())
+			actualConf.HotCap = 0.1
+			actualConf.WarmCap = 0.1
+		})
+		It("queues limited by reader caps without data loss", func() {
+			DoRead()
+			Expect(err).To(BeNil())
+			Expect(actual.itemsNum()).To(Equal(expected.itemsNum()))
+			Expect(actual.hotOverflow()).To(BeFalse())
+			Expect(actual.warmOverflow()).To(BeFalse())
+		})
+	})
+
 	Context("with expired item", func() {
 		var expiredKey string
 		BeforeEach(func() {
@@ -137,7 +254,7 @@ var _ = Describe("Snapshot", func() {
 			it := p.sizeItem(Rand.Intn(8 << 10))
 			expected.set(it)
 			expiredKey = it.Key
-			expected.table[expiredKey].Exptime = nowUnix() - 3
+			expected.table[expiredKey].Exptime = NowUnix() - 3
 
 			for i := 0; i < Rand.Intn(5); i++ {
 				expected.set(p.randSizeItem())
@@ -169,6 +286,111 @@ var _ = Describe("Snapshot", func() {
 
 	})
 
+	Context("segmented", func() {
+		var segmentSize int
+		BeforeEach(func() {
+			segmentSize = snapshotSegmentSize
+			snapshotSegmentSize = 1 << 10
+			expected.snapshotParallelism = 3
+			for i := 0; expected.size() < expected.limits.total-testNodeSize; i++ {
+				it := p.randSizeItem()
+				expected.set(it)
+				if Rand.Intn(2) == 0 {
+					expected.touch([]byte(it.Key))
+				}
+			}
+		})
+		AfterEach(func() { snapshotSegmentSize = segmentSize })
+		AssertEquvalent()
+
+		Context("parallel read", func() {
+			BeforeEach(func() { actualConf.SnapshotParallelism = 3 })
+			AssertEquvalent()
+			It("extra data not corrupted", func() {
+				data := []byte("extra data")
+				snapshot.Write(data)
+				DoRead()
+				Expect(err).To(BeNil())
+				ExpectBytesEqual(snapshot.Bytes(), data)
+			})
+			It("read data recycled on truncated snapshot", func() {
+				snapshot.Truncate(snapshot.Len() - 1)
+				pool := recycle.NewNoPool()
+				actual, err = readSnapshot(snapshot, pool, l, actualConf)
+				Expect(err).NotTo(BeNil())
+				Expect(pool.NotRecycled()).To(BeEmpty())
+			})
+		})
+
+		Context("version 1", func() {
+			// Version 1 segment is prefixed only by length, and can span queues.
+			JustBeforeEach(func() {
+				snapshot.Reset()
+				s := expected.snapshot()
+				info := s.info()
+				info.Segmented = true
+				err := gob.NewEncoder(snapshot).Encode(info)
+				Expect(err).To(BeNil())
+				var nodes []nodeSnapshot
+				for _, q := range s.queues {
+					nodes = append(nodes, q.nodes...)
+				}
+				segment := &bytes.Buffer{}
+				err = encodeSegment(segment, nodes)
+				Expect(err).To(BeNil())
+				binary.Write(snapshot, binary.BigEndian, uint64(segment.Len()))
+				segment.WriteTo(snapshot)
+			})
+			AssertEquvalent()
+		})
+
+		Context("with empty items", func() {
+			BeforeEach(func() {
+				for i := 0; i < 3; i++ {
+					expected.set(p.sizeItem(0))
+				}
+			})
+			AssertEquvalent()
+		})
+	})
+
+	Context("unsupported version", func() {
+		JustBeforeEach(func() {
+			snapshot.Reset()
+			info := snapshotInfo{Version: snapshotVersion + 1}
+			err := gob.NewEncoder(snapshot).Encode(info)
+			Expect(err).To(BeNil())
+		})
+		It("error", func() {
+			DoRead()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("snapshot version %v is not supported", snapshotVersion+1))
+		})
+	})
+
+	Context("truncated", func() {
+		BeforeEach(func() {
+			actualConf.AsyncEviction = true
+			for i := 0; i < 3; i++ {
+				expected.set(p.randSizeItem())
+			}
+		})
+		JustBeforeEach(func() {
+			snapshot.Truncate(snapshot.Len() - 1)
+		})
+		It("error and no cache", func() {
+			DoRead()
+			Expect(err).NotTo(BeNil())
+			Expect(actual).To(BeNil())
+		})
+		It("read data recycled", func() {
+			pool := recycle.NewNoPool()
+			actual, err = readSnapshot(snapshot, pool, l, actualConf)
+			Expect(err).NotTo(BeNil())
+			Expect(pool.NotRecycled()).To(BeEmpty())
+		})
+	})
+
 	Context("overflow after read", func() {
 		BeforeEach(func() {
 			actualConf = Config{
@@ -192,3 +414,194 @@ var _ = Describe("Snapshot", func() {
 	})
 
 })
+
+var _ = Describe("GobPersister", func() {
+	var (
+		l        log.Logger
+		p        testPool
+		expected *lru
+		items    []Item
+		buf      *bytes.Buffer
+	)
+	BeforeEach(func() {
+		resetTestKeys()
+		l = log.NewLogger(log.DebugLevel, GinkgoWriter)
+		p = testPool{recycle.NewPool()}
+		expected = newLRU(l, Config{Size: 64 * (1 << 10)})
+		items = nil
+		for i := 0; i < Rand.Intn(10)+3; i++ {
+			it := p.randSizeItem()
+			items = append(items, it)
+			expected.set(it)
+		}
+		buf = &bytes.Buffer{}
+		err := expected.snapshot().Persist(&GobPersister{W: buf})
+		Expect(err).To(BeNil())
+	})
+
+	It("all items restored", func() {
+		actual, err := readPersisted(&GobPersister{R: buf}, p.Pool, l, Config{Size: 64 * (1 << 10)})
+		Expect(err).To(BeNil())
+		actual.ExpectInvariantsOk()
+		Expect(actual.itemsNum()).To(Equal(len(items)))
+		for _, it := range items {
+			views := actual.get([]byte(it.Key))
+			Expect(views).To(HaveLen(1))
+			ExpectViewOfItem(views[0], it)
+		}
+	})
+
+	It("CAS uniques restored", func() {
+		actual, err := readPersisted(&GobPersister{R: buf}, p.Pool, l, Config{Size: 64 * (1 << 10)})
+		Expect(err).To(BeNil())
+		Expect(actual.cas).To(Equal(expected.cas))
+		for _, it := range items {
+			views := actual.get([]byte(it.Key))
+			Expect(views[0].CAS).To(Equal(expected.table[it.Key].CAS))
+			views[0].Reader.Close()
+		}
+	})
+
+	It("read data recycled on error", func() {
+		buf.Truncate(buf.Len() - 1)
+		pool := recycle.NewNoPool()
+		actual, err := readPersisted(&GobPersister{R: buf}, pool, l, Config{Size: 64 * (1 << 10)})
+		Expect(err).NotTo(BeNil())
+		Expect(actual).To(BeNil())
+		Expect(pool.NotRecycled()).To(BeEmpty())
+	})
+
+	It("unread data skipped", func() {
+		var keys []string
+		err := (&GobPersister{R: buf}).ReadAll(func(meta ItemMeta, r io.Reader) error {
+			keys = append(keys, meta.Key)
+			return nil
+		})
+		Expect(err).To(BeNil())
+		Expect(keys).To(HaveLen(len(items)))
+	})
+
+	It("LRU state restored", func() {
+		actual, err := ReadLockingLRUPersisted(&GobPersister{R: buf}, p.Pool, l, Config{Size: 64 * (1 << 10)})
+		Expect(err).To(BeNil())
+		ExpectLRUsToBeEquvalent(actual.lru, expected)
+	})
+
+	Context("items written one by one", func() {
+		BeforeEach(func() {
+			buf.Reset()
+			persister := &GobPersister{W: buf}
+			for _, it := range items {
+				r := it.Data.NewReader()
+				err := persister.WriteItem(expected.table[it.Key].ItemMeta, r)
+				r.Close()
+				Expect(err).To(BeNil())
+			}
+		})
+
+		It("all items restored", func() {
+			actual, err := ReadLockingLRUPersisted(&GobPersister{R: buf}, p.Pool, l, Config{Size: 64 * (1 << 10)})
+			Expect(err).To(BeNil())
+			actual.ExpectInvariantsOk()
+			Expect(actual.itemsNum()).To(Equal(len(items)))
+			Expect(actual.cas).To(Equal(expected.cas))
+			for _, it := range items {
+				views := actual.get([]byte(it.Key))
+				Expect(views).To(HaveLen(1))
+				Expect(views[0].CAS).To(Equal(expected.table[it.Key].CAS))
+				ExpectViewOfItem(views[0], it)
+			}
+		})
+	})
+})
+
+var _ = Describe("Snapshot and concurrent set of the same key", func() {
+	var (
+		l   log.Logger
+		p   testPool
+		c   *LRU
+		old Item
+	)
+	const size = 64 * (1 << 10)
+	BeforeEach(func() {
+		resetTestKeys()
+		l = log.NewLogger(log.WarnLevel, GinkgoWriter)
+		p = testPool{recycle.NewNoPool()}
+		c = NewLRU(l, Config{Size: size})
+		old = p.sizeItem(4 << 10)
+		c.Set(old)
+	})
+	OldData := func() []byte {
+		r := old.Data.NewReader()
+		defer r.Close()
+		data, _ := ioutil.ReadAll(r)
+		return data
+	}
+
+	It("snapshot reader keeps old data alive", func() {
+		// Keep copy of old data, because it will be recycled by overwrite.
+		oldData := OldData()
+		c.lock.RLock()
+		s := c.snapshot()
+		c.lock.RUnlock()
+
+		overwrite := p.sizeItem(old.Bytes)
+		overwrite.Key = old.Key
+		c.Set(overwrite)
+		views := c.Get([]byte(old.Key))
+		Expect(views).To(HaveLen(1))
+		ExpectViewOfItem(views[0], overwrite)
+
+		Expect(p.NotRecycled()).To(HaveLen(2), "old data is alive until snapshot write")
+		buf := &bytes.Buffer{}
+		_, err := s.WriteTo(buf)
+		Expect(err).To(BeNil())
+		Expect(p.NotRecycled()).To(ConsistOf(overwrite.Data), "old data is recycled after snapshot write")
+
+		restored, err := readSnapshot(buf, p.Pool, l, Config{Size: size})
+		Expect(err).To(BeNil())
+		restoredViews := restored.get([]byte(old.Key))
+		Expect(restoredViews).To(HaveLen(1))
+		restoredData, _ := ioutil.ReadAll(restoredViews[0].Reader)
+		restoredViews[0].Reader.Close()
+		ExpectBytesEqual(restoredData, oldData)
+
+		restored.delete([]byte(old.Key))
+		c.Delete([]byte(old.Key))
+		Expect(p.NotRecycled()).To(BeEmpty())
+	})
+
+	It("concurrent overwrites", func() {
+		c.lock.RLock()
+		s := c.snapshot()
+		c.lock.RUnlock()
+		oldData := OldData()
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				overwrite := p.sizeItem(Rand.Intn(8 << 10))
+				overwrite.Key = old.Key
+				c.Set(overwrite)
+			}
+		}()
+		buf := &bytes.Buffer{}
+		_, err := s.WriteTo(buf)
+		Expect(err).To(BeNil())
+		<-done
+
+		restored, err := readSnapshot(buf, p.Pool, l, Config{Size: size})
+		Expect(err).To(BeNil())
+		restoredViews := restored.get([]byte(old.Key))
+		Expect(restoredViews).To(HaveLen(1))
+		restoredData, _ := ioutil.ReadAll(restoredViews[0].Reader)
+		restoredViews[0].Reader.Close()
+		ExpectBytesEqual(restoredData, oldData)
+
+		restored.delete([]byte(old.Key))
+		c.Delete([]byte(old.Key))
+		Expect(p.NotRecycled()).To(BeEmpty())
+	})
+})
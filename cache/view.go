@@ -7,9 +7,27 @@ type View interface {
 	// Provided rawCommand CAN be invalidated after call.
 	// Implementations should copy it if needed.
 	NewSetter(rawCommand []byte) Setter
+	// NewAdder returns adder.
+	// Provided rawCommand CAN be invalidated after call.
+	// Implementations should copy it if needed.
+	NewAdder(rawCommand []byte) Adder
+	// NewReplacer returns replacer.
+	// Provided rawCommand CAN be invalidated after call.
+	// Implementations should copy it if needed.
+	NewReplacer(rawCommand []byte) Replacer
+	// NewCaser returns caser.
+	// Provided rawCommand CAN be invalidated after call.
+	// Implementations should copy it if needed.
+	NewCaser(rawCommand []byte) Caser
+	// NewIncrementer returns incrementer.
+	// Provided rawCommand MUST NOT be invalidated Incrementer.Incr or Incrementer.Decr call.
+	NewIncrementer(rawCommand []byte) Incrementer
 	// NewGetter returns getter.
 	// Provided rawCommand MUST NOT be invalidated Getter.Get call.
 	NewGetter(rawCommand []byte) Getter
+	// NewGetAndToucher returns get and toucher.
+	// Provided rawCommand MUST NOT be invalidated GetAndToucher.GetAndTouch call.
+	NewGetAndToucher(rawCommand []byte) GetAndToucher
 	// NewDeleter returns deleter.
 	// Provided rawCommand MUST NOT be invalidated Deleter.Delete call.
 	NewDeleter(rawCommand []byte) Deleter
@@ -23,15 +41,37 @@ type Viewable interface {
 type Getter interface {
 	Get(key ...[]byte) (views []ItemView)
 }
+type GetAndToucher interface {
+	GetAndTouch(exptime int64, key ...[]byte) (views []ItemView)
+}
 type Setter interface {
 	Set(i Item)
 }
+type Adder interface {
+	Add(i Item) (stored bool)
+}
+type Replacer interface {
+	Replace(i Item) (stored bool)
+}
+type Caser interface {
+	Cas(i Item, casID uint64) CasResult
+}
+type Incrementer interface {
+	Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool)
+	Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool)
+}
 type Deleter interface {
 	Delete(key []byte) (deleted bool)
 }
 
-func (c *LRU) NewGetter(rawCommand []byte) Getter   { return c }
-func (c *LRU) NewSetter(rawCommand []byte) Setter   { return c }
-func (c *LRU) NewDeleter(rawCommand []byte) Deleter { return c }
+func (c *LRU) NewGetter(rawCommand []byte) Getter     { return c }
+func (c *LRU) NewSetter(rawCommand []byte) Setter     { return c }
+func (c *LRU) NewAdder(rawCommand []byte) Adder       { return c }
+func (c *LRU) NewReplacer(rawCommand []byte) Replacer { return c }
+func (c *LRU) NewCaser(rawCommand []byte) Caser       { return c }
+func (c *LRU) NewDeleter(rawCommand []byte) Deleter   { return c }
+
+func (c *LRU) NewIncrementer(rawCommand []byte) Incrementer     { return c }
+func (c *LRU) NewGetAndToucher(rawCommand []byte) GetAndToucher { return c }
 
 var _ View = (*LRU)(nil)
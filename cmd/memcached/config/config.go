@@ -15,6 +15,8 @@ import (
 	"github.com/facebookgo/stackerr"
 
 	"github.com/Skipor/memcached"
+	"github.com/Skipor/memcached/aof"
+	"github.com/Skipor/memcached/cache"
 	"github.com/Skipor/memcached/internal/util"
 	"github.com/Skipor/memcached/log"
 )
@@ -22,7 +24,15 @@ import (
 const RotateSizeCoef = 3 //TODO make configurable
 
 func Parse(conf Config) (mconf memcached.Config, err error) {
-	mconf.LogDestination, err = logDestination(conf.LogDestination)
+	var maxLogSize int64
+	if conf.MaxLogSize != "" {
+		maxLogSize, err = parseSize(conf.MaxLogSize)
+		if err != nil {
+			err = stackerr.Newf("Max log size parse error: %v", err)
+			return
+		}
+	}
+	mconf.LogDestination, mconf.LogSink, err = logDestination(conf.LogDestination, maxLogSize, conf.MaxLogBackups)
 	if err != nil {
 		err = stackerr.Newf("Log destination open error: %v", err)
 		return
@@ -32,6 +42,25 @@ func Parse(conf Config) (mconf memcached.Config, err error) {
 		err = stackerr.Newf("Cache size parse error: %v", err)
 		return
 	}
+	mconf.Cache.ExpiredSweep = conf.ExpiredSweep
+	mconf.Cache.PromoteAfterHits = conf.PromoteAfterHits
+	mconf.Cache.SnapshotParallelism = conf.SnapshotParallelism
+	mconf.Cache.CrawlPeriod = conf.CrawlPeriod
+	mconf.Cache.CrawlBatchSize = conf.CrawlBatchSize
+	mconf.Cache.AsyncEviction = conf.AsyncEviction
+	mconf.Cache.HotCap = conf.HotCap
+	mconf.Cache.WarmCap = conf.WarmCap
+	if err = mconf.Cache.CheckCaps(); err != nil {
+		err = stackerr.Newf("Caps check error: %v", err)
+		return
+	}
+	if conf.MaxAsyncOverflow != "" {
+		mconf.Cache.MaxAsyncOverflow, err = parseSize(conf.MaxAsyncOverflow)
+		if err != nil {
+			err = stackerr.Newf("Max async overflow parse error: %v", err)
+			return
+		}
+	}
 	mconf.MaxItemSize, err = parseSize(conf.MaxItemSize)
 	if err != nil {
 		err = stackerr.Newf("Max item size parse error: %v", err)
@@ -41,14 +70,95 @@ func Parse(conf Config) (mconf memcached.Config, err error) {
 		err = stackerr.Newf("Too large max item size.")
 		return
 	}
+	if err = mconf.CheckMaxItemSize(); err != nil {
+		err = stackerr.Newf("Max item size check error: %v", util.Unwrap(err))
+		return
+	}
+	if conf.MemoryBudget != "" {
+		mconf.MemoryBudget, err = parseSize(conf.MemoryBudget)
+		if err != nil {
+			err = stackerr.Newf("Memory budget parse error: %v", err)
+			return
+		}
+	}
+	if conf.MinChunkSize != "" {
+		var size int64
+		size, err = parseSize(conf.MinChunkSize)
+		if err != nil {
+			err = stackerr.Newf("Min chunk size parse error: %v", err)
+			return
+		}
+		mconf.MinChunkSize = int(size)
+	}
+	if conf.MaxChunkSize != "" {
+		var size int64
+		size, err = parseSize(conf.MaxChunkSize)
+		if err != nil {
+			err = stackerr.Newf("Max chunk size parse error: %v", err)
+			return
+		}
+		mconf.MaxChunkSize = int(size)
+	}
+	if conf.MaxResponseBacklog != "" {
+		var backlog int64
+		backlog, err = parseSize(conf.MaxResponseBacklog)
+		if err != nil {
+			err = stackerr.Newf("Max response backlog parse error: %v", err)
+			return
+		}
+		mconf.MaxResponseBacklog = int(backlog)
+	}
 	mconf.LogLevel, err = log.LevelFromString(conf.LogLevel)
 	if err != nil {
 		err = stackerr.Newf("Log level parse error: %v", err)
 		return
 	}
+	mconf.LogFormat, err = log.FormatFromString(conf.LogFormat)
+	if err != nil {
+		err = stackerr.Newf("Log format parse error: %v", err)
+		return
+	}
+	mconf.MaxRetainedChunks = conf.MaxRetainedChunks
+	mconf.WriteTimeout = conf.WriteTimeout
+	mconf.FlushPerCommand = conf.FlushPerCommand
+	mconf.MaxKeysPerGet = conf.MaxKeysPerGet
+	mconf.MaxConnections = conf.MaxConnections
+	mconf.RejectOverConnLimit = conf.RejectOverConnLimit
+	mconf.DataChecksum = conf.DataChecksum
+	mconf.Banner = conf.Banner
+	mconf.LogErrorCommand = conf.LogErrorCommand
+	mconf.ReplyErrorCommand = conf.ReplyErrorCommand
+	mconf.VerboseUnknownCommand = conf.VerboseUnknownCommand
+	mconf.EnableMaxItemSizeCommand = conf.EnableMaxItemSizeCommand
+	mconf.RecordOps = conf.RecordOps
+	mconf.DebugAddr = conf.DebugAddr
+	mconf.ShutdownTimeout = conf.ShutdownTimeout
+	for _, command := range strings.Split(conf.DisabledCommands, ",") {
+		command = strings.ToLower(strings.TrimSpace(command))
+		if command == "" {
+			continue
+		}
+		if !memcached.IsCommand(command) {
+			err = stackerr.Newf("Disabled commands parse error: unknown command %q", command)
+			return
+		}
+		mconf.DisabledCommands = append(mconf.DisabledCommands, command)
+	}
+	if conf.RejectKeyPrefixes != "" {
+		mconf.RejectKeyPrefixes = strings.Split(conf.RejectKeyPrefixes, ",")
+	}
 	mconf.FixCorruptedAOF = conf.AOF.FixCorrupted
+	mconf.ServeWhileWarming = conf.AOF.ServeWhileWarming
+	mconf.BackgroundReplay = conf.AOF.BackgroundReplay
 	mconf.AOF.Sync = conf.AOF.Sync
+	mconf.AOF.Fsync, err = aof.FsyncPolicyFromString(conf.AOF.Fsync)
+	if err != nil {
+		err = stackerr.Newf("Fsync policy parse error: %v", err)
+		return
+	}
 	mconf.AOF.Name = conf.AOF.Name
+	mconf.AOF.Checksummed = conf.AOF.Checksummed
+	mconf.CompressSnapshot = conf.AOF.CompressSnapshot
 	var bufSize int64
 	bufSize, err = parseSize(conf.AOF.BufSize)
 	mconf.AOF.BufSize = int(bufSize)
@@ -56,8 +166,18 @@ func Parse(conf Config) (mconf memcached.Config, err error) {
 		err = stackerr.Newf("BufSize parse error: %v", err)
 		return
 	}
-	mconf.AOF.RotateSize = mconf.Cache.Size * RotateSizeCoef
-	mconf.Addr = net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+	if !conf.AOF.DisableRotation {
+		mconf.AOF.RotateSize = mconf.Cache.Size * RotateSizeCoef
+	}
+	if conf.Socket == "" {
+		mconf.Addr = net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+		return
+	}
+	if conf.Host != "" {
+		err = stackerr.Newf("Host and socket are mutually exclusive.")
+		return
+	}
+	mconf.Socket = conf.Socket
 	return
 }
 
@@ -67,8 +187,14 @@ func Default() *Config {
 		Host:           "",
 		LogDestination: "stderr",
 		LogLevel:       "info",
+		LogFormat:      "text",
+		MaxLogBackups:  3,
 		CacheSize:      "64m",
+		HotCap:         cache.DefaultCap,
+		WarmCap:        cache.DefaultCap,
 		MaxItemSize:    "1m",
+
+		ShutdownTimeout: 10 * time.Second,
 		AOF: AOFConfig{
 			BufSize: "4k",
 		},
@@ -78,38 +204,91 @@ func Default() *Config {
 type Config struct {
 	Port           int    `json:"port,omitempty"`
 	Host           string `json:"host,omitempty"`
-	LogDestination string `json:"log-destination,omitempty"` // Stdout, stderr, or filepath.
+	Socket         string `json:"socket,omitempty"`          // UNIX socket path, listened instead of host and port.
+	LogDestination string `json:"log-destination,omitempty"` // Stdout, stderr, syslog or filepath.
 	LogLevel       string `json:"log-level,omitempty"`
+	LogFormat      string `json:"log-format,omitempty"`   // Text or json.
+	MaxLogSize     string `json:"max-log-size,omitempty"` // Log file is rotated, when its size exceeds it. Empty disables rotation.
+	MaxLogBackups  int    `json:"max-log-backups,omitempty"`
 	// Size values 10g, 128m, 1024k, 1000000b
-	CacheSize   string    `json:"cache-size,omitempty"`
-	MaxItemSize string    `json:"max-item-size,omitempty"`
-	AOF         AOFConfig `json:"aof,omitempty"`
+	CacheSize           string        `json:"cache-size,omitempty"`
+	ExpiredSweep        int           `json:"expired-sweep,omitempty"`
+	PromoteAfterHits    int           `json:"promote-after-hits,omitempty"`
+	SnapshotParallelism int           `json:"snapshot-parallelism,omitempty"` // Goroutines encoding snapshot on AOF rotation and decoding it on start.
+	CrawlPeriod         time.Duration `json:"crawl-period,omitempty"`         // 0 disables expired items crawler.
+	CrawlBatchSize      int           `json:"crawl-batch-size,omitempty"`
+	AsyncEviction       bool          `json:"async-eviction,omitempty"`
+	MaxAsyncOverflow    string        `json:"max-async-overflow,omitempty"` // Empty for default.
+	HotCap              float64       `json:"hot-cap,omitempty"`            // Part of cache size for HOT queue.
+	WarmCap             float64       `json:"warm-cap,omitempty"`           // Part of cache size for WARM queue.
+	MaxItemSize         string        `json:"max-item-size,omitempty"`
+	MemoryBudget        string        `json:"memory-budget,omitempty"`       // Empty if unlimited.
+	MinChunkSize        string        `json:"min-chunk,omitempty"`           // Empty for default.
+	MaxChunkSize        string        `json:"max-chunk,omitempty"`           // Empty for default.
+	MaxRetainedChunks   int           `json:"max-retained-chunks,omitempty"` // 0 if unlimited.
+	WriteTimeout        time.Duration `json:"write-timeout,omitempty"`
+	FlushPerCommand     bool          `json:"flush-per-command,omitempty"`
+	MaxResponseBacklog  string        `json:"max-response-backlog,omitempty"` // Empty if unlimited.
+	MaxKeysPerGet       int           `json:"max-keys-per-get,omitempty"`     // 0 for default.
+	MaxConnections      int           `json:"max-connections,omitempty"`      // 0 if unlimited.
+	RejectOverConnLimit bool          `json:"reject-over-conn-limit,omitempty"`
+	DataChecksum        bool          `json:"data-checksum,omitempty"`
+	Banner              string        `json:"banner,omitempty"` // Sent before first version response.
+	// Comma separated commands, that will be replied with client error.
+	DisabledCommands string `json:"disabled-commands,omitempty"`
+	// Comma separated reserved key prefixes, that can't be set.
+	RejectKeyPrefixes string `json:"reject-key-prefixes,omitempty"`
+	// Enables max_item_size command, that overrides max item size for connection. Only for trusted clients.
+	EnableMaxItemSizeCommand bool `json:"enable-max-item-size-command,omitempty"`
+	// Debug options, that can leak keys into log and responses.
+	LogErrorCommand       bool `json:"log-error-command,omitempty"`
+	ReplyErrorCommand     bool `json:"reply-error-command,omitempty"`
+	VerboseUnknownCommand bool `json:"verbose-unknown-command,omitempty"`
+	RecordOps             int  `json:"record-ops,omitempty"` // Number of last cache operations kept for dump_ops.
+	// Address of HTTP server with pprof and stats JSON endpoints. Empty if disabled.
+	DebugAddr string `json:"debug-addr,omitempty"`
+	// Time given to commands in progress on stop. 0 if unlimited.
+	ShutdownTimeout time.Duration `json:"shutdown-timeout,omitempty"`
+
+	AOF AOFConfig `json:"aof,omitempty"`
 }
 
 type AOFConfig struct {
 	Name         string        `json:"name,omitempty"`
 	Sync         time.Duration `json:"sync,omitempty"`
+	Fsync        string        `json:"fsync,omitempty"` // Always, everysec or no. Derived from sync period if empty.
 	BufSize      string        `json:"buf-size,omitempty"`
 	FixCorrupted bool          `json:"fix-corrupted,omitempty"`
+	// DisableRotation makes AOF grow forever. Useful, if AOF is compacted by external process.
+	DisableRotation bool `json:"disable-rotation,omitempty"`
+	// ServeWhileWarming makes server accept connections while AOF is replayed.
+	ServeWhileWarming bool `json:"serve-while-warming,omitempty"`
+	// BackgroundReplay makes server serve partially replayed cache while AOF command log is replayed.
+	BackgroundReplay bool `json:"background-replay,omitempty"`
+	// Checksummed makes new AOF transactions checksummed, to detect corruption on replay.
+	Checksummed bool `json:"checksummed,omitempty"`
+	// CompressSnapshot makes snapshot written on rotation gzip compressed.
+	CompressSnapshot bool `json:"compress-snapshot,omitempty"`
 }
 
+// Merge sets def fields to not zero override fields.
+// Nested structs are merged recursively, so override can set only some of their fields.
 func Merge(def, override *Config) {
-	defAof := def.AOF
-	merge(def, override)
-
-	// HACK: manual recursion. Some third party high level reflection package should be used here.
-	merge(&defAof, &override.AOF)
-	def.AOF = defAof
+	merge(reflect.ValueOf(def).Elem(), reflect.ValueOf(override).Elem())
 }
-func merge(def, override interface{}) {
-	defVal := reflect.ValueOf(def).Elem()
-	overrideVal := reflect.ValueOf(override).Elem()
-	for i, end := 0, defVal.NumField(); i < end; i++ {
-
-		overrideVal := overrideVal.Field(i)
-		fmt.Sprintf("%v", overrideVal)
-		if !util.IsZeroVal(overrideVal) {
-			defVal.Field(i).Set(overrideVal)
+
+func merge(def, override reflect.Value) {
+	for i, end := 0, def.NumField(); i < end; i++ {
+		defField, overrideField := def.Field(i), override.Field(i)
+		if !defField.CanSet() {
+			continue // Unexported.
+		}
+		if defField.Kind() == reflect.Struct {
+			merge(defField, overrideField)
+			continue
+		}
+		if !util.IsZeroVal(overrideField) {
+			defField.Set(overrideField)
 		}
 	}
 }
@@ -153,14 +332,29 @@ func parseSize(s string) (size int64, err error) {
 	return
 }
 
-func logDestination(dest string) (w io.Writer, err error) {
+// SyslogTag is tag of syslog messages.
+const SyslogTag = "memcached"
+
+// logDestination returns writer for stdout, stderr or file path, or sink for syslog destination.
+// File is rotated when its size exceeds maxSize, if it is not zero.
+func logDestination(dest string, maxSize int64, maxBackups int) (w io.Writer, s log.Sink, err error) {
 	switch strings.ToLower(dest) {
 	case "stderr":
 		w = os.Stderr
 	case "stdout":
 		w = os.Stdout
+	case "syslog":
+		var ss *log.SyslogSink
+		ss, err = log.NewSyslogSink(SyslogTag)
+		if err == nil {
+			s = ss
+		}
 	default:
-		w, err = os.OpenFile(dest, os.O_APPEND|os.O_CREATE, 0)
+		if maxSize != 0 {
+			w, err = log.OpenRotatingFile(dest, maxSize, maxBackups)
+			break
+		}
+		w, err = os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	}
 	return
 }
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Merge", func() {
+	type mergeCase struct {
+		name     string
+		def      Config
+		override Config
+		expected Config
+	}
+	cases := []mergeCase{
+		{
+			name:     "empty override",
+			def:      Config{Port: 11211, LogLevel: "info", AOF: AOFConfig{Name: "aof", BufSize: "4k"}},
+			override: Config{},
+			expected: Config{Port: 11211, LogLevel: "info", AOF: AOFConfig{Name: "aof", BufSize: "4k"}},
+		},
+		{
+			name:     "top level override",
+			def:      Config{Port: 11211, LogLevel: "info", ShutdownTimeout: time.Second},
+			override: Config{LogLevel: "debug", ShutdownTimeout: time.Minute},
+			expected: Config{Port: 11211, LogLevel: "debug", ShutdownTimeout: time.Minute},
+		},
+		{
+			name:     "nested override",
+			def:      Config{AOF: AOFConfig{Name: "aof", BufSize: "4k", Fsync: "everysec"}},
+			override: Config{AOF: AOFConfig{Name: "other", BufSize: "8k", Fsync: "always"}},
+			expected: Config{AOF: AOFConfig{Name: "other", BufSize: "8k", Fsync: "always"}},
+		},
+		{
+			name:     "nested partial override",
+			def:      Config{Port: 11211, AOF: AOFConfig{Name: "aof", BufSize: "4k"}},
+			override: Config{AOF: AOFConfig{Checksummed: true}},
+			expected: Config{Port: 11211, AOF: AOFConfig{Name: "aof", BufSize: "4k", Checksummed: true}},
+		},
+		{
+			name:     "zero values don't override",
+			def:      Config{Port: 11211, AsyncEviction: true, AOF: AOFConfig{Checksummed: true}},
+			override: Config{Port: 0, AsyncEviction: false, AOF: AOFConfig{Checksummed: false}},
+			expected: Config{Port: 11211, AsyncEviction: true, AOF: AOFConfig{Checksummed: true}},
+		},
+	}
+	for _, c := range cases {
+		c := c
+		It(c.name, func() {
+			Merge(&c.def, &c.override)
+			Expect(c.def).To(Equal(c.expected))
+		})
+	}
+
+	It("default merged with itself not changed", func() {
+		def := Default()
+		Merge(def, Default())
+		Expect(def).To(Equal(Default()))
+	})
+})
+
+var _ = Describe("Parse", func() {
+	It("max item size larger than HOT queue rejected", func() {
+		conf := *Default()
+		conf.CacheSize = "1m"
+		conf.MaxItemSize = "1m"
+		_, err := Parse(conf)
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("doesn't fit in HOT queue"))
+	})
+
+	It("max item size fitting in HOT queue accepted", func() {
+		conf := *Default()
+		conf.CacheSize = "16m"
+		conf.HotCap = 0.5
+		conf.MaxItemSize = "4m"
+		mconf, err := Parse(conf)
+		Expect(err).To(BeNil())
+		Expect(mconf.MaxItemSize).To(BeEquivalentTo(4 << 20))
+	})
+
+	It("disabled commands normalized", func() {
+		conf := *Default()
+		conf.DisabledCommands = " Delete, MDELETE ,"
+		mconf, err := Parse(conf)
+		Expect(err).To(BeNil())
+		Expect(mconf.DisabledCommands).To(Equal([]string{"delete", "mdelete"}))
+	})
+
+	It("unknown disabled command rejected", func() {
+		conf := *Default()
+		conf.DisabledCommands = "delete,flush_all"
+		_, err := Parse(conf)
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring(`unknown command "flush_all"`))
+	})
+})
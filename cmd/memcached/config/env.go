@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// EnvPrefix is prefix of environment variables, that configure memcached.
+const EnvPrefix = "MEMCACHED_"
+
+// FromEnv returns config with fields set from environment variables.
+// Variable name is EnvPrefix followed by upper case json tag of field, where '-' replaced by '_'.
+// Nested struct fields are prefixed by struct name: for example, MEMCACHED_CACHE_SIZE, MEMCACHED_AOF_NAME.
+// Values are parsed like in YAML config. Unset and empty variables leave fields zero, so they don't override on Merge.
+func FromEnv() (conf Config, err error) {
+	err = fromEnv(reflect.ValueOf(&conf).Elem(), EnvPrefix)
+	return
+}
+
+func fromEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		name = prefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			err := fromEnv(field, name+"_")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		err := setValue(field, value)
+		if err != nil {
+			return stackerr.Newf("environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
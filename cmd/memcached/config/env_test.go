@@ -0,0 +1,88 @@
+package config
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FromEnv", func() {
+	var env map[string]string
+	BeforeEach(func() { env = nil })
+	JustBeforeEach(func() {
+		for k, v := range env {
+			os.Setenv(k, v)
+		}
+	})
+	AfterEach(func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	})
+
+	Context("set", func() {
+		BeforeEach(func() {
+			env = map[string]string{
+				"MEMCACHED_PORT":              "11212",
+				"MEMCACHED_CACHE_SIZE":        "128m",
+				"MEMCACHED_ASYNC_EVICTION":    "true",
+				"MEMCACHED_SHUTDOWN_TIMEOUT":  "3s",
+				"MEMCACHED_AOF_NAME":          "memcached.aof",
+				"MEMCACHED_AOF_FIX_CORRUPTED": "1",
+				"MEMCACHED_LOG_LEVEL":         "",
+			}
+		})
+		It("parsed", func() {
+			conf, err := FromEnv()
+			Expect(err).To(BeNil())
+			Expect(conf).To(Equal(Config{
+				Port:            11212,
+				CacheSize:       "128m",
+				AsyncEviction:   true,
+				ShutdownTimeout: 3 * time.Second,
+				AOF: AOFConfig{
+					Name:         "memcached.aof",
+					FixCorrupted: true,
+				},
+			}))
+		})
+		It("merged over file config, and under flags", func() {
+			fileConf := Default()
+			fileConf.Port = 1
+			fileConf.LogLevel = "warn"
+			fileConf.AOF.BufSize = "8k"
+			envConf, err := FromEnv()
+			Expect(err).To(BeNil())
+			Merge(fileConf, &envConf)
+			flagConf := Config{CacheSize: "1g"}
+			Merge(fileConf, &flagConf)
+
+			Expect(fileConf.Port).To(Equal(11212))
+			Expect(fileConf.LogLevel).To(Equal("warn"), "empty variable doesn't override")
+			Expect(fileConf.CacheSize).To(Equal("1g"))
+			Expect(fileConf.MaxItemSize).To(Equal(Default().MaxItemSize))
+			Expect(fileConf.AOF).To(Equal(AOFConfig{Name: "memcached.aof", FixCorrupted: true, BufSize: "8k"}))
+		})
+	})
+
+	Context("unset", func() {
+		It("zero config", func() {
+			conf, err := FromEnv()
+			Expect(err).To(BeNil())
+			Expect(conf).To(Equal(Config{}))
+		})
+	})
+
+	Context("invalid", func() {
+		BeforeEach(func() {
+			env = map[string]string{"MEMCACHED_AOF_SYNC": "often"}
+		})
+		It("error names variable", func() {
+			_, err := FromEnv()
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("environment variable MEMCACHED_AOF_SYNC"))
+		})
+	})
+})
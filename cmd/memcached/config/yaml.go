@@ -0,0 +1,221 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/stackerr"
+)
+
+// Unmarshal decodes config file data, that format is chosen by file extension ext.
+// ".yaml" and ".yml" files are decoded as YAML, other as JSON.
+// Keys of both formats are Config json tags.
+func Unmarshal(ext string, data []byte, conf *Config) error {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		entries, err := parseYAML(data)
+		if err != nil {
+			return err
+		}
+		return decodeYAML(entries, reflect.ValueOf(conf).Elem(), "")
+	}
+	err := json.Unmarshal(data, conf)
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return stackerr.Newf("key %q: can't decode %s into %s", typeErr.Field, typeErr.Value, typeErr.Type)
+	}
+	return stackerr.Wrap(err)
+}
+
+// yamlEntry is "key: value" line of YAML mapping, or "key:" line followed by nested mapping.
+// Only YAML subset, that is enough for Config, is supported: nested mappings of scalars and comments.
+type yamlEntry struct {
+	line    int
+	indent  int
+	key     string
+	value   string
+	nested  bool
+	entries []yamlEntry
+}
+
+func parseYAML(data []byte) ([]yamlEntry, error) {
+	var lines []yamlEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		num := i + 1
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, stackerr.Newf("line %v: tabs can't be used for indentation", num)
+		}
+		if strings.HasPrefix(content, "- ") || content == "-" {
+			return nil, stackerr.Newf("line %v: sequences are not supported", num)
+		}
+		e := yamlEntry{line: num, indent: len(line) - len(content)}
+		sep := strings.Index(content, ": ")
+		if sep == -1 {
+			if !strings.HasSuffix(content, ":") {
+				return nil, stackerr.Newf("line %v: \"key: value\" expected", num)
+			}
+			sep = len(content) - 1
+		}
+		e.key = strings.TrimSpace(content[:sep])
+		value, err := unquoteYAML(strings.TrimSpace(content[sep+1:]))
+		if err != nil {
+			return nil, stackerr.Newf("line %v: key %q: %v", num, e.key, err)
+		}
+		e.value = value
+		lines = append(lines, e)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	entries, rest, err := nestYAML(lines, lines[0].indent)
+	if err == nil && len(rest) != 0 {
+		err = stackerr.Newf("line %v: unexpected indentation", rest[0].line)
+	}
+	return entries, err
+}
+
+// nestYAML groups lines with indent into entries, that contain more indented lines after them.
+// Rest lines have smaller indent.
+func nestYAML(lines []yamlEntry, indent int) (entries, rest []yamlEntry, err error) {
+	for len(lines) > 0 && lines[0].indent >= indent {
+		e := lines[0]
+		lines = lines[1:]
+		if e.indent != indent {
+			err = stackerr.Newf("line %v: unexpected indentation", e.line)
+			return
+		}
+		if e.value == "" && len(lines) > 0 && lines[0].indent > indent {
+			e.nested = true
+			e.entries, lines, err = nestYAML(lines, lines[0].indent)
+			if err != nil {
+				return
+			}
+		}
+		entries = append(entries, e)
+	}
+	rest = lines
+	return
+}
+
+// stripYAMLComment removes comment, that starts with '#' at line start or after space, and not in quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteYAML(s string) (string, error) {
+	if len(s) < 2 {
+		return s, nil
+	}
+	switch {
+	case s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	return s, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decodeYAML sets fields of struct v, that json tag names match entry keys.
+// Durations can be set in nanoseconds like in JSON, or in time.ParseDuration format.
+func decodeYAML(entries []yamlEntry, v reflect.Value, prefix string) error {
+	fields := make(map[string]int, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		key := prefix + e.key
+		if seen[e.key] {
+			return stackerr.Newf("line %v: key %q: duplicated", e.line, key)
+		}
+		seen[e.key] = true
+		i, ok := fields[e.key]
+		if !ok {
+			return stackerr.Newf("line %v: key %q: unknown", e.line, key)
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if !e.nested && e.value != "" {
+				return stackerr.Newf("line %v: key %q: mapping expected", e.line, key)
+			}
+			err := decodeYAML(e.entries, field, key+".")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if e.nested {
+			return stackerr.Newf("line %v: key %q: value expected, but mapping found", e.line, key)
+		}
+		err := setValue(field, e.value)
+		if err != nil {
+			return stackerr.Newf("line %v: key %q: %v", e.line, key, err)
+		}
+	}
+	return nil
+}
+
+// setValue parses s into v according to its kind.
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil && v.Type() == durationType {
+			var d time.Duration
+			d, err = time.ParseDuration(s)
+			n = int64(d)
+		}
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return errors.New("unsupported type " + v.Type().String())
+}
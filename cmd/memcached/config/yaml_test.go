@@ -0,0 +1,113 @@
+package config
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unmarshal", func() {
+	const jsonConf = `{
+  "port": 11211,
+  "host": "localhost",
+  "log-level": "debug",
+  "cache-size": "64m",
+  "hot-cap": 0.3,
+  "async-eviction": true,
+  "banner": "memcached # ready",
+  "shutdown-timeout": 5000000000,
+  "aof": {
+    "name": "memcached.aof",
+    "sync": 1000000000,
+    "fix-corrupted": true
+  }
+}`
+	const yamlConf = `
+# Server.
+port: 11211
+host: "localhost"
+log-level: debug  # Comment after value.
+cache-size: 64m
+hot-cap: 0.3
+async-eviction: true
+banner: 'memcached # ready'
+shutdown-timeout: 5s
+
+aof:
+  name: memcached.aof
+  sync: 1000000000
+  fix-corrupted: true
+`
+	expected := Config{
+		Port:            11211,
+		Host:            "localhost",
+		LogLevel:        "debug",
+		CacheSize:       "64m",
+		HotCap:          0.3,
+		AsyncEviction:   true,
+		Banner:          "memcached # ready",
+		ShutdownTimeout: 5 * time.Second,
+		AOF: AOFConfig{
+			Name:         "memcached.aof",
+			Sync:         time.Second,
+			FixCorrupted: true,
+		},
+	}
+
+	It("json", func() {
+		var conf Config
+		err := Unmarshal(".json", []byte(jsonConf), &conf)
+		Expect(err).To(BeNil())
+		Expect(conf).To(Equal(expected))
+	})
+
+	It("yaml", func() {
+		var conf Config
+		err := Unmarshal(".yaml", []byte(yamlConf), &conf)
+		Expect(err).To(BeNil())
+		Expect(conf).To(Equal(expected))
+	})
+
+	It("yml", func() {
+		var conf Config
+		err := Unmarshal(".YML", []byte(yamlConf), &conf)
+		Expect(err).To(BeNil())
+		Expect(conf).To(Equal(expected))
+	})
+
+	It("yaml overrides only set values", func() {
+		conf := Config{Port: 1, AOF: AOFConfig{BufSize: "4k"}}
+		err := Unmarshal(".yaml", []byte("aof:\n  name: x\n"), &conf)
+		Expect(err).To(BeNil())
+		Expect(conf).To(Equal(Config{Port: 1, AOF: AOFConfig{Name: "x", BufSize: "4k"}}))
+	})
+
+	type errorCase struct {
+		name   string
+		ext    string
+		data   string
+		substr string
+	}
+	errorCases := []errorCase{
+		{"json invalid type", ".json", `{"aof": {"sync": "1s"}}`, `key "aof.sync"`},
+		{"yaml invalid int", ".yaml", "port: x", `line 1: key "port"`},
+		{"yaml invalid nested", ".yaml", "aof:\n  fix-corrupted: maybe", `line 2: key "aof.fix-corrupted"`},
+		{"yaml unknown key", ".yaml", "aof:\n  wtf: 1", `line 2: key "aof.wtf": unknown`},
+		{"yaml duplicated key", ".yaml", "port: 1\nport: 2", `line 2: key "port": duplicated`},
+		{"yaml mapping expected", ".yaml", "aof: x", `line 1: key "aof": mapping expected`},
+		{"yaml value expected", ".yaml", "port:\n  x: 1", `line 1: key "port": value expected`},
+		{"yaml bad indentation", ".yaml", "aof:\n    name: x\n  sync: 1", `line 3: unexpected indentation`},
+		{"yaml sequence", ".yaml", "port:\n  - 1", `line 2: sequences are not supported`},
+		{"yaml no value", ".yaml", "port 1", `line 1: "key: value" expected`},
+	}
+	for _, c := range errorCases {
+		c := c
+		It(c.name, func() {
+			var conf Config
+			err := Unmarshal(c.ext, []byte(c.data), &conf)
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(c.substr))
+		})
+	}
+})
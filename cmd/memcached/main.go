@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/Skipor/memcached"
 	"github.com/Skipor/memcached/cmd/memcached/config"
@@ -16,35 +18,54 @@ import (
 )
 
 func main() {
-	// TODO pprof monitoring on configurable port
-	conf := loadConfigOrDie()
+	conf, flg := loadConfigOrDie()
+	if flg.MergeAOFs != "" {
+		err := memcached.MergeAOFs(conf, strings.Split(flg.MergeAOFs, ","))
+		if err != nil {
+			log.NewLogger(log.FatalLevel, os.Stderr).Fatal("AOFs merge error: ", err)
+		}
+		return
+	}
 	s, err := memcached.NewServer(conf)
 	if err != nil {
 		log.NewLogger(log.FatalLevel, os.Stderr).Fatal("Can't start server: ", err)
 	}
+	s.ReloadConfig = func() (memcached.Config, error) { return reloadConfig(flg) }
 	if tag.Debug {
 		s.Log.Warn("Using debug build. It has more runtime checks and large perfomance overhead.")
 	}
 	if tag.Race {
 		s.Log.Info("Race detector is on.")
 	}
-	s.Log.Infof("Serve on %s.", s.Addr)
+	if s.Socket != "" {
+		s.Log.Infof("Serve on %s.", s.Socket)
+	} else {
+		s.Log.Infof("Serve on %s.", s.Addr)
+	}
 	err = s.ListenAndServe()
+	if err == memcached.ErrStoped {
+		s.Log.Info("Server stopped.")
+		return
+	}
 	s.Log.Fatal("Serve error: ", err)
 }
 
 const usage = `
 Config values merge rules:
 1) config file value overrides default
-2) command line value overrides any
+2) environment variable value overrides config file
+3) command line value overrides any
+Environment variable name is MEMCACHED_ followed by upper case option name, where '-' replaced by '_'.
+AOF options are prefixed by AOF_: MEMCACHED_CACHE_SIZE, MEMCACHED_AOF_NAME.
 Options:
 `
 
 // config parses command flags, reads config file if any, returns merged config.
 // Config values merge rules:
 // 1) config file value overrides default
-// 2) command line value overrides any
-func loadConfigOrDie() memcached.Config {
+// 2) environment variable value overrides config file
+// 3) command line value overrides any
+func loadConfigOrDie() (memcached.Config, Flags) {
 	l := log.NewLogger(log.DebugLevel, os.Stderr)
 	l.Debug("Memcached server start.\n\n")
 	flg := parseFlags()
@@ -52,31 +73,64 @@ func loadConfigOrDie() memcached.Config {
 	if err := validateFlagConf(flg.Config); err != nil {
 		l.Fatal(err)
 	}
+	mconf, err := loadConfig(flg)
+	if err != nil {
+		l.Fatal(err)
+	}
+	return mconf, flg
+}
+
+// loadConfig reads config file if any, and merges it with environment and flags config.
+func loadConfig(flg Flags) (mconf memcached.Config, err error) {
 	fileConf := config.Default()
 
 	if flg.ConfigPath != "" {
-		data, err := ioutil.ReadFile(flg.ConfigPath)
+		var data []byte
+		data, err = ioutil.ReadFile(flg.ConfigPath)
 		if err != nil {
-			l.Fatal("Config file read error: ", err)
+			err = stackerr.Newf("Config file read error: %v", err)
+			return
 		}
-		err = json.Unmarshal(data, fileConf)
+		err = config.Unmarshal(filepath.Ext(flg.ConfigPath), data, fileConf)
 		if err != nil {
-			l.Fatal("Config parse error: ", err)
+			err = stackerr.Newf("Config parse error: %v", err)
+			return
 		}
 	}
 
+	envConf, err := config.FromEnv()
+	if err != nil {
+		err = stackerr.Newf("Environment config parse error: %v", err)
+		return
+	}
+	config.Merge(fileConf, &envConf)
+
 	//l.Debugf("File config BEFORE merge: %#v\n", fileConf)
 	config.Merge(fileConf, &flg.Config)
 	//l.Debugf("File config AFTER merge: %#v\n", fileConf)
-	mconf, err := config.Parse(*fileConf)
+	return config.Parse(*fileConf)
+}
+
+// reloadConfig loads config for memcached.Server.Reload.
+func reloadConfig(flg Flags) (mconf memcached.Config, err error) {
+	mconf, err = loadConfig(flg)
 	if err != nil {
-		l.Fatal(err)
+		return
+	}
+	// Log destination can't be changed live, so reopened one is not used.
+	if c, ok := mconf.LogDestination.(io.Closer); ok && c != os.Stdout && c != os.Stderr {
+		c.Close()
+	}
+	if c, ok := mconf.LogSink.(io.Closer); ok {
+		c.Close()
 	}
-	return mconf
+	return
 }
 
 type Flags struct {
 	ConfigPath string
+	// MergeAOFs is comma separated AOF names to merge into new AOF, instead of serving.
+	MergeAOFs string
 	config.Config
 }
 
@@ -86,7 +140,8 @@ type Flags struct {
 // NOTE: for simplicity configure only from file.
 func parseFlags() Flags {
 	var f Flags
-	flag.StringVar(&f.ConfigPath, "config", "", "path to json config")
+	flag.StringVar(&f.ConfigPath, "config", "", "path to json or yaml config")
+	flag.StringVar(&f.MergeAOFs, "merge-aofs", "", "comma separated AOFs to merge into new AOF passed by aof-name, then exit")
 
 	def := config.Default()
 	usage := func(usage string, defVal interface{}) string {
@@ -99,14 +154,58 @@ func parseFlags() Flags {
 	}
 	flag.StringVar(&f.Host, "host", "", usage("host address to bind", def.Host))
 	flag.IntVar(&f.Port, "port", 0, usage("port num", def.Port))
-	flag.StringVar(&f.LogDestination, "log-destination", "", usage("log destination: stederr, stdout or file path", def.LogDestination))
+	flag.StringVar(&f.Socket, "socket", "", usage("UNIX socket path to listen instead of host and port", def.Socket))
+	flag.StringVar(&f.LogDestination, "log-destination", "", usage("log destination: stederr, stdout, syslog or file path", def.LogDestination))
 	flag.StringVar(&f.LogLevel, "log-level", "", usage("log level: debug, info, warn, error, fatal", def.LogLevel))
+	flag.StringVar(&f.LogFormat, "log-format", "", usage("log format: text or json", def.LogFormat))
+	flag.StringVar(&f.MaxLogSize, "max-log-size", "", usage("log file size that triggers its rotation: 100m, 1g; empty disables rotation", def.MaxLogSize))
+	flag.IntVar(&f.MaxLogBackups, "max-log-backups", 0, usage("number of rotated log files kept", def.MaxLogBackups))
 	flag.StringVar(&f.CacheSize, "cache-size", "", usage("cache size: 2g, 64m", def.CacheSize))
 	flag.StringVar(&f.MaxItemSize, "max-item-size", "", usage("max item size: 10m, 1024k", def.MaxItemSize))
+	flag.IntVar(&f.ExpiredSweep, "expired-sweep", 0, usage("max items scanned for expired before live items eviction; 0 disables sweep", def.ExpiredSweep))
+	flag.IntVar(&f.PromoteAfterHits, "promote-after-hits", 0, usage("hits after which item is protected from eviction by moving to warm", def.PromoteAfterHits))
+	flag.IntVar(&f.SnapshotParallelism, "snapshot-parallelism", 0, usage("number of goroutines encoding snapshot on AOF rotation and decoding it on start; 0 or 1 for sequential encoding", def.SnapshotParallelism))
+	flag.DurationVar(&f.CrawlPeriod, "crawl-period", 0, usage("period of background removal of expired items; 0 disables crawler", def.CrawlPeriod))
+	flag.IntVar(&f.CrawlBatchSize, "crawl-batch-size", 0, usage("max items scanned by crawler under single cache lock; 0 for default", def.CrawlBatchSize))
+	flag.BoolVar(&f.AsyncEviction, "async-eviction", false, usage("evict items in background goroutine on overflow; lower set latency", def.AsyncEviction))
+	flag.StringVar(&f.MaxAsyncOverflow, "max-async-overflow", "", usage("cache overflow, after which eviction is synchronous even with async-eviction: 4m; 1/16 of cache size if empty", def.MaxAsyncOverflow))
+	flag.Float64Var(&f.HotCap, "hot-cap", 0, usage("part of cache size for HOT queue, in (0, 1]", def.HotCap))
+	flag.Float64Var(&f.WarmCap, "warm-cap", 0, usage("part of cache size for WARM queue, in (0, 1]; hot-cap + warm-cap should be <= 1", def.WarmCap))
+	flag.StringVar(&f.MemoryBudget, "memory-budget", "", usage("max total size of items data: 2g, 64m; unlimited if empty", def.MemoryBudget))
+	flag.StringVar(&f.MinChunkSize, "min-chunk", "", usage("min size of chunks, that items data is stored in: 4k; 128b if empty", def.MinChunkSize))
+	flag.StringVar(&f.MaxChunkSize, "max-chunk", "", usage("max size of chunks, that items data is stored in, not less than 16k: 4m; 1m if empty", def.MaxChunkSize))
+	flag.IntVar(&f.MaxRetainedChunks, "max-retained-chunks", 0, usage("max recycled chunks of every size kept for reuse, others are freed by GC; 0 for unlimited", def.MaxRetainedChunks))
+	flag.DurationVar(&f.WriteTimeout, "write-timeout", 0, usage("timeout of response chunk write; 0 for no timeout", def.WriteTimeout))
+	flag.BoolVar(&f.FlushPerCommand, "flush-per-command", false, usage("flush every get value at once; lower latency, lower throughput", def.FlushPerCommand))
+	flag.StringVar(&f.MaxResponseBacklog, "max-response-backlog", "", usage("max size of unflushed get response values, connection is closed on exceed: 16m; unlimited if empty", def.MaxResponseBacklog))
+	flag.IntVar(&f.MaxKeysPerGet, "max-keys-per-get", 0, usage("max keys in single get, gets, gat or gats; 0 for 1024", def.MaxKeysPerGet))
+	flag.IntVar(&f.MaxConnections, "max-connections", 0, usage("max concurrently served connections; accept blocks on limit; 0 for unlimited", def.MaxConnections))
+	flag.BoolVar(&f.RejectOverConnLimit, "reject-over-conn-limit", false, usage("close connections over max-connections limit with server error, instead of blocking accept", def.RejectOverConnLimit))
+	flag.BoolVar(&f.DataChecksum, "data-checksum", false, usage("verify item data checksum on get, to detect in-memory corruption", def.DataChecksum))
+	flag.StringVar(&f.Banner, "banner", "", usage("line sent to text protocol client before response to its first version command, for telnet sessions", def.Banner))
+	flag.StringVar(&f.DisabledCommands, "disabled-commands", "", usage("comma separated text protocol commands to disable, case insensitive: delete,mdelete", def.DisabledCommands))
+	flag.StringVar(&f.RejectKeyPrefixes, "reject-key-prefixes", "", usage("comma separated reserved key prefixes, that can't be set: internal:,proxy:", def.RejectKeyPrefixes))
+	flag.BoolVar(&f.EnableMaxItemSizeCommand, "enable-max-item-size-command", false, usage("enable max_item_size command, that overrides max item size for connection; only for trusted clients", def.EnableMaxItemSizeCommand))
+	flag.BoolVar(&f.LogErrorCommand, "log-error-command", false, usage("log command that caused server error; keys can leak into log", def.LogErrorCommand))
+	flag.BoolVar(&f.ReplyErrorCommand, "reply-error-command", false, usage("send command that caused server error to client", def.ReplyErrorCommand))
+	flag.BoolVar(&f.VerboseUnknownCommand, "verbose-unknown-command", false, usage("reply unknown command name in ERROR response", def.VerboseUnknownCommand))
+	flag.IntVar(&f.RecordOps, "record-ops", 0, usage("number of last cache operations kept for dump_ops command; keys can leak into responses; 0 disables recording", def.RecordOps))
+	flag.StringVar(&f.DebugAddr, "debug-addr", "", usage("address of HTTP server with /debug/pprof/ and /stats endpoints: localhost:6060; disabled if empty", def.DebugAddr))
+	flag.DurationVar(&f.ShutdownTimeout, "shutdown-timeout", 0, usage("time given to commands in progress on SIGINT or SIGTERM; 0 for no limit", def.ShutdownTimeout))
 	flag.StringVar(&f.AOF.Name, "aof-name", "", usage("Append Only File(AOF) name", def.AOF.Name))
 	flag.DurationVar(&f.AOF.Sync, "sync", 0, usage("AOF sync period", def.AOF.Sync))
+	flag.StringVar(&f.AOF.Fsync, "fsync", "", usage("AOF fsync policy: "+
+		"always - sync every command, slowest, nothing acknowledged is lost on crash; "+
+		"everysec - sync every sync period in background, commands since last sync can be lost; "+
+		"no - never sync, leave it to OS, fastest, unbounded loss on OS crash or power failure; "+
+		"if empty, always is used for sync period less than 100ms, everysec otherwise", def.AOF.Fsync))
 	flag.StringVar(&f.AOF.BufSize, "buf-size", "", usage("AOF buffer size", def.AOF.BufSize))
 	flag.BoolVar(&f.AOF.FixCorrupted, "fix-corrupted", false, usage("truncate AOF to valid prefix, if it is possible.", def.AOF.FixCorrupted))
+	flag.BoolVar(&f.AOF.DisableRotation, "disable-rotation", false, usage("never rotate AOF", def.AOF.DisableRotation))
+	flag.BoolVar(&f.AOF.Checksummed, "aof-checksum", false, usage("write CRC32 of every transaction into new AOF, to detect corruption on replay; existing AOF format is kept", def.AOF.Checksummed))
+	flag.BoolVar(&f.AOF.CompressSnapshot, "compress-snapshot", false, usage("gzip cache snapshot written on AOF rotation; less disk usage, slower rotation and start", def.AOF.CompressSnapshot))
+	flag.BoolVar(&f.AOF.ServeWhileWarming, "serve-while-warming", false, usage("accept connections while AOF is replayed, replying server error", def.AOF.ServeWhileWarming))
+	flag.BoolVar(&f.AOF.BackgroundReplay, "background-replay", false, usage("serve cache while AOF command log is replayed; not replayed keys are misses", def.AOF.BackgroundReplay))
 	flag.Parse()
 	return f
 }
@@ -2,12 +2,20 @@ package memcached
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Skipor/memcached/cache"
 	"github.com/Skipor/memcached/internal/util"
 	"github.com/Skipor/memcached/log"
+	"github.com/Skipor/memcached/recycle"
 	"github.com/facebookgo/stackerr"
 )
 
@@ -18,31 +26,83 @@ type conn struct {
 	*ConnMeta
 	log   log.Logger
 	cache cache.View
+	// newCacheView is used to get cache view, when connection accepted
+	// while warming up is finished.
+	newCacheView func() cache.View
+	// deleteRaw is buffer for delete commands made from multi delete keys.
+	deleteRaw []byte
+	// maxItemSize is ConnMeta.MaxItemSize, that can be overridden for connection.
+	maxItemSize int
+	// lastCommand is copy of last command line truncated to MaxErrorCommandLen.
+	// It is saved only if command should be reported on server error.
+	lastCommand []byte
+	// backlog is size of values written since last flush.
+	backlog int
+	// valueHeader is buffer for VALUE lines of get responses.
+	valueHeader []byte
+	// binary is set, if client uses binary protocol.
+	binary bool
+	// binaryBuf is buffer for binary request extras and key.
+	binaryBuf []byte
+	// binaryRaw is buffer for text commands made from binary requests.
+	binaryRaw []byte
+	// bannerSent is set after ConnMeta.Banner is sent.
+	bannerSent bool
+	// writeFailed is set when write into connection failed.
+	// Connection can't be used for response after that.
+	writeFailed bool
+	// idle is set while connection waits for next command. Guarded by idleLock.
+	idle     bool
+	idleLock sync.Mutex
 }
 
 func newConn(l log.Logger, m *ConnMeta, cache cache.View, rwc io.ReadWriteCloser) *conn {
 	return &conn{
-		reader:   newReader(rwc, m.Pool),
-		Writer:   bufio.NewWriterSize(rwc, OutBufferSize),
-		closer:   rwc,
-		ConnMeta: m,
-		log:      l,
-		cache:    cache,
+		reader:      newReader(rwc, m.Pool),
+		Writer:      bufio.NewWriterSize(rwc, OutBufferSize),
+		closer:      rwc,
+		ConnMeta:    m,
+		log:         l,
+		cache:       cache,
+		maxItemSize: m.MaxItemSize,
 	}
 }
 
+// closeReason describes why connection was closed.
+type closeReason string
+
+const (
+	closeClientEOF   closeReason = "client_eof"
+	closeClientQuit  closeReason = "client_quit"
+	closeReadTimeout closeReason = "read_timeout"
+	closeWriteError  closeReason = "write_error"
+	closeServerError closeReason = "server_error"
+	closeServerStop  closeReason = "server_stop"
+)
+
 func (c *conn) serve() {
 	c.log.Info("Serve connection.")
+	reason := closeServerError
 	defer func() {
 		if r := recover(); r != nil {
 			c.serverError(stackerr.Newf("Panic: %s", r))
 			panic(c)
 		}
 		c.Close()
-		c.log.Info("Connection closed.")
+		atomic.AddInt64(&c.Stats.CurrConnections, -1)
+		c.log.Infof("Connection closed. Reason: %s.", reason)
 	}()
 
-	err := c.loop()
+	if !c.waitCommand() {
+		reason = closeServerStop
+		return
+	}
+	var err error
+	if c.isBinaryClient() {
+		reason, err = c.binaryLoop()
+	} else {
+		reason, err = c.loop()
+	}
 	if err != nil {
 		c.serverError(err)
 	}
@@ -53,55 +113,270 @@ func (c *conn) Close() error {
 	return c.closer.Close()
 }
 
-func (c *conn) loop() error {
+// loop serves commands until error or QuitCommand. Returned reason is closeClientEOF on client disconnect
+// before command, closeClientQuit on quit, otherwise it describes returned error.
+func (c *conn) loop() (reason closeReason, err error) {
 	for {
+		if !c.waitCommand() {
+			return closeServerStop, nil
+		}
 		raw, command, fields, clientErr, err := c.readCommand()
+		if c.LogErrorCommand || c.ReplyErrorCommand {
+			c.saveLastCommand(raw)
+		}
 		if err != nil {
 			if err == io.EOF {
 				// Just client disconnect. Ok.
-				return nil
+				return closeClientEOF, nil
+			}
+			err = stackerr.Wrap(err)
+			return c.closeReason(err), err
+		}
+		if clientErr == nil && c.cache == nil {
+			if c.isWarmedUp() {
+				c.cache = c.newCacheView()
+			} else if !availableWhileWarmingUp(string(command)) {
+				err = c.warmingUp(command, fields)
+				if err != nil {
+					return c.closeReason(err), err
+				}
+				continue
 			}
-			return stackerr.Wrap(err)
 		}
-		if clientErr == nil {
+		if clientErr == nil && c.DisabledCommands[string(command)] {
+			clientErr, err = c.disabledCommand(command, fields)
+		} else if clientErr == nil {
 			c.log.Debugf("Command: %s.", command)
 			switch string(command) { // No allocation.
-			case GetCommand, GetsCommand:
+			case GetCommand:
+				getter := c.cache.NewGetter(raw)
+				clientErr, err = c.get(getter, fields, false)
+			case GetsCommand:
+				getter := c.cache.NewGetter(raw)
+				clientErr, err = c.get(getter, fields, true)
+			case GatCommand, GatsCommand:
+				toucher := c.cache.NewGetAndToucher(raw)
+				clientErr, err = c.getAndTouch(toucher, fields, string(command) == GatsCommand)
+			case GetQuietCommand:
 				getter := c.cache.NewGetter(raw)
-				clientErr, err = c.get(getter, fields)
+				clientErr, err = c.getQuiet(getter, fields)
+			case NoopCommand:
+				clientErr, err = c.noop(fields)
 			case SetCommand:
 				setter := c.cache.NewSetter(raw)
 				clientErr, err = c.set(setter, fields)
+			case AddCommand:
+				adder := c.cache.NewAdder(raw)
+				clientErr, err = c.add(adder, fields)
+			case ReplaceCommand:
+				replacer := c.cache.NewReplacer(raw)
+				clientErr, err = c.replace(replacer, fields)
+			case CasCommand:
+				caser := c.cache.NewCaser(raw)
+				clientErr, err = c.cas(caser, fields)
+			case IncrCommand, DecrCommand:
+				incrementer := c.cache.NewIncrementer(raw)
+				clientErr, err = c.incr(incrementer, fields, string(command) == DecrCommand)
 			case DeleteCommand:
 				deleter := c.cache.NewDeleter(raw)
 				clientErr, err = c.delete(deleter, fields)
+			case MultiDeleteCommand:
+				clientErr, err = c.multiDelete(fields)
+			case MaxItemSizeCommand:
+				clientErr, err = c.setMaxItemSize(command, fields)
+			case EvictCommand:
+				clientErr, err = c.evict(command, fields)
+			case DumpOpsCommand:
+				clientErr, err = c.dumpOps(command, fields)
+			case RotateAOFCommand:
+				clientErr, err = c.rotateAOF(command, fields)
+			case StatsCommand:
+				clientErr, err = c.stats(fields)
+			case VersionCommand:
+				clientErr, err = c.version(fields)
+			case QuitCommand:
+				if len(fields) != 0 {
+					clientErr = stackerr.Wrap(ErrTooManyFields)
+					break
+				}
+				// Connection is flushed and closed by serve.
+				return closeClientQuit, nil
 			default:
 				c.log.Error("Unexpected command: ", command)
-				err = c.sendResponse(ErrorResponse)
+				err = c.unknownCommand(command)
 			}
 		}
 		if clientErr != nil && err == nil {
 			err = c.sendClientError(clientErr)
 		}
+		if err == io.EOF {
+			// Client disconnect in the middle of command. Ok.
+			return closeClientEOF, nil
+		}
 		if err != nil {
-			return err
+			return c.closeReason(err), err
 		}
 	}
 }
 
-func (c *conn) get(getter cache.Getter, fields [][]byte) (clientErr, err error) {
+// closeReason classifies error, that stopped connection loop.
+func (c *conn) closeReason(err error) closeReason {
+	if c.writeFailed {
+		return closeWriteError
+	}
+	err = util.Unwrap(err)
+	if err == io.ErrUnexpectedEOF {
+		// Client disconnected in the middle of command.
+		return closeClientEOF
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return closeReadTimeout
+	}
+	return closeServerError
+}
+
+// disabledCommand rejects command disabled by configuration.
+func (c *conn) disabledCommand(command []byte, fields [][]byte) (clientErr, err error) {
+	c.log.Warnf("Disabled command: %s.", command)
+	clientErr = stackerr.Wrap(ErrCommandDisabled)
+	err = c.discardCommandData(command, fields)
+	return
+}
+
+// warmingUp rejects command received before cache was read from AOF.
+func (c *conn) warmingUp(command []byte, fields [][]byte) (err error) {
+	c.log.Debugf("Command %s received while warming up.", command)
+	err = c.discardCommandData(command, fields)
+	if err != nil {
+		return
+	}
+	return c.sendResponse(ServerErrorResponse + " " + WarmingUpMessage)
+}
+
+// availableWhileWarmingUp returns true for commands, that don't need cache. They are served while
+// cache is warming up, so health checks can see server stats, and clients can close connection cleanly.
+func availableWhileWarmingUp(command string) bool {
+	switch command {
+	case QuitCommand, VersionCommand, StatsCommand:
+		return true
+	}
+	return false
+}
+
+// discardCommandData discards data following not executed command line, so next command can be read.
+func (c *conn) discardCommandData(command []byte, fields [][]byte) (err error) {
+	switch string(command) {
+	case SetCommand, AddCommand, ReplaceCommand:
+		meta, _, parseErr := parseSetFields(fields)
+		if parseErr == nil {
+			_, err = c.Discard(meta.Bytes + len(Separator))
+		}
+	case CasCommand:
+		meta, _, _, parseErr := parseCasFields(fields)
+		if parseErr == nil {
+			_, err = c.Discard(meta.Bytes + len(Separator))
+		}
+	case MultiDeleteCommand:
+		count, _, parseErr := parseMultiDeleteFields(fields)
+		for i := 0; parseErr == nil && i < count && err == nil; i++ {
+			_, _, err = c.readKeyLine()
+		}
+	}
+	return
+}
+
+// get sends found values. CAS uniques are sent, if withCAS is true.
+func (c *conn) get(getter cache.Getter, fields [][]byte, withCAS bool) (clientErr, err error) {
+	var keys [][]byte
+	keys, clientErr = parseGetFields(fields, c.MaxKeysPerGet)
+	if clientErr != nil {
+		return
+	}
+	var views []cache.ItemView
+	if og, ok := getter.(oneGetter); ok && len(keys) == 1 {
+		if view, found := og.GetOne(keys[0]); found {
+			one := [1]cache.ItemView{view}
+			views = one[:]
+		}
+	} else {
+		views = getter.Get(keys...)
+	}
+	c.Stats.countGet(len(keys), len(views))
+
+	err = c.sendGetResponse(views, withCAS)
+	return
+}
+
+// oneGetter is cache.Getter with single key get, that avoids slice allocations.
+type oneGetter interface {
+	GetOne(key []byte) (view cache.ItemView, found bool)
+}
+
+// getAndTouch sets exptime of found items, and sends them as get does.
+func (c *conn) getAndTouch(toucher cache.GetAndToucher, fields [][]byte, withCAS bool) (clientErr, err error) {
+	var exptime int64
 	var keys [][]byte
-	keys, clientErr = parseGetFields(fields)
+	exptime, keys, clientErr = parseGatFields(fields, c.MaxKeysPerGet)
+	if clientErr != nil {
+		return
+	}
+	views := toucher.GetAndTouch(exptime, keys...)
+	c.Stats.countGet(len(keys), len(views))
+
+	err = c.sendGetResponse(views, withCAS)
+	return
+}
+
+// getQuiet writes found values, but not END. Values are flushed with next response,
+// or at once if FlushPerCommand is set.
+func (c *conn) getQuiet(getter cache.Getter, fields [][]byte) (clientErr, err error) {
+	var keys [][]byte
+	keys, clientErr = parseGetFields(fields, c.MaxKeysPerGet)
 	if clientErr != nil {
 		return
 	}
 	views := getter.Get(keys...)
+	c.Stats.countGet(len(keys), len(views))
 
-	err = c.sendGetResponse(views)
+	err = c.writeValues(views, false)
 	return
 }
 
-func (c *conn) sendGetResponse(views []cache.ItemView) error {
+func (c *conn) noop(fields [][]byte) (clientErr, err error) {
+	if len(fields) != 0 {
+		clientErr = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	err = c.sendResponse(EndResponse)
+	return
+}
+
+// appendValueHeader appends "VALUE <key> <flags> <bytes> [<cas unique>]\r\n" line to b.
+// It is formatted without fmt, that allocates on every call.
+func appendValueHeader(b []byte, meta cache.ItemMeta, withCAS bool) []byte {
+	b = append(b, ValueResponse...)
+	b = append(b, ' ')
+	b = append(b, meta.Key...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(meta.Flags), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(meta.Bytes), 10)
+	if withCAS {
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, meta.CAS, 10)
+	}
+	return append(b, Separator...)
+}
+
+func (c *conn) sendGetResponse(views []cache.ItemView, withCAS bool) error {
+	err := c.writeValues(views, withCAS)
+	if err != nil {
+		return err
+	}
+	return c.sendResponse(EndResponse)
+}
+
+func (c *conn) writeValues(views []cache.ItemView, withCAS bool) error {
 	c.log.Debugf("Sending %v founded values.", len(views))
 	var readerIndex int
 	defer func() {
@@ -112,49 +387,366 @@ func (c *conn) sendGetResponse(views []cache.ItemView) error {
 	}()
 	for ; readerIndex < len(views); readerIndex++ {
 		view := views[readerIndex]
+		if err := view.Reader.Verify(); err != nil {
+			// Treat as cache miss.
+			c.log.Errorf("Value of key %s: %v. Evicting.", view.Key, err)
+			view.Reader.Close()
+			// Note: item can be overwritten after get, so new item can be deleted. It is not a problem for cache.
+			c.deleteKey(view.Key)
+			continue
+		}
+		c.backlog += len(view.Key) + view.Bytes
+		if c.MaxResponseBacklog != 0 && c.backlog > c.MaxResponseBacklog {
+			c.log.Errorf("Response backlog exceeded: %v bytes of values are not flushed.", c.backlog)
+			return stackerr.Wrap(ErrBacklogExceeded)
+		}
 		c.log.Debugf("Sending value %v. Key %s.", readerIndex, view.Key)
-		c.WriteString(ValueResponse)
-		c.WriteByte(' ')
-		c.WriteString(view.Key)
-		fmt.Fprintf(c, " %v %v"+Separator, view.Flags, view.Bytes)
-		view.Reader.WriteTo(c)
+		c.valueHeader = appendValueHeader(c.valueHeader[:0], view.ItemMeta, withCAS)
+		c.Write(c.valueHeader)
+		view.Reader.WriteTo(chunkWriter{c})
 		_, err := c.WriteString(Separator)
 		if err != nil {
 			return stackerr.Wrap(err)
 		}
 		view.Reader.Close()
+		if c.FlushPerCommand {
+			err = c.Flush()
+			if err != nil {
+				readerIndex++
+				return err
+			}
+		}
 	}
-	return c.sendResponse(EndResponse)
+	return nil
+}
+
+// coldestKeysView is cache.View that can return keys of items that would be evicted first.
+type coldestKeysView interface {
+	ColdestKeys(n int) []string
+}
+
+// evict evicts coldest items by deleting them one by one through cache view.
+func (c *conn) evict(command []byte, fields [][]byte) (clientErr, err error) {
+	view, ok := c.cache.(coldestKeysView)
+	if !ok {
+		err = c.unknownCommand(command)
+		return
+	}
+	var n int
+	n, clientErr = parseEvictFields(fields)
+	if clientErr != nil {
+		return
+	}
+	var evicted int
+	for _, key := range view.ColdestKeys(n) {
+		// Item can be deleted concurrently.
+		if c.deleteKey(key) {
+			evicted++
+		}
+	}
+	c.log.Infof("Evicted %v items by command.", evicted)
+	err = c.sendResponse(fmt.Sprintf("%s %v", EvictedResponse, evicted))
+	return
+}
+
+// isReservedKey returns true if key has one of RejectKeyPrefixes.
+func (c *conn) isReservedKey(key string) bool {
+	for _, prefix := range c.RejectKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpOps sends recorded cache operations.
+func (c *conn) dumpOps(command []byte, fields [][]byte) (clientErr, err error) {
+	if c.Recorder == nil {
+		err = c.unknownCommand(command)
+		return
+	}
+	if len(fields) != 0 {
+		clientErr = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	for _, op := range c.Recorder.Ops() {
+		c.WriteString(OpResponse)
+		c.WriteString(" ")
+		c.WriteString(op.String())
+		c.WriteString(Separator)
+	}
+	err = c.sendResponse(EndResponse)
+	return
+}
+
+// aofRotatorView is cache.View that can force AOF rotation.
+type aofRotatorView interface {
+	RotateAOF() error
+}
+
+// rotateAOF rotates AOF of cache view. Busy server error is sent, if rotation is already in process.
+func (c *conn) rotateAOF(command []byte, fields [][]byte) (clientErr, err error) {
+	view, ok := c.cache.(aofRotatorView)
+	if !ok {
+		err = c.unknownCommand(command)
+		return
+	}
+	if len(fields) != 0 {
+		clientErr = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	rotateErr := view.RotateAOF()
+	if rotateErr != nil {
+		c.log.Warnf("AOF rotation by command failed: %v", rotateErr)
+		err = c.sendResponse(fmt.Sprintf("%s %s", ServerErrorResponse, util.Unwrap(rotateErr)))
+		return
+	}
+	c.log.Info("AOF rotated by command.")
+	err = c.sendResponse(OkResponse)
+	return
+}
+
+func (c *conn) version(fields [][]byte) (clientErr, err error) {
+	if len(fields) != 0 {
+		clientErr = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	if c.Banner != "" && !c.binary && !c.bannerSent {
+		c.bannerSent = true
+		err = c.sendResponse(c.Banner)
+		if err != nil {
+			return
+		}
+	}
+	err = c.sendResponse(VersionResponse + " " + Version)
+	return
+}
+
+// usageView is cache.View that can return number and size of items in cache.
+type usageView interface {
+	Usage() (items int, size int64)
+}
+
+// queueStatsView is cache.View that can return stats of cache queues.
+type queueStatsView interface {
+	QueueStats() []cache.QueueStats
+}
+
+// queueItemsView is cache.View that can return metas of cache queue items.
+type queueItemsView interface {
+	QueueItems(queue, limit int) []cache.ItemMeta
+}
+
+// stats sends server counters, cache usage if cache view supports it, and cache counters if they are available.
+// Items and slabs stats are sent, if subcommand is passed.
+func (c *conn) stats(fields [][]byte) (clientErr, err error) {
+	if len(fields) > 0 && string(fields[0]) == StatsCachedumpOption {
+		return c.cachedump(fields[1:])
+	}
+	if len(fields) > 1 {
+		clientErr = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	var stats []stat
+	switch {
+	case len(fields) == 0:
+		stats = c.Stats.stats()
+		if view, ok := c.cache.(usageView); ok {
+			items, size := view.Usage()
+			stats = append(stats, stat{"curr_items", items}, stat{"bytes", size})
+		}
+		if c.CacheMetrics != nil {
+			stats = append(stats, cacheStats(c.CacheMetrics.Load())...)
+		}
+	case string(fields[0]) == StatsItemsOption:
+		if view, ok := c.cache.(queueStatsView); ok {
+			stats = itemsStats(view.QueueStats())
+		}
+	case string(fields[0]) == StatsSlabsOption:
+		stats = append(slabsStats(c.Pool.ChunkClassStats()), poolStats(c.Pool.Stats())...)
+	default:
+		clientErr = stackerr.Wrap(ErrInvalidOption)
+		return
+	}
+	for _, s := range stats {
+		c.WriteString(s.String())
+		c.WriteString(Separator)
+	}
+	err = c.sendResponse(EndResponse)
+	return
+}
+
+// cachedump sends items of cache queue chosen by class. Nothing is sent, if cache view doesn't support it.
+func (c *conn) cachedump(fields [][]byte) (clientErr, err error) {
+	var queue, limit int
+	queue, limit, clientErr = parseCachedumpFields(fields)
+	if clientErr != nil {
+		return
+	}
+	if view, ok := c.cache.(queueItemsView); ok {
+		for _, meta := range view.QueueItems(queue, limit) {
+			fmt.Fprintf(c, "%s %s [%v b; %v s]%s", ItemResponse, meta.Key, meta.Bytes, meta.Exptime, Separator)
+		}
+	}
+	err = c.sendResponse(EndResponse)
+	return
+}
+
+// deleteKey deletes key, that was not passed by client in delete command.
+// Delete is passed to cache view as delete command, so it is logged in AOF as such.
+func (c *conn) deleteKey(key string) (deleted bool) {
+	c.deleteRaw = append(append(append(c.deleteRaw[:0], DeleteCommand+" "...), key...), Separator...)
+	return c.cache.NewDeleter(c.deleteRaw).Delete(c.deleteRaw[len(DeleteCommand)+1 : len(c.deleteRaw)-len(Separator)])
 }
 
 func (c *conn) set(setter cache.Setter, fields [][]byte) (clientErr, err error) {
-	var i cache.Item
-	var noreply bool
-	i.ItemMeta, noreply, clientErr = parseSetFields(fields)
+	meta, noreply, clientErr := parseSetFields(fields)
+	if clientErr != nil {
+		err = c.discardCommand()
+		return
+	}
+	return c.store(meta, noreply, func(i cache.Item) string {
+		setter.Set(i)
+		return StoredResponse
+	})
+}
+
+// add stores item only if key is not in cache.
+// Data block is read anyway, so next command can be read.
+func (c *conn) add(adder cache.Adder, fields [][]byte) (clientErr, err error) {
+	meta, noreply, clientErr := parseSetFields(fields)
+	if clientErr != nil {
+		err = c.discardCommand()
+		return
+	}
+	return c.store(meta, noreply, func(i cache.Item) string {
+		if adder.Add(i) {
+			return StoredResponse
+		}
+		return NotStoredResponse
+	})
+}
+
+// replace stores item only if key is in cache.
+// Data block is read anyway, so next command can be read.
+func (c *conn) replace(replacer cache.Replacer, fields [][]byte) (clientErr, err error) {
+	meta, noreply, clientErr := parseSetFields(fields)
+	if clientErr != nil {
+		err = c.discardCommand()
+		return
+	}
+	return c.store(meta, noreply, func(i cache.Item) string {
+		if replacer.Replace(i) {
+			return StoredResponse
+		}
+		return NotStoredResponse
+	})
+}
+
+// cas stores item only if it was not modified since client got its cas unique.
+func (c *conn) cas(caser cache.Caser, fields [][]byte) (clientErr, err error) {
+	meta, casID, noreply, clientErr := parseCasFields(fields)
 	if clientErr != nil {
 		err = c.discardCommand()
 		return
 	}
-	c.log.Debugf("set %#v", i.ItemMeta)
+	return c.store(meta, noreply, func(i cache.Item) string {
+		switch caser.Cas(i, casID) {
+		case cache.CasStored:
+			return StoredResponse
+		case cache.CasExists:
+			return ExistsResponse
+		default:
+			return NotFoundResponse
+		}
+	})
+}
 
-	if i.Bytes > c.MaxItemSize {
+// store reads data block of storage command and passes item to store func, that returns response.
+func (c *conn) store(meta cache.ItemMeta, noreply bool, store func(i cache.Item) (response string)) (clientErr, err error) {
+	i := cache.Item{ItemMeta: meta}
+	c.log.Debugf("store %#v", i.ItemMeta)
+
+	if i.Bytes > c.maxItemSize {
 		clientErr = stackerr.Wrap(ErrTooLargeItem)
 		_, err = c.Discard(i.Bytes + len(Separator))
 		return
 	}
+	if c.isReservedKey(i.Key) {
+		clientErr = stackerr.Wrap(ErrReservedKeyPrefix)
+		_, err = c.Discard(i.Bytes + len(Separator))
+		return
+	}
+	if !c.itemFits(i.ItemMeta) {
+		c.log.Errorf("Item of %v bytes doesn't fit in cache.", i.Bytes)
+		_, err = c.Discard(i.Bytes + len(Separator))
+		if err == nil {
+			err = c.sendResponse(fmt.Sprintf("%s %s", ServerErrorResponse, ErrTooLargeForCache))
+		}
+		return
+	}
 
 	i.Data, clientErr, err = c.readDataBlock(i.Bytes)
+	if util.Unwrap(err) == recycle.ErrOutOfMemory {
+		c.log.Error("Item data doesn't fit in memory budget.")
+		_, err = c.Discard(i.Bytes + len(Separator))
+		if err == nil {
+			err = c.sendResponse(fmt.Sprintf("%s %s", ServerErrorResponse, recycle.ErrOutOfMemory))
+		}
+		return
+	}
+	if cause := util.Unwrap(err); cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		c.log.Debug("Client disconnected before end of data block.")
+		err = io.EOF
+		return
+	}
 	if err != nil || clientErr != nil {
 		return
 	}
 
-	setter.Set(i)
+	atomic.AddInt64(&c.Stats.CmdSet, 1)
+	response := store(i)
 
 	if noreply {
 		err = c.Flush()
 		return
 	}
-	err = c.sendResponse(StoredResponse)
+	err = c.sendResponse(response)
+	return
+}
+
+// incr increments value, or decrements it, if decr is true.
+func (c *conn) incr(incrementer cache.Incrementer, fields [][]byte, decr bool) (clientErr, err error) {
+	var key []byte
+	var delta uint64
+	var noreply bool
+	key, delta, noreply, clientErr = parseIncrFields(fields)
+	if clientErr != nil {
+		return
+	}
+	c.log.Debugf("incr %s; delta: %v; decr: %v; noreply: %v", key, delta, decr, noreply)
+
+	var newVal uint64
+	var found, notNumeric bool
+	if decr {
+		newVal, found, notNumeric = incrementer.Decr(key, delta)
+	} else {
+		newVal, found, notNumeric = incrementer.Incr(key, delta)
+	}
+	if notNumeric {
+		clientErr = stackerr.Wrap(ErrNotNumeric)
+		return
+	}
+
+	if noreply {
+		err = c.Flush()
+		return
+	}
+	if !found {
+		err = c.sendResponse(NotFoundResponse)
+		return
+	}
+	err = c.sendResponse(strconv.FormatUint(newVal, 10))
 	return
 }
 
@@ -168,6 +760,7 @@ func (c *conn) delete(deleter cache.Deleter, fields [][]byte) (clientErr, err er
 	c.log.Debugf("delete %s; noreply: %v", key, noreply)
 
 	deleted := deleter.Delete(key)
+	c.Stats.countDelete(deleted)
 
 	if noreply {
 		err = c.Flush()
@@ -183,12 +776,195 @@ func (c *conn) delete(deleter cache.Deleter, fields [][]byte) (clientErr, err er
 	return
 }
 
+// multiDelete reads keys from command body and deletes them one by one.
+// Every key delete is passed to cache view as separate delete command,
+// so it is logged in AOF as such. Invalid keys are skipped,
+// but whole body is read, and client error is returned after all deletes.
+func (c *conn) multiDelete(fields [][]byte) (clientErr, err error) {
+	var count int
+	var noreply bool
+	count, noreply, clientErr = parseMultiDeleteFields(fields)
+	if clientErr != nil {
+		return
+	}
+	c.log.Debugf("mdelete %v keys; noreply: %v", count, noreply)
+
+	var deleted, notFound int
+	for i := 0; i < count; i++ {
+		var key []byte
+		var keyErr error
+		key, keyErr, err = c.readKeyLine()
+		if err != nil {
+			return
+		}
+		if keyErr != nil {
+			if clientErr == nil {
+				clientErr = keyErr
+			}
+			continue
+		}
+		c.deleteRaw = append(append(append(c.deleteRaw[:0], DeleteCommand+" "...), key...), Separator...)
+		keyDeleted := c.cache.NewDeleter(c.deleteRaw).Delete(key)
+		c.Stats.countDelete(keyDeleted)
+		if keyDeleted {
+			deleted++
+		} else {
+			notFound++
+		}
+	}
+	if clientErr != nil {
+		return
+	}
+
+	if noreply {
+		err = c.Flush()
+		return
+	}
+	err = c.sendResponse(fmt.Sprintf("%s %v %s %v", DeletedResponse, deleted, NotFoundResponse, notFound))
+	return
+}
+
+// setMaxItemSize lowers max item size for connection. It is unknown command, unless enabled,
+// because client can pin large items otherwise.
+func (c *conn) setMaxItemSize(command []byte, fields [][]byte) (clientErr, err error) {
+	if !c.EnableMaxItemSizeCommand {
+		err = c.unknownCommand(command)
+		return
+	}
+	var size int
+	size, clientErr = parseMaxItemSizeFields(fields, MaxItemSize)
+	if clientErr != nil {
+		return
+	}
+	// Items of larger size would be rejected by every set anyway.
+	if !c.itemFits(cache.ItemMeta{Key: strings.Repeat("k", MaxKeySize), Bytes: size}) {
+		clientErr = stackerr.Wrap(ErrTooLargeForCache)
+		return
+	}
+	c.log.Infof("Max item size overridden: %v.", size)
+	c.maxItemSize = size
+	err = c.sendResponse(OkResponse)
+	return
+}
+
+// chunkWriter writes into conn by WriteChunkSize chunks, refreshing write deadline before every chunk.
+// So slow client can't block connection goroutine on huge value write for long,
+// and large value write is not one giant write into socket.
+type chunkWriter struct{ c *conn }
+
+func (w chunkWriter) Write(p []byte) (nn int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > WriteChunkSize {
+			chunk = chunk[:WriteChunkSize]
+		}
+		w.c.refreshWriteDeadline()
+		var n int
+		n, err = w.c.Writer.Write(chunk)
+		nn += n
+		if err != nil {
+			w.c.writeFailed = true
+			return
+		}
+		p = p[n:]
+	}
+	return
+}
+
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func (c *conn) refreshWriteDeadline() {
+	if c.WriteTimeout == 0 {
+		return
+	}
+	if d, ok := c.closer.(writeDeadliner); ok {
+		d.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+	}
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// waitCommand blocks until next command data is received. It returns false, if server is stopping
+// and connection should be closed, because there is no command in progress.
+// Connections without read deadline support can't be interrupted, so they just wait.
+func (c *conn) waitCommand() bool {
+	d, ok := c.closer.(readDeadliner)
+	if !ok || c.Buffered() > 0 {
+		return true
+	}
+	c.idleLock.Lock()
+	if c.isDraining() {
+		c.idleLock.Unlock()
+		return false
+	}
+	c.idle = true
+	c.idleLock.Unlock()
+
+	_, err := c.Peek(1)
+
+	c.idleLock.Lock()
+	c.idle = false
+	draining := c.isDraining()
+	c.idleLock.Unlock()
+	if !draining {
+		return true
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	// Command was received before interrupt, and should be served.
+	d.SetReadDeadline(time.Time{})
+	return true
+}
+
+// interruptIdle makes connection waiting for next command stop waiting.
+func (c *conn) interruptIdle() {
+	c.idleLock.Lock()
+	defer c.idleLock.Unlock()
+	if c.idle {
+		c.closer.(readDeadliner).SetReadDeadline(time.Now())
+	}
+}
+
+func (c *conn) unknownCommand(command []byte) error {
+	if !c.VerboseUnknownCommand {
+		return c.sendResponse(ErrorResponse)
+	}
+	if len(command) > MaxErrorCommandLen {
+		command = command[:MaxErrorCommandLen]
+	}
+	return c.sendResponse(fmt.Sprintf("%s unknown command: %s", ErrorResponse, command))
+}
+
+// saveLastCommand saves command line for report on server error.
+// Only command line is saved, so set data block is never reported.
+func (c *conn) saveLastCommand(raw []byte) {
+	raw = bytes.TrimSuffix(raw, separatorBytes)
+	if len(raw) > MaxErrorCommandLen {
+		raw = raw[:MaxErrorCommandLen]
+	}
+	c.lastCommand = append(c.lastCommand[:0], raw...)
+}
+
 func (c *conn) serverError(err error) {
-	c.log.Error("Server error: ", err)
-	if err == io.ErrUnexpectedEOF {
+	if c.LogErrorCommand {
+		c.log.Errorf("Server error on command %q: %v", c.lastCommand, err)
+	} else {
+		c.log.Error("Server error: ", err)
+	}
+	if err == io.ErrUnexpectedEOF || c.binary {
+		// Binary clients can't parse text error, so connection is just closed.
 		return
 	}
 	err = util.Unwrap(err)
+	if c.ReplyErrorCommand {
+		c.sendResponse(fmt.Sprintf("%s %s; command: %q", ServerErrorResponse, err, c.lastCommand))
+		return
+	}
 	c.sendResponse(fmt.Sprintf("%s %s", ServerErrorResponse, err))
 }
 
@@ -199,11 +975,17 @@ func (c *conn) sendClientError(err error) error {
 }
 
 func (c *conn) sendResponse(res string) error {
+	c.refreshWriteDeadline()
 	c.WriteString(res)
 	c.WriteString(Separator)
 	return c.Flush()
 }
 
 func (c *conn) Flush() error {
-	return stackerr.Wrap(c.Writer.Flush())
+	c.backlog = 0
+	err := c.Writer.Flush()
+	if err != nil {
+		c.writeFailed = true
+	}
+	return stackerr.Wrap(err)
 }
@@ -1,11 +1,17 @@
 package memcached
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -45,10 +51,16 @@ func ReadAll(i *cache.Item) []byte {
 func (o *Out) ExpectItem(i *cache.Item) {
 	Eventually(o).Should(Say(ValueResponse + " "))
 	o.expectChunk([]byte(i.Key))
-	Eventually(o).Should(Say(fmt.Sprintf(" %v %v"+SeparatorPattern, i.Flags, i.Bytes)))
+	Eventually(o).Should(Say(" %v %v"+SeparatorPattern, i.Flags, i.Bytes))
 	expectedData := ReadAll(i)
-	actualData, err := ioutil.ReadAll(io.LimitReader(o.buf, int64(i.Bytes)))
-	Expect(err).To(BeNil())
+	// Large values are written by chunks, so data can be not fully written yet.
+	actualData := make([]byte, i.Bytes)
+	var read int
+	Eventually(func() int {
+		n, _ := o.buf.Read(actualData[read:])
+		read += n
+		return read
+	}, ReadTimeout).Should(Equal(i.Bytes))
 	ExpectBytesEqual(actualData, expectedData)
 	Expect(o).To(Say(SeparatorPattern))
 }
@@ -99,7 +111,7 @@ var _ = Describe("Conn", func() {
 
 	AssertSay := func(pattern string) {
 		It("expected response", func() {
-			Eventually(out, ReadTimeout).Should(Say(pattern))
+			Eventually(out, ReadTimeout).Should(Say("%s", pattern))
 		})
 	}
 
@@ -119,23 +131,104 @@ var _ = Describe("Conn", func() {
 		AssertSay(ServerErrorPattern)
 	})
 
+	Context("server error with command reply", func() {
+		BeforeEach(func() {
+			cMeta.ReplyErrorCommand = true
+			input = "get key"
+		})
+		JustBeforeEach(func() {
+			in.CloseWithError(errors.New("test err"))
+		})
+		AssertSay(ServerErrorResponse + ` test err; command: "get key"` + SeparatorPattern)
+	})
+
+	Context("unknown command", func() {
+		Input("xxx key" + Separator)
+		AssertSay(ErrorPattern)
+		Context("verbose", func() {
+			BeforeEach(func() { cMeta.VerboseUnknownCommand = true })
+			AssertSay(ErrorResponse + " unknown command: xxx" + SeparatorPattern)
+		})
+	})
+
+	Context("disabled command", func() {
+		BeforeEach(func() {
+			cMeta.DisabledCommands = map[string]bool{SetCommand: true, DeleteCommand: true}
+		})
+		Context("delete", func() {
+			Input("delete key" + Separator)
+			AssertSay(ClientErrorResponse + " command disabled" + SeparatorPattern)
+		})
+		Context("set data discarded", func() {
+			BeforeEach(func() { mcache.On("Get", mock.Anything).Return(nil) })
+			Input("set key 0 0 3" + Separator + "get" + Separator + "get key" + Separator)
+			It("next command executed", func() {
+				Eventually(out, ReadTimeout).Should(Say(ClientErrorResponse + " command disabled" + SeparatorPattern))
+				Eventually(out, ReadTimeout).Should(Say(EndPattern))
+			})
+		})
+	})
+
+	Context("warming up", func() {
+		var warmedUp chan struct{}
+		BeforeEach(func() {
+			warmedUp = make(chan struct{})
+			cMeta.warmedUp = warmedUp
+			c.cache = nil
+			c.newCacheView = func() cache.View { return mcache }
+		})
+		Input("set key 0 0 3" + Separator + "get" + Separator + "get key" + Separator)
+		It("commands rejected until warmed up", func() {
+			mcache.On("Get", mock.Anything).Return(nil)
+			Eventually(out, ReadTimeout).Should(Say(ServerErrorResponse + " " + WarmingUpMessage + SeparatorPattern))
+			Eventually(out, ReadTimeout).Should(Say(ServerErrorResponse + " " + WarmingUpMessage + SeparatorPattern))
+			close(warmedUp)
+			io.WriteString(in, "get key"+Separator)
+			Eventually(out, ReadTimeout).Should(Say(EndPattern))
+		})
+		It("version, stats and quit served", func() {
+			io.WriteString(in, VersionCommand+Separator+StatsCommand+Separator+QuitCommand+Separator)
+			Eventually(out, ReadTimeout).Should(Say("%s %s"+SeparatorPattern, VersionResponse, Version))
+			Eventually(out, ReadTimeout).Should(Say(StatResponse + " uptime"))
+			Eventually(out, ReadTimeout).Should(Say(EndPattern))
+			Eventually(serveFinished, ReadTimeout).Should(BeClosed())
+		})
+	})
+
 	Context("client error", func() {
 		Input("get \r\n")
 		AssertSay(ClientErrorPattern)
 	})
 
+	Context("too many keys", func() {
+		BeforeEach(func() {
+			cMeta.MaxKeysPerGet = 2
+			mcache.On("Get", mock.Anything).Return(nil).Once()
+		})
+		Input(GetCommand + " key_0 key_1 key_2" + Separator +
+			GatCommand + " 0 key_0 key_1 key_2" + Separator +
+			GetCommand + " key_0 key_1" + Separator)
+		It("rejected before cache get", func() {
+			Eventually(out, ReadTimeout).Should(Say("%s", ClientErrorResponse+" "+ErrTooManyKeys.Error()+SeparatorPattern))
+			Eventually(out, ReadTimeout).Should(Say("%s", ClientErrorResponse+" "+ErrTooManyKeys.Error()+SeparatorPattern))
+			Eventually(out, ReadTimeout).Should(Say(EndPattern))
+		})
+	})
+
 	Context("delete", func() {
 		var key string
+		var time string
 		var noreply bool
 		var deleted bool
 		AfterEach(func() {
+			time = ""
 			noreply = false
 			deleted = false
 		})
 		JustBeforeEach(func() {
 			key = "test_key"
 			mcache.On("Delete", []byte(key)).Return(deleted)
-			input = "delete " + key
+			input = "delete " + key + time
 			if noreply {
 				input += " noreply"
 			}
@@ -153,6 +246,197 @@ var _ = Describe("Conn", func() {
 			BeforeEach(func() { deleted = true })
 			AssertSay(DeletedPattern)
 		})
+		Context("zero time", func() {
+			BeforeEach(func() {
+				time = " 0"
+				deleted = true
+			})
+			AssertSay(DeletedPattern)
+			Context("no reply", func() {
+				BeforeEach(func() { noreply = true })
+				It("not replied", func() {
+					Consistently(out).ShouldNot(Say(DeletedPattern))
+				})
+			})
+		})
+		Context("non zero time", func() {
+			BeforeEach(func() { time = " 5" })
+			JustBeforeEach(func() {
+				// cache.Cache.Delete should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			AssertSay(ClientErrorResponse + " " + regexp.QuoteMeta(ErrDelayedDelete.Error()) + SeparatorPattern)
+		})
+	})
+
+	Context("mdelete", func() {
+		var keys []string
+		BeforeEach(func() {
+			keys = []string{"key_0", "key_1", "key_2"}
+			mcache.On("Delete", []byte(keys[0])).Return(true)
+			mcache.On("Delete", []byte(keys[1])).Return(false)
+			mcache.On("Delete", []byte(keys[2])).Return(true)
+		})
+		JustBeforeEach(func() {
+			for _, k := range keys {
+				io.WriteString(in, k+Separator)
+			}
+		})
+		Context("summary", func() {
+			Input("mdelete 3" + Separator)
+			AssertSay(DeletedResponse + ` 2 ` + NotFoundResponse + ` 1` + SeparatorPattern)
+		})
+		Context("no reply", func() {
+			Input("mdelete 3 noreply" + Separator)
+			It("say nothing", func() {})
+		})
+		Context("invalid key", func() {
+			BeforeEach(func() {
+				keys = append(keys, "invalid\x7fkey")
+			})
+			Input("mdelete 4" + Separator)
+			AssertSay(ClientErrorPattern)
+		})
+	})
+
+	Context("evict", func() {
+		BeforeEach(func() {
+			mcache.On("ColdestKeys", 2).Return([]string{"key_0", "key_1"})
+			mcache.On("Delete", []byte("key_0")).Return(true)
+			mcache.On("Delete", []byte("key_1")).Return(false)
+		})
+		Input(EvictCommand + " 2" + Separator)
+		AssertSay(EvictedResponse + " 1" + SeparatorPattern)
+	})
+
+	Context("dump ops", func() {
+		Input(DumpOpsCommand + Separator)
+		Context("recording disabled", func() {
+			AssertSay(ErrorPattern)
+		})
+		Context("recording enabled", func() {
+			BeforeEach(func() {
+				cMeta.Recorder = cache.NewRecorder(2)
+				cMeta.Recorder.Record(cache.Op{Time: time.Now(), Name: "get", Keys: []string{"key_0", "key_1"}, Result: 1})
+			})
+			AssertSay(OpResponse + ` \S+ get key_0,key_1 1` + SeparatorPattern + EndPattern)
+		})
+	})
+
+	Context("rotate aof", func() {
+		Context("not supported by view", func() {
+			Input(RotateAOFCommand + Separator)
+			AssertSay(ErrorPattern)
+		})
+	})
+
+	Context("version", func() {
+		Context("ok", func() {
+			Input(VersionCommand + Separator)
+			AssertSay(VersionResponse + " " + Version + SeparatorPattern)
+		})
+		Context("extra fields", func() {
+			Input(VersionCommand + " wtf" + Separator)
+			AssertSay(ClientErrorPattern)
+		})
+	})
+
+	Context("quit", func() {
+		Context("ok", func() {
+			Input(VersionCommand + Separator + QuitCommand + Separator)
+			It("previous response flushed and connection closed", func() {
+				Eventually(out, ReadTimeout).Should(Say("%s", VersionResponse+" "+Version+SeparatorPattern))
+				Eventually(serveFinished).Should(BeClosed())
+			})
+		})
+		Context("noreply", func() {
+			Input(QuitCommand + " " + NoReplyOption + Separator)
+			It("client error, and connection is not closed", func() {
+				Eventually(out, ReadTimeout).Should(Say("%s", ClientErrorPattern))
+				Consistently(serveFinished).ShouldNot(BeClosed())
+			})
+		})
+	})
+
+	Context("stats", func() {
+		Context("counters", func() {
+			BeforeEach(func() {
+				mcache.On("Get", mock.Anything).Return(nil)
+				mcache.On("Delete", []byte("key_0")).Return(true)
+				mcache.On("Usage").Return(3, int64(100))
+				input = GetCommand + " key_0 key_1" + Separator +
+					DeleteCommand + " key_0" + Separator +
+					StatsCommand + Separator
+			})
+			AssertSay(EndPattern + DeletedResponse + SeparatorPattern +
+				StatResponse + " uptime 0" + SeparatorPattern +
+				StatResponse + ` time \d+` + SeparatorPattern +
+				StatResponse + " curr_connections 0" + SeparatorPattern +
+				StatResponse + " total_connections 0" + SeparatorPattern +
+				StatResponse + " cmd_get 2" + SeparatorPattern +
+				StatResponse + " cmd_set 0" + SeparatorPattern +
+				StatResponse + " get_hits 0" + SeparatorPattern +
+				StatResponse + " get_misses 2" + SeparatorPattern +
+				StatResponse + " delete_misses 0" + SeparatorPattern +
+				StatResponse + " delete_hits 1" + SeparatorPattern +
+				StatResponse + " curr_items 3" + SeparatorPattern +
+				StatResponse + " bytes 100" + SeparatorPattern +
+				EndPattern)
+		})
+		Context("items", func() {
+			BeforeEach(func() {
+				mcache.On("QueueStats").Return([]cache.QueueStats{{Items: 2, Age: 10}, {}, {Items: 1, Age: 1}})
+			})
+			Input(StatsCommand + " " + StatsItemsOption + Separator)
+			AssertSay(StatResponse + " items:1:number 2" + SeparatorPattern +
+				StatResponse + " items:1:age 10" + SeparatorPattern +
+				StatResponse + " items:3:number 1" + SeparatorPattern +
+				StatResponse + " items:3:age 1" + SeparatorPattern +
+				EndPattern)
+		})
+		Context("slabs", func() {
+			var data *recycle.Data
+			BeforeEach(func() {
+				data, _ = cMeta.Pool.ReadData(strings.NewReader(strings.Repeat("x", 100)), 100)
+			})
+			AfterEach(func() { data.Recycle() })
+			Input(StatsCommand + " " + StatsSlabsOption + Separator)
+			AssertSay(StatResponse + " 1:chunk_size 128" + SeparatorPattern +
+				StatResponse + " 1:total_pages 1" + SeparatorPattern +
+				StatResponse + " 1:used_chunks 1" + SeparatorPattern +
+				StatResponse + " active_slabs 1" + SeparatorPattern +
+				StatResponse + " total_malloced 128" + SeparatorPattern +
+				StatResponse + ` pool_allocated_chunks \d+` + SeparatorPattern +
+				StatResponse + " pool_recycled_chunks 0" + SeparatorPattern +
+				StatResponse + " pool_dropped_chunks 0" + SeparatorPattern +
+				StatResponse + " pool_gc_chunks 0" + SeparatorPattern +
+				EndPattern)
+		})
+		Context("cachedump", func() {
+			BeforeEach(func() {
+				mcache.On("QueueItems", 2, 5).Return([]cache.ItemMeta{
+					{Key: "key_0", Bytes: 10, Exptime: 0},
+					{Key: "key_1", Bytes: 3, Exptime: 1500000000},
+				})
+			})
+			Input(StatsCommand + " " + StatsCachedumpOption + " 3 5" + Separator)
+			AssertSay(ItemResponse + ` key_0 \[10 b; 0 s\]` + SeparatorPattern +
+				ItemResponse + ` key_1 \[3 b; 1500000000 s\]` + SeparatorPattern +
+				EndPattern)
+		})
+		Context("cachedump of invalid class", func() {
+			BeforeEach(func() { mcache.ExpectedCalls = nil })
+			Input(StatsCommand + " " + StatsCachedumpOption + " 4 5" + Separator)
+			AssertSay(ClientErrorPattern)
+		})
+		Context("extra fields", func() {
+			Input(StatsCommand + " items wtf" + Separator)
+			AssertSay(ClientErrorPattern)
+		})
+		Context("unknown subcommand", func() {
+			Input(StatsCommand + " wtf" + Separator)
+			AssertSay(ClientErrorPattern)
+		})
 	})
 
 	Context("set", func() {
@@ -202,6 +486,299 @@ var _ = Describe("Conn", func() {
 			})
 			AssertSay(ClientErrorPattern)
 		})
+		Context("reserved key prefix", func() {
+			BeforeEach(func() { cMeta.RejectKeyPrefixes = []string{"internal:", "test_"} })
+			JustBeforeEach(func() {
+				// cache.Cache.Set should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			AssertSay(ClientErrorResponse + " " + ErrReservedKeyPrefix.Error() + SeparatorPattern)
+		})
+		Context("not reserved key prefix", func() {
+			BeforeEach(func() { cMeta.RejectKeyPrefixes = []string{"internal:"} })
+			AssertSay(StoredPattern)
+		})
+		Context("too large for cache", func() {
+			BeforeEach(func() {
+				cMeta.CacheSize = 1 << 10
+				meta.Bytes = 1 << 10
+			})
+			JustBeforeEach(func() {
+				// cache.Cache.Set should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			AssertSay(ServerErrorResponse + " " + ErrTooLargeForCache.Error() + SeparatorPattern)
+		})
+		Context("out of memory", func() {
+			BeforeEach(func() {
+				meta.Bytes = 2
+				cMeta.Pool.SetMemoryBudget(1)
+			})
+			JustBeforeEach(func() {
+				// cache.Cache.Set should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			AssertSay(ServerErrorPattern)
+		})
+		Context("max item size lowered", func() {
+			BeforeEach(func() {
+				cMeta.EnableMaxItemSizeCommand = true
+				meta.Bytes = 2
+				input = fmt.Sprintf("%s %v%s", MaxItemSizeCommand, meta.Bytes-1, Separator)
+			})
+			JustBeforeEach(func() {
+				// cache.Cache.Set should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			It("too large", func() {
+				Eventually(out, ReadTimeout).Should(Say(OkResponse + SeparatorPattern))
+				Eventually(out, ReadTimeout).Should(Say(ClientErrorPattern))
+			})
+		})
+		Context("max item size raised", func() {
+			BeforeEach(func() {
+				cMeta.EnableMaxItemSizeCommand = true
+				meta.Bytes = cMeta.MaxItemSize + 1
+				input = fmt.Sprintf("%s %v%s", MaxItemSizeCommand, meta.Bytes, Separator)
+			})
+			It("stored", func() {
+				Eventually(out, ReadTimeout).Should(Say(OkResponse + SeparatorPattern))
+				Eventually(out, ReadTimeout).Should(Say(StoredPattern))
+			})
+		})
+	})
+
+	Context("add", func() {
+		var stored bool
+		JustBeforeEach(func() {
+			mcache.On("Add", mock.Anything).Return(func(i cache.Item) bool {
+				Expect(i.Key).To(Equal("test_key"))
+				Expect(ReadAll(&i)).To(BeEquivalentTo("x"))
+				return stored
+			})
+		})
+		Input(AddCommand + " test_key 1 0 1" + Separator + "x" + Separator + NoopCommand + Separator)
+		Context("stored", func() {
+			BeforeEach(func() { stored = true })
+			AssertSay(StoredPattern + EndPattern)
+		})
+		Context("not stored", func() {
+			BeforeEach(func() { stored = false })
+			AssertSay(NotStoredPattern + EndPattern)
+		})
+	})
+
+	Context("replace", func() {
+		var (
+			meta   cache.ItemMeta
+			stored bool
+		)
+		BeforeEach(func() {
+			meta.Key = "test_key"
+			meta.Exptime = Rand.Int63n(time.Now().Unix()) + MaxRelativeExptime
+			meta.Flags = Rand.Uint32()
+			meta.Bytes = Rand.Intn(cMeta.MaxItemSize)
+		})
+		JustBeforeEach(func() {
+			data := make([]byte, meta.Bytes)
+			io.ReadFull(Rand, data)
+			mcache.On("Replace", mock.Anything).Return(func(i cache.Item) bool {
+				Expect(i.ItemMeta).To(Equal(meta))
+				ExpectBytesEqual(ReadAll(&i), data)
+				return stored
+			})
+			// Noop checks that data block is read, and next command is parsed correctly.
+			input = fmt.Sprintf("%s %s %v %v %v%s%s%s%s%s", ReplaceCommand,
+				meta.Key, meta.Flags, meta.Exptime, meta.Bytes, Separator, data, Separator, NoopCommand, Separator)
+			io.WriteString(in, input)
+		})
+
+		Context("stored", func() {
+			BeforeEach(func() { stored = true })
+			AssertSay(StoredPattern + EndPattern)
+		})
+		Context("not stored", func() {
+			BeforeEach(func() { stored = false })
+			AssertSay(NotStoredPattern + EndPattern)
+		})
+		Context("too large item", func() {
+			BeforeEach(func() { meta.Bytes = cMeta.MaxItemSize + 1 })
+			JustBeforeEach(func() {
+				// cache.Cache.Replace should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			AssertSay(ClientErrorPattern + EndPattern)
+		})
+	})
+
+	Context("gets", func() {
+		var it *cache.Item
+		BeforeEach(func() {
+			it = &cache.Item{ItemMeta: cache.ItemMeta{Key: "test_key", Flags: 1, Bytes: 1, CAS: 42}}
+			it.Data, _ = cMeta.Pool.ReadData(strings.NewReader("x"), it.Bytes)
+			mcache.On("Get", mock.Anything).Return(func(...[]byte) []cache.ItemView {
+				return []cache.ItemView{it.NewView()}
+			})
+		})
+		AfterEach(func() { it.Data.Recycle() })
+		Context("cas unique sent", func() {
+			Input(GetsCommand + " test_key" + Separator)
+			AssertSay(ValueResponse + " test_key 1 1 42" + SeparatorPattern + "x" + SeparatorPattern + EndPattern)
+		})
+		Context("get doesn't send cas unique", func() {
+			Input(GetCommand + " test_key" + Separator)
+			AssertSay(ValueResponse + " test_key 1 1" + SeparatorPattern + "x" + SeparatorPattern + EndPattern)
+		})
+	})
+
+	Context("gat", func() {
+		var it *cache.Item
+		BeforeEach(func() {
+			it = &cache.Item{ItemMeta: cache.ItemMeta{Key: "test_key", Flags: 1, Bytes: 1, CAS: 42}}
+			it.Data, _ = cMeta.Pool.ReadData(strings.NewReader("x"), it.Bytes)
+			mcache.On("GetAndTouch", mock.Anything, mock.Anything).Return(func(exptime int64, keys ...[]byte) []cache.ItemView {
+				Expect(exptime).To(BeNumerically("~", cache.NowUnix()+100, 1))
+				Expect(keys).To(Equal([][]byte{[]byte("test_key")}))
+				return []cache.ItemView{it.NewView()}
+			})
+		})
+		AfterEach(func() { it.Data.Recycle() })
+		Context("gat", func() {
+			Input(GatCommand + " 100 test_key" + Separator)
+			AssertSay(ValueResponse + " test_key 1 1" + SeparatorPattern + "x" + SeparatorPattern + EndPattern)
+		})
+		Context("gats sends cas unique", func() {
+			Input(GatsCommand + " 100 test_key" + Separator)
+			AssertSay(ValueResponse + " test_key 1 1 42" + SeparatorPattern + "x" + SeparatorPattern + EndPattern)
+		})
+		Context("no keys", func() {
+			Input(GatCommand + " 100" + Separator)
+			JustBeforeEach(func() {
+				// cache.Cache.GetAndTouch should not be called.
+				mcache.ExpectedCalls = nil
+			})
+			AssertSay(ClientErrorPattern)
+		})
+	})
+
+	Context("gat with zero exptime", func() {
+		var it *cache.Item
+		BeforeEach(func() {
+			it = &cache.Item{ItemMeta: cache.ItemMeta{Key: "test_key", Flags: 1, Bytes: 1}}
+			it.Data, _ = cMeta.Pool.ReadData(strings.NewReader("x"), it.Bytes)
+			mcache.On("GetAndTouch", int64(0), mock.Anything).Return(func(int64, ...[]byte) []cache.ItemView {
+				return []cache.ItemView{it.NewView()}
+			})
+		})
+		AfterEach(func() { it.Data.Recycle() })
+		Input(GatCommand + " 0 test_key" + Separator)
+		AssertSay(ValueResponse + " test_key 1 1" + SeparatorPattern + "x" + SeparatorPattern + EndPattern)
+	})
+
+	Context("cas", func() {
+		var (
+			result cache.CasResult
+			casID  uint64
+		)
+		BeforeEach(func() {
+			casID = Rand.Uint64()
+			input = fmt.Sprintf("%s test_key 1 0 1 %v%sx%s%s%s", CasCommand, casID, Separator, Separator, NoopCommand, Separator)
+		})
+		JustBeforeEach(func() {
+			mcache.On("Cas", mock.Anything, casID).Return(func(i cache.Item, _ uint64) cache.CasResult {
+				Expect(i.Key).To(Equal("test_key"))
+				Expect(ReadAll(&i)).To(BeEquivalentTo("x"))
+				return result
+			})
+		})
+		Context("stored", func() {
+			BeforeEach(func() { result = cache.CasStored })
+			AssertSay(StoredPattern + EndPattern)
+		})
+		Context("exists", func() {
+			BeforeEach(func() { result = cache.CasExists })
+			AssertSay(ExistsResponse + SeparatorPattern + EndPattern)
+		})
+		Context("not found", func() {
+			BeforeEach(func() { result = cache.CasNotFound })
+			AssertSay(NotFoundResponse + SeparatorPattern + EndPattern)
+		})
+	})
+
+	Context("incr", func() {
+		key := []byte("test_key")
+		var (
+			method            string
+			newVal            uint64
+			found, notNumeric bool
+		)
+		BeforeEach(func() {
+			method = "Incr"
+			newVal, found, notNumeric = 0, true, false
+		})
+		JustBeforeEach(func() {
+			mcache.On(method, key, uint64(5)).Return(newVal, found, notNumeric)
+		})
+		Context("incremented", func() {
+			BeforeEach(func() { newVal = 42 })
+			Input(IncrCommand + " test_key 5" + Separator)
+			AssertSay("42" + SeparatorPattern)
+		})
+		Context("decremented", func() {
+			BeforeEach(func() {
+				method = "Decr"
+				newVal = 42
+			})
+			Input(DecrCommand + " test_key 5" + Separator)
+			AssertSay("42" + SeparatorPattern)
+		})
+		Context("not found", func() {
+			BeforeEach(func() { found = false })
+			Input(IncrCommand + " test_key 5" + Separator)
+			AssertSay(NotFoundResponse + SeparatorPattern)
+		})
+		Context("not numeric", func() {
+			BeforeEach(func() { notNumeric = true })
+			Input(IncrCommand + " test_key 5" + Separator)
+			AssertSay(ClientErrorResponse + " " + ErrNotNumeric.Error() + SeparatorPattern)
+		})
+		Context("invalid delta", func() {
+			JustBeforeEach(func() { mcache.ExpectedCalls = nil })
+			Input(IncrCommand + " test_key -5" + Separator)
+			AssertSay(ClientErrorPattern)
+		})
+		Context("no reply", func() {
+			BeforeEach(func() { newVal = 42 })
+			Input(IncrCommand + " test_key 5 noreply" + Separator + NoopCommand + Separator)
+			AssertSay("^" + EndPattern)
+		})
+	})
+
+	Context("max item size", func() {
+		Context("disabled", func() {
+			Input(fmt.Sprintf("%s %v%s", MaxItemSizeCommand, 1, Separator))
+			AssertSay("^" + ErrorResponse + SeparatorPattern)
+		})
+		Context("enabled", func() {
+			BeforeEach(func() { cMeta.EnableMaxItemSizeCommand = true })
+			Context("too large", func() {
+				Input(fmt.Sprintf("%s %v%s", MaxItemSizeCommand, MaxItemSize+1, Separator))
+				AssertSay(ClientErrorPattern)
+			})
+			Context("raised above configured", func() {
+				Input(fmt.Sprintf("%s %v%s", MaxItemSizeCommand, DefaultMaxItemSize+1, Separator))
+				AssertSay(OkResponse + SeparatorPattern)
+			})
+			Context("not fitting in cache", func() {
+				BeforeEach(func() { cMeta.CacheSize = 4 << 20 })
+				Input(fmt.Sprintf("%s %v%s", MaxItemSizeCommand, 4<<20, Separator))
+				AssertSay(ClientErrorResponse + " " + ErrTooLargeForCache.Error() + SeparatorPattern)
+			})
+			Context("lowered", func() {
+				Input(fmt.Sprintf("%s %v%s", MaxItemSizeCommand, 1, Separator))
+				AssertSay(OkResponse + SeparatorPattern)
+			})
+		})
 	})
 
 	Context("get", func() {
@@ -211,11 +788,15 @@ var _ = Describe("Conn", func() {
 			items      []*cache.Item
 			keys       [][]byte
 			leak       chan *recycle.Data
+			command    string
+			tail       string
 		)
 
 		BeforeEach(func() {
 			leak = make(chan *recycle.Data)
 			cMeta.Pool.SetLeakCallback(recycle.NotifyOnLeak(leak))
+			command = GetCommand
+			tail = ""
 		})
 		AfterEach(func() {
 			kn = 0
@@ -266,11 +847,11 @@ var _ = Describe("Conn", func() {
 				}
 				return
 			})
-			input = "get"
+			input = command
 			for _, k := range keys {
 				input += " " + string(k)
 			}
-			input += Separator
+			input += Separator + tail
 			io.WriteString(in, input)
 		})
 
@@ -284,6 +865,260 @@ var _ = Describe("Conn", func() {
 				foundItems = []int{0, 2, 4}
 			})
 			AssertGotExpectedItems()
+			Context("response backlog exceeded", func() {
+				BeforeEach(func() { cMeta.MaxResponseBacklog = 1 })
+				AssertSay(ServerErrorResponse + " " + ErrBacklogExceeded.Error() + SeparatorPattern)
+			})
+		})
+		Context("quiet", func() {
+			BeforeEach(func() {
+				command = GetQuietCommand
+				kn = 5
+				foundItems = []int{1, 3}
+			})
+			Context("terminated by noop", func() {
+				BeforeEach(func() { tail = NoopCommand + Separator })
+				AssertGotExpectedItems()
+			})
+			Context("flush per command", func() {
+				BeforeEach(func() { cMeta.FlushPerCommand = true })
+				It("values sent without noop", func() {
+					for i := range foundItems {
+						out.ExpectItem(items[i])
+					}
+				})
+			})
+		})
+	})
+})
+
+var _ = Describe("Conn banner", func() {
+	const banner = "test banner"
+	var (
+		client net.Conn
+		c      *conn
+	)
+	BeforeEach(func() {
+		var server net.Conn
+		server, client = net.Pipe()
+		cMeta := &ConnMeta{Banner: banner}
+		cMeta.init()
+		c = newConn(log.NewLogger(log.DebugLevel, GinkgoWriter), cMeta, &cachemocks.Cache{}, server)
+		go c.serve()
+	})
+	AfterEach(func() { client.Close() })
+
+	It("not sent on connect", func() {
+		go io.WriteString(client, NoopCommand+Separator)
+		line, err := bufio.NewReader(client).ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(EndResponse + Separator))
+	})
+
+	It("sent once before first version response", func() {
+		go io.WriteString(client, VersionCommand+Separator+VersionCommand+Separator)
+		r := bufio.NewReader(client)
+		for _, expected := range []string{banner, VersionResponse + " " + Version, VersionResponse + " " + Version} {
+			line, err := r.ReadString('\n')
+			Expect(err).To(BeNil())
+			Expect(line).To(Equal(expected + Separator))
+		}
+	})
+})
+
+var _ = Describe("Conn chunked write", func() {
+	var (
+		client, server net.Conn
+		cMeta          *ConnMeta
+		mcache         *cachemocks.Cache
+		c              *conn
+		it             *cache.Item
+		reason         closeReason
+		loopFinished   chan struct{}
+	)
+	BeforeEach(func() {
+		server, client = net.Pipe()
+		cMeta = &ConnMeta{}
+		cMeta.init()
+		mcache = &cachemocks.Cache{}
+		c = newConn(log.NewLogger(log.DebugLevel, GinkgoWriter), cMeta, mcache, server)
+		it = &cache.Item{ItemMeta: cache.ItemMeta{Key: "test_key", Bytes: 3*WriteChunkSize + 1}}
+		it.Data, _ = cMeta.Pool.ReadData(FastRand, it.Bytes)
+		mcache.On("Get", mock.Anything).Return(func(...[]byte) []cache.ItemView {
+			return []cache.ItemView{it.NewView()}
+		})
+		loopFinished = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			reason, _ = c.loop()
+			close(loopFinished)
+		}()
+	})
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+		Eventually(loopFinished).Should(BeClosed())
+		it.Data.Recycle()
+	})
+
+	It("value larger than chunk written completely", func() {
+		_, err := io.WriteString(client, GetCommand+" test_key"+Separator)
+		Expect(err).To(BeNil())
+		r := bufio.NewReader(client)
+		line, err := r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(fmt.Sprintf("%s test_key 0 %v%s", ValueResponse, it.Bytes, Separator)))
+		data := make([]byte, it.Bytes)
+		_, err = io.ReadFull(r, data)
+		Expect(err).To(BeNil())
+		ExpectBytesEqual(data, ReadAll(it))
+		line, err = r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(Separator))
+		line, err = r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(EndResponse + Separator))
+	})
+
+	It("connection closed, when client doesn't read for write timeout", func() {
+		cMeta.WriteTimeout = 50 * time.Millisecond
+		_, err := io.WriteString(client, GetCommand+" test_key"+Separator)
+		Expect(err).To(BeNil())
+		// Client doesn't read response, so write blocks.
+		Eventually(loopFinished, ReadTimeout).Should(BeClosed())
+		Expect(reason).To(Equal(closeWriteError))
+	})
+})
+
+var _ = Describe("Conn close reason", func() {
+	var (
+		client, server net.Conn
+		c              *conn
+		reason         closeReason
+		loopErr        error
+		loopFinished   chan struct{}
+	)
+	BeforeEach(func() {
+		server, client = net.Pipe()
+		cMeta := &ConnMeta{}
+		cMeta.init()
+		c = newConn(log.NewLogger(log.DebugLevel, GinkgoWriter), cMeta, &cachemocks.Cache{}, server)
+		loopFinished = make(chan struct{})
+	})
+	JustBeforeEach(func() {
+		go func() {
+			defer GinkgoRecover()
+			reason, loopErr = c.loop()
+			close(loopFinished)
+		}()
+	})
+	AfterEach(func() {
+		client.Close()
+		server.Close()
+	})
+
+	It("client eof", func() {
+		client.Close()
+		Eventually(loopFinished).Should(BeClosed())
+		Expect(loopErr).To(BeNil())
+		Expect(reason).To(Equal(closeClientEOF))
+	})
+
+	It("client eof in the middle of command", func() {
+		_, err := io.WriteString(client, "noo")
+		Expect(err).To(BeNil())
+		client.Close()
+		Eventually(loopFinished).Should(BeClosed())
+		Expect(loopErr).NotTo(BeNil())
+		Expect(reason).To(Equal(closeClientEOF))
+	})
+
+	Context("client eof in set", func() {
+		It("after header", func() {
+			_, err := io.WriteString(client, "set key 0 0 10"+Separator)
+			Expect(err).To(BeNil())
+			client.Close()
+			Eventually(loopFinished).Should(BeClosed())
+			Expect(loopErr).To(BeNil())
+			Expect(reason).To(Equal(closeClientEOF))
+		})
+		It("in the middle of data block", func() {
+			_, err := io.WriteString(client, "set key 0 0 10"+Separator+"abc")
+			Expect(err).To(BeNil())
+			client.Close()
+			Eventually(loopFinished).Should(BeClosed())
+			Expect(loopErr).To(BeNil())
+			Expect(reason).To(Equal(closeClientEOF))
+		})
+	})
+
+	Context("read timeout", func() {
+		BeforeEach(func() { server.SetReadDeadline(time.Now()) })
+		It("", func() {
+			Eventually(loopFinished).Should(BeClosed())
+			Expect(loopErr).NotTo(BeNil())
+			Expect(reason).To(Equal(closeReadTimeout))
 		})
 	})
+
+	It("write error", func() {
+		_, err := io.WriteString(client, NoopCommand+Separator)
+		Expect(err).To(BeNil())
+		client.Close()
+		Eventually(loopFinished).Should(BeClosed())
+		Expect(loopErr).NotTo(BeNil())
+		Expect(reason).To(Equal(closeWriteError))
+	})
 })
+
+var _ = Describe("value header", func() {
+	meta := cache.ItemMeta{Key: "test_key", Flags: 1 << 31, Bytes: 1 << 20, CAS: 1 << 40}
+	It("without CAS", func() {
+		Expect(string(appendValueHeader(nil, meta, false))).To(Equal(
+			ValueResponse + " test_key " + fmt.Sprint(meta.Flags) + " " + fmt.Sprint(meta.Bytes) + Separator))
+	})
+	It("with CAS", func() {
+		Expect(string(appendValueHeader([]byte("prefix"), meta, true))).To(Equal("prefix" +
+			ValueResponse + " test_key " + fmt.Sprint(meta.Flags) + " " + fmt.Sprint(meta.Bytes) + " " + fmt.Sprint(meta.CAS) + Separator))
+	})
+})
+
+// BenchmarkValueHeader measures VALUE line formatting into reused buffer. It should not allocate.
+func BenchmarkValueHeader(b *testing.B) {
+	meta := cache.ItemMeta{Key: "bench_key", Flags: 1 << 31, Bytes: 1 << 20, CAS: 1 << 40}
+	buf := appendValueHeader(nil, meta, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = appendValueHeader(buf[:0], meta, true)
+	}
+}
+
+// BenchmarkMultiGet measures response of 100 keys get with small values, without network.
+func BenchmarkMultiGet(b *testing.B) {
+	const keysNum = 100
+	l := log.NewLogger(log.ErrorLevel, ioutil.Discard)
+	c := cache.NewLRU(l, cache.Config{Size: 1 << 20})
+	cMeta := &ConnMeta{}
+	cMeta.init()
+	var keys [][]byte
+	for i := 0; i < keysNum; i++ {
+		key := "bench_key_" + strconv.Itoa(i)
+		keys = append(keys, []byte(key))
+		data, _ := cMeta.Pool.ReadData(strings.NewReader("value"), 5)
+		c.Set(cache.Item{ItemMeta: cache.ItemMeta{Key: key, Flags: 1 << 30, Bytes: 5}, Data: data})
+	}
+	rwc := struct {
+		io.ReadCloser
+		io.Writer
+	}{ioutil.NopCloser(strings.NewReader("")), ioutil.Discard}
+	conn := newConn(l, cMeta, c, rwc)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := conn.sendGetResponse(c.Get(keys...), true)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
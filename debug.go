@@ -0,0 +1,124 @@
+package memcached
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// debugShutdownTimeout is time given to debug requests in progress on server stop.
+const debugShutdownTimeout = time.Second
+
+// startDebugServer serves net/http/pprof handlers, /stats JSON endpoint
+// and /metrics Prometheus endpoint on DebugAddr.
+// Debug server errors are not fatal for memcached server, so they are only logged.
+func (s *Server) startDebugServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/stats", s.serveDebugStats)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	s.debugServer = &http.Server{Addr: s.DebugAddr, Handler: mux}
+	go func() {
+		s.Log.Infof("Serve debug on %s.", s.DebugAddr)
+		err := s.debugServer.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			s.Log.Error("Debug server error: ", err)
+		}
+	}()
+}
+
+func (s *Server) stopDebugServer() {
+	ctx, cancel := context.WithTimeout(context.Background(), debugShutdownTimeout)
+	defer cancel()
+	err := s.debugServer.Shutdown(ctx)
+	if err != nil {
+		s.Log.Error("Debug server shutdown error: ", err)
+	}
+}
+
+// serveDebugStats writes same counters as StatsCommand, and pool counters, as JSON object.
+func (s *Server) serveDebugStats(w http.ResponseWriter, r *http.Request) {
+	stats := append(s.Stats.stats(), poolStats(s.Pool.Stats())...)
+	if s.isWarmedUp() {
+		if view, ok := s.NewCacheView().(usageView); ok {
+			items, size := view.Usage()
+			stats = append(stats, stat{"curr_items", items}, stat{"bytes", size})
+		}
+	}
+	if s.CacheMetrics != nil {
+		stats = append(stats, cacheStats(s.CacheMetrics.Load())...)
+	}
+	obj := make(map[string]interface{}, len(stats))
+	for _, st := range stats {
+		obj[st.name] = st.value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(obj)
+	if err != nil {
+		s.Log.Error("Debug stats write error: ", err)
+	}
+}
+
+// evictionsView is cache.View that can return number of evicted items.
+type evictionsView interface {
+	Evictions() int64
+}
+
+// metric is single sample of Prometheus text exposition format.
+type metric struct {
+	name  string
+	typ   string // Prometheus metric type: counter or gauge.
+	help  string
+	value int64
+}
+
+func (m metric) writeTo(w io.Writer) (err error) {
+	_, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	return
+}
+
+// serveMetrics writes server and cache counters in Prometheus text exposition format.
+// Cache metrics are written only after warm up.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	ps := s.Pool.Stats()
+	metrics := []metric{
+		{"memcached_get_hits_total", "counter", "Number of keys found by get commands.", atomic.LoadInt64(&s.Stats.GetHits)},
+		{"memcached_get_misses_total", "counter", "Number of keys not found by get commands.", atomic.LoadInt64(&s.Stats.GetMisses)},
+		{"memcached_pool_allocated_chunks_total", "counter", "Number of data chunks allocated on pool miss.", ps.AllocatedChunks},
+		{"memcached_pool_recycled_chunks_total", "counter", "Number of data chunks returned into pool.", ps.RecycledChunks},
+		{"memcached_pool_dropped_chunks_total", "counter", "Number of recycled data chunks left to GC, because pool is full.", ps.DroppedChunks},
+		{"memcached_pool_gc_chunks_total", "counter", "Number of small data chunks bypassing pool.", ps.GCChunks},
+	}
+	if s.isWarmedUp() {
+		view := s.NewCacheView()
+		if uv, ok := view.(usageView); ok {
+			items, size := uv.Usage()
+			metrics = append(metrics,
+				metric{"memcached_items", "gauge", "Number of items in cache.", int64(items)},
+				metric{"memcached_bytes", "gauge", "Total size of items in cache.", size},
+			)
+		}
+		if ev, ok := view.(evictionsView); ok {
+			metrics = append(metrics, metric{"memcached_evictions_total", "counter", "Number of evicted items.", ev.Evictions()})
+		}
+		if s.aofRotations != nil {
+			metrics = append(metrics, metric{"memcached_aof_rotations_total", "counter", "Number of finished AOF rotations.", s.aofRotations()})
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		if err := m.writeTo(w); err != nil {
+			s.Log.Error("Metrics write error: ", err)
+			return
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -66,6 +67,30 @@ func RandSizeItem() *memcache.Item {
 	return NewItem(Rand.Intn(1 << 10))
 }
 
+// BinaryItems returns items with values, that contain protocol separators, responses and null bytes.
+// Data block is read by length, so such values should pass through unchanged.
+func BinaryItems() (items []*memcache.Item) {
+	values := []string{
+		"\r\n",
+		"\r\n\r\n",
+		"\r",
+		"\n",
+		"\x00",
+		"\x00\r\n\x00",
+		"END\r\n",
+		"VALUE key 0 5\r\nabcde\r\nEND\r\n",
+		"set key 0 0 1\r\nx\r\n",
+		// Separator on input buffer boundary.
+		strings.Repeat("x", memcached.InBufferSize-1) + "\r\n" + strings.Repeat("\x00", 100),
+	}
+	for _, v := range values {
+		it := NewItem(0)
+		it.Value = []byte(v)
+		items = append(items, it)
+	}
+	return
+}
+
 func ExpectItemsEqualWithOffset(off int, a, b *memcache.Item) {
 	off++
 	ExpectWithOffset(off, a.Key).To(Equal(b.Key))
@@ -103,6 +103,26 @@ var _ = Describe("Integration", func() {
 			Expect(err).To(Equal(memcache.ErrCacheMiss))
 		})
 
+		It("empty value", func() {
+			set := RandSizeItem()
+			set.Value = []byte{}
+			err = c.Set(set)
+			Expect(err).To(BeNil())
+			get, err := c.Get(set.Key)
+			Expect(err).To(BeNil())
+			ExpectItemsEqual(get, set)
+		})
+
+		It("binary values", func() {
+			for _, set := range BinaryItems() {
+				err = c.Set(set)
+				Expect(err).To(BeNil())
+				get, err := c.Get(set.Key)
+				Expect(err).To(BeNil())
+				ExpectItemsEqual(get, set)
+			}
+		})
+
 		It("multi get", func() {
 			var keys []string
 			items := map[string]*memcache.Item{}
@@ -180,6 +200,39 @@ var _ = Describe("Integration", func() {
 			Expect(err).ToNot(HaveOccurred())
 			ExpectItemsEqual(get, set)
 		})
+		It("empty value recover", func() {
+			set := RandSizeItem()
+			set.Value = []byte{}
+			err = c.Set(set)
+			Expect(err).ToNot(HaveOccurred())
+
+			session.Interrupt().Wait(SessionWaitTime)
+			Expect(session).To(Exit(0))
+			StartMemcached()
+			Connect()
+
+			get, err := c.Get(set.Key)
+			Expect(err).ToNot(HaveOccurred())
+			ExpectItemsEqual(get, set)
+		})
+		It("binary values recover", func() {
+			items := BinaryItems()
+			for _, set := range items {
+				err = c.Set(set)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			session.Interrupt().Wait(SessionWaitTime)
+			Expect(session).To(Exit(0))
+			StartMemcached()
+			Connect()
+
+			for _, set := range items {
+				get, err := c.Get(set.Key)
+				Expect(err).ToNot(HaveOccurred())
+				ExpectItemsEqual(get, set)
+			}
+		})
 		Context("input much larger that chache size", func() {
 			var (
 				its    []*memcache.Item
@@ -188,6 +241,7 @@ var _ = Describe("Integration", func() {
 
 			BeforeEach(func() {
 				inConf.CacheSize = "64k"
+				inConf.MaxItemSize = "16k" // Default doesn't fit in such small cache.
 				inConf.LogLevel = "info"
 			})
 			JustBeforeEach(func() {
@@ -6,6 +6,7 @@ func IsZero(i interface{}) bool {
 	return IsZeroVal(reflect.ValueOf(i))
 }
 
+// IsZeroVal works with not comparable types too. Slices and maps are zero only if nil.
 func IsZeroVal(v reflect.Value) bool {
-	return v.Interface() == reflect.Zero(v.Type()).Interface()
+	return v.IsZero()
 }
@@ -0,0 +1,91 @@
+package log
+
+import (
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// AsyncSink is Sink that enqueues entries and writes them to inner Sink in background goroutine.
+// It decouples logging latency from caller, what is important on chatty debug level.
+// Caller file and line are resolved on Output call and prepended to message,
+// because inner sink call depth is meaningless in background goroutine.
+// Inner sink is called with zero call depth, so it should not add them itself
+// (stdlib log.Lshortfile flag should not be set).
+type AsyncSink struct {
+	inner   Sink
+	lines   chan asyncEntry
+	drop    bool
+	dropped int64 // Atomic.
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+var _ Sink = (*AsyncSink)(nil)
+
+type asyncEntry struct {
+	level  Level
+	fields Fields
+	msg    string
+}
+
+// NewAsyncSink returns AsyncSink that blocks Output callers when buffer of bufLines is full.
+func NewAsyncSink(inner Sink, bufLines int) *AsyncSink {
+	return newAsyncSink(inner, bufLines, false)
+}
+
+// NewDroppingAsyncSink returns AsyncSink that drops lines when buffer of bufLines is full.
+func NewDroppingAsyncSink(inner Sink, bufLines int) *AsyncSink {
+	return newAsyncSink(inner, bufLines, true)
+}
+
+func newAsyncSink(inner Sink, bufLines int, drop bool) *AsyncSink {
+	s := &AsyncSink{
+		inner: inner,
+		lines: make(chan asyncEntry, bufLines),
+		drop:  drop,
+		done:  make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+func (s *AsyncSink) Output(callDepth int, level Level, fields Fields, msg string) error {
+	if _, file, lineNum, ok := runtime.Caller(callDepth); ok {
+		msg = filepath.Base(file) + ":" + strconv.Itoa(lineNum) + ": " + msg
+	}
+	entry := asyncEntry{level, fields, msg}
+	if !s.drop {
+		s.lines <- entry
+		return nil
+	}
+	select {
+	case s.lines <- entry:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+	return nil
+}
+
+// Dropped returns number of lines dropped because of full buffer.
+func (s *AsyncSink) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close writes all enqueued lines and stops background goroutine.
+// Output must not be called after Close.
+func (s *AsyncSink) Close() error {
+	s.closeOnce.Do(func() { close(s.lines) })
+	<-s.done
+	return nil
+}
+
+func (s *AsyncSink) loop() {
+	defer close(s.done)
+	for e := range s.lines {
+		s.inner.Output(0, e.level, e.fields, e.msg)
+	}
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// JSONSink is Sink that writes every entry into w as JSON object followed by new line:
+// {"level":"INFO","time":"2006-01-02T15:04:05.999999999Z07:00","caller":"file.go:42","msg":"message",...fields}
+// Caller is resolved only for positive call depth. Fields named as entry keys are skipped.
+type JSONSink struct {
+	lock sync.Mutex
+	w    io.Writer
+	buf  bytes.Buffer
+}
+
+var _ Sink = (*JSONSink)(nil)
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+var jsonEntryKeys = []string{"level", "time", "caller", "msg"}
+
+func (s *JSONSink) Output(callDepth int, level Level, fields Fields, msg string) (err error) {
+	now := time.Now()
+	var caller string
+	if callDepth > 0 {
+		if _, file, line, ok := runtime.Caller(callDepth); ok {
+			caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+	}
+	var fieldsData []byte
+	if len(fields) != 0 {
+		fieldsData, err = json.Marshal(withoutKeys(fields, jsonEntryKeys))
+		if err != nil {
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.buf.Reset()
+	s.buf.WriteString(`{"level":"`)
+	s.buf.WriteString(level.String())
+	s.buf.WriteString(`","time":"`)
+	s.buf.WriteString(now.Format(time.RFC3339Nano))
+	s.buf.WriteString(`"`)
+	if caller != "" {
+		s.buf.WriteString(`,"caller":`)
+		writeJSONString(&s.buf, caller)
+	}
+	s.buf.WriteString(`,"msg":`)
+	writeJSONString(&s.buf, msg)
+	if len(fieldsData) > len("{}") {
+		s.buf.WriteByte(',')
+		s.buf.Write(fieldsData[1:]) // Without opening brace.
+	} else {
+		s.buf.WriteByte('}')
+	}
+	s.buf.WriteByte('\n')
+	_, err = s.buf.WriteTo(s.w)
+	return
+}
+
+// withoutKeys returns f, or its copy without keys, if f has some of them.
+func withoutKeys(f Fields, keys []string) Fields {
+	var res Fields
+	for _, k := range keys {
+		if _, ok := f[k]; !ok {
+			continue
+		}
+		if res == nil {
+			res = make(Fields, len(f))
+			for fk, v := range f {
+				res[fk] = v
+			}
+		}
+		delete(res, k)
+	}
+	if res == nil {
+		return f
+	}
+	return res
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	data, _ := json.Marshal(s) // String marshal never fails.
+	buf.Write(data)
+}
@@ -11,9 +11,11 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
-// Logger interface is subset of github.com/uber-common/bark.Logger methods.
+// Logger interface is subset of github.com/uber-common/bark.Logger methods,
+// extended with level control.
 type Logger interface {
 	Debug(args ...interface{})
 	Debugf(format string, args ...interface{})
@@ -29,6 +31,10 @@ type Logger interface {
 	Panicf(format string, args ...interface{})
 	WithFields(keyValues LogFields) Logger
 	Fields() Fields
+	// SetLevel changes level of logger and all loggers made from it by WithFields, and vice versa.
+	// It is safe to call concurrently with logging.
+	SetLevel(l Level)
+	Level() Level
 }
 
 type LogFields interface {
@@ -83,29 +89,65 @@ func LevelFromString(s string) (l Level, err error) {
 	return
 }
 
+// Format is log output format.
+type Format string
+
+const (
+	// TextFormat is human readable line "LEVEL: {fields} msg", prefixed with time and caller.
+	TextFormat Format = "text"
+	// JSONFormat is JSON object per line. See NewJSONSink for details.
+	JSONFormat Format = "json"
+)
+
+func FormatFromString(s string) (f Format, err error) {
+	f = Format(strings.ToLower(s))
+	switch f {
+	case TextFormat, JSONFormat:
+	default:
+		err = errors.New("invalid format " + s)
+	}
+	return
+}
+
 const stdLoggerFlags = log.LstdFlags | log.Lmicroseconds | log.Lshortfile
 
 func NewLogger(l Level, w io.Writer) Logger {
-	return NewLoggerSink(l, log.New(w, "", stdLoggerFlags))
+	return NewLoggerSink(l, NewTextSink(log.New(w, "", stdLoggerFlags)))
+}
+
+func NewJSONLogger(l Level, w io.Writer) Logger {
+	return NewLoggerSink(l, NewJSONSink(w))
+}
+
+// NewFormatLogger returns logger writing into w in format f. Empty format is TextFormat.
+func NewFormatLogger(l Level, f Format, w io.Writer) Logger {
+	if f == JSONFormat {
+		return NewJSONLogger(l, w)
+	}
+	return NewLogger(l, w)
 }
 
 func NewLoggerSink(l Level, s Sink) Logger {
+	level := int32(l)
 	return &logger{
 		sink:  s,
-		level: l,
+		level: &level,
 	}
 }
 
 // logger is primitive stdlib log.Logger wrapper for more common interface.
 type logger struct {
 	sink   Sink
-	level  Level
+	level  *int32 // Atomic. Shared with loggers made by WithFields.
 	depth  int
 	fields Fields
 }
 
 func (l *logger) Fields() Fields { return l.fields }
 
+func (l *logger) SetLevel(lvl Level) { atomic.StoreInt32(l.level, int32(lvl)) }
+func (l *logger) Level() Level       { return Level(atomic.LoadInt32(l.level)) }
+
 func (l *logger) WithFields(keyValues LogFields) Logger {
 	copy := *l
 
@@ -151,27 +193,43 @@ func (l *logger) Fatalf(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// Sink writes log entries. callDepth is number of stack frames to skip from Output call to logging caller,
+// like in stdlib log.Logger.Output.
 type Sink interface {
-	Output(callDepth int, s string) error
+	Output(callDepth int, level Level, fields Fields, msg string) error
 }
 
 const initialLoggerCallDepth = 3
 
 func (l *logger) log(lvl Level, args ...interface{}) {
-	if lvl >= l.level {
-		s := render(lvl, l.fields, fmt.Sprint(args...))
-		l.sink.Output(l.depth+initialLoggerCallDepth, s)
+	if lvl >= l.Level() {
+		l.sink.Output(l.depth+initialLoggerCallDepth, lvl, l.fields, fmt.Sprint(args...))
 	}
 }
 
 func (l *logger) logf(lvl Level, format string, args ...interface{}) {
-	if lvl >= l.level {
-		s := render(lvl, l.fields, fmt.Sprintf(format, args...))
-		l.sink.Output(l.depth+initialLoggerCallDepth, s)
+	if lvl >= l.Level() {
+		l.sink.Output(l.depth+initialLoggerCallDepth, lvl, l.fields, fmt.Sprintf(format, args...))
 	}
 }
 
-func render(l Level, f Fields, msg string) string {
+// NewTextSink returns Sink that writes entries in TextFormat into stdlib logger.
+func NewTextSink(l *log.Logger) Sink {
+	return stdSink{l, formatText}
+}
+
+// stdSink formats entries into lines and writes them into stdlib logger.
+type stdSink struct {
+	logger *log.Logger
+	format func(level Level, fields Fields, msg string) string
+}
+
+func (s stdSink) Output(callDepth int, level Level, fields Fields, msg string) error {
+	// One more frame for stdSink.Output itself.
+	return s.logger.Output(callDepth+1, s.format(level, fields, msg))
+}
+
+func formatText(l Level, f Fields, msg string) string {
 	if len(f) == 0 {
 		return l.String() + ": " + msg
 	}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var buf *bytes.Buffer
+	BeforeEach(func() { buf = &bytes.Buffer{} })
+
+	Context("text", func() {
+		It("fields written", func() {
+			NewLogger(DebugLevel, buf).WithFields(Fields{"conn": 1}).Info("message")
+			Expect(buf.String()).To(MatchRegexp(`log_test.go:\d+: INFO: {"conn":1} message\n$`))
+		})
+		It("no fields", func() {
+			NewLogger(DebugLevel, buf).Warn("message")
+			Expect(buf.String()).To(HaveSuffix(": WARN: message\n"))
+		})
+		It("level filtered", func() {
+			NewLogger(InfoLevel, buf).Debug("message")
+			Expect(buf.Len()).To(BeZero())
+		})
+	})
+
+	Context("json", func() {
+		It("fields written", func() {
+			NewJSONLogger(DebugLevel, buf).WithFields(Fields{"conn": 1, "msg": "shadowed"}).Errorf("message %v", 2)
+			Expect(buf.String()).To(HaveSuffix("}\n"))
+			var entry map[string]interface{}
+			err := json.Unmarshal(buf.Bytes(), &entry)
+			Expect(err).To(BeNil())
+			Expect(entry).To(HaveKeyWithValue("level", "ERROR"))
+			Expect(entry).To(HaveKeyWithValue("msg", "message 2"))
+			Expect(entry).To(HaveKeyWithValue("conn", BeEquivalentTo(1)))
+			Expect(entry).To(HaveKey("time"))
+			Expect(entry["caller"]).To(HavePrefix("log_test.go:"))
+		})
+	})
+
+	It("async sink passes fields", func() {
+		s := NewAsyncSink(NewJSONSink(buf), 1)
+		NewLoggerSink(DebugLevel, s).WithFields(Fields{"conn": 1}).Info("message")
+		s.Close()
+		Expect(strings.Count(buf.String(), "\n")).To(Equal(1))
+		Expect(buf.String()).To(MatchRegexp(`"msg":"log_test.go:\d+: message","conn":1}\n$`))
+	})
+
+	Context("async sink with blocked inner sink", func() {
+		var inner *blockingSink
+		BeforeEach(func() { inner = newBlockingSink(NewJSONSink(buf)) })
+
+		It("dropping drops lines when buffer is full", func() {
+			s := NewDroppingAsyncSink(inner, 2)
+			l := NewLoggerSink(DebugLevel, s)
+			l.Info("taken")
+			Eventually(inner.started).Should(Receive())
+			for i := 0; i < 5; i++ {
+				l.Info("queued")
+			}
+			Expect(s.Dropped()).To(BeEquivalentTo(3))
+			close(inner.unblock)
+			s.Close()
+			Expect(strings.Count(buf.String(), "\n")).To(Equal(3))
+		})
+
+		It("close flushes queued lines", func() {
+			s := NewAsyncSink(inner, 10)
+			l := NewLoggerSink(DebugLevel, s)
+			for i := 0; i < 5; i++ {
+				l.Info("queued")
+			}
+			closed := make(chan struct{})
+			go func() {
+				s.Close()
+				close(closed)
+			}()
+			Consistently(closed).ShouldNot(BeClosed())
+			close(inner.unblock)
+			Eventually(closed).Should(BeClosed())
+			Expect(strings.Count(buf.String(), "\n")).To(Equal(5))
+		})
+	})
+})
+
+// blockingSink passes lines to inner sink after unblock is closed.
+// started is signaled on Output call.
+type blockingSink struct {
+	inner   Sink
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func newBlockingSink(inner Sink) *blockingSink {
+	return &blockingSink{inner, make(chan struct{}, 1), make(chan struct{})}
+}
+
+func (s *blockingSink) Output(callDepth int, level Level, fields Fields, msg string) error {
+	select {
+	case s.started <- struct{}{}:
+	default:
+	}
+	<-s.unblock
+	return s.inner.Output(callDepth, level, fields, msg)
+}
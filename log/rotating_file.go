@@ -0,0 +1,101 @@
+package log
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// RotatingFile is io.Writer appending into file, that is rotated when its size exceeds max size.
+// On rotation, file is renamed to "<name>.1", older backups are shifted ("<name>.1" to "<name>.2" and so on),
+// and new file is opened. Only max backups are kept, and zero max backups means that rotated file is removed.
+// Logger serializes writes itself, but RotatingFile can be shared by many loggers,
+// so writes and rotation are guarded by mutex anyway.
+type RotatingFile struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+var _ io.WriteCloser = (*RotatingFile)(nil)
+
+func OpenRotatingFile(name string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		name:       name,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write rotates file before write, if p doesn't fit in max size.
+// Data larger than max size is written into empty file as is.
+func (f *RotatingFile) Write(p []byte) (n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err = f.rotate()
+		if err != nil {
+			return
+		}
+	}
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	if f.maxBackups == 0 {
+		err = os.Remove(f.name)
+	} else {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			err = os.Rename(f.backupName(i), f.backupName(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(f.name, f.backupName(1))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) backupName(i int) string {
+	return f.name + "." + strconv.Itoa(i)
+}
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/Skipor/memcached/testutil"
+)
+
+var _ = Describe("RotatingFile", func() {
+	const maxSize = 100
+	var (
+		name string
+		f    *RotatingFile
+	)
+	BeforeEach(func() {
+		name = TmpFileName()
+	})
+	AfterEach(func() {
+		f.Close()
+		for _, n := range []string{name, name + ".1", name + ".2", name + ".3"} {
+			os.Remove(n)
+		}
+	})
+	Open := func(maxBackups int) {
+		var err error
+		f, err = OpenRotatingFile(name, maxSize, maxBackups)
+		Expect(err).To(BeNil())
+	}
+	Write := func(s string) {
+		_, err := f.Write([]byte(s))
+		Expect(err).To(BeNil())
+	}
+	ExpectFile := func(name string, data string) {
+		actual, err := ioutil.ReadFile(name)
+		Expect(err).To(BeNil())
+		Expect(string(actual)).To(Equal(data))
+	}
+	line := func(c string) string { return strings.Repeat(c, maxSize/2) }
+
+	It("no rotation below max size", func() {
+		Open(2)
+		Write(line("a"))
+		Write(line("b"))
+		ExpectFile(name, line("a")+line("b"))
+		Expect(name + ".1").NotTo(BeAnExistingFile())
+	})
+
+	It("backups shifted", func() {
+		Open(2)
+		for _, c := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			Write(line(c))
+		}
+		ExpectFile(name, line("g"))
+		ExpectFile(name+".1", line("e")+line("f"))
+		ExpectFile(name+".2", line("c")+line("d"))
+		Expect(name + ".3").NotTo(BeAnExistingFile())
+	})
+
+	It("size of existing file accounted", func() {
+		err := ioutil.WriteFile(name, []byte(line("a")+line("b")), 0644)
+		Expect(err).To(BeNil())
+		Open(1)
+		Write(line("c"))
+		ExpectFile(name, line("c"))
+		ExpectFile(name+".1", line("a")+line("b"))
+	})
+
+	It("no backups", func() {
+		Open(0)
+		Write(line("a") + line("b"))
+		Write(line("c"))
+		ExpectFile(name, line("c"))
+		Expect(name + ".1").NotTo(BeAnExistingFile())
+	})
+
+	It("logger writes rotated", func() {
+		Open(1)
+		l := NewLogger(DebugLevel, f)
+		for i := 0; i < 3; i++ {
+			l.Info(line("x"))
+		}
+		// Every line is larger than max size, so every write after first rotates file.
+		Expect(name + ".1").To(BeAnExistingFile())
+		data, err := ioutil.ReadFile(name)
+		Expect(err).To(BeNil())
+		Expect(strings.Count(string(data), "\n")).To(Equal(1))
+	})
+})
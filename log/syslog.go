@@ -0,0 +1,58 @@
+// +build !windows,!plan9
+
+package log
+
+import (
+	"log/syslog"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// NewSyslogLogger returns Logger that writes into local syslog daemon with tag.
+func NewSyslogLogger(level Level, tag string) (Logger, error) {
+	s, err := NewSyslogSink(tag)
+	if err != nil {
+		return nil, err
+	}
+	return NewLoggerSink(level, s), nil
+}
+
+// SyslogSink is Sink that writes entries into syslog at priority mapped from level.
+// Message is formatted like in TextFormat, and prefixed with caller file and line.
+type SyslogSink struct {
+	w *syslog.Writer
+}
+
+var _ Sink = (*SyslogSink)(nil)
+
+// NewSyslogSink connects to local syslog daemon. Entries are written with daemon facility and tag.
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w}, nil
+}
+
+func (s *SyslogSink) Output(callDepth int, level Level, fields Fields, msg string) error {
+	m := formatText(level, fields, msg)
+	if callDepth > 0 {
+		if _, file, line, ok := runtime.Caller(callDepth); ok {
+			m = filepath.Base(file) + ":" + strconv.Itoa(line) + ": " + m
+		}
+	}
+	switch level {
+	case DebugLevel:
+		return s.w.Debug(m)
+	case InfoLevel:
+		return s.w.Info(m)
+	case WarnLevel:
+		return s.w.Warning(m)
+	case ErrorLevel:
+		return s.w.Err(m)
+	}
+	return s.w.Crit(m)
+}
+
+func (s *SyslogSink) Close() error { return s.w.Close() }
@@ -0,0 +1,26 @@
+// +build windows plan9
+
+package log
+
+import "errors"
+
+var ErrSyslogUnsupported = errors.New("syslog is not supported on this platform")
+
+func NewSyslogLogger(level Level, tag string) (Logger, error) {
+	return nil, ErrSyslogUnsupported
+}
+
+// SyslogSink is stub for platforms without syslog.
+type SyslogSink struct{}
+
+var _ Sink = (*SyslogSink)(nil)
+
+func NewSyslogSink(tag string) (*SyslogSink, error) {
+	return nil, ErrSyslogUnsupported
+}
+
+func (s *SyslogSink) Output(callDepth int, level Level, fields Fields, msg string) error {
+	return ErrSyslogUnsupported
+}
+
+func (s *SyslogSink) Close() error { return ErrSyslogUnsupported }
@@ -1,8 +1,12 @@
 package memcached
 
 import (
+	"io"
+	"strconv"
+
 	"github.com/Skipor/memcached/aof"
 	"github.com/Skipor/memcached/cache"
+	"github.com/Skipor/memcached/recycle"
 )
 
 type logginCacheViewFabric struct {
@@ -53,16 +57,46 @@ func (v *loggingCacheView) NewGetter(raw []byte) cache.Getter {
 	}
 }
 
+func (v *loggingCacheView) NewGetAndToucher(raw []byte) cache.GetAndToucher {
+	return &lcvOperation{
+		loggingCacheView: v,
+		raw:              raw,
+	}
+}
+
 func (v *loggingCacheView) NewSetter(raw []byte) cache.Setter {
+	return v.newCopyingOperation(raw)
+}
+
+func (v *loggingCacheView) NewAdder(raw []byte) cache.Adder {
+	return v.newCopyingOperation(raw)
+}
+
+func (v *loggingCacheView) NewReplacer(raw []byte) cache.Replacer {
+	return v.newCopyingOperation(raw)
+}
+
+func (v *loggingCacheView) NewCaser(raw []byte) cache.Caser {
+	return v.newCopyingOperation(raw)
+}
+
+// newCopyingOperation returns operation with copy of raw, which can be invalidated while data block read.
+func (v *loggingCacheView) newCopyingOperation(raw []byte) *lcvOperation {
 	if v.rawCopy == nil {
 		v.rawCopy = make([]byte, 0, len(raw))
 	}
 	v.rawCopy = append(v.rawCopy[:0], raw...)
-	o := &lcvOperation{
+	return &lcvOperation{
 		loggingCacheView: v,
 		raw:              v.rawCopy,
 	}
-	return o
+}
+
+func (v *loggingCacheView) NewIncrementer(raw []byte) cache.Incrementer {
+	return &lcvOperation{
+		loggingCacheView: v,
+		raw:              raw,
+	}
 }
 
 func (v *loggingCacheView) NewDeleter(raw []byte) cache.Deleter {
@@ -83,6 +117,52 @@ func assertNoErr(err error) {
 	}
 }
 
+// ColdestKeys is not logged, because it doesn't change cache.
+func (v *loggingCacheView) ColdestKeys(n int) (keys []string) {
+	v.cache.RLock()
+	keys = v.cache.ColdestKeys(n)
+	v.cache.RUnlock()
+	return
+}
+
+// Keys is not logged, because it doesn't change cache.
+func (v *loggingCacheView) Keys(limit int) (keys [][]byte) {
+	v.cache.RLock()
+	keys = v.cache.Keys(limit)
+	v.cache.RUnlock()
+	return
+}
+
+// QueueItems is not logged, because it doesn't change cache.
+func (v *loggingCacheView) QueueItems(queue, limit int) (metas []cache.ItemMeta) {
+	v.cache.RLock()
+	metas = v.cache.QueueItems(queue, limit)
+	v.cache.RUnlock()
+	return
+}
+
+// Usage is not logged, because it doesn't change cache.
+func (v *loggingCacheView) Usage() (items int, size int64) {
+	v.cache.RLock()
+	items, size = v.cache.Usage()
+	v.cache.RUnlock()
+	return
+}
+
+// Evictions is not logged, because it doesn't change cache.
+func (v *loggingCacheView) Evictions() int64 { return v.cache.Evictions() }
+
+// RotateAOF rotates AOF synchronously. aof.ErrRotateInProcess is returned, if rotation is already in process.
+func (v *loggingCacheView) RotateAOF() error { return v.aof.Rotate() }
+
+// QueueStats is not logged, because it doesn't change cache.
+func (v *loggingCacheView) QueueStats() (stats []cache.QueueStats) {
+	v.cache.RLock()
+	stats = v.cache.QueueStats()
+	v.cache.RUnlock()
+	return
+}
+
 func (o *lcvOperation) Get(keys ...[]byte) (views []cache.ItemView) {
 	o.cache.RLock()
 	views = o.cache.Get(keys...)
@@ -102,6 +182,14 @@ func (o *lcvOperation) Get(keys ...[]byte) (views []cache.ItemView) {
 	return
 }
 
+// GetAndTouch changes items exptime, so it requires write lock, and is logged always as get.
+func (o *lcvOperation) GetAndTouch(exptime int64, keys ...[]byte) (views []cache.ItemView) {
+	o.cache.Lock()
+	views = o.cache.GetAndTouch(exptime, keys...)
+	o.logIf(true)
+	return
+}
+
 func (o *lcvOperation) Set(i cache.Item) {
 	itemReader := i.Data.NewReader()
 
@@ -110,6 +198,56 @@ func (o *lcvOperation) Set(i cache.Item) {
 	t := o.aof.NewTransaction()
 	o.cache.Unlock()
 
+	o.logItem(t, itemReader)
+}
+
+// Add logs only stored item, because not stored add doesn't change cache.
+func (o *lcvOperation) Add(i cache.Item) (stored bool) {
+	o.storeIf(i, func() bool {
+		stored = o.cache.Add(i)
+		return stored
+	})
+	return
+}
+
+// Replace logs only stored item, because not stored replace doesn't change cache.
+func (o *lcvOperation) Replace(i cache.Item) (stored bool) {
+	o.storeIf(i, func() bool {
+		stored = o.cache.Replace(i)
+		return stored
+	})
+	return
+}
+
+// Cas logs only stored item, because not stored cas doesn't change cache.
+func (o *lcvOperation) Cas(i cache.Item, casID uint64) (result cache.CasResult) {
+	o.storeIf(i, func() bool {
+		result = o.cache.Cas(i, casID)
+		return result == cache.CasStored
+	})
+	return
+}
+
+// storeIf calls store under cache lock, and logs item if it was stored.
+func (o *lcvOperation) storeIf(i cache.Item, store func() (stored bool)) {
+	itemReader := i.Data.NewReader()
+
+	o.cache.Lock()
+	if !store() {
+		o.cache.Unlock()
+		itemReader.Close()
+		o.raw = nil
+		o.loggingCacheView = nil
+		return
+	}
+	t := o.aof.NewTransaction()
+	o.cache.Unlock()
+
+	o.logItem(t, itemReader)
+}
+
+// logItem writes command with item data into transaction, and closes it.
+func (o *lcvOperation) logItem(t io.WriteCloser, itemReader *recycle.DataReader) {
 	_, err := t.Write(o.raw)
 	assertNoErr(err)
 
@@ -125,9 +263,78 @@ func (o *lcvOperation) Set(i cache.Item) {
 	itemReader.Close()
 	o.raw = nil
 	o.loggingCacheView = nil
+}
+
+// Incr logs only changed value, because replay of not changed doesn't change cache too.
+// Changed item is logged as set, same as stored add, replace and cas.
+func (o *lcvOperation) Incr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	o.cache.Lock()
+	newVal, found, notNumeric = o.cache.Incr(key, delta)
+	o.logSetIf(key, found && !notNumeric)
+	return
+}
+
+// Decr logs only changed value, same as Incr.
+func (o *lcvOperation) Decr(key []byte, delta uint64) (newVal uint64, found, notNumeric bool) {
+	o.cache.Lock()
+	newVal, found, notNumeric = o.cache.Decr(key, delta)
+	o.logSetIf(key, found && !notNumeric)
 	return
+}
+
+// logSetIf logs set of item with key, if changed is true. Cache write lock should be acquired, and is released.
+// Raw incr or decr is not logged, because item can be expired at replay time. Then replay would miss it,
+// and don't assign CAS unique, so CAS uniques assigned after replay would repeat ones, that clients have got.
+func (o *lcvOperation) logSetIf(key []byte, changed bool) {
+	var view cache.ItemView
+	if changed {
+		view, changed = o.cache.Peek(key)
+	}
+	if !changed {
+		o.logIf(false)
+		return
+	}
+	o.rawCopy = appendSetCommand(o.rawCopy[:0], view.ItemMeta)
+	o.raw = o.rawCopy
+	t := o.aof.NewTransaction()
+	o.cache.Unlock()
 
+	o.logItem(t, view.Reader)
 }
+
+// appendSetCommand appends "set <key> <flags> <exptime> <bytes>\r\n" line to b.
+// Exptime is absolute, so it is same at replay.
+func appendSetCommand(b []byte, meta cache.ItemMeta) []byte {
+	b = append(b, SetCommand...)
+	b = append(b, ' ')
+	b = append(b, meta.Key...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(meta.Flags), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, meta.Exptime, 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(meta.Bytes), 10)
+	return append(b, Separator...)
+}
+
+// logIf logs raw command, if changed is true. Cache write lock should be acquired, and is released.
+func (o *lcvOperation) logIf(changed bool) {
+	if !changed {
+		o.cache.Unlock()
+	} else {
+		t := o.aof.NewTransaction()
+		o.cache.Unlock()
+
+		_, err := t.Write(o.raw)
+		assertNoErr(err)
+
+		err = t.Close()
+		assertNoErr(err)
+	}
+	o.raw = nil
+	o.loggingCacheView = nil
+}
+
 func (o *lcvOperation) Delete(key []byte) (deleted bool) {
 	o.cache.Lock()
 	deleted = o.cache.Delete(key)
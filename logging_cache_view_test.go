@@ -2,6 +2,7 @@ package memcached
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
 
@@ -76,7 +77,7 @@ var _ = Describe("LoggingTestView", func() {
 	})
 
 	It("get", func() {
-		keys, err := parseGetFields(bytes.Fields(getRaw)[1:])
+		keys, err := parseGetFields(bytes.Fields(getRaw)[1:], 0)
 		Expect(err).To(BeNil())
 		expected := make([]cache.ItemView, 4)
 		mcache.On("Get", keys).Return(expected)
@@ -86,6 +87,18 @@ var _ = Describe("LoggingTestView", func() {
 		ExpectFileEqual(getRaw)
 	})
 
+	It("gat", func() {
+		gatRaw := []byte("gat 100 yyy xxx\r\n")
+		exptime, keys, err := parseGatFields(bytes.Fields(gatRaw)[1:], 0)
+		Expect(err).To(BeNil())
+		expected := make([]cache.ItemView, 2)
+		mcache.On("GetAndTouch", exptime, keys).Return(expected)
+		ExpectLock()
+		actual := v.NewGetAndToucher(gatRaw).GetAndTouch(exptime, keys...)
+		Expect(actual).To(Equal(expected))
+		ExpectFileEqual(gatRaw)
+	})
+
 	It("set", func() {
 		meta, _, err := parseSetFields(bytes.Fields(setRaw)[1:])
 		Expect(err).To(BeNil())
@@ -103,4 +116,54 @@ var _ = Describe("LoggingTestView", func() {
 		ExpectFileEqual(expectedData)
 	})
 
+	Context("incr", func() {
+		incrRaw := []byte("incr xxx 1\r\n")
+		key := []byte("xxx")
+		BeforeEach(ExpectLock)
+		It("changed logged as set", func() {
+			mcache.On("Incr", key, uint64(1)).Return(uint64(2), true, false)
+			data, _ := recycle.NewPool().ReadData(bytes.NewReader([]byte("2")), 1)
+			meta := cache.ItemMeta{Key: string(key), Flags: 7, Exptime: cache.NowUnix() + 100, Bytes: 1}
+			mcache.On("Peek", key).Return(cache.ItemView{ItemMeta: meta, Reader: data.NewReader()}, true)
+			newVal, _, _ := v.NewIncrementer(incrRaw).Incr(key, 1)
+			Expect(newVal).To(BeEquivalentTo(2))
+			ExpectFileEqual([]byte(fmt.Sprintf("set xxx 7 %v 1\r\n2\r\n", meta.Exptime)))
+		})
+		It("not found not logged", func() {
+			mcache.On("Decr", key, uint64(1)).Return(uint64(0), false, false)
+			v.NewIncrementer(incrRaw).Decr(key, 1)
+			ExpectFileEqual(nil)
+		})
+	})
+
+	Context("replace", func() {
+		var it cache.Item
+		BeforeEach(func() {
+			setRaw = []byte("replace key 0 0 1\r\n")
+			meta, _, err := parseSetFields(bytes.Fields(setRaw)[1:])
+			Expect(err).To(BeNil())
+			data, _ := recycle.NewPool().ReadData(bytes.NewReader(setData), len(setData))
+			it = cache.Item{
+				ItemMeta: meta,
+				Data:     data,
+			}
+			ExpectLock()
+		})
+
+		It("stored", func() {
+			expectedData := bytes.Join([][]byte{setRaw, setData, separatorBytes}, nil)
+			mcache.On("Replace", it).Return(true)
+			replacer := v.NewReplacer(setRaw)
+			setRaw[1] = 0 // Model raw invalidation
+			Expect(replacer.Replace(it)).To(BeTrue())
+			ExpectFileEqual(expectedData)
+		})
+
+		It("not stored", func() {
+			mcache.On("Replace", it).Return(false)
+			Expect(v.NewReplacer(setRaw).Replace(it)).To(BeFalse())
+			ExpectFileEqual(nil)
+		})
+	})
+
 })
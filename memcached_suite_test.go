@@ -37,6 +37,7 @@ const (
 	ClientErrorPattern = ClientErrorResponse + ` ` + ErrorMsgPattern + SeparatorPattern
 	ServerErrorPattern = ServerErrorResponse + ` ` + ErrorMsgPattern + SeparatorPattern
 	StoredPattern      = StoredResponse + SeparatorPattern
+	NotStoredPattern   = NotStoredResponse + SeparatorPattern
 	EndPattern         = EndResponse + SeparatorPattern
 	DeletedPattern     = DeletedResponse + SeparatorPattern
 	NotFoundPattern    = NotFoundResponse + SeparatorPattern
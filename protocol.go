@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"io"
 	"strconv"
-	"time"
 
 	"github.com/Skipor/memcached/cache"
 	"github.com/Skipor/memcached/recycle"
@@ -18,19 +17,75 @@ const (
 	MaxItemSize        = 128 * (1 << 20) // 128 MB.
 	DefaultMaxItemSize = 1 << 20
 	MaxCommandSize     = 1 << 12
+	// DefaultMaxKeysPerGet limits number of items pinned by single get response.
+	DefaultMaxKeysPerGet = 1 << 10
 
 	MaxRelativeExptime = 60 * 60 * 24 * 30 // 30 days.
 
 	Separator = "\r\n"
 
-	SetCommand    = "set"
+	SetCommand     = "set"
+	AddCommand     = "add"
+	ReplaceCommand = "replace"
+	// CasCommand is "cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]\r\n" followed by data block.
+	// Cas unique of item is sent in reply to GetsCommand.
+	CasCommand    = "cas"
 	GetCommand    = "get"
 	GetsCommand   = "gets"
 	DeleteCommand = "delete"
+	// GatCommand is "gat <exptime> <key>*\r\n". It gets values and sets their exptime.
+	// GatsCommand is same, but sends cas uniques like GetsCommand.
+	GatCommand  = "gat"
+	GatsCommand = "gats"
+	// IncrCommand and DecrCommand are "incr <key> <delta> [noreply]\r\n".
+	// Item value should be decimal uint64. New value is replied.
+	IncrCommand = "incr"
+	DecrCommand = "decr"
+
+	// GetQuietCommand is get that sends only found values without END and flush.
+	// Client can pipeline them and mark completion by NoopCommand.
+	GetQuietCommand = "getq"
+	// NoopCommand just sends END response.
+	NoopCommand = "noop"
+	// MultiDeleteCommand is "mdelete <count> [noreply]\r\n" followed by count lines with keys.
+	MultiDeleteCommand = "mdelete"
+	// MaxItemSizeCommand is "max_item_size <bytes>". It overrides max item size for connection.
+	// Size can be raised above configured max item size, up to MaxItemSize, if item of such size fits in cache.
+	// Command is unknown, unless Config.EnableMaxItemSizeCommand is set.
+	MaxItemSizeCommand = "max_item_size"
+	// EvictCommand is "evict <n>". It evicts up to n coldest items, and replies "EVICTED <evicted>".
+	// Evictions are passed to cache view as delete commands, so they are logged in AOF as such.
+	EvictCommand = "evict"
+	// DumpOpsCommand is "dump_ops". It replies operations recorded by cache.Recorder as "OP <op>" lines, followed by END.
+	DumpOpsCommand = "dump_ops"
+	// RotateAOFCommand is "rotate_aof". It synchronously rotates AOF regardless of its size, and replies "OK".
+	// If rotation is already in process, server error is replied.
+	RotateAOFCommand = "rotate_aof"
+	// StatsCommand is "stats [items|slabs]". It replies server counters as "STAT <name> <value>" lines, followed by END.
+	// Items stats describe cache queues, and slabs stats describe recycle.Pool chunk sizes and counters.
+	// See itemsStats, slabsStats and poolStats for details.
+	// "stats cachedump <class> <limit>" replies up to limit items of queue, that is reported as class
+	// in items stats, as "ITEM <key> [<bytes> b; <exptime> s]" lines, followed by END. 0 limit means all items.
+	StatsCommand         = "stats"
+	StatsItemsOption     = "items"
+	StatsSlabsOption     = "slabs"
+	StatsCachedumpOption = "cachedump"
+	// VersionCommand is "version". It replies "VERSION <Version>".
+	VersionCommand = "version"
+	// QuitCommand is "quit". Connection is closed without response.
+	QuitCommand = "quit"
 
 	NoReplyOption = "noreply"
 
+	OkResponse          = "OK"
 	StoredResponse      = "STORED"
+	NotStoredResponse   = "NOT_STORED"
+	ExistsResponse      = "EXISTS"
+	EvictedResponse     = "EVICTED"
+	OpResponse          = "OP"
+	ItemResponse        = "ITEM"
+	StatResponse        = "STAT"
+	VersionResponse     = "VERSION"
 	ValueResponse       = "VALUE"
 	EndResponse         = "END"
 	DeletedResponse     = "DELETED"
@@ -38,12 +93,23 @@ const (
 	ErrorResponse       = "ERROR"
 	ClientErrorResponse = "CLIENT_ERROR"
 	ServerErrorResponse = "SERVER_ERROR"
+	// WarmingUpMessage is server error message for commands received while AOF is replayed.
+	WarmingUpMessage = "warming up"
 
 	// Implementation specific consts.
 	InBufferSize  = 16 * (1 << 10)
 	OutBufferSize = 16 * (1 << 10)
+	// MaxErrorCommandLen is max length of command reported on server error.
+	MaxErrorCommandLen = 128
+	// WriteChunkSize is max size of value part written at once.
+	// Write deadline is refreshed before every chunk write.
+	WriteChunkSize = OutBufferSize
 )
 
+// Version is server version replied to VersionCommand. It can be set on build:
+// go build -ldflags "-X github.com/Skipor/memcached.Version=<version>"
+var Version = "0.1.0"
+
 var _ = func() (_ struct{}) {
 	if MaxCommandSize < InBufferSize {
 		panic("max command should fit in input buffer")
@@ -53,6 +119,9 @@ var _ = func() (_ struct{}) {
 
 var (
 	ErrTooLargeKey          = errors.New("too large key")
+	ErrTooLargeForCache     = errors.New("object too large for cache")
+	ErrReservedKeyPrefix    = errors.New("reserved key prefix")
+	ErrBacklogExceeded      = errors.New("response backlog exceeded")
 	ErrTooLargeItem         = errors.New("too large item")
 	ErrInvalidOption        = errors.New("invalid option")
 	ErrTooManyFields        = errors.New("too many fields")
@@ -62,10 +131,47 @@ var (
 	ErrFieldsParseError     = errors.New("fields parse error ")
 	ErrInvalidLineSeparator = errors.New("invalid line separator")
 	ErrInvalidCharInKey     = errors.New("key contains invalid characters")
+	ErrEmptyKey             = errors.New("empty key")
+	ErrCommandDisabled      = errors.New("command disabled")
+	ErrNotNumeric           = errors.New("cannot increment or decrement non-numeric value")
+	ErrInvalidMagic         = errors.New("invalid binary protocol magic")
+	ErrTooManyConnections   = errors.New("too many connections")
+	ErrDelayedDelete        = errors.New("bad command line format.  Usage: delete <key> [noreply]")
+	ErrTooManyKeys          = errors.New("too many keys")
 
 	separatorBytes = []byte(Separator)
 )
 
+// commands is set of text protocol commands.
+var commands = map[string]bool{
+	SetCommand:         true,
+	AddCommand:         true,
+	ReplaceCommand:     true,
+	CasCommand:         true,
+	GetCommand:         true,
+	GetsCommand:        true,
+	DeleteCommand:      true,
+	GatCommand:         true,
+	GatsCommand:        true,
+	IncrCommand:        true,
+	DecrCommand:        true,
+	GetQuietCommand:    true,
+	NoopCommand:        true,
+	MultiDeleteCommand: true,
+	MaxItemSizeCommand: true,
+	EvictCommand:       true,
+	DumpOpsCommand:     true,
+	RotateAOFCommand:   true,
+	StatsCommand:       true,
+	VersionCommand:     true,
+	QuitCommand:        true,
+}
+
+// IsCommand returns true, if name is text protocol command.
+func IsCommand(name string) bool {
+	return commands[name]
+}
+
 func isInvalidFieldChar(b byte) bool {
 	return b <= ' ' || b == 127
 }
@@ -135,10 +241,7 @@ func parseSetFields(fields [][]byte) (m cache.ItemMeta, noreply bool, err error)
 		}
 	}
 	m.Flags = uint32(parsed[0])
-	m.Exptime = int64(parsed[1])
-	if m.Exptime < MaxRelativeExptime {
-		m.Exptime += time.Now().Unix()
-	}
+	m.Exptime = absExptime(int64(parsed[1]))
 	m.Bytes = int(parsed[2])
 	if m.Bytes < 0 || m.Bytes > MaxItemSize {
 		err = ErrTooLargeItem
@@ -146,17 +249,175 @@ func parseSetFields(fields [][]byte) (m cache.ItemMeta, noreply bool, err error)
 	return
 }
 
+// parseCasFields parses "cas" fields, that are "set" fields with cas unique before noreply option.
+func parseCasFields(fields [][]byte) (m cache.ItemMeta, casID uint64, noreply bool, err error) {
+	const casIndex = 4 // After key and 3 set extra fields.
+	if len(fields) < casIndex+1 {
+		err = stackerr.Wrap(ErrMoreFieldsRequired)
+		return
+	}
+	casID, err = strconv.ParseUint(string(fields[casIndex]), 10, 64)
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+		return
+	}
+	setFields := append(fields[:casIndex:casIndex], fields[casIndex+1:]...)
+	m, noreply, err = parseSetFields(setFields)
+	return
+}
+
+func parseIncrFields(fields [][]byte) (key []byte, delta uint64, noreply bool, err error) {
+	const extraRequired = 1
+	var extra [][]byte
+	key, extra, noreply, err = parseKeyFields(fields, extraRequired)
+	if err != nil {
+		return
+	}
+	delta, err = strconv.ParseUint(string(extra[0]), 10, 64)
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+	}
+	return
+}
+
+// parseDeleteFields parses "delete <key> [<time>] [noreply]" fields. Time is accepted for old clients,
+// but delayed delete is not supported, like in memcached, so only zero time is valid.
 func parseDeleteFields(fields [][]byte) (key []byte, noreply bool, err error) {
 	const extraRequired = 0
+	if len(fields) > 1 && string(fields[1]) != NoReplyOption {
+		if string(fields[1]) != "0" {
+			err = stackerr.Wrap(ErrDelayedDelete)
+			return
+		}
+		fields = append(fields[:1:1], fields[2:]...)
+	}
 	key, _, noreply, err = parseKeyFields(fields, extraRequired)
 	return
 }
 
-func parseGetFields(fields [][]byte) (keys [][]byte, err error) {
+// parseMultiDeleteFields parses "mdelete" fields. Keys count is first and only required field.
+func parseMultiDeleteFields(fields [][]byte) (count int, noreply bool, err error) {
+	const extraRequired = 0
+	var countField []byte
+	countField, _, noreply, err = parseKeyFields(fields, extraRequired)
+	if err != nil {
+		return
+	}
+	var parsed uint64
+	parsed, err = strconv.ParseUint(string(countField), 10, 31)
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+		return
+	}
+	count = int(parsed)
+	return
+}
+
+// parseMaxItemSizeFields parses size, that should be not larger than limit.
+func parseMaxItemSizeFields(fields [][]byte, limit int) (size int, err error) {
+	if len(fields) < 1 {
+		err = stackerr.Wrap(ErrMoreFieldsRequired)
+		return
+	}
+	if len(fields) > 1 {
+		err = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	var parsed uint64
+	parsed, err = strconv.ParseUint(string(fields[0]), 10, 31)
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+		return
+	}
+	size = int(parsed)
+	if size > limit {
+		err = stackerr.Wrap(ErrTooLargeItem)
+	}
+	return
+}
+
+func parseEvictFields(fields [][]byte) (n int, err error) {
+	if len(fields) < 1 {
+		err = stackerr.Wrap(ErrMoreFieldsRequired)
+		return
+	}
+	if len(fields) > 1 {
+		err = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	var parsed uint64
+	parsed, err = strconv.ParseUint(string(fields[0]), 10, 31)
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+		return
+	}
+	n = int(parsed)
+	return
+}
+
+// parseCachedumpFields parses "<class> <limit>" fields of "stats cachedump".
+// Class is 1 for cold, 2 for warm and 3 for hot queue, as in items stats. Queue index is returned.
+func parseCachedumpFields(fields [][]byte) (queue, limit int, err error) {
+	if len(fields) < 2 {
+		err = stackerr.Wrap(ErrMoreFieldsRequired)
+		return
+	}
+	if len(fields) > 2 {
+		err = stackerr.Wrap(ErrTooManyFields)
+		return
+	}
+	var class, parsedLimit uint64
+	class, err = strconv.ParseUint(string(fields[0]), 10, 31)
+	if err == nil {
+		parsedLimit, err = strconv.ParseUint(string(fields[1]), 10, 31)
+	}
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+		return
+	}
+	if class < 1 || class > cache.Queues {
+		err = stackerr.Wrap(ErrInvalidOption)
+		return
+	}
+	return int(class) - 1, int(parsedLimit), nil
+}
+
+// absExptime converts exptime relative to now into absolute unix time.
+// Zero exptime means that item never expires, so it is returned as is.
+func absExptime(exptime int64) int64 {
+	if exptime != 0 && exptime < MaxRelativeExptime {
+		exptime += cache.NowUnix()
+	}
+	return exptime
+}
+
+// parseGatFields parses "gat" fields, that are exptime followed by "get" fields.
+func parseGatFields(fields [][]byte, maxKeys int) (exptime int64, keys [][]byte, err error) {
 	if len(fields) == 0 {
 		err = stackerr.Wrap(ErrMoreFieldsRequired)
 		return
 	}
+	var parsed uint64
+	parsed, err = strconv.ParseUint(string(fields[0]), 10, 32)
+	if err != nil {
+		err = stackerr.Newf("%s: %s", ErrFieldsParseError, err)
+		return
+	}
+	exptime = absExptime(int64(parsed))
+	keys, err = parseGetFields(fields[1:], maxKeys)
+	return
+}
+
+// parseGetFields parses "get" keys. Number of keys is limited by maxKeys, if it is not 0.
+func parseGetFields(fields [][]byte, maxKeys int) (keys [][]byte, err error) {
+	if len(fields) == 0 {
+		err = stackerr.Wrap(ErrMoreFieldsRequired)
+		return
+	}
+	if maxKeys != 0 && len(fields) > maxKeys {
+		err = stackerr.Wrap(ErrTooManyKeys)
+		return
+	}
 	for _, key := range fields {
 		err = checkKey(key)
 		if err != nil {
@@ -235,6 +496,36 @@ func (r reader) readDataBlock(size int) (data *recycle.Data, clientErr, err erro
 	return
 }
 
+// readKeyLine reads separator terminated key line of command body.
+// WARN: retuned key points into read buffed and invalidated after next read.
+func (r reader) readKeyLine() (key []byte, clientErr, err error) {
+	var line []byte
+	line, err = r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		clientErr = stackerr.Wrap(ErrTooLargeKey)
+		err = r.discardCommand()
+		return
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		err = stackerr.Wrap(err)
+		return
+	}
+	if !bytes.HasSuffix(line, separatorBytes) {
+		clientErr = stackerr.Wrap(ErrInvalidLineSeparator)
+		return
+	}
+	key = bytes.TrimSuffix(line, separatorBytes)
+	if len(key) == 0 {
+		clientErr = stackerr.Wrap(ErrEmptyKey)
+		return
+	}
+	clientErr = checkKey(key)
+	return
+}
+
 // discardCommand discard all input untill next separator.
 func (r reader) discardCommand() error {
 	for {
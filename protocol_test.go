@@ -418,7 +418,7 @@ var _ = Describe("parse set fields", func() {
 				Expect(m.Flags).To(Equal(flags))
 				Expect(m.Bytes).To(Equal(bytes))
 				Expect(noreply).To(Equal(expectedNoreply))
-				if exptime < MaxRelativeExptime {
+				if exptime != 0 && exptime < MaxRelativeExptime {
 					exptime += time.Now().Unix()
 				}
 				Expect([]int64{m.Exptime - 1, m.Exptime}).To(ContainElement(exptime))
@@ -430,6 +430,13 @@ var _ = Describe("parse set fields", func() {
 			BeforeEach(func() { exptime = MaxRelativeExptime + 1 })
 			AssertParsedWell()
 		})
+		Context("with zero exptime", func() {
+			BeforeEach(func() { exptime = 0 })
+			It("never expires", func() {
+				Expect(err).To(BeNil())
+				Expect(m.Exptime).To(BeZero())
+			})
+		})
 		Context("with noreply", func() {
 			BeforeEach(func() { expectedNoreply = true })
 			AssertParsedWell()
@@ -496,3 +503,104 @@ var _ = Describe("parse set fields", func() {
 		Context("non numeric", TestInvalidParam("xxx"))
 	})
 })
+
+var _ = Describe("parse gat fields", func() {
+	var (
+		input   string
+		exptime int64
+		keys    [][]byte
+		err     error
+	)
+	JustBeforeEach(func() {
+		exptime, keys, err = parseGatFields(bytes.Fields([]byte(input)), 0)
+	})
+
+	Context("correct input", func() {
+		BeforeEach(func() { input = "100 a b" })
+		It("parsed well", func() {
+			Expect(err).To(BeNil())
+			Expect(exptime).To(BeNumerically("~", cache.NowUnix()+100, 1))
+			Expect(keys).To(Equal([][]byte{[]byte("a"), []byte("b")}))
+		})
+	})
+	Context("absolute exptime", func() {
+		BeforeEach(func() { input = fmt.Sprintf("%v a", MaxRelativeExptime+1) })
+		It("not changed", func() {
+			Expect(err).To(BeNil())
+			Expect(exptime).To(BeEquivalentTo(MaxRelativeExptime + 1))
+		})
+	})
+	Context("zero exptime", func() {
+		BeforeEach(func() { input = "0 a" })
+		It("never expires", func() {
+			Expect(err).To(BeNil())
+			Expect(exptime).To(BeZero())
+		})
+	})
+	Context("no keys", func() {
+		BeforeEach(func() { input = "100" })
+		It("error", func() {
+			Expect(err).NotTo(BeNil())
+		})
+	})
+	Context("invalid exptime", func() {
+		BeforeEach(func() { input = "-1 a" })
+		It("parse error", func() {
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(ErrFieldsParseError.Error()))
+		})
+	})
+})
+
+var _ = Describe("parse cas fields", func() {
+	var (
+		input   string
+		m       cache.ItemMeta
+		casID   uint64
+		noreply bool
+		err     error
+	)
+	JustBeforeEach(func() {
+		m, casID, noreply, err = parseCasFields(bytes.Fields([]byte(input)))
+	})
+
+	Context("correct input", func() {
+		BeforeEach(func() { input = fmt.Sprintf("xx 1 0 2 %v noreply", uint64(math.MaxUint64)) })
+		It("parsed well", func() {
+			Expect(err).To(BeNil())
+			Expect(m.Key).To(Equal("xx"))
+			Expect(m.Flags).To(BeEquivalentTo(1))
+			Expect(m.Bytes).To(Equal(2))
+			Expect(casID).To(BeEquivalentTo(uint64(math.MaxUint64)))
+			Expect(noreply).To(BeTrue())
+		})
+	})
+	Context("no cas unique", func() {
+		BeforeEach(func() { input = "xx 1 0 2" })
+		It("more fields required", func() {
+			Expect(util.Unwrap(err)).To(Equal(ErrMoreFieldsRequired))
+		})
+	})
+	Context("invalid cas unique", func() {
+		BeforeEach(func() { input = "xx 1 0 2 -1" })
+		It("parse error", func() {
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(ErrFieldsParseError.Error()))
+		})
+	})
+	Context("invalid set fields", func() {
+		BeforeEach(func() { input = "xx 1 0 2 1 wtf" })
+		It("set fields error", func() {
+			Expect(util.Unwrap(err)).To(Equal(ErrInvalidOption))
+		})
+	})
+})
+
+var _ = Describe("is command", func() {
+	It("text protocol commands known", func() {
+		Expect(IsCommand(GetCommand)).To(BeTrue())
+		Expect(IsCommand(RotateAOFCommand)).To(BeTrue())
+		Expect(IsCommand("GET")).To(BeFalse())
+		Expect(IsCommand("flush_all")).To(BeFalse())
+	})
+})
@@ -1,8 +1,12 @@
 package recycle
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"strconv"
 	"sync/atomic"
 )
 
@@ -13,6 +17,8 @@ type Data struct {
 	recycleCalled int32 // Atomic.
 	references    int32 // Atomic.
 	chunks        [][]byte
+	// checksums are chunks CRCs. Nil if pool checksum is off.
+	checksums []uint32
 }
 
 func newData(p *Pool, chunks [][]byte) *Data {
@@ -45,6 +51,72 @@ func (d *Data) WriteTo(w io.Writer) (nn int64, err error) {
 	return
 }
 
+// WriteToAt writes n bytes of data starting from off. Range should be in data.
+func (d *Data) WriteToAt(w io.Writer, off, n int64) (nn int64, err error) {
+	if off < 0 || n < 0 || off+n > d.size() {
+		return 0, ErrInvalidSeek
+	}
+	r := d.NewReader()
+	_, err = r.Seek(off, io.SeekStart)
+	if err == nil {
+		nn, err = r.WriteNTo(w, n)
+	}
+	r.Close()
+	return
+}
+
+// maxUintLen is max length of decimal uint64.
+const maxUintLen = 20
+
+// ParseUint parses data as decimal ASCII uint64. Number can span multiple chunks.
+// ErrNotNumeric is returned if data is empty, has non digits, or overflows uint64.
+func (d *Data) ParseUint() (v uint64, err error) {
+	var buf [maxUintLen]byte
+	var n int
+	for _, chunk := range d.chunks {
+		if n+len(chunk) > len(buf) {
+			return 0, ErrNotNumeric
+		}
+		n += copy(buf[n:], chunk)
+	}
+	v, err = strconv.ParseUint(string(buf[:n]), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumeric
+	}
+	return
+}
+
+// NewUint returns new Data from same pool, that contains decimal ASCII v.
+// Memory budget is not checked, because such data is small, and usually replaces
+// data of similar size.
+func (d *Data) NewUint(v uint64) *Data {
+	var buf [maxUintLen]byte
+	b := strconv.AppendUint(buf[:0], v, 10)
+	data, err := d.pool.readData(context.Background(), bytes.NewReader(b), len(b), false)
+	if err != nil {
+		panic(err) // Reader has enough data.
+	}
+	return data
+}
+
+func (d *Data) size() (size int64) {
+	for _, chunk := range d.chunks {
+		size += int64(len(chunk))
+	}
+	return
+}
+
+// Verify checks that chunks match checksums computed on read.
+// ErrCorrupted is returned on mismatch. Always nil if pool checksum is off.
+func (d *Data) Verify() error {
+	for i, sum := range d.checksums {
+		if crc32.Checksum(d.chunks[i], crcTable) != sum {
+			return ErrCorrupted
+		}
+	}
+	return nil
+}
+
 func (d *Data) decReference() {
 	readersLeft := atomic.AddInt32(&d.references, -1)
 	if readersLeft == 0 {
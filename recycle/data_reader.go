@@ -11,6 +11,7 @@ type DataReader struct {
 var _ interface {
 	io.ReadCloser
 	io.WriterTo
+	io.Seeker
 } = (*DataReader)(nil)
 
 func (r *DataReader) WriteTo(w io.Writer) (nn int64, err error) {
@@ -26,6 +27,57 @@ func (r *DataReader) WriteTo(w io.Writer) (nn int64, err error) {
 	return
 }
 
+// WriteNTo writes up to n bytes from current position.
+func (r *DataReader) WriteNTo(w io.Writer, n int64) (nn int64, err error) {
+	for nn < n && !r.eof() {
+		chunk := r.chunk()
+		if left := n - nn; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		var written int
+		written, err = w.Write(chunk)
+		r.readed(written)
+		nn += int64(written)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Seek sets position of next read or write. Position can't be out of data.
+// Chunk containing position is found by chunks iteration.
+func (r *DataReader) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos = r.pos()
+	case io.SeekEnd:
+		pos = r.data.size()
+	default:
+		return r.pos(), ErrInvalidSeek
+	}
+	pos += offset
+	if pos < 0 || pos > r.data.size() {
+		return r.pos(), ErrInvalidSeek
+	}
+	r.chunkIndex, r.byteIndex = 0, 0
+	left := pos
+	for ; !r.eof() && left >= int64(len(r.data.chunks[r.chunkIndex])); r.chunkIndex++ {
+		left -= int64(len(r.data.chunks[r.chunkIndex]))
+	}
+	r.byteIndex = int(left)
+	return
+}
+
+// pos returns position of next read.
+func (r *DataReader) pos() (pos int64) {
+	for _, chunk := range r.data.chunks[:r.chunkIndex] {
+		pos += int64(len(chunk))
+	}
+	return pos + int64(r.byteIndex)
+}
+
 // Read method is for test purpose only. WriteTo should be uses instead.
 func (r *DataReader) Read(p []byte) (nn int, err error) {
 	// panic("use WriteTo (io.Copy can do it for you) to avoid copy and allocations")
@@ -40,6 +92,11 @@ func (r *DataReader) Read(p []byte) (nn int, err error) {
 	return
 }
 
+// Verify verifies read data. See Data.Verify for details.
+func (r *DataReader) Verify() error {
+	return r.data.Verify()
+}
+
 func (r *DataReader) Close() error {
 	if !r.isClosed() {
 		// It is good style to handle multiple Close calls,
@@ -2,10 +2,13 @@ package recycle
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"runtime"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -31,6 +34,14 @@ var _ = Describe("Pool create", func() {
 		})
 	})
 
+	It("chunk sizes from bounds", func() {
+		Expect(ChunkSizes(1<<10, 1<<13)).To(Equal([]int{1 << 10, 1 << 11, 1 << 12, 1 << 13}))
+		Expect(ChunkSizes(1000, 5000)).To(Equal([]int{1000, 2000, 4000, 5000}))
+		Expect(ChunkSizes(1<<10, 1<<10)).To(Equal([]int{1 << 10}))
+		Expect(func() { ChunkSizes(0, 1<<10) }).To(Panic())
+		Expect(func() { ChunkSizes(1<<10, 1<<9) }).To(Panic())
+	})
+
 	Context("invalid configuration", func() {
 		JustBeforeEach(func() {
 			Expect(func() {
@@ -120,6 +131,19 @@ var _ = Describe("chunk requested", func() {
 			Expect(p.chunk(chunkSize)).NotTo(Equal(chunk))
 		})
 	})
+
+	Context("chunk class stats", func() {
+		BeforeEach(func() {
+			chunkSize = p.MinChunkSize() + 1
+		})
+		It("used chunk counted until recycle", func() {
+			stats := p.ChunkClassStats()
+			Expect(stats).To(HaveLen(len(p.chunkSizes)))
+			Expect(stats[1]).To(Equal(ChunkClassStats{p.chunkSizes[1], 1}))
+			p.recycleChunk(chunk)
+			Expect(p.ChunkClassStats()[1].UsedChunks).To(BeZero())
+		})
+	})
 })
 
 var _ = Describe("data read", func() {
@@ -169,6 +193,51 @@ var _ = Describe("data read", func() {
 				ExpectBytesEqual(buf.Bytes(), input)
 			})
 
+			It("range got from WriteToAt", func() {
+				off := Rand.Intn(len(input) + 1)
+				n := Rand.Intn(len(input) - off + 1)
+				By(fmt.Sprintf("Range: %v-%v of %v", off, off+n, len(input)))
+				nn, err := data.WriteToAt(buf, int64(off), int64(n))
+				Expect(err).To(BeNil())
+				Expect(nn).To(BeEquivalentTo(n))
+				ExpectBytesEqual(buf.Bytes(), input[off:off+n])
+			})
+
+			It("range spanning chunks got from WriteToAt", func() {
+				if len(data.chunks) < 2 {
+					Skip("single chunk data")
+				}
+				off := len(data.chunks[0]) - 1
+				n := len(input) - off
+				_, err := data.WriteToAt(buf, int64(off), int64(n))
+				Expect(err).To(BeNil())
+				ExpectBytesEqual(buf.Bytes(), input[off:])
+			})
+
+			It("out of range WriteToAt fails", func() {
+				_, err := data.WriteToAt(buf, int64(len(input)), 1)
+				Expect(err).To(Equal(ErrInvalidSeek))
+			})
+
+			It("seek", func() {
+				r := data.NewReader()
+				defer r.Close()
+				pos, err := r.Seek(0, io.SeekEnd)
+				Expect(err).To(BeNil())
+				Expect(pos).To(BeEquivalentTo(len(input)))
+				Expect(r.eof()).To(BeTrue())
+
+				back := Rand.Intn(len(input) + 1)
+				pos, err = r.Seek(int64(-back), io.SeekCurrent)
+				Expect(err).To(BeNil())
+				Expect(pos).To(BeEquivalentTo(len(input) - back))
+				buf.ReadFrom(r)
+				ExpectBytesEqual(buf.Bytes(), input[len(input)-back:])
+
+				_, err = r.Seek(-1, io.SeekStart)
+				Expect(err).To(Equal(ErrInvalidSeek))
+			})
+
 		})
 
 		Context("concurrent reads", func() {
@@ -292,3 +361,271 @@ var _ = Describe("data read", func() {
 		})
 	})
 })
+
+// stalledReader reads n bytes from r, then cancels context and blocks forever.
+type stalledReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		r.cancel()
+		select {}
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= n
+	if r.n == 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+var _ = Describe("context read", func() {
+	It("canceled context aborts read and recycles read chunks", func() {
+		p := NewPool()
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &stalledReader{r: FastRand, n: p.MaxChunkSize(), cancel: cancel}
+		data, err := p.ReadDataContext(ctx, r, 3*p.MaxChunkSize())
+		Expect(err).To(Equal(context.Canceled))
+		Expect(data).To(BeNil())
+		Expect(p.InUse()).To(BeZero())
+		for _, class := range p.ChunkClassStats() {
+			Expect(class.UsedChunks).To(BeZero())
+		}
+		Expect(p.Stats().RecycledChunks).To(BeEquivalentTo(1))
+	})
+
+	It("done context fails before read", func() {
+		p := NewPool()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		data, err := p.ReadDataContext(ctx, &stalledReader{cancel: cancel}, 1)
+		Expect(err).To(Equal(context.Canceled))
+		Expect(data).To(BeNil())
+		Expect(p.Stats()).To(Equal(PoolStats{}))
+	})
+})
+
+var _ = Describe("data chunks capacity", func() {
+	p := NewPoolSizes([]int{1 << 8, 1 << 10, 1 << 12})
+	for _, tc := range []struct {
+		size     int
+		capacity int
+	}{
+		{100, 100}, // GC chunk is exactly sized.
+		{1<<10 + 1, 1 << 12},
+		{1<<12 + 300, 1<<12 + 1<<10},
+		{3<<12 + 1<<8, 3<<12 + 1<<8},
+		{2<<12 + 1<<10 + 1, 2<<12 + 1<<12},
+	} {
+		tc := tc
+		It(fmt.Sprintf("minimal for size %v", tc.size), func() {
+			data, err := p.ReadData(FastRand, tc.size)
+			Expect(err).To(BeNil())
+			defer data.Recycle()
+			var capacity int
+			for i, ch := range data.chunks {
+				if i != len(data.chunks)-1 {
+					Expect(len(ch)).To(Equal(p.MaxChunkSize()), "interior chunk is not max sized")
+				}
+				capacity += cap(ch)
+			}
+			Expect(capacity).To(Equal(tc.capacity))
+		})
+	}
+})
+
+var _ = Describe("memory budget", func() {
+	var p *Pool
+	const budget = 1 << 20
+	BeforeEach(func() {
+		p = NewPool()
+		p.SetMemoryBudget(budget)
+	})
+
+	It("data larger than budget", func() {
+		data, err := p.ReadData(FastRand, budget+1)
+		Expect(err).To(Equal(ErrOutOfMemory))
+		Expect(data).To(BeNil())
+		Expect(p.InUse()).To(BeZero())
+	})
+
+	It("budget freed after recycle", func() {
+		data, err := p.ReadData(FastRand, budget)
+		Expect(err).To(BeNil())
+		Expect(p.InUse()).To(BeEquivalentTo(budget))
+		_, err = p.ReadData(FastRand, 1)
+		Expect(err).To(Equal(ErrOutOfMemory))
+
+		data.Recycle()
+		Expect(p.InUse()).To(BeZero())
+		data, err = p.ReadData(FastRand, 1)
+		Expect(err).To(BeNil())
+		data.Recycle()
+	})
+})
+
+var _ = Describe("pool stats", func() {
+	It("counters move on read and recycle", func() {
+		p := NewPool()
+		Expect(p.Stats()).To(Equal(PoolStats{}))
+		size := 2*p.MaxChunkSize() + p.MinChunkSize()/2
+		data, err := p.ReadData(FastRand, size)
+		Expect(err).To(BeNil())
+		stats := p.Stats()
+		Expect(stats.AllocatedChunks).To(BeEquivalentTo(2)) // Pool is empty, so both large chunks are allocated.
+		Expect(stats.GCChunks).To(BeEquivalentTo(1))
+		Expect(stats.RecycledChunks).To(BeZero())
+
+		data.Recycle()
+		stats = p.Stats()
+		Expect(stats.RecycledChunks).To(BeEquivalentTo(2))
+		Expect(stats.GCChunks).To(BeEquivalentTo(1))
+	})
+
+	It("no pool chunks counted as GC", func() {
+		p := NewNoPool()
+		data, err := p.ReadData(FastRand, p.MaxChunkSize()+1)
+		Expect(err).To(BeNil())
+		data.Recycle()
+		Expect(p.Stats()).To(Equal(PoolStats{GCChunks: 2}))
+	})
+})
+
+var _ = Describe("bounded pool", func() {
+	It("retains no more than max chunks of size", func() {
+		const maxRetained = 3
+		const extra = 2
+		p := NewBoundedPool([]int{1 << 10}, maxRetained)
+		var datas []*Data
+		recycled := map[*byte]bool{}
+		for i := 0; i < maxRetained+extra; i++ {
+			data, err := p.ReadData(FastRand, 1<<10)
+			Expect(err).To(BeNil())
+			recycled[&data.chunks[0][0]] = true
+			datas = append(datas, data)
+		}
+		for _, data := range datas {
+			data.Recycle()
+		}
+		Expect(p.Stats()).To(Equal(PoolStats{
+			AllocatedChunks: maxRetained + extra,
+			RecycledChunks:  maxRetained,
+			DroppedChunks:   extra,
+		}))
+
+		var reused int
+		for i := 0; i < maxRetained+extra; i++ {
+			data, err := p.ReadData(FastRand, 1<<10)
+			Expect(err).To(BeNil())
+			if recycled[&data.chunks[0][0]] {
+				reused++
+			}
+			defer data.Recycle()
+		}
+		Expect(reused).To(Equal(maxRetained))
+		Expect(p.Stats().AllocatedChunks).To(BeEquivalentTo(maxRetained + 2*extra))
+	})
+
+	It("negative max retained panics", func() {
+		Expect(func() { NewBoundedPool(nil, -1) }).To(Panic())
+	})
+})
+
+var _ = Describe("no pool", func() {
+	var p *Pool
+	BeforeEach(func() { p = NewNoPool() })
+
+	It("tracks not recycled data", func() {
+		size := p.MaxChunkSize() + Rand.Intn(p.MaxChunkSize())
+		data, err := p.ReadData(FastRand, size)
+		Expect(err).To(BeNil())
+		other, err := p.ReadData(FastRand, Rand.Intn(size))
+		Expect(err).To(BeNil())
+		Expect(p.NotRecycled()).To(ConsistOf(data, other))
+
+		data.Recycle()
+		Expect(p.NotRecycled()).To(ConsistOf(other))
+		r := other.NewReader()
+		other.Recycle()
+		Expect(p.NotRecycled()).To(ConsistOf(other))
+		r.Close()
+		Expect(p.NotRecycled()).To(BeEmpty())
+	})
+
+	It("panics on NotRecycled call for pool", func() {
+		Expect(func() { NewPool().NotRecycled() }).To(Panic())
+	})
+})
+
+var _ = Describe("checksum", func() {
+	var (
+		p    *Pool
+		data *Data
+	)
+	BeforeEach(func() {
+		p = NewPool()
+		p.SetChecksum(true)
+		var err error
+		data, err = p.ReadData(FastRand, 2*p.MaxChunkSize()+1)
+		Expect(err).To(BeNil())
+	})
+	AfterEach(func() { data.Recycle() })
+
+	It("not corrupted", func() {
+		Expect(data.Verify()).To(BeNil())
+		r := data.NewReader()
+		Expect(r.Verify()).To(BeNil())
+		r.Close()
+	})
+	It("corrupted", func() {
+		data.chunks[1][Rand.Intn(len(data.chunks[1]))]++
+		Expect(data.Verify()).To(Equal(ErrCorrupted))
+	})
+	It("off", func() {
+		d, _ := NewPool().ReadData(FastRand, 10)
+		d.chunks[0][0]++
+		Expect(d.Verify()).To(BeNil())
+		d.Recycle()
+	})
+})
+
+var _ = Describe("uint data", func() {
+	var p *Pool
+	BeforeEach(func() { p = NewPoolSizes([]int{4, 8}) })
+	Read := func(s string) *Data {
+		data, err := p.ReadData(strings.NewReader(s), len(s))
+		Expect(err).To(BeNil())
+		return data
+	}
+
+	It("parsed across chunks", func() {
+		data := Read("18446744073709551615")
+		Expect(len(data.chunks)).To(BeNumerically(">", 1))
+		Expect(data.ParseUint()).To(BeEquivalentTo(uint64(math.MaxUint64)))
+		data.Recycle()
+	})
+	It("not numeric", func() {
+		for _, s := range []string{"", "1a", "-1", " 1", "18446744073709551616", "000000000000000000001"} {
+			data := Read(s)
+			_, err := data.ParseUint()
+			Expect(err).To(Equal(ErrNotNumeric), "%q", s)
+			data.Recycle()
+		}
+	})
+	It("new uint ignores memory budget", func() {
+		data := Read("1")
+		p.SetMemoryBudget(1)
+		newData := data.NewUint(12345)
+		Expect(newData.ParseUint()).To(BeEquivalentTo(12345))
+		Expect(p.InUse()).To(BeEquivalentTo(6))
+		data.Recycle()
+		newData.Recycle()
+		Expect(p.InUse()).To(BeZero())
+	})
+})
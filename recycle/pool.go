@@ -2,22 +2,46 @@
 package recycle
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const minDefChunkSize = 1 << 7
 const maxDefChunkSize = 1 << 20
 
-var DefaultChunkSizes = func() (sz []int) {
-	for chSz := minDefChunkSize; chSz <= maxDefChunkSize; chSz *= 2 {
+var DefaultChunkSizes = ChunkSizes(minDefChunkSize, maxDefChunkSize)
+
+// ChunkSizes returns sizes doubling from min, and max as last size.
+func ChunkSizes(min, max int) (sz []int) {
+	if min <= 0 || max < min {
+		panic("invalid chunk size bounds")
+	}
+	for chSz := min; chSz < max; chSz *= 2 {
 		sz = append(sz, chSz)
 	}
-	return
-}()
+	return append(sz, max)
+}
+
+// ErrOutOfMemory is returned from ReadData, when data doesn't fit in memory budget.
+var ErrOutOfMemory = errors.New("out of memory")
+
+// ErrCorrupted is returned from Data.Verify, when data doesn't match checksum computed on read.
+var ErrCorrupted = errors.New("data corrupted")
+
+// ErrNotNumeric is returned by Data.ParseUint, when data is not decimal uint64.
+var ErrNotNumeric = errors.New("not numeric")
+
+// ErrInvalidSeek is returned by DataReader.Seek on invalid whence, or position out of data.
+var ErrInvalidSeek = errors.New("invalid seek")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
 // TODO bench for performance and allocations. Single and concurrent.
 
@@ -25,15 +49,66 @@ type Pool struct {
 	leakCallback LeakCallback
 	chunkSizes   []int
 	chunkPools   []sync.Pool
+	// boundedPools are used instead of chunkPools by bounded pool. Their capacity is max number of retained chunks.
+	boundedPools []chan []byte
+	// usedChunks are numbers of not recycled chunks of chunkSizes. Atomic.
+	usedChunks []int64
+	// memoryBudget is max total size of not recycled data. 0 if unlimited.
+	memoryBudget int64
+	inUse        int64     // Atomic.
+	stats        PoolStats // Atomic.
+	// checksum is true, if per chunk CRC should be computed on read.
+	checksum bool
+
+	// noPool is true for pool created by NewNoPool.
+	noPool bool
+	// liveLock protects live. live is set of not recycled data. Tracked only if noPool is true.
+	liveLock sync.Mutex
+	live     map[*Data]struct{}
 }
 
 func NewPool() *Pool {
 	return NewPoolSizes(DefaultChunkSizes)
 }
 
+// NewNoPool creates pool, that never reuses chunks, but tracks all not recycled data.
+// It makes leak detection deterministic: all leaked data can be got by NotRecycled call
+// without GC and finalizers usage.
+// Note: this is for test and debug purpose only.
+func NewNoPool() *Pool {
+	p := NewPool()
+	p.noPool = true
+	p.live = make(map[*Data]struct{})
+	return p
+}
+
+// NotRecycled returns data that was read, but was not recycled yet.
+// It can be called only for pool created by NewNoPool.
+func (p *Pool) NotRecycled() (data []*Data) {
+	if !p.noPool {
+		panic("not recycled data tracked only by no pool")
+	}
+	p.liveLock.Lock()
+	for d := range p.live {
+		data = append(data, d)
+	}
+	p.liveLock.Unlock()
+	return
+}
+
 // NewPoolSizes creates new pool, which produce chunks with sizes described in chunkSizes.
 // chunkSizes should be sorted.
 func NewPoolSizes(chunkSizes []int) *Pool {
+	return NewBoundedPool(chunkSizes, 0)
+}
+
+// NewBoundedPool creates pool like NewPoolSizes, that keeps at most maxRetainedPerSize recycled chunks
+// of every size. Chunks recycled over it are left to GC. It caps memory held by idle chunks
+// after burst of large items, at the cost of lower reuse rate. 0 maxRetainedPerSize is unlimited.
+func NewBoundedPool(chunkSizes []int, maxRetainedPerSize int) *Pool {
+	if maxRetainedPerSize < 0 {
+		panic("negative max retained chunks")
+	}
 	if chunkSizes == nil {
 		chunkSizes = DefaultChunkSizes[:]
 	}
@@ -46,38 +121,97 @@ func NewPoolSizes(chunkSizes []int) *Pool {
 			panic("sizes unsorted or have duplicates")
 		}
 	}
-	chunkPools := make([]sync.Pool, len(chunkSizes))
-	for i := range chunkSizes {
-		size := chunkSizes[i] // Move into range declaration cause using same size.
-		chunkPools[i].New = func() interface{} {
-			return make([]byte, size)
-		}
-	}
-	return &Pool{
+	p := &Pool{
 		chunkSizes: chunkSizes,
-		chunkPools: chunkPools,
+		usedChunks: make([]int64, len(chunkSizes)),
+	}
+	if maxRetainedPerSize == 0 {
+		p.chunkPools = make([]sync.Pool, len(chunkSizes))
+		return p
+	}
+	// sync.Pool can't be bounded, so free lists are used.
+	p.boundedPools = make([]chan []byte, len(chunkSizes))
+	for i := range p.boundedPools {
+		p.boundedPools[i] = make(chan []byte, maxRetainedPerSize)
 	}
+	return p
 }
 
+// ReadData reads size bytes from r into new Data.
+// If memory budget is set and Data doesn't fit in it, ErrOutOfMemory is returned before any allocation or read.
 func (p *Pool) ReadData(r io.Reader, size int) (*Data, error) {
+	return p.ReadDataContext(context.Background(), r, size)
+}
+
+// ReadDataContext is ReadData, that is aborted with ctx.Err() when ctx is done.
+// Context is checked between chunks reads, so blocked read of chunk is not interrupted.
+// Already read chunks are recycled on abort.
+func (p *Pool) ReadDataContext(ctx context.Context, r io.Reader, size int) (*Data, error) {
+	return p.readData(ctx, r, size, true)
+}
+
+// readData reads data, checking memory budget if checkBudget is true.
+func (p *Pool) readData(ctx context.Context, r io.Reader, size int, checkBudget bool) (*Data, error) {
+	inUse := atomic.AddInt64(&p.inUse, int64(size))
+	if checkBudget && p.memoryBudget != 0 && inUse > p.memoryBudget {
+		atomic.AddInt64(&p.inUse, -int64(size))
+		return nil, ErrOutOfMemory
+	}
 	chunksNum := (size + p.MaxChunkSize() - 1) / p.MaxChunkSize()
 	chunks := make([][]byte, chunksNum)
-	for i := 0; i < chunksNum; i++ {
-		chunks[i] = p.chunk(size)
-		n, err := io.ReadFull(r, chunks[i])
+	for i, left := 0, size; i < chunksNum; i++ {
+		err := ctx.Err()
+		if err == nil {
+			chunks[i] = p.chunk(left)
+			left -= len(chunks[i])
+			_, err = io.ReadFull(r, chunks[i])
+		}
 		if err != nil {
+			for _, ch := range chunks {
+				if ch != nil {
+					p.recycleChunk(ch)
+				}
+			}
+			atomic.AddInt64(&p.inUse, -int64(size))
 			return nil, err
 		}
-		size -= n
 	}
 
 	d := newData(p, chunks)
+	if p.checksum {
+		d.checksums = make([]uint32, chunksNum)
+		for i, ch := range chunks {
+			d.checksums[i] = crc32.Checksum(ch, crcTable)
+		}
+	}
+	if p.noPool {
+		p.liveLock.Lock()
+		p.live[d] = struct{}{}
+		p.liveLock.Unlock()
+	}
 	if p.leakCallback != nil {
 		runtime.SetFinalizer(d, checkLeakFinalizer(p.leakCallback))
 	}
 	return d, nil
 }
 
+// SetMemoryBudget sets max total size of not recycled data. 0 means unlimited.
+// Should be called before pool usage.
+func (p *Pool) SetMemoryBudget(budget int64) {
+	p.memoryBudget = budget
+}
+
+// SetChecksum enables per chunk CRC computation in ReadData, that can be verified by Data.Verify.
+// It is defense against in-memory data corruption. Should be called before pool usage.
+func (p *Pool) SetChecksum(on bool) {
+	p.checksum = on
+}
+
+// InUse returns total size of not recycled data.
+func (p *Pool) InUse() int64 {
+	return atomic.LoadInt64(&p.inUse)
+}
+
 type LeakCallback func(*Data)
 
 // SetLeakCallback sets callback, which is called before GC of not recycled data.
@@ -104,42 +238,129 @@ var WarnOnLeak LeakCallback = func(d *Data) {
 }
 
 func (p *Pool) recycleData(d *Data) {
+	var size int
 	for _, ch := range d.chunks {
+		size += len(ch)
 		p.recycleChunk(ch)
 	}
+	atomic.AddInt64(&p.inUse, -int64(size))
+	if p.noPool {
+		p.liveLock.Lock()
+		delete(p.live, d)
+		p.liveLock.Unlock()
+	}
 }
 
 // chunk return chunk for Data.
 // returned slice len equal to size or p.maxChunkSize()
 func (p *Pool) chunk(size int) []byte {
+	if p.noPool {
+		if size > p.MaxChunkSize() {
+			size = p.MaxChunkSize()
+		}
+		atomic.AddInt64(&p.stats.GCChunks, 1)
+		return make([]byte, size)
+	}
 	if p.isGCChunkSize(size) {
 		// GC will handle such case better.
+		atomic.AddInt64(&p.stats.GCChunks, 1)
 		return make([]byte, size)
 	}
 	var i int
 	// O(n) but len(chunkSizes) should be <= 30 normally.
 	for i = range p.chunkSizes {
 		if size <= p.chunkSizes[i] {
-			return p.chunkPools[i].Get().([]byte)[0:size]
+			return p.pooledChunk(i)[0:size]
+		}
+	}
+	return p.pooledChunk(i)
+}
+
+// pooledChunk returns chunk of i-th size, recycled or allocated if there is no one.
+// Chunk pools have no New function, so misses are counted here.
+func (p *Pool) pooledChunk(i int) []byte {
+	atomic.AddInt64(&p.usedChunks[i], 1)
+	if p.boundedPools != nil {
+		select {
+		case chunk := <-p.boundedPools[i]:
+			return chunk
+		default:
 		}
+	} else if chunk := p.chunkPools[i].Get(); chunk != nil {
+		return chunk.([]byte)
 	}
-	return p.chunkPools[i].Get().([]byte)
+	atomic.AddInt64(&p.stats.AllocatedChunks, 1)
+	return make([]byte, p.chunkSizes[i])
 }
 
 func (p *Pool) recycleChunk(chunk []byte) {
 	size := cap(chunk)
-	if p.isGCChunkSize(size) {
+	if p.noPool || p.isGCChunkSize(size) {
 		// Garbage, that should be collected by GC.
 		return
 	}
 	// O(n) but len(chunkSizes) should be <= 30 normally.
 	for i := range p.chunkSizes {
 		if size == p.chunkSizes[i] {
-			p.chunkPools[i].Put(chunk[:size])
+			atomic.AddInt64(&p.usedChunks[i], -1)
+			p.putChunk(i, chunk[:size])
 			return
 		}
 	}
-	panic(fmt.Errorf("unexpected chunk size: %s", size))
+	panic(fmt.Errorf("unexpected chunk size: %v", size))
+}
+
+// putChunk returns chunk of i-th size for reuse, or leaves it to GC, if bounded pool is full.
+func (p *Pool) putChunk(i int, chunk []byte) {
+	if p.boundedPools == nil {
+		atomic.AddInt64(&p.stats.RecycledChunks, 1)
+		p.chunkPools[i].Put(chunk)
+		return
+	}
+	select {
+	case p.boundedPools[i] <- chunk:
+		atomic.AddInt64(&p.stats.RecycledChunks, 1)
+	default:
+		atomic.AddInt64(&p.stats.DroppedChunks, 1)
+	}
+}
+
+// ChunkClassStats describes not recycled chunks of one size.
+type ChunkClassStats struct {
+	ChunkSize  int
+	UsedChunks int64
+}
+
+// ChunkClassStats returns stats of every chunk size in increasing size order.
+// Chunks of GC handled sizes are not counted.
+func (p *Pool) ChunkClassStats() []ChunkClassStats {
+	stats := make([]ChunkClassStats, len(p.chunkSizes))
+	for i, size := range p.chunkSizes {
+		stats[i] = ChunkClassStats{size, atomic.LoadInt64(&p.usedChunks[i])}
+	}
+	return stats
+}
+
+// PoolStats are pool counters, that describe recycling effectiveness.
+type PoolStats struct {
+	// AllocatedChunks is number of chunks allocated, because there were no recycled chunk of required size.
+	AllocatedChunks int64
+	// RecycledChunks is number of chunks returned into pool for reuse.
+	RecycledChunks int64
+	// DroppedChunks is number of recycled chunks left to GC, because pool retains max number of chunks of their size.
+	DroppedChunks int64
+	// GCChunks is number of chunks too small for pool, that are allocated and collected by GC.
+	// All chunks of pool created by NewNoPool are counted here.
+	GCChunks int64
+}
+
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		AllocatedChunks: atomic.LoadInt64(&p.stats.AllocatedChunks),
+		RecycledChunks:  atomic.LoadInt64(&p.stats.RecycledChunks),
+		DroppedChunks:   atomic.LoadInt64(&p.stats.DroppedChunks),
+		GCChunks:        atomic.LoadInt64(&p.stats.GCChunks),
+	}
 }
 
 func (p *Pool) MinChunkSize() int {
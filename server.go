@@ -4,12 +4,17 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/facebookgo/stackerr"
+
 	"github.com/Skipor/memcached/aof"
 	"github.com/Skipor/memcached/cache"
 	"github.com/Skipor/memcached/internal/tag"
@@ -19,36 +24,206 @@ import (
 
 const DefaultAddr = ":11211"
 
-var ErrStoped = errors.New("memcached server have been stoped")
+var (
+	ErrStoped        = errors.New("memcached server have been stoped")
+	ErrAddrAndSocket = errors.New("TCP address and UNIX socket can't be listened both")
+	ErrChunkSizes    = errors.New("max chunk size should be not less than min chunk size and IO buffers size")
+	ErrBannerLines   = errors.New("banner should be single line")
+)
 
 type Config struct {
 	Addr           string
+	Socket         string // UNIX domain socket path listened instead of TCP Addr, that should be empty then.
 	LogDestination io.Writer
 	LogLevel       log.Level
+	LogFormat      log.Format // Empty is log.TextFormat.
+	LogSink        log.Sink   // If set, used instead of LogDestination and LogFormat.
+
+	MaxItemSize  int64
+	MemoryBudget int64 // Max total size of items data. 0 if unlimited.
+	// MinChunkSize and MaxChunkSize bound sizes of chunks, that items data is stored in.
+	// Sizes double from min to max. 0 for recycle.DefaultChunkSizes bounds.
+	// Max chunk size should be not less than InBufferSize and OutBufferSize.
+	MinChunkSize int
+	MaxChunkSize int
+	WriteTimeout time.Duration // 0 if no timeout.
+	// MaxRetainedChunks is max number of recycled chunks of every size kept for reuse. 0 if unlimited.
+	MaxRetainedChunks int
+	// FlushPerCommand makes every get value flushed at once, including getq values,
+	// instead of buffering until response is complete. It reduces latency
+	// at the cost of throughput. Accepted TCP connections have TCP_NODELAY set by default.
+	FlushPerCommand bool
+	// MaxResponseBacklog is max size of keys and values written into get responses since last flush.
+	// Get values are flushed only at response end, and getq values are flushed with next response,
+	// so client pipelining many gets can make server buffer large response. Connection is closed with
+	// "SERVER_ERROR response backlog exceeded" on exceed. 0 if unlimited.
+	MaxResponseBacklog int
+	// MaxKeysPerGet is max number of keys in single get, gets, gat or gats. It limits number of items
+	// pinned by response. DefaultMaxKeysPerGet is used, if it is 0.
+	MaxKeysPerGet int
+	// MaxConnections is max number of concurrently served connections. 0 if unlimited.
+	// Accept blocks on limit, unless RejectOverConnLimit is set.
+	MaxConnections int
+	// RejectOverConnLimit makes connection accepted on MaxConnections limit closed at once
+	// with "SERVER_ERROR too many connections" response.
+	RejectOverConnLimit bool
+	// DataChecksum enables detection of in-memory item data corruption.
+	// Corrupted item is evicted and treated as cache miss.
+	DataChecksum bool
+	Cache        cache.Config
+
+	// Debug options. Command can contain private keys, so they are off by default.
+	LogErrorCommand   bool // Log command that caused server error.
+	ReplyErrorCommand bool // Send command that caused server error in response.
+	// VerboseUnknownCommand enables "ERROR unknown command: <cmd>" response instead of bare "ERROR".
+	VerboseUnknownCommand bool
+	// EnableMaxItemSizeCommand enables MaxItemSizeCommand, that overrides max item size for connection.
+	// It allows items larger than MaxItemSize, so it should be enabled only for trusted clients.
+	EnableMaxItemSizeCommand bool
 
-	MaxItemSize int64
-	Cache       cache.Config
+	// Banner is line sent to text protocol client before response to its first VersionCommand, if set.
+	// Nothing is sent on connect, so protocol clients are not confused, unless they send version
+	// command, that interactive (telnet) session user can send to see banner. Binary protocol
+	// clients never get it. Banner can't contain line breaks.
+	Banner string
+
+	// DisabledCommands are replied with "CLIENT_ERROR command disabled".
+	DisabledCommands []string
+	// RejectKeyPrefixes are reserved key prefixes. Set of such key is replied with
+	// "CLIENT_ERROR reserved key prefix". Get and delete of such keys are allowed.
+	RejectKeyPrefixes []string
 
 	FixCorruptedAOF bool
 	AOF             aof.Config
+	// ServeWhileWarming makes NewServer return without waiting AOF replay.
+	// Commands received during replay are replied with "SERVER_ERROR warming up".
+	ServeWhileWarming bool
+	// BackgroundReplay makes server serve cache while AOF command log is replayed into it.
+	// Keys not replayed yet are misses. AOF snapshot is read before serve anyway.
+	BackgroundReplay bool
+	// CompressSnapshot makes AOF rotation write gzip compressed cache snapshot.
+	// Snapshot is read regardless of this option, so it can be changed between restarts.
+	CompressSnapshot bool
+	// RecordOps is number of last cache operations recorded for dump by DumpOpsCommand. 0 disables recording.
+	RecordOps int
+	// DebugAddr is address of HTTP server with pprof handlers and /stats JSON endpoint. Empty if disabled.
+	DebugAddr string
+	// ShutdownTimeout limits time, that Stop waits for commands in progress. 0 if unlimited.
+	ShutdownTimeout time.Duration
+}
+
+func newLogger(conf Config) log.Logger {
+	if conf.LogSink != nil {
+		return log.NewLoggerSink(conf.LogLevel, conf.LogSink)
+	}
+	return log.NewFormatLogger(conf.LogLevel, conf.LogFormat, conf.LogDestination)
+}
+
+func newPool(conf Config) (*recycle.Pool, error) {
+	def := recycle.DefaultChunkSizes
+	min, max := conf.MinChunkSize, conf.MaxChunkSize
+	if min == 0 {
+		min = def[0]
+	}
+	if max == 0 {
+		max = def[len(def)-1]
+	}
+	if min <= 0 || max < min || max < InBufferSize || max < OutBufferSize {
+		return nil, stackerr.Wrap(ErrChunkSizes)
+	}
+	if conf.MaxRetainedChunks < 0 {
+		return nil, stackerr.Newf("negative max retained chunks: %v", conf.MaxRetainedChunks)
+	}
+	return recycle.NewBoundedPool(recycle.ChunkSizes(min, max), conf.MaxRetainedChunks), nil
+}
+
+// CheckMaxItemSize returns error, if item of max item size with longest key doesn't fit in cache HOT queue.
+// Such items would be rejected by size check of every set, so configuration is inconsistent.
+// Any size fits, if cache size is unknown.
+func (conf Config) CheckMaxItemSize() error {
+	maxItemSize := conf.MaxItemSize
+	if maxItemSize == 0 {
+		maxItemSize = DefaultMaxItemSize
+	}
+	meta := cache.ItemMeta{Key: strings.Repeat("k", MaxKeySize), Bytes: int(maxItemSize)}
+	if conf.Cache.Size == 0 || cache.ItemFits(conf.Cache, meta) {
+		return nil
+	}
+	return stackerr.Newf("max item size %v doesn't fit in HOT queue of cache of size %v: increase cache size or HOT cap, or decrease max item size",
+		maxItemSize, conf.Cache.Size)
+}
+
+// maxKeysPerGet returns MaxKeysPerGet, or DefaultMaxKeysPerGet if it is not set.
+func (conf Config) maxKeysPerGet() int {
+	if conf.MaxKeysPerGet == 0 {
+		return DefaultMaxKeysPerGet
+	}
+	return conf.MaxKeysPerGet
 }
 
 func NewServer(conf Config) (s *Server, err error) {
-	l := log.NewLogger(conf.LogLevel, conf.LogDestination)
-	p := recycle.NewPool()
+	if conf.Addr != "" && conf.Socket != "" {
+		err = stackerr.Wrap(ErrAddrAndSocket)
+		return
+	}
+	if strings.ContainsAny(conf.Banner, "\r\n") {
+		err = stackerr.Wrap(ErrBannerLines)
+		return
+	}
+	err = conf.CheckMaxItemSize()
+	if err != nil {
+		return
+	}
+	p, err := newPool(conf)
 	if err != nil {
 		return
 	}
+	l := newLogger(conf)
+	p.SetMemoryBudget(conf.MemoryBudget)
+	p.SetChecksum(conf.DataChecksum)
+	if conf.Cache.Metrics == nil {
+		conf.Cache.Metrics = &cache.AtomicMetrics{}
+	}
+	cacheMetrics, _ := conf.Cache.Metrics.(*cache.AtomicMetrics)
 
 	var onStop func()
 	var newCacheView func() cache.View
-	if conf.AOF.Name != "" {
+	var aofRotations func() int64
+	var warmedUp chan struct{}
+	if conf.AOF.Name != "" && conf.ServeWhileWarming {
+		warmedUp = make(chan struct{})
+		var fabric *logginCacheViewFabric
+		go func() {
+			var err error
+			fabric, err = newLoggingCacheViewFabric(l, p, conf)
+			if err != nil {
+				l.Fatal("Warm up failed: ", err)
+			}
+			l.Info("Warm up finished.")
+			close(warmedUp)
+		}()
+		// Called only after warm up.
+		newCacheView = func() cache.View { return fabric.New() }
+		aofRotations = func() int64 { return fabric.aof.Rotations() }
+		onStop = func() {
+			select {
+			case <-warmedUp:
+			default:
+				return // Nothing to flush.
+			}
+			err := fabric.aof.Close()
+			if err != nil {
+				l.Error("AOF close error: ", err)
+			}
+		}
+	} else if conf.AOF.Name != "" {
 		var fabric *logginCacheViewFabric
 		fabric, err = newLoggingCacheViewFabric(l, p, conf)
 		if err != nil {
 			return
 		}
 		newCacheView = fabric.New
+		aofRotations = fabric.aof.Rotations
 
 		// We need to flush and sync AOF data on quit.
 		onStop = func() {
@@ -64,15 +239,53 @@ func NewServer(conf Config) (s *Server, err error) {
 		}
 	}
 
+	var recorder *cache.Recorder
+	if conf.RecordOps > 0 {
+		recorder = cache.NewRecorder(conf.RecordOps)
+		newRecordedView := newCacheView
+		newCacheView = func() cache.View {
+			return cache.NewRecordingView(newRecordedView(), recorder)
+		}
+	}
+
 	s = &Server{
 		Addr:         conf.Addr,
+		Socket:       conf.Socket,
 		Log:          l,
 		NewCacheView: newCacheView,
+		DebugAddr:    conf.DebugAddr,
+
+		ShutdownTimeout:     conf.ShutdownTimeout,
+		MaxConnections:      conf.MaxConnections,
+		RejectOverConnLimit: conf.RejectOverConnLimit,
 		ConnMeta: ConnMeta{
-			Pool:        p,
-			MaxItemSize: int(conf.MaxItemSize),
+			Pool:               p,
+			MaxItemSize:        int(conf.MaxItemSize),
+			WriteTimeout:       conf.WriteTimeout,
+			FlushPerCommand:    conf.FlushPerCommand,
+			CacheSize:          conf.Cache.Size,
+			CacheHotCap:        conf.Cache.HotCap,
+			MaxResponseBacklog: conf.MaxResponseBacklog,
+			MaxKeysPerGet:      conf.MaxKeysPerGet,
+
+			LogErrorCommand:       conf.LogErrorCommand,
+			ReplyErrorCommand:     conf.ReplyErrorCommand,
+			VerboseUnknownCommand: conf.VerboseUnknownCommand,
+			Banner:                conf.Banner,
+			DisabledCommands:      make(map[string]bool),
+			warmedUp:              warmedUp,
+			Recorder:              recorder,
+			CacheMetrics:          cacheMetrics,
+			RejectKeyPrefixes:     conf.RejectKeyPrefixes,
+
+			EnableMaxItemSizeCommand: conf.EnableMaxItemSizeCommand,
 		},
-		onStop: onStop,
+		onStop:       onStop,
+		aofRotations: aofRotations,
+		config:       conf,
+	}
+	for _, command := range conf.DisabledCommands {
+		s.DisabledCommands[command] = true
 	}
 	l.Debugf("Config: %#v", conf)
 	return
@@ -83,51 +296,191 @@ func NewServer(conf Config) (s *Server, err error) {
 type Server struct {
 	ConnMeta
 	Addr         string
+	Socket       string // Same as in Config.
 	Log          log.Logger
 	NewCacheView func() cache.View
-	connCounter  int64
+	// DebugAddr is same as in Config.
+	DebugAddr string
+	// ShutdownTimeout is same as in Config.
+	ShutdownTimeout time.Duration
+	// ReloadConfig returns config, that is applied by Reload on SIGHUP. Nil if reload is disabled.
+	ReloadConfig func() (Config, error)
+	// MaxConnections and RejectOverConnLimit are same as in Config.
+	MaxConnections      int
+	RejectOverConnLimit bool
+	connCounter         int64 // Atomic.
+	// connSlots is semaphore of MaxConnections capacity. Nil if connections are unlimited.
+	// It is replaced on MaxConnections reload, so connection releases slot of semaphore it was acquired from.
+	connSlots chan struct{}
+	// reloadLock guards options, that can be changed by Reload: MaxItemSize and connSlots.
+	reloadLock sync.Mutex
+	// config is Config, that server was made from, or applied by last Reload.
+	config Config
+	// conns are connections being served. Guarded by connsLock.
+	conns     map[*conn]struct{}
+	connsLock sync.Mutex
+	connsWG   sync.WaitGroup
 
-	stopState int32 // Atomic.
+	stopState int32         // Atomic.
+	stopping  chan struct{} // Closed on Stop.
 	listener  net.Listener
 	onStop    func()
 	sigs      chan os.Signal
+	// debugServer serves DebugAddr. Nil if debug server is disabled.
+	debugServer *http.Server
+	// aofRotations returns number of AOF rotations. Called only after warm up. Nil if AOF is disabled.
+	aofRotations func() int64
+
+	doneOnce   sync.Once
+	done       chan struct{} // Closed when serve is finished.
+	finishOnce sync.Once
+	serveErr   error
 }
 
 // connMeta is data shared between connections.
 type ConnMeta struct {
+	// Stats is first field, for 64-bit alignment of its atomic counters.
+	Stats       Stats
 	Pool        *recycle.Pool
 	MaxItemSize int
+	// WriteTimeout is applied to every chunk of written response, if connection supports deadlines.
+	WriteTimeout time.Duration
+	// FlushPerCommand is Config.FlushPerCommand.
+	FlushPerCommand bool
+	// CacheSize is used to reject items, that can't fit in cache. 0 if unknown.
+	CacheSize int64
+	// CacheHotCap is Config.Cache.HotCap, that limits item size together with CacheSize.
+	CacheHotCap float64
+	// MaxResponseBacklog is Config.MaxResponseBacklog.
+	MaxResponseBacklog int
+	// MaxKeysPerGet is Config.MaxKeysPerGet.
+	MaxKeysPerGet int
+
+	LogErrorCommand       bool
+	ReplyErrorCommand     bool
+	VerboseUnknownCommand bool
+	Banner                string
+	// DisabledCommands is set of commands, that should not be executed.
+	DisabledCommands map[string]bool
+	// RejectKeyPrefixes is Config.RejectKeyPrefixes.
+	RejectKeyPrefixes []string
+	// EnableMaxItemSizeCommand is Config.EnableMaxItemSizeCommand.
+	EnableMaxItemSizeCommand bool
+	// warmedUp is closed when cache is ready. Nil if cache is ready from start.
+	warmedUp chan struct{}
+	// Recorder contains cache operations for DumpOpsCommand. Nil if recording is disabled.
+	Recorder *cache.Recorder
+	// CacheMetrics are cache counters reported by StatsCommand. Nil if Config.Cache.Metrics
+	// is not *cache.AtomicMetrics.
+	CacheMetrics *cache.AtomicMetrics
+	// draining is set on server stop. Connections are closed after command in progress then.
+	draining int32 // Atomic.
+}
+
+// itemFits returns false, if item can't fit in cache. Any item fits, if cache size is unknown.
+func (m *ConnMeta) itemFits(meta cache.ItemMeta) bool {
+	return m.CacheSize == 0 || cache.ItemFits(cache.Config{Size: m.CacheSize, HotCap: m.CacheHotCap}, meta)
+}
+
+func (m *ConnMeta) isDraining() bool {
+	return atomic.LoadInt32(&m.draining) == 1
 }
 
+func (m *ConnMeta) isWarmedUp() bool {
+	if m.warmedUp == nil {
+		return true
+	}
+	select {
+	case <-m.warmedUp:
+		return true
+	default:
+		return false
+	}
+}
+
+// ListenAndServe listens Socket, if it is set, or TCP Addr otherwise.
+// Stale socket file is removed before listen.
 func (s *Server) ListenAndServe() error {
+	if s.Socket != "" {
+		if s.Addr != "" {
+			return s.finish(stackerr.Wrap(ErrAddrAndSocket))
+		}
+		err := os.Remove(s.Socket)
+		if err != nil && !os.IsNotExist(err) {
+			return s.finish(err)
+		}
+		l, err := net.Listen("unix", s.Socket)
+		if err != nil {
+			return s.finish(err)
+		}
+		return s.Serve(l)
+	}
 	if s.Addr == "" {
 		s.Addr = DefaultAddr
 	}
 	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
-		return err
+		return s.finish(err)
 	}
 	return s.Serve(l)
 }
 
 func (s *Server) Serve(l net.Listener) error {
+	return s.finish(s.serve(l))
+}
+
+// Wait blocks until server stops serving and returns serve error.
+// ErrStoped is returned after Stop call.
+func (s *Server) Wait() error {
+	<-s.doneChan()
+	return s.serveErr
+}
+
+func (s *Server) doneChan() chan struct{} {
+	s.doneOnce.Do(func() { s.done = make(chan struct{}) })
+	return s.done
+}
+
+// finish saves serve error and unblocks Wait callers.
+// Only error of first finished serve is saved.
+func (s *Server) finish(err error) error {
+	s.finishOnce.Do(func() {
+		s.serveErr = err
+		close(s.doneChan())
+	})
+	return err
+}
+
+func (s *Server) serve(l net.Listener) error {
 	s.listener = l
 	s.init()
-	if s.onStop != nil {
+	if s.DebugAddr != "" {
+		s.startDebugServer()
+	}
+	if s.onStop != nil || s.debugServer != nil || s.Socket != "" || s.ReloadConfig != nil {
 		s.sigs = make(chan os.Signal)
-		signal.Notify(s.sigs, syscall.SIGINT, syscall.SIGTERM)
+		if s.onStop != nil || s.debugServer != nil || s.Socket != "" {
+			// Graceful stop on termination is needed only when there is something to clean up.
+			signal.Notify(s.sigs, syscall.SIGINT, syscall.SIGTERM)
+		}
+		if s.ReloadConfig != nil {
+			signal.Notify(s.sigs, syscall.SIGHUP)
+		}
 		defer func() {
-			s.onStop()
+			s.stop()
+			signal.Stop(s.sigs)
 			close(s.sigs)
 		}()
 		go func() {
-			sig, ok := <-s.sigs
-			if !ok {
+			for sig := range s.sigs {
+				s.Log.Info("Signal received: ", sig)
+				if sig == syscall.SIGHUP {
+					s.reload()
+					continue
+				}
+				s.Stop()
 				return
 			}
-			s.Log.Info("Signal received: ", sig)
-			s.onStop()
-			os.Exit(0)
 		}()
 	}
 	// Temporary errors handling copy-pasted from http.Server.Serve().
@@ -137,6 +490,7 @@ func (s *Server) Serve(l net.Listener) error {
 		if err != nil {
 			if s.isStoped() {
 				s.Log.Info("Server was stopped. Accept return: ", err)
+				s.drain()
 				return ErrStoped
 			}
 			if ne, ok := err.(net.Error); !(ok && ne.Temporary()) {
@@ -155,8 +509,113 @@ func (s *Server) Serve(l net.Listener) error {
 			continue
 		}
 		tempDelay = 0
-		go s.newConn(c).serve()
+		s.reloadLock.Lock()
+		slots := s.connSlots
+		s.reloadLock.Unlock()
+		if !s.acquireConnSlot(c, slots) {
+			continue
+		}
+		// Connection is registered before serve goroutine start, so drain can't miss it.
+		conn := s.newConn(c)
+		go func() {
+			conn.serve()
+			s.removeConn(conn)
+			releaseConnSlot(slots)
+		}()
+	}
+}
+
+// acquireConnSlot blocks until connection can be served, or returns false, if connection
+// was rejected because of RejectOverConnLimit.
+func (s *Server) acquireConnSlot(c net.Conn, slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !s.RejectOverConnLimit {
+		s.Log.Warn("Max connections reached. Accept blocked.")
+		select {
+		case slots <- struct{}{}:
+			return true
+		case <-s.stopping:
+			c.Close()
+			return false
+		}
+	}
+	s.Log.Warn("Max connections reached. Connection rejected.")
+	if s.WriteTimeout != 0 {
+		c.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+	}
+	io.WriteString(c, ServerErrorResponse+" "+ErrTooManyConnections.Error()+Separator)
+	c.Close()
+	return false
+}
+
+func releaseConnSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// reload applies config returned by ReloadConfig.
+func (s *Server) reload() {
+	conf, err := s.ReloadConfig()
+	if err != nil {
+		s.Log.Error("Config reload error: ", err)
+		return
+	}
+	s.Reload(conf)
+}
+
+// Reload applies options, that are safe to change live: log level, max item size and max connections.
+// Max item size and connections limit are applied to new connections, and connections served before
+// reload are not counted against new limit. Changes of options, that can't be applied live, are logged as ignored.
+// Reload should be called only after serve start.
+func (s *Server) Reload(conf Config) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.Log.SetLevel(conf.LogLevel)
+	// Cache can't be changed live, so max item size is checked against current cache config.
+	checked := s.config
+	checked.MaxItemSize = conf.MaxItemSize
+	if err := checked.CheckMaxItemSize(); err != nil {
+		s.Log.Errorf("Invalid max item size: %v. Change ignored.", err)
+		conf.MaxItemSize = s.config.MaxItemSize
+	}
+	s.MaxItemSize = int(conf.MaxItemSize)
+	if s.MaxItemSize == 0 {
+		s.MaxItemSize = DefaultMaxItemSize
+	}
+	if s.MaxConnections != conf.MaxConnections {
+		s.MaxConnections = conf.MaxConnections
+		s.connSlots = nil
+		if s.MaxConnections > 0 {
+			s.connSlots = make(chan struct{}, s.MaxConnections)
+		}
+	}
+	ignored := []struct {
+		name    string
+		changed bool
+	}{
+		{"address", conf.Addr != s.config.Addr},
+		{"socket", conf.Socket != s.config.Socket},
+		{"cache size", conf.Cache.Size != s.config.Cache.Size},
+		{"AOF name", conf.AOF.Name != s.config.AOF.Name},
 	}
+	for _, option := range ignored {
+		if option.changed {
+			s.Log.Warnf("Option %s can't be changed live. Change ignored.", option.name)
+		}
+	}
+	s.config.LogLevel = conf.LogLevel
+	s.config.MaxItemSize = conf.MaxItemSize
+	s.config.MaxConnections = conf.MaxConnections
+	s.Log.Infof("Config reloaded. Log level: %s, max item size: %v, max connections: %v.",
+		conf.LogLevel, s.MaxItemSize, s.MaxConnections)
 }
 
 const (
@@ -164,11 +623,67 @@ const (
 	serverStopped
 )
 
+// Stop closes listener, waits until served connections finish commands in progress,
+// but not longer than ShutdownTimeout, releases resources and returns.
+// Stop can be called many times, but only after serve start.
 func (s *Server) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.stopState, serverActive, serverStopped) {
+		<-s.doneChan()
+		return
+	}
 	s.Log.Info("Stopping server.")
-	atomic.StoreInt32(&s.stopState, serverStopped)
+	close(s.stopping)
 	s.listener.Close()
-	// Accept will return error, and listening goroutine will call s.onStop().
+	// Accept will return error, and listening goroutine will drain connections and call s.onStop().
+	<-s.doneChan()
+}
+
+// drain waits until served connections are closed, but not longer than ShutdownTimeout.
+// Connections waiting for next command are closed at once, other are closed after
+// command in progress is served.
+func (s *Server) drain() {
+	atomic.StoreInt32(&s.draining, 1)
+	s.connsLock.Lock()
+	s.Log.Infof("Draining %v connections.", len(s.conns))
+	for c := range s.conns {
+		c.interruptIdle()
+	}
+	s.connsLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.connsWG.Wait()
+		close(drained)
+	}()
+	var timeout <-chan time.Time
+	if s.ShutdownTimeout > 0 {
+		timer := time.NewTimer(s.ShutdownTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-drained:
+		s.Log.Info("Connections drained.")
+	case <-timeout:
+		s.Log.Warn("Shutdown timeout expired. Connections in progress are abandoned.")
+	}
+}
+
+// stop releases resources, that should be released on serve finish.
+func (s *Server) stop() {
+	if s.Socket != "" {
+		// Listener removes socket file on close, but process can exit on signal without close.
+		err := os.Remove(s.Socket)
+		if err != nil && !os.IsNotExist(err) {
+			s.Log.Error("Socket remove error: ", err)
+		}
+	}
+	if s.debugServer != nil {
+		s.stopDebugServer()
+	}
+	if s.onStop != nil {
+		s.onStop()
+	}
 }
 
 func (s *Server) isStoped() bool {
@@ -176,22 +691,48 @@ func (s *Server) isStoped() bool {
 }
 
 func (s *Server) newConn(c net.Conn) *conn {
+	var view cache.View
+	if s.isWarmedUp() {
+		view = s.NewCacheView()
+	}
+	s.reloadLock.Lock() // ConnMeta.MaxItemSize is read.
 	conn := newConn(
-		s.Log.WithFields(log.Fields{"conn": s.connCounter}),
+		s.Log.WithFields(log.Fields{"conn": atomic.AddInt64(&s.connCounter, 1) - 1}),
 		&s.ConnMeta,
-		s.NewCacheView(),
+		view,
 		c,
 	)
-	s.connCounter++
+	s.reloadLock.Unlock()
+	// Cache view will be got on first command after warm up.
+	conn.newCacheView = s.NewCacheView
+	atomic.AddInt64(&s.Stats.CurrConnections, 1)
+	atomic.AddInt64(&s.Stats.TotalConnections, 1)
+	s.connsWG.Add(1)
+	s.connsLock.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsLock.Unlock()
 	return conn
 }
 
+// removeConn unregisters connection, after it was served.
+func (s *Server) removeConn(c *conn) {
+	s.connsLock.Lock()
+	delete(s.conns, c)
+	s.connsLock.Unlock()
+	s.connsWG.Done()
+}
+
 func (s *Server) init() {
 
 	if s.Log == nil {
 		s.Log = log.NewLogger(log.ErrorLevel, os.Stderr)
 	}
 	s.ConnMeta.init()
+	s.conns = make(map[*conn]struct{})
+	s.stopping = make(chan struct{})
+	if s.MaxConnections > 0 {
+		s.connSlots = make(chan struct{}, s.MaxConnections)
+	}
 	if s.NewCacheView == nil {
 		s.Log.Panic("No cache fabric provided.")
 	}
@@ -208,10 +749,16 @@ func (s *Server) init() {
 }
 
 func (m *ConnMeta) init() {
+	if m.Stats.started.IsZero() {
+		m.Stats.started = time.Now()
+	}
 	if m.Pool == nil {
 		m.Pool = recycle.NewPool()
 	}
 	if m.MaxItemSize == 0 {
 		m.MaxItemSize = DefaultMaxItemSize
 	}
+	if m.MaxKeysPerGet == 0 {
+		m.MaxKeysPerGet = DefaultMaxKeysPerGet
+	}
 }
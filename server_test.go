@@ -0,0 +1,355 @@
+package memcached
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/Skipor/memcached/cache"
+	"github.com/Skipor/memcached/internal/util"
+	"github.com/Skipor/memcached/log"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		s      *Server
+		waited chan error
+		served bool
+	)
+	BeforeEach(func() {
+		var err error
+		s, err = NewServer(Config{LogDestination: GinkgoWriter, LogLevel: log.DebugLevel})
+		Expect(err).To(BeNil())
+		waited = make(chan error, 1)
+		served = false
+		// Wait can outlive spec, so it should not read variables reassigned by next one.
+		srv, ch := s, waited
+		go func() { ch <- srv.Wait() }()
+	})
+	AfterEach(func() {
+		if served {
+			s.Stop()
+		}
+	})
+	Serve := func(l net.Listener) {
+		served = true
+		go s.Serve(l)
+	}
+
+	It("Wait returns listen error", func() {
+		s.Addr = "invalid address"
+		err := s.ListenAndServe()
+		Expect(err).NotTo(BeNil())
+		Eventually(waited).Should(Receive(Equal(err)))
+	})
+
+	It("Wait returns first serve error", func() {
+		s.Addr = "invalid address"
+		err := s.ListenAndServe()
+		Expect(err).NotTo(BeNil())
+		s.Socket = "memcached.sock"
+		Expect(util.Unwrap(s.ListenAndServe())).To(Equal(ErrAddrAndSocket))
+		Eventually(waited).Should(Receive(Equal(err)))
+		Expect(s.Wait()).To(Equal(err))
+	})
+
+	It("Wait returns after stop", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		Eventually(func() error {
+			c, err := net.Dial("tcp", l.Addr().String())
+			if err == nil {
+				c.Close()
+			}
+			return err
+		}).Should(BeNil())
+		Consistently(waited).ShouldNot(Receive())
+		s.Stop()
+		Eventually(waited).Should(Receive(Equal(ErrStoped)))
+	})
+
+	It("serve on unix socket", func() {
+		dir, err := ioutil.TempDir("", "memcached_test")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+		s.Socket = filepath.Join(dir, "memcached.sock")
+		Expect(ioutil.WriteFile(s.Socket, nil, 0600)).To(Succeed()) // Stale socket.
+		c := cache.NewLRU(s.Log, cache.Config{Size: 1 << 20})
+		s.NewCacheView = func() cache.View { return c }
+		served = true
+		go s.ListenAndServe()
+		var client net.Conn
+		Eventually(func() error {
+			client, err = net.Dial("unix", s.Socket)
+			return err
+		}).Should(BeNil())
+		defer client.Close()
+		io.WriteString(client, SetCommand+" test_key 0 0 3"+Separator+"xxx"+Separator+GetCommand+" test_key"+Separator)
+		r := bufio.NewReader(client)
+		var response string
+		for !strings.HasSuffix(response, EndResponse+Separator) {
+			line, err := r.ReadString('\n')
+			Expect(err).To(BeNil())
+			response += line
+		}
+		Expect(response).To(Equal(StoredResponse + Separator +
+			ValueResponse + " test_key 0 3" + Separator + "xxx" + Separator + EndResponse + Separator))
+
+		s.Stop()
+		Eventually(waited).Should(Receive(Equal(ErrStoped)))
+		_, err = os.Stat(s.Socket)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("addr and socket are exclusive", func() {
+		_, err := NewServer(Config{Addr: DefaultAddr, Socket: "memcached.sock"})
+		Expect(util.Unwrap(err)).To(Equal(ErrAddrAndSocket))
+	})
+
+	It("custom chunk sizes", func() {
+		s, err := NewServer(Config{
+			LogDestination: GinkgoWriter,
+			MinChunkSize:   4 << 10,
+			MaxChunkSize:   4 << 20,
+			MaxItemSize:    8 << 20,
+			Cache:          cache.Config{Size: 32 << 20},
+		})
+		Expect(err).To(BeNil())
+		Expect(s.Pool.MaxChunkSize()).To(Equal(4 << 20))
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		go s.Serve(l)
+		defer s.Stop()
+		client, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer client.Close()
+
+		value := strings.Repeat("x", 6<<20)
+		go io.WriteString(client, SetCommand+" test_key 0 0 "+strconv.Itoa(len(value))+Separator+value+Separator+
+			GetCommand+" test_key"+Separator)
+		r := bufio.NewReader(client)
+		line, err := r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(StoredResponse + Separator))
+		line, err = r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(ValueResponse + " test_key 0 " + strconv.Itoa(len(value)) + Separator))
+		data := make([]byte, len(value)+len(Separator))
+		_, err = io.ReadFull(r, data)
+		Expect(err).To(BeNil())
+		Expect(string(data) == value+Separator).To(BeTrue())
+		line, err = r.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal(EndResponse + Separator))
+	})
+
+	It("max item size not fitting in cache rejected", func() {
+		_, err := NewServer(Config{MaxItemSize: 1 << 20, Cache: cache.Config{Size: 1 << 20}})
+		Expect(err).NotTo(BeNil())
+		Expect((Config{MaxItemSize: 1 << 20, Cache: cache.Config{Size: 4 << 20}}).CheckMaxItemSize()).To(BeNil())
+		Expect((Config{Cache: cache.Config{Size: 1 << 20}}).CheckMaxItemSize()).NotTo(BeNil()) // Default max item size.
+		Expect((Config{MaxItemSize: 1 << 30}).CheckMaxItemSize()).To(BeNil())                  // Unknown cache size.
+	})
+
+	It("multiline banner rejected", func() {
+		_, err := NewServer(Config{Banner: "first\r\nsecond"})
+		Expect(util.Unwrap(err)).To(Equal(ErrBannerLines))
+		_, err = NewServer(Config{Banner: "first\nsecond"})
+		Expect(util.Unwrap(err)).To(Equal(ErrBannerLines))
+	})
+
+	It("invalid chunk sizes", func() {
+		_, err := NewServer(Config{MinChunkSize: 1 << 20, MaxChunkSize: 1 << 19})
+		Expect(util.Unwrap(err)).To(Equal(ErrChunkSizes))
+		_, err = NewServer(Config{MaxChunkSize: InBufferSize / 2})
+		Expect(util.Unwrap(err)).To(Equal(ErrChunkSizes))
+	})
+
+	It("stop drains connections", func() {
+		c := cache.NewLRU(s.Log, cache.Config{Size: 1 << 20})
+		s.NewCacheView = func() cache.View { return c }
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		connIdle := func() (idle []bool) {
+			s.connsLock.Lock()
+			defer s.connsLock.Unlock()
+			for conn := range s.conns {
+				conn.idleLock.Lock()
+				idle = append(idle, conn.idle)
+				conn.idleLock.Unlock()
+			}
+			return
+		}
+		busy, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer busy.Close()
+		Eventually(connIdle).Should(Equal([]bool{true}))
+		io.WriteString(busy, SetCommand+" test_key 0 0 3"+Separator+"x")
+		Eventually(connIdle).Should(Equal([]bool{false}))
+		idle, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer idle.Close()
+		Eventually(connIdle).Should(ConsistOf(true, false))
+
+		stopped := make(chan struct{})
+		go func() {
+			s.Stop()
+			close(stopped)
+		}()
+		// Idle connection is closed at once.
+		_, err = ioutil.ReadAll(idle)
+		Expect(err).To(BeNil())
+		Consistently(stopped).ShouldNot(BeClosed())
+		Expect(waited).NotTo(Receive())
+
+		io.WriteString(busy, "xx"+Separator)
+		response, err := ioutil.ReadAll(busy)
+		Expect(err).To(BeNil())
+		Expect(string(response)).To(Equal(StoredResponse + Separator))
+		Eventually(stopped).Should(BeClosed())
+		Eventually(waited).Should(Receive(Equal(ErrStoped)))
+	})
+
+	It("stop gives up on shutdown timeout", func() {
+		s.ShutdownTimeout = 50 * time.Millisecond
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		busy, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer busy.Close()
+		io.WriteString(busy, SetCommand+" test_key 0 0 3"+Separator)
+		Eventually(func() int64 { return atomic.LoadInt64(&s.Stats.CurrConnections) }).Should(BeEquivalentTo(1))
+		s.Stop()
+		Eventually(waited).Should(Receive(Equal(ErrStoped)))
+	})
+
+	It("connections counted", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		c, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		Eventually(func() int64 { return atomic.LoadInt64(&s.Stats.CurrConnections) }).Should(BeEquivalentTo(1))
+		c.Close()
+		Eventually(func() int64 { return atomic.LoadInt64(&s.Stats.CurrConnections) }).Should(BeZero())
+		Expect(atomic.LoadInt64(&s.Stats.TotalConnections)).To(BeEquivalentTo(1))
+	})
+
+	It("connection over limit rejected", func() {
+		s.MaxConnections = 1
+		s.RejectOverConnLimit = true
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		first, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer first.Close()
+		Eventually(func() int64 { return atomic.LoadInt64(&s.Stats.CurrConnections) }).Should(BeEquivalentTo(1))
+
+		second, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		response, _ := ioutil.ReadAll(second)
+		Expect(string(response)).To(Equal(ServerErrorResponse + " " + ErrTooManyConnections.Error() + Separator))
+
+		first.Close()
+		Eventually(func() int { return len(s.connSlots) }).Should(BeZero())
+		third, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer third.Close()
+		Eventually(func() int64 { return atomic.LoadInt64(&s.Stats.TotalConnections) }).Should(BeEquivalentTo(2))
+	})
+
+	It("config reloaded on SIGHUP", func() {
+		s.config.Cache.Size = 1 << 20
+		s.ReloadConfig = func() (Config, error) {
+			return Config{
+				LogLevel:       log.WarnLevel,
+				MaxItemSize:    1 << 10,
+				MaxConnections: 1,
+				Cache:          cache.Config{Size: 1 << 30},
+			}, nil
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		// Connection is accepted after signal handler setup.
+		c, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer c.Close()
+		Eventually(func() int64 { return atomic.LoadInt64(&s.Stats.CurrConnections) }).Should(BeEquivalentTo(1))
+
+		Expect(syscall.Kill(os.Getpid(), syscall.SIGHUP)).To(Succeed())
+		Eventually(s.Log.Level).Should(Equal(log.WarnLevel))
+		s.reloadLock.Lock()
+		defer s.reloadLock.Unlock()
+		Expect(s.MaxItemSize).To(Equal(1 << 10))
+		Expect(s.MaxConnections).To(Equal(1))
+		Expect(cap(s.connSlots)).To(Equal(1))
+		Expect(s.config.Cache.Size).To(BeEquivalentTo(1<<20), "cache size change ignored")
+	})
+
+	It("reload of max item size not fitting in cache ignored", func() {
+		s.config.Cache.Size = 1 << 20
+		s.config.MaxItemSize = 1 << 10
+		s.MaxItemSize = 1 << 10
+		s.Reload(Config{LogLevel: log.DebugLevel, MaxItemSize: 1 << 20})
+		Expect(s.MaxItemSize).To(Equal(1 << 10))
+		Expect(s.config.MaxItemSize).To(BeEquivalentTo(1 << 10))
+		s.Reload(Config{LogLevel: log.DebugLevel, MaxItemSize: 1 << 12})
+		Expect(s.MaxItemSize).To(Equal(1 << 12))
+	})
+
+	It("debug stats and metrics served", func() {
+		debugListener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		s.DebugAddr = debugListener.Addr().String()
+		debugListener.Close()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		Serve(l)
+		var res *http.Response
+		Eventually(func() error {
+			res, err = http.Get("http://" + s.DebugAddr + "/stats")
+			return err
+		}).Should(BeNil())
+		var stats map[string]int64
+		err = json.NewDecoder(res.Body).Decode(&stats)
+		res.Body.Close()
+		Expect(err).To(BeNil())
+		Expect(stats).To(HaveKeyWithValue("curr_connections", BeZero()))
+		Expect(stats).To(HaveKeyWithValue("curr_items", BeZero()))
+		Expect(stats).To(HaveKeyWithValue("total_items", BeZero()))
+		Expect(stats).To(HaveKey("uptime"))
+
+		res, err = http.Get("http://" + s.DebugAddr + "/metrics")
+		Expect(err).To(BeNil())
+		metrics, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		Expect(err).To(BeNil())
+		Expect(string(metrics)).To(ContainSubstring("# TYPE memcached_evictions_total counter\nmemcached_evictions_total 0\n"))
+		Expect(string(metrics)).To(ContainSubstring("\nmemcached_get_hits_total 0\n"))
+		Expect(string(metrics)).To(ContainSubstring("\nmemcached_items 0\n"))
+		Expect(string(metrics)).To(ContainSubstring("\nmemcached_pool_recycled_chunks_total 0\n"))
+
+		s.Stop()
+		Eventually(waited).Should(Receive(Equal(ErrStoped)))
+		_, err = http.Get("http://" + s.DebugAddr + "/stats")
+		Expect(err).NotTo(BeNil())
+	})
+})
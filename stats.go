@@ -0,0 +1,129 @@
+package memcached
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Skipor/memcached/cache"
+	"github.com/Skipor/memcached/recycle"
+)
+
+// Stats are server counters reported by StatsCommand.
+// Counters are shared between connections, so they should be accessed atomically.
+type Stats struct {
+	CmdGet           int64 // Number of keys requested by get commands.
+	CmdSet           int64 // Number of storage commands.
+	GetHits          int64
+	GetMisses        int64
+	DeleteHits       int64
+	DeleteMisses     int64
+	CurrConnections  int64
+	TotalConnections int64
+	// started is time since uptime is counted.
+	started time.Time
+}
+
+// countGet counts get of keys number of keys, hits of them were found.
+func (s *Stats) countGet(keys, hits int) {
+	atomic.AddInt64(&s.CmdGet, int64(keys))
+	atomic.AddInt64(&s.GetHits, int64(hits))
+	atomic.AddInt64(&s.GetMisses, int64(keys-hits))
+}
+
+func (s *Stats) countDelete(deleted bool) {
+	if deleted {
+		atomic.AddInt64(&s.DeleteHits, 1)
+	} else {
+		atomic.AddInt64(&s.DeleteMisses, 1)
+	}
+}
+
+// stat is single "STAT <name> <value>" line of stats response.
+type stat struct {
+	name  string
+	value interface{}
+}
+
+func (s stat) String() string {
+	return fmt.Sprintf("%s %s %v", StatResponse, s.name, s.value)
+}
+
+// stats returns server counters in order of memcached stats response.
+func (s *Stats) stats() []stat {
+	return []stat{
+		{"uptime", int64(time.Since(s.started) / time.Second)},
+		{"time", time.Now().Unix()},
+		{"curr_connections", atomic.LoadInt64(&s.CurrConnections)},
+		{"total_connections", atomic.LoadInt64(&s.TotalConnections)},
+		{"cmd_get", atomic.LoadInt64(&s.CmdGet)},
+		{"cmd_set", atomic.LoadInt64(&s.CmdSet)},
+		{"get_hits", atomic.LoadInt64(&s.GetHits)},
+		{"get_misses", atomic.LoadInt64(&s.GetMisses)},
+		{"delete_misses", atomic.LoadInt64(&s.DeleteMisses)},
+		{"delete_hits", atomic.LoadInt64(&s.DeleteHits)},
+	}
+}
+
+// cacheStats returns cache counters. Expired items are not memcached stat, but are
+// reported too, because expirations are counted separately from evictions.
+func cacheStats(m cache.AtomicMetrics) []stat {
+	return []stat{
+		{"total_items", m.Sets},
+		{"evictions", m.Evictions},
+		{"expired_items", m.Expirations},
+	}
+}
+
+// slabPageSize is size of memcached slab page, which chunks are allocated by.
+const slabPageSize = 1 << 20
+
+// itemsStats returns items stats in memcached format. Cache has no slab classes, so every
+// non empty queue is reported as pseudo slab class: 1 for cold, 2 for warm and 3 for hot queue.
+func itemsStats(queues []cache.QueueStats) (stats []stat) {
+	for i, q := range queues {
+		if q.Items == 0 {
+			continue
+		}
+		prefix := fmt.Sprintf("items:%v:", i+1)
+		stats = append(stats,
+			stat{prefix + "number", q.Items},
+			stat{prefix + "age", q.Age},
+		)
+	}
+	return
+}
+
+// slabsStats returns slabs stats in memcached format. Every recycle.Pool chunk size
+// with used chunks is reported as slab class, numbered from 1 in chunk size order.
+// Pool doesn't allocate chunks by pages, so pages are approximated by used chunks size.
+func slabsStats(classes []recycle.ChunkClassStats) (stats []stat) {
+	var active int
+	var malloced int64
+	for i, class := range classes {
+		if class.UsedChunks == 0 {
+			continue
+		}
+		active++
+		size := class.UsedChunks * int64(class.ChunkSize)
+		malloced += size
+		prefix := fmt.Sprintf("%v:", i+1)
+		stats = append(stats,
+			stat{prefix + "chunk_size", class.ChunkSize},
+			stat{prefix + "total_pages", (size + slabPageSize - 1) / slabPageSize},
+			stat{prefix + "used_chunks", class.UsedChunks},
+		)
+	}
+	return append(stats, stat{"active_slabs", active}, stat{"total_malloced", malloced})
+}
+
+// poolStats returns recycle.Pool counters. They are not memcached stats, so they are
+// reported after slabs stats.
+func poolStats(ps recycle.PoolStats) []stat {
+	return []stat{
+		{"pool_allocated_chunks", ps.AllocatedChunks},
+		{"pool_recycled_chunks", ps.RecycledChunks},
+		{"pool_dropped_chunks", ps.DroppedChunks},
+		{"pool_gc_chunks", ps.GCChunks},
+	}
+}